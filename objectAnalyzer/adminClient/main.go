@@ -0,0 +1,1389 @@
+package main
+
+// Command line tool for the admin endpoints of the apiServer
+//
+//    ./adminClient.bin -key <adminApiKey> keys create -name "firewall connector"
+//    ./adminClient.bin trusted import ../workerBee/trustedCSV/trusted.csv
+//    ./adminClient.bin thresholds set -band high -min-score 20 -block-days 30
+//    ./adminClient.bin export blocklist -format text -o blocklist.txt
+//
+// The admin key can also be set with the OA_ADMIN_API_KEY environment variable
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"client"
+)
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, c *client.Client, args []string) error
+}
+
+var commands = map[string]map[string]command{
+	"keys": {
+		"create": {"-name <name> [-role submit|admin]", keysCreate},
+		"list":   {"", keysList},
+		"revoke": {"<id>", keysRevoke},
+	},
+	"trusted": {
+		"add":    {"-object <object> -type ipv4|ipv4CIDR|ipv6 [-notes <notes>] [-source <source>]", trustedAdd},
+		"remove": {"<object>", trustedRemove},
+		"list":   {"", trustedList},
+		"import": {"<file.csv>", trustedImport},
+	},
+	"thresholds": {
+		"get": {"", thresholdsGet},
+		"set": {"-band <name> [-min-score <score>] [-block true|false] [-block-days <days>] [-remove]", thresholdsSet},
+	},
+	"settings": {
+		"get": {"", settingsGet},
+		"set": {"[-f <file.json>] [-weights 4,2,1,1] [-rescore-hours <hours>] [-limit-pending <n>] [-limit-rescore <n>] [-limit-export <n>] [-malicious-score <score>] [-malicious-min-fidelity Low|Medium|High] [-suspicious-score <score>] [-benign-max-score <score>] [-half-life <type|source:name>=<hours>] [-lookback-days <days>] [-sighting-days <days>] [-archive-days <days>] [-archive-max-mb <mb>] [-stale-days <days>] [-stale-max-score <score>] [-stage-run-days <days>] [-import-batch-days <days>] [-stage-interval <stage>=<seconds>] [-enrich <type>=<enricher:enricher>] [-enrich-timeout-ms <ms>] [-enrich-cache-minutes <minutes>] [-enrich-refresh-days <days>] [-limit-enrich <n>]", settingsSet},
+	},
+	"scoring": {
+		"get": {"", scoringGet},
+		"set": {"<rules.json>", scoringSet},
+	},
+	"export": {
+		"blocklist": {"[-min-score <score>] [-verdict <verdicts>] [-type <object_type>] [-limit <n>] [-format json|text] [-o <file>]", exportBlocklist},
+	},
+	"imports": {
+		"show":     {"[-outcome accepted|rejected] [-limit <n>] <batch id>", importsShow},
+		"rollback": {"[-dry-run] <batch id>", importsRollback},
+	},
+	"pending": {
+		"stats": {"", pendingStats},
+		"purge": {"[-older-than-days <days>] [-type <object_type>] [-source <source>] [-all]", pendingPurge},
+	},
+	"quarantine": {
+		"list":     {"[-batch <id>] [-source <source>] [-type <object_type>] [-reason <reason>] [-older-than-days <days>] [-limit <n>]", quarantineList},
+		"fix":      {"-object <object> -type <object_type> <id>", quarantineFix},
+		"resubmit": {"[-id <id>] [-batch <id>] [-source <source>] [-type <object_type>] [-reason <reason>] [-older-than-days <days>] [-all]", quarantineResubmit},
+		"purge":    {"[-id <id>] [-batch <id>] [-source <source>] [-type <object_type>] [-reason <reason>] [-older-than-days <days>] [-all]", quarantinePurge},
+	},
+	"objects": {
+		"show":      {"<object>", objectsShow},
+		"list":      {"[-verdict <verdicts>] [-type <object_type>] [-limit <n>]", objectsList},
+		"score":     {"[-limit <n>] <object>", objectsScore},
+		"sightings": {"[-days <n>] <object>", objectsSightings},
+		"verdicts":  {"[-limit <n>] <object>", objectsVerdicts},
+		"confirm":   {"[-unset] <object>", objectsConfirm},
+		"untrust":   {"<object>", objectsUntrust},
+	},
+	"db": {
+		"backup":  {"", dbBackup},
+		"backups": {"", dbBackups},
+		"restore": {"<backup name>", dbRestore},
+		"vacuum":  {"", dbVacuum},
+	},
+	"stages": {
+		"runs": {"[-stage <stage>] [-limit <n>]", stagesRuns},
+	},
+}
+
+var jsonOutput bool
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] <group> <action> [args]\n\nFlags:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, group := range []string{"keys", "trusted", "thresholds", "settings", "scoring", "export", "imports", "pending", "quarantine", "objects", "db", "stages"} {
+		for _, action := range sortedKeys(commands[group]) {
+			fmt.Fprintf(os.Stderr, "  %s %s %s\n", group, action, commands[group][action].usage)
+		}
+	}
+}
+
+func sortedKeys(m map[string]command) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func main() {
+	URLPtr := flag.String("url", "https://127.0.0.1:9000", "URL of the apiServer")
+	CAPtr := flag.String("ca", "../apiServer/keys/tls.crt", "Certificate or CA that issued the apiServer certificate")
+	ServerNamePtr := flag.String("server-name", "", "Name expected in the apiServer certificate when it is not the host in -url")
+	KeyPtr := flag.String("key", "", "Admin API key, defaults to the OA_ADMIN_API_KEY environment variable")
+	APIKeyPtr := flag.String("api-key", "", "API key for objects show and export blocklist, defaults to OA_API_KEY or the admin key")
+	TimeoutPtr := flag.Duration("timeout", 30*time.Second, "Timeout of each request")
+	flag.BoolVar(&jsonOutput, "json", false, "Print the responses as JSON")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[args[0]][args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s %s\n\n", args[0], args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	adminKey := *KeyPtr
+	if adminKey == "" {
+		adminKey = os.Getenv("OA_ADMIN_API_KEY")
+	}
+	if adminKey == "" {
+		log.Fatalf("Set the admin API key with -key or OA_ADMIN_API_KEY\n")
+	}
+	apiKey := *APIKeyPtr
+	if apiKey == "" {
+		apiKey = os.Getenv("OA_API_KEY")
+	}
+	if apiKey == "" {
+		// The lookup and export endpoints also accept the admin key
+		apiKey = adminKey
+	}
+
+	opts := []client.Option{client.WithAdminKey(adminKey), client.WithTimeout(*TimeoutPtr), client.WithUserAgent("objectAnalyzer-adminClient")}
+	if *CAPtr != "" {
+		opts = append(opts, client.WithCAFile(*CAPtr))
+	}
+	if *ServerNamePtr != "" {
+		opts = append(opts, client.WithServerName(*ServerNamePtr))
+	}
+	c, err := client.New(*URLPtr, apiKey, opts...)
+	if err != nil {
+		log.Fatalf("Failed to create the client: %v\n", err)
+	}
+
+	if err := cmd.run(context.Background(), c, args[2:]); err != nil {
+		log.Fatalf("%s %s: %v\n", args[0], args[1], err)
+	}
+}
+
+// newFlags creates the flags of an action, the usage is printed when they fail to parse
+func newFlags(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ExitOnError)
+}
+
+// oneArg returns the single positional argument of an action
+func oneArg(fs *flag.FlagSet, args []string, name string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("expected one argument, the %s", name)
+	}
+	return fs.Arg(0), nil
+}
+
+func noArgs(name string, args []string) error {
+	fs := newFlags(name)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	return nil
+}
+
+func sortedNames[V any](m map[string]V) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// splitList splits a comma separated flag value, empty items are dropped
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+func keysCreate(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("keys create")
+	name := fs.String("name", "", "Name of the key, for example the system that uses it")
+	role := fs.String("role", "submit", "submit (import, lookup and export) or admin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return errors.New("-name is required")
+	}
+
+	key, err := c.CreateKey(ctx, *name, *role)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(key)
+	}
+	fmt.Printf("Created key %d (%s, %s)\n", key.ID, key.Name, key.Role)
+	fmt.Printf("Key: %s\n", key.Key)
+	fmt.Println("The key is not stored by the server and can not be shown again.")
+	return nil
+}
+
+func keysList(ctx context.Context, c *client.Client, args []string) error {
+	if err := noArgs("keys list", args); err != nil {
+		return err
+	}
+	keys, err := c.ListKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(keys)
+	}
+	tw := newTable()
+	fmt.Fprintln(tw, "ID\tNAME\tROLE\tPREFIX\tCREATED\tREVOKED")
+	for _, key := range keys {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", key.ID, key.Name, key.Role, key.KeyPrefix, key.Created, key.Revoked)
+	}
+	return tw.Flush()
+}
+
+func keysRevoke(ctx context.Context, c *client.Client, args []string) error {
+	arg, err := oneArg(newFlags("keys revoke"), args, "key id")
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid key id %s", arg)
+	}
+	if err := c.RevokeKey(ctx, id); err != nil {
+		return err
+	}
+	fmt.Printf("Revoked key %d\n", id)
+	return nil
+}
+
+func trustedAdd(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("trusted add")
+	var obj client.TrustedObject
+	fs.StringVar(&obj.Object, "object", "", "IPv4 address, IPv4 CIDR or IPv6 address")
+	fs.StringVar(&obj.ObjectType, "type", "", "ipv4, ipv4CIDR or ipv6")
+	fs.StringVar(&obj.Notes, "notes", "", "Notes")
+	fs.StringVar(&obj.Source, "source", "adminClient", "Source")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if obj.Object == "" || obj.ObjectType == "" {
+		return errors.New("-object and -type are required")
+	}
+
+	result, err := c.AddTrusted(ctx, []client.TrustedObject{obj})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Trusted %d objects\n", result.Count)
+	return nil
+}
+
+func trustedRemove(ctx context.Context, c *client.Client, args []string) error {
+	object, err := oneArg(newFlags("trusted remove"), args, "trusted object")
+	if err != nil {
+		return err
+	}
+	if err := c.RemoveTrusted(ctx, object); err != nil {
+		return err
+	}
+	fmt.Printf("Removed trusted object %s\n", object)
+	return nil
+}
+
+func trustedList(ctx context.Context, c *client.Client, args []string) error {
+	if err := noArgs("trusted list", args); err != nil {
+		return err
+	}
+	objects, err := c.ListTrusted(ctx)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(objects)
+	}
+	tw := newTable()
+	fmt.Fprintln(tw, "OBJECT\tTYPE\tSOURCE\tLAST SEEN\tNOTES")
+	for _, obj := range objects {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", obj.Object, obj.ObjectType, obj.Source, obj.LastSeen, obj.Notes)
+	}
+	return tw.Flush()
+}
+
+// trustedImport reads a CSV in the format of the workerBee trustedCSV directory
+// Column headers of object, object_type, notes and source, object and object_type are required
+func trustedImport(ctx context.Context, c *client.Client, args []string) error {
+	file, err := oneArg(newFlags("trusted import"), args, "CSV file")
+	if err != nil {
+		return err
+	}
+	objects, err := readTrustedCSV(file)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("no trusted objects found in %s", file)
+	}
+
+	result, err := c.AddTrusted(ctx, objects)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d trusted objects from %s\n", result.Count, file)
+	return nil
+}
+
+func readTrustedCSV(file string) ([]client.TrustedObject, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", file, err)
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	headers, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the headers of %s: %w", file, err)
+	}
+	columns := make(map[string]int)
+	for i, header := range headers {
+		columns[strings.ToLower(strings.TrimSpace(header))] = i
+	}
+	for _, required := range []string{"object", "object_type"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("%s is missing the %s column", file, required)
+		}
+	}
+	value := func(record []string, column string) string {
+		if i, ok := columns[column]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var objects []client.TrustedObject
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read line %d of %s: %w", line, file, err)
+		}
+		obj := client.TrustedObject{
+			Object:     value(record, "object"),
+			ObjectType: value(record, "object_type"),
+			Notes:      value(record, "notes"),
+			Source:     value(record, "source"),
+		}
+		if obj.Object == "" || obj.ObjectType == "" {
+			return nil, fmt.Errorf("line %d of %s is missing the object or object_type", line, file)
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
+
+func thresholdsGet(ctx context.Context, c *client.Client, args []string) error {
+	if err := noArgs("thresholds get", args); err != nil {
+		return err
+	}
+	settings, err := c.GetSettings(ctx)
+	if err != nil {
+		return err
+	}
+	return printBands(settings.SeverityBands)
+}
+
+// thresholdsSet changes one severity band, a band that does not exist is added
+func thresholdsSet(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("thresholds set")
+	name := fs.String("band", "", "Name of the severity band, for example high")
+	minScore := fs.Int("min-score", -1, "Lowest risk_score of the band")
+	block := fs.String("block", "", "true to export the band to the blocklist by default, false to not")
+	blockDays := fs.Int("block-days", -1, "Only export objects in the band seen within this many days, 0 has no limit")
+	remove := fs.Bool("remove", false, "Remove the band")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return errors.New("-band is required")
+	}
+
+	// Only change the values that were set
+	settings, err := c.GetSettings(ctx)
+	if err != nil {
+		return err
+	}
+	index := -1
+	for i, band := range settings.SeverityBands {
+		if band.Name == *name {
+			index = i
+		}
+	}
+	switch {
+	case *remove && index < 0:
+		return fmt.Errorf("no severity band named %s", *name)
+	case *remove:
+		settings.SeverityBands = append(settings.SeverityBands[:index], settings.SeverityBands[index+1:]...)
+	default:
+		if index < 0 {
+			if *minScore < 0 {
+				return fmt.Errorf("-min-score is required to add the severity band %s", *name)
+			}
+			settings.SeverityBands = append(settings.SeverityBands, client.SeverityBand{Name: *name})
+			index = len(settings.SeverityBands) - 1
+		}
+		band := &settings.SeverityBands[index]
+		if *minScore >= 0 {
+			band.MinScore = *minScore
+		}
+		if *block != "" {
+			value, err := strconv.ParseBool(*block)
+			if err != nil {
+				return fmt.Errorf("invalid -block %s, use true or false", *block)
+			}
+			band.Block = value
+		}
+		if *blockDays >= 0 {
+			band.BlockDays = *blockDays
+		}
+	}
+
+	settings, err = c.SetSettings(ctx, settings)
+	if err != nil {
+		return err
+	}
+	return printBands(settings.SeverityBands)
+}
+
+func printBands(bands []client.SeverityBand) error {
+	if jsonOutput {
+		return printJSON(bands)
+	}
+	sort.Slice(bands, func(i, j int) bool { return bands[i].MinScore < bands[j].MinScore })
+	tw := newTable()
+	fmt.Fprintln(tw, "BAND\tMIN SCORE\tBLOCK\tBLOCK DAYS")
+	for _, band := range bands {
+		days := strconv.Itoa(band.BlockDays)
+		if band.BlockDays == 0 {
+			days = "no limit"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%t\t%s\n", band.Name, band.MinScore, band.Block, days)
+	}
+	return tw.Flush()
+}
+
+func settingsGet(ctx context.Context, c *client.Client, args []string) error {
+	if err := noArgs("settings get", args); err != nil {
+		return err
+	}
+	settings, err := c.GetSettings(ctx)
+	if err != nil {
+		return err
+	}
+	return printSettings(settings)
+}
+
+// settingsSet changes the scoring weights, rescore interval, batch limits and retention, or replaces every setting from a JSON file
+func settingsSet(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("settings set")
+	file := fs.String("f", "", "JSON file with the settings to replace, - reads stdin")
+	weights := fs.String("weights", "", "Scoring weights of the current week, last week, two and three weeks ago, for example 4,2,1,1")
+	rescoreHours := fs.Int("rescore-hours", 0, "Rescore objects when their risk score is older than this many hours")
+	limitPending := fs.Int("limit-pending", 0, "Rows moved from pending_import per workerBee run")
+	limitRescore := fs.Int("limit-rescore", 0, "Objects rescored per workerBee run")
+	limitExport := fs.Int("limit-export", 0, "Maximum limit of the blocklist export")
+	maliciousScore := fs.Int("malicious-score", 0, "Risk score at or above which an object is malicious")
+	maliciousFidelity := fs.String("malicious-min-fidelity", "", "Lowest fidelity of a malicious object, below it the object is suspicious")
+	suspiciousScore := fs.Int("suspicious-score", 0, "Risk score at or above which an object is suspicious")
+	benignMaxScore := fs.Int("benign-max-score", -1, "Risk score at or below which a scored object is benign")
+	halfLives := fs.String("half-life", "", "Comma separated half-lives in hours of the decay factor, for example default=168,ipv4=72,source:feedA=24")
+	lookbackDays := fs.Int("lookback-days", 0, "Sightings older than this many days are not scored")
+	sightingDays := fs.Int("sighting-days", -1, "workerBee -prune deletes sightings older than this many days, 0 keeps them")
+	archiveDays := fs.Int("archive-days", -1, "workerBee -prune deletes archived CSV files older than this many days, 0 keeps them")
+	archiveMaxMB := fs.Int("archive-max-mb", -1, "workerBee -prune deletes the oldest archived CSV files above this size, 0 has no limit")
+	staleDays := fs.Int("stale-days", -1, "workerBee -prune expires low scored objects not seen for this many days, 0 keeps them")
+	staleMaxScore := fs.Int("stale-max-score", -1, "Highest risk score of an object expired by workerBee -prune")
+	stageRunDays := fs.Int("stage-run-days", -1, "workerBee -prune deletes the runs of the stages older than this many days, 0 keeps them")
+	importBatchDays := fs.Int("import-batch-days", -1, "workerBee -prune deletes the import batches finished more than this many days ago, 0 keeps them")
+	stageIntervals := fs.String("stage-interval", "", "Comma separated seconds between the runs of the workerBee -daemon stages, for example rescore=900,backup=0")
+	enrich := fs.String("enrich", "", "Comma separated enrichers of each object type in order, for example ipv4=geo_csv:rdns,domain=dns, an empty list disables the type")
+	enrichTimeout := fs.Int("enrich-timeout-ms", 0, "Longest a lookup of one enricher may take in milliseconds")
+	enrichCache := fs.Int("enrich-cache-minutes", -1, "Minutes a lookup of an enricher is reused, 0 does not cache")
+	enrichRefresh := fs.Int("enrich-refresh-days", -1, "The enrich stage looks up objects enriched more than this many days ago, 0 only never enriched objects")
+	limitEnrich := fs.Int("limit-enrich", 0, "Objects looked up per run of the enrich stage")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	settings, err := c.GetSettings(ctx)
+	if err != nil {
+		return err
+	}
+	if *file != "" {
+		var data []byte
+		if *file == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(*file)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", *file, err)
+		}
+		// Keys that are not in the file keep their current value
+		if err := json.Unmarshal(data, &settings); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", *file, err)
+		}
+	}
+	if *weights != "" {
+		var values []int
+		for _, field := range strings.Split(*weights, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil {
+				return fmt.Errorf("invalid -weights %s", *weights)
+			}
+			values = append(values, n)
+		}
+		if len(values) != 4 {
+			return fmt.Errorf("-weights needs 4 values, found %d", len(values))
+		}
+		settings.ScoringWeights = client.ScoringWeights{CurrentWeek: values[0], LastWeek: values[1], TwoWeeksAgo: values[2], ThreeWeeksAgo: values[3]}
+	}
+	if *rescoreHours > 0 {
+		settings.RescoreIntervalHours = *rescoreHours
+	}
+	if *limitPending > 0 {
+		settings.BatchLimits.PendingImport = *limitPending
+	}
+	if *limitRescore > 0 {
+		settings.BatchLimits.Rescore = *limitRescore
+	}
+	if *limitExport > 0 {
+		settings.BatchLimits.Export = *limitExport
+	}
+	if *maliciousScore > 0 {
+		settings.VerdictRules.MaliciousScore = *maliciousScore
+	}
+	if *maliciousFidelity != "" {
+		settings.VerdictRules.MaliciousMinFidelity = *maliciousFidelity
+	}
+	if *suspiciousScore > 0 {
+		settings.VerdictRules.SuspiciousScore = *suspiciousScore
+	}
+	if *benignMaxScore >= 0 {
+		settings.VerdictRules.BenignMaxScore = *benignMaxScore
+	}
+	for _, item := range splitList(*halfLives) {
+		name, value, ok := strings.Cut(item, "=")
+		hours, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if !ok || err != nil {
+			return fmt.Errorf("invalid -half-life %s, use <type|source:name>=<hours>", item)
+		}
+		name = strings.TrimSpace(name)
+		hl := &settings.DecayHalfLives
+		if source, ok := strings.CutPrefix(name, "source:"); ok {
+			if hl.Sources == nil {
+				hl.Sources = map[string]float64{}
+			}
+			hl.Sources[source] = hours
+		} else if name == "default" {
+			hl.DefaultHours = hours
+		} else {
+			if hl.ObjectTypes == nil {
+				hl.ObjectTypes = map[string]float64{}
+			}
+			hl.ObjectTypes[name] = hours
+		}
+	}
+	if *lookbackDays > 0 {
+		settings.DecayHalfLives.LookbackDays = *lookbackDays
+	}
+	if *sightingDays >= 0 {
+		settings.Retention.SightingDays = *sightingDays
+	}
+	if *archiveDays >= 0 {
+		settings.Retention.ArchiveDays = *archiveDays
+	}
+	if *archiveMaxMB >= 0 {
+		settings.Retention.ArchiveMaxMB = *archiveMaxMB
+	}
+	if *staleDays >= 0 {
+		settings.Retention.StaleObjectDays = *staleDays
+	}
+	if *staleMaxScore >= 0 {
+		settings.Retention.StaleMaxScore = *staleMaxScore
+	}
+	if *stageRunDays >= 0 {
+		settings.Retention.StageRunDays = *stageRunDays
+	}
+	if *importBatchDays >= 0 {
+		settings.Retention.ImportBatchDays = *importBatchDays
+	}
+	for _, item := range splitList(*stageIntervals) {
+		name, value, ok := strings.Cut(item, "=")
+		seconds, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil {
+			return fmt.Errorf("invalid -stage-interval %s, use <stage>=<seconds>", item)
+		}
+		interval := stageInterval(&settings.StageIntervals, strings.TrimSpace(name))
+		if interval == nil {
+			return fmt.Errorf("unknown stage %s in -stage-interval", name)
+		}
+		*interval = seconds
+	}
+	for _, item := range splitList(*enrich) {
+		objectType, value, ok := strings.Cut(item, "=")
+		objectType = strings.TrimSpace(objectType)
+		if !ok || objectType == "" {
+			return fmt.Errorf("invalid -enrich %s, use <type>=<enricher:enricher>", item)
+		}
+		var names []string
+		for _, name := range strings.Split(value, ":") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		en := &settings.Enrichment
+		if len(names) == 0 {
+			delete(en.ObjectTypes, objectType)
+			continue
+		}
+		if en.ObjectTypes == nil {
+			en.ObjectTypes = map[string][]string{}
+		}
+		en.ObjectTypes[objectType] = names
+	}
+	if *enrichTimeout > 0 {
+		settings.Enrichment.TimeoutMS = *enrichTimeout
+	}
+	if *enrichCache >= 0 {
+		settings.Enrichment.CacheMinutes = *enrichCache
+	}
+	if *enrichRefresh >= 0 {
+		settings.Enrichment.RefreshDays = *enrichRefresh
+	}
+	if *limitEnrich > 0 {
+		settings.Enrichment.BatchLimit = *limitEnrich
+	}
+
+	settings, err = c.SetSettings(ctx, settings)
+	if err != nil {
+		return err
+	}
+	return printSettings(settings)
+}
+
+func printSettings(settings client.Settings) error {
+	if jsonOutput {
+		return printJSON(settings)
+	}
+	if err := printBands(settings.SeverityBands); err != nil {
+		return err
+	}
+	w := settings.ScoringWeights
+	fmt.Printf("\nScoring Weights: current week %d, last week %d, two weeks ago %d, three weeks ago %d\n", w.CurrentWeek, w.LastWeek, w.TwoWeeksAgo, w.ThreeWeeksAgo)
+	fmt.Printf("Rescore Interval: %d hours\n", settings.RescoreIntervalHours)
+	l := settings.BatchLimits
+	fmt.Printf("Batch Limits: pending_import %d, rescore %d, export %d\n", l.PendingImport, l.Rescore, l.Export)
+	v := settings.VerdictRules
+	fmt.Printf("Verdict Rules: malicious %d with %s fidelity, suspicious %d, benign at most %d\n", v.MaliciousScore, v.MaliciousMinFidelity, v.SuspiciousScore, v.BenignMaxScore)
+	hl := settings.DecayHalfLives
+	halfLives := []string{fmt.Sprintf("default %gh", hl.DefaultHours)}
+	for _, name := range sortedNames(hl.ObjectTypes) {
+		halfLives = append(halfLives, fmt.Sprintf("%s %gh", name, hl.ObjectTypes[name]))
+	}
+	for _, name := range sortedNames(hl.Sources) {
+		halfLives = append(halfLives, fmt.Sprintf("source %s %gh", name, hl.Sources[name]))
+	}
+	fmt.Printf("Decay Half-Lives: %s, lookback %d days\n", strings.Join(halfLives, ", "), hl.LookbackDays)
+	r := settings.Retention
+	fmt.Printf("Retention: sightings %d days, archive %d days and %d MB, objects at or below %d not seen for %d days, stage runs %d days, import batches %d days\n", r.SightingDays, r.ArchiveDays, r.ArchiveMaxMB, r.StaleMaxScore, r.StaleObjectDays, r.StageRunDays, r.ImportBatchDays)
+	si := settings.StageIntervals
+	fmt.Printf("Stage Intervals: import_csv %ds, process_imports %ds, trusted_csv %ds, mark_trusted %ds, enrich %ds, rescore %ds, prune %ds, backup %ds\n", si.ImportCSV, si.ProcessImports, si.TrustedCSV, si.MarkTrusted, si.Enrich, si.Rescore, si.Prune, si.Backup)
+	en := settings.Enrichment
+	enrichers := []string{}
+	for _, objectType := range sortedNames(en.ObjectTypes) {
+		enrichers = append(enrichers, fmt.Sprintf("%s %s", objectType, strings.Join(en.ObjectTypes[objectType], ", ")))
+	}
+	if len(enrichers) == 0 {
+		enrichers = append(enrichers, "none enabled")
+	}
+	fmt.Printf("Enrichment: %s; timeout %dms, cache %d minutes, refresh %d days, limit %d\n", strings.Join(enrichers, "; "), en.TimeoutMS, en.CacheMinutes, en.RefreshDays, en.BatchLimit)
+	return nil
+}
+
+// stageInterval returns the setting of a workerBee stage, nil for an unknown stage
+func stageInterval(si *client.StageIntervals, stage string) *int {
+	return map[string]*int{
+		"import_csv":      &si.ImportCSV,
+		"process_imports": &si.ProcessImports,
+		"trusted_csv":     &si.TrustedCSV,
+		"mark_trusted":    &si.MarkTrusted,
+		"enrich":          &si.Enrich,
+		"rescore":         &si.Rescore,
+		"prune":           &si.Prune,
+		"backup":          &si.Backup,
+	}[stage]
+}
+
+func scoringGet(ctx context.Context, c *client.Client, args []string) error {
+	if err := noArgs("scoring get", args); err != nil {
+		return err
+	}
+	rules, err := c.GetScoringRules(ctx)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(rules)
+	}
+	fmt.Printf("Version: %d\nMax Raw Score: %g\n\n", rules.Version, rules.MaxRawScore)
+	tw := newTable()
+	fmt.Fprintln(tw, "RULE\tFACTOR\tOP\tWEIGHT\tCAP\tVALUES\tDISABLED")
+	for _, rule := range rules.Rules {
+		var values []string
+		for key, value := range rule.Values {
+			values = append(values, fmt.Sprintf("%s=%g", key, value))
+		}
+		sort.Strings(values)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%g\t%g\t%s\t%t\n", rule.Name, rule.Factor, rule.Op, rule.Weight, rule.Cap, strings.Join(values, ","), rule.Disabled)
+	}
+	return tw.Flush()
+}
+
+// scoringSet replaces the rules with a JSON file, use scoring get -json to start from the current rules
+func scoringSet(ctx context.Context, c *client.Client, args []string) error {
+	file, err := oneArg(newFlags("scoring set"), args, "JSON file of rules")
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	var rules client.ScoringRuleSet
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", file, err)
+	}
+
+	rules, err = c.SetScoringRules(ctx, rules)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Saved scoring rules version %d, every object will be rescored by the workerBee\n", rules.Version)
+	return nil
+}
+
+func exportBlocklist(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("export blocklist")
+	var opts client.BlocklistOptions
+	fs.IntVar(&opts.MinScore, "min-score", 0, "Minimum risk_score, defaults to the lowest severity band that is blocked")
+	fs.StringVar(&opts.ObjectType, "type", "", "Only export one object type: ipv4, ipv6, domain, url or hash")
+	verdicts := fs.String("verdict", "", "Only export objects with these comma separated verdicts, for example malicious,suspicious")
+	fs.IntVar(&opts.Limit, "limit", 0, "Maximum number of objects")
+	format := fs.String("format", "text", "json or text for one object per line")
+	output := fs.String("o", "", "Write the blocklist to a file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	opts.Verdicts = splitList(*verdicts)
+
+	var data []byte
+	switch *format {
+	case "text":
+		text, err := c.ExportBlocklistText(ctx, opts)
+		if err != nil {
+			return err
+		}
+		data = []byte(text)
+	case "json":
+		blocklist, err := c.ExportBlocklist(ctx, opts)
+		if err != nil {
+			return err
+		}
+		data, err = json.MarshalIndent(blocklist, "", "  ")
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	default:
+		return fmt.Errorf("invalid format %s, use json or text", *format)
+	}
+
+	if *output == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(*output, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", *output, err)
+	}
+	log.Printf("Blocklist written to %s\n", *output)
+	return nil
+}
+
+func importsShow(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("imports show")
+	outcome := fs.String("outcome", "", "Only list the accepted or the rejected rows")
+	limit := fs.Int("limit", 0, "Maximum number of rows, 0 uses the server default")
+	value, err := oneArg(fs, args, "batch id")
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid batch id %s", value)
+	}
+	batch, err := c.ImportBatch(ctx, id, *outcome, *limit)
+	if err != nil {
+		if client.IsNotFound(err) {
+			return fmt.Errorf("no import batch %d, it may have been pruned", id)
+		}
+		return err
+	}
+	if jsonOutput {
+		return printJSON(batch)
+	}
+	tw := newTable()
+	fmt.Fprintf(tw, "Batch:\t%d\n", batch.ID)
+	fmt.Fprintf(tw, "Status:\t%s\n", batch.Status)
+	fmt.Fprintf(tw, "Source:\t%s %s\n", batch.Source, batch.FileName)
+	fmt.Fprintf(tw, "Submitted By:\t%s\n", batch.SubmittedBy)
+	fmt.Fprintf(tw, "Rows:\t%d, %d accepted, %d rejected, %d pending, %d purged\n", batch.TotalRows, batch.Accepted, batch.Rejected, batch.Pending, batch.Purged)
+	fmt.Fprintf(tw, "Created:\t%s\n", batch.CreatedAt)
+	fmt.Fprintf(tw, "Started:\t%s\n", batch.StartedAt)
+	fmt.Fprintf(tw, "Finished:\t%s\n", batch.FinishedAt)
+	if batch.RolledBackAt != "" {
+		fmt.Fprintf(tw, "Rolled Back:\t%s\n", batch.RolledBackAt)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(batch.Rows) == 0 {
+		return nil
+	}
+	fmt.Println()
+	tw = newTable()
+	fmt.Fprintln(tw, "ROW\tOBJECT\tTYPE\tOUTCOME\tREASON")
+	for _, row := range batch.Rows {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", row.Row, row.Object, row.ObjectType, row.Outcome, row.Reason)
+	}
+	return tw.Flush()
+}
+
+func importsRollback(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("imports rollback")
+	dryRun := fs.Bool("dry-run", false, "Show what would be removed without removing it")
+	value, err := oneArg(fs, args, "batch id")
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid batch id %s", value)
+	}
+	result, err := c.RollbackImportBatch(ctx, id, *dryRun)
+	if err != nil {
+		if client.IsNotFound(err) {
+			return fmt.Errorf("no import batch %d, it may have been pruned", id)
+		}
+		return err
+	}
+	if jsonOutput {
+		return printJSON(result)
+	}
+	verb := "Removed"
+	if result.DryRun {
+		verb = "Would remove"
+	}
+	fmt.Printf("%s %d pending rows and %d sightings of import batch %d\n", verb, result.PendingRows, result.Sightings, id)
+	fmt.Printf("%d objects updated, %d objects deleted, %d rescored\n\n", result.ObjectsUpdated, result.ObjectsDeleted, result.Rescored)
+	tw := newTable()
+	fmt.Fprintln(tw, "OBJECT\tOCCURRENCES REMOVED\tLEFT\tFIRST SEEN\tLAST SEEN")
+	for _, object := range result.Objects {
+		if object.Deleted {
+			fmt.Fprintf(tw, "%s\t%d\tdeleted\t\t\n", object.Object, object.Occurrences)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", object.Object, object.Occurrences, object.OccurrenceCount, object.FirstSeen, object.LastSeen)
+	}
+	return tw.Flush()
+}
+
+func pendingStats(ctx context.Context, c *client.Client, args []string) error {
+	if err := noArgs("pending stats", args); err != nil {
+		return err
+	}
+	stats, err := c.PendingStats(ctx)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(stats)
+	}
+	fmt.Printf("Total:   %d\n", stats.Total)
+	fmt.Printf("Claimed: %d\n", stats.Claimed)
+	fmt.Printf("Oldest:  %s\n", stats.Oldest)
+	fmt.Printf("Newest:  %s\n", stats.Newest)
+	fmt.Printf("Quarantined: %d\n\n", stats.Quarantined)
+	tw := newTable()
+	fmt.Fprintln(tw, "OBJECT TYPE\tCOUNT")
+	for objectType, count := range stats.ByType {
+		fmt.Fprintf(tw, "%s\t%d\n", objectType, count)
+	}
+	fmt.Fprintln(tw, "\t")
+	fmt.Fprintln(tw, "SOURCE\tCOUNT")
+	for source, count := range stats.BySource {
+		fmt.Fprintf(tw, "%s\t%d\n", source, count)
+	}
+	return tw.Flush()
+}
+
+func pendingPurge(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("pending purge")
+	var opts client.PurgeOptions
+	fs.IntVar(&opts.OlderThanDays, "older-than-days", 0, "Only purge rows imported more than this many days ago")
+	fs.StringVar(&opts.ObjectType, "type", "", "Only purge one object type")
+	fs.StringVar(&opts.Source, "source", "", "Only purge rows from one source")
+	fs.BoolVar(&opts.All, "all", false, "Purge every row in the pending_import table")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if opts.OlderThanDays == 0 && opts.ObjectType == "" && opts.Source == "" && !opts.All {
+		return errors.New("set -older-than-days, -type, -source or -all")
+	}
+
+	result, err := c.PurgePending(ctx, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Purged %d rows from pending_import\n", result.Count)
+	return nil
+}
+
+// quarantineFlags adds the filters of the quarantine actions, -id and -all are only added for resubmit and purge
+func quarantineFlags(fs *flag.FlagSet, opts *client.QuarantineOptions, every bool) {
+	fs.Int64Var(&opts.BatchID, "batch", 0, "Only the rows of one import batch")
+	fs.StringVar(&opts.Source, "source", "", "Only the rows from one source")
+	fs.StringVar(&opts.ObjectType, "type", "", "Only one object type")
+	fs.StringVar(&opts.Reason, "reason", "", "Only the rows rejected for this reason")
+	fs.IntVar(&opts.OlderThanDays, "older-than-days", 0, "Only the rows quarantined more than this many days ago")
+	if every {
+		fs.Int64Var(&opts.ID, "id", 0, "Only one quarantined row")
+		fs.BoolVar(&opts.All, "all", false, "Every row in the quarantine")
+	}
+}
+
+func quarantineFiltered(opts client.QuarantineOptions) error {
+	if opts.ID == 0 && opts.BatchID == 0 && opts.Source == "" && opts.ObjectType == "" && opts.Reason == "" && opts.OlderThanDays == 0 && !opts.All {
+		return errors.New("set -id, -batch, -source, -type, -reason, -older-than-days or -all")
+	}
+	return nil
+}
+
+func quarantineList(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("quarantine list")
+	var opts client.QuarantineOptions
+	quarantineFlags(fs, &opts, false)
+	fs.IntVar(&opts.Limit, "limit", 0, "Maximum number of rows, 0 uses the server default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	rows, err := c.ListQuarantine(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(rows)
+	}
+	tw := newTable()
+	fmt.Fprintln(tw, "ID\tOBJECT\tTYPE\tSOURCE\tBATCH\tREASON\tQUARANTINED\tFIXED")
+	for _, row := range rows {
+		batch := ""
+		if row.BatchID != 0 {
+			batch = fmt.Sprintf("%d:%d", row.BatchID, row.BatchRow)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", row.ID, row.Object, row.ObjectType, row.Source, batch, row.Reason, row.QuarantinedAt, row.FixedAt)
+	}
+	return tw.Flush()
+}
+
+func quarantineFix(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("quarantine fix")
+	object := fs.String("object", "", "Corrected object")
+	objectType := fs.String("type", "", "Corrected object type, ipv4, ipv6, domain, url or hash")
+	value, err := oneArg(fs, args, "quarantine id")
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid quarantine id %s", value)
+	}
+	if *object == "" || *objectType == "" {
+		return errors.New("-object and -type are required")
+	}
+	row, err := c.FixQuarantined(ctx, id, *object, *objectType)
+	if err != nil {
+		if client.IsNotFound(err) {
+			return fmt.Errorf("no quarantined row %d", id)
+		}
+		return err
+	}
+	if jsonOutput {
+		return printJSON(row)
+	}
+	fmt.Printf("Quarantined row %d is now %s (%s), resubmit it to import it\n", row.ID, row.Object, row.ObjectType)
+	return nil
+}
+
+func quarantineResubmit(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("quarantine resubmit")
+	var opts client.QuarantineOptions
+	quarantineFlags(fs, &opts, true)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := quarantineFiltered(opts); err != nil {
+		return err
+	}
+	result, err := c.ResubmitQuarantined(ctx, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Resubmitted %d quarantined rows to pending_import\n", result.Count)
+	return nil
+}
+
+func quarantinePurge(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("quarantine purge")
+	var opts client.QuarantineOptions
+	quarantineFlags(fs, &opts, true)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := quarantineFiltered(opts); err != nil {
+		return err
+	}
+	result, err := c.PurgeQuarantine(ctx, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Purged %d rows from the quarantine\n", result.Count)
+	return nil
+}
+
+func objectsShow(ctx context.Context, c *client.Client, args []string) error {
+	object, err := oneArg(newFlags("objects show"), args, "object")
+	if err != nil {
+		return err
+	}
+	intel, err := c.Lookup(ctx, object)
+	if err != nil {
+		if client.IsNotFound(err) {
+			return fmt.Errorf("%s has not been processed", object)
+		}
+		if tombstone, ok := client.Expired(err); ok {
+			return fmt.Errorf("%s expired at %s, last seen %s with risk score %d", object, tombstone.ExpiredAt, tombstone.LastSeen, tombstone.RiskScore)
+		}
+		return err
+	}
+	if jsonOutput {
+		return printJSON(intel)
+	}
+	tw := newTable()
+	fmt.Fprintf(tw, "Object:\t%s\n", intel.Object)
+	fmt.Fprintf(tw, "Type:\t%s\n", intel.ObjectType)
+	fmt.Fprintf(tw, "Risk Score:\t%d (updated %s)\n", intel.RiskScore, intel.RiskScoreLastUpdated)
+	fmt.Fprintf(tw, "Severity:\t%s\n", intel.Severity)
+	fmt.Fprintf(tw, "Verdict:\t%s\n", intel.Verdict)
+	fmt.Fprintf(tw, "Fidelity:\t%s\n", intel.Fidelity)
+	fmt.Fprintf(tw, "Confirmed Risk:\t%t\n", intel.ConfirmedRisk)
+	fmt.Fprintf(tw, "Trusted:\t%t\n", intel.Trusted)
+	fmt.Fprintf(tw, "First Seen:\t%s\n", intel.FirstSeen)
+	fmt.Fprintf(tw, "Last Seen:\t%s\n", intel.LastSeen)
+	fmt.Fprintf(tw, "Occurrences:\t%d\n", intel.OccurrenceCount)
+	fmt.Fprintf(tw, "Geo:\t%s %s %s %s\n", intel.GeoCountry, intel.GeoRegion, intel.GeoOrg, intel.GeoASN)
+	if intel.EnrichedAt != "" {
+		fmt.Fprintf(tw, "Enriched:\t%s\n", intel.EnrichedAt)
+	}
+	if intel.ObjectAdditionalInfo != "" {
+		fmt.Fprintf(tw, "Additional Info:\t%s\n", intel.ObjectAdditionalInfo)
+	}
+	if intel.EnrichmentInfo != "" {
+		fmt.Fprintf(tw, "Enrichment Info:\t%s\n", intel.EnrichmentInfo)
+	}
+	fmt.Fprintf(tw, "Notes:\t%s\n", intel.Notes)
+	return tw.Flush()
+}
+
+func objectsList(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("objects list")
+	var opts client.ObjectListOptions
+	verdicts := fs.String("verdict", "", "Comma separated verdicts: malicious, suspicious, unknown, benign or trusted")
+	fs.StringVar(&opts.ObjectType, "type", "", "Only list one object type: ipv4, ipv6, domain, url or hash")
+	fs.IntVar(&opts.Limit, "limit", 100, "Maximum number of objects")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	opts.Verdicts = splitList(*verdicts)
+
+	list, err := c.ListObjects(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(list)
+	}
+	tw := newTable()
+	fmt.Fprintln(tw, "OBJECT	TYPE	RISK SCORE	VERDICT	LAST SEEN")
+	for _, obj := range list.Objects {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", obj.Object, obj.ObjectType, obj.RiskScore, obj.Verdict, obj.LastSeen)
+	}
+	return tw.Flush()
+}
+
+// objectsVerdicts prints when and why the verdict of an object changed
+func objectsVerdicts(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("objects verdicts")
+	limit := fs.Int("limit", 20, "Number of changes to show, newest first")
+	object, err := oneArg(fs, args, "object")
+	if err != nil {
+		return err
+	}
+	history, err := c.VerdictHistory(ctx, object, *limit)
+	if err != nil {
+		if client.IsNotFound(err) {
+			return fmt.Errorf("%s has not been processed", object)
+		}
+		return err
+	}
+	if jsonOutput {
+		return printJSON(history)
+	}
+	fmt.Printf("%s verdict %s\n\n", history.Object, history.Verdict)
+	tw := newTable()
+	fmt.Fprintln(tw, "CHANGED\tFROM\tTO\tREASON")
+	for _, change := range history.History {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", change.ChangedAt, change.OldVerdict, change.NewVerdict, change.Reason)
+	}
+	return tw.Flush()
+}
+
+// objectsSightings prints the sightings of an object on each day
+func objectsSightings(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("objects sightings")
+	days := fs.Int("days", 30, "Number of days back to count")
+	object, err := oneArg(fs, args, "object")
+	if err != nil {
+		return err
+	}
+	trend, err := c.SightingTrend(ctx, object, *days)
+	if err != nil {
+		if client.IsNotFound(err) {
+			return fmt.Errorf("%s has not been processed", object)
+		}
+		return err
+	}
+	if jsonOutput {
+		return printJSON(trend)
+	}
+	fmt.Printf("%s seen %d times in the last %d days\n\n", trend.Object, trend.Total, trend.Days)
+	tw := newTable()
+	fmt.Fprintln(tw, "DAY\tSIGHTINGS\tSOURCES")
+	for _, day := range trend.History {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", day.Day, day.Count, day.Sources)
+	}
+	return tw.Flush()
+}
+
+// objectsScore prints why an object has its risk score
+func objectsScore(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("objects score")
+	limit := fs.Int("limit", 1, "Number of scoring runs to show, newest first")
+	object, err := oneArg(fs, args, "object")
+	if err != nil {
+		return err
+	}
+	history, err := c.ScoreHistory(ctx, object, *limit)
+	if err != nil {
+		if client.IsNotFound(err) {
+			return fmt.Errorf("%s has not been processed", object)
+		}
+		return err
+	}
+	if jsonOutput {
+		return printJSON(history)
+	}
+	fmt.Printf("%s risk score %d (%s)\n", history.Object, history.RiskScore, history.Severity)
+	if len(history.History) == 0 {
+		fmt.Println("The object has not been scored yet")
+	}
+	for _, entry := range history.History {
+		fmt.Printf("\nScored %s: %d (raw %.2f) with rules version %d\n", entry.ScoredAt, entry.Score, entry.RawScore, entry.RuleVersion)
+		tw := newTable()
+		fmt.Fprintln(tw, "RULE\tFACTOR\tOP\tVALUE\tWEIGHT\tPOINTS")
+		for _, c := range entry.Breakdown {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%g\t%g\t%+.2f\n", c.Rule, c.Factor, c.Op, c.Value, c.Weight, c.Points)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func objectsConfirm(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("objects confirm")
+	unset := fs.Bool("unset", false, "Clear confirmed_risk instead of setting it")
+	object, err := oneArg(fs, args, "object")
+	if err != nil {
+		return err
+	}
+	status, err := c.ConfirmObject(ctx, object, !*unset)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %s\n", status.Object, status.Status)
+	return nil
+}
+
+func objectsUntrust(ctx context.Context, c *client.Client, args []string) error {
+	object, err := oneArg(newFlags("objects untrust"), args, "object")
+	if err != nil {
+		return err
+	}
+	status, err := c.UntrustObject(ctx, object)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %s\n", status.Object, status.Status)
+	if status.CoveredBy != "" {
+		fmt.Printf("Warning: %s is still covered by the trusted CIDR %s and will be marked trusted again, remove it with: trusted remove %s\n", status.Object, status.CoveredBy, status.CoveredBy)
+	}
+	return nil
+}
+
+func dbBackup(ctx context.Context, c *client.Client, args []string) error {
+	if err := noArgs("db backup", args); err != nil {
+		return err
+	}
+	backup, err := c.BackupDB(ctx)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(backup)
+	}
+	fmt.Printf("Database backed up on the server to %s (%d bytes)\n", backup.Path, backup.SizeBytes)
+	for _, name := range backup.Removed {
+		fmt.Printf("Removed the old backup %s\n", name)
+	}
+	return nil
+}
+
+func dbBackups(ctx context.Context, c *client.Client, args []string) error {
+	if err := noArgs("db backups", args); err != nil {
+		return err
+	}
+	list, err := c.ListBackups(ctx)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(list)
+	}
+	fmt.Printf("Backups in %s on the server\n", list.Directory)
+	tw := newTable()
+	fmt.Fprintln(tw, "NAME\tCREATED\tSIZE\tCOMPRESSED")
+	for _, backup := range list.Backups {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%t\n", backup.Name, backup.CreatedAt, backup.SizeBytes, backup.Compressed)
+	}
+	return tw.Flush()
+}
+
+func dbRestore(ctx context.Context, c *client.Client, args []string) error {
+	name, err := oneArg(newFlags("db restore"), args, "backup name")
+	if err != nil {
+		return err
+	}
+	restored, err := c.RestoreDB(ctx, name)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(restored)
+	}
+	fmt.Printf("Database restored from %s, applied %d migrations\n", restored.Restored, restored.MigrationsApplied)
+	return nil
+}
+
+func dbVacuum(ctx context.Context, c *client.Client, args []string) error {
+	if err := noArgs("db vacuum", args); err != nil {
+		return err
+	}
+	if err := c.VacuumDB(ctx); err != nil {
+		return err
+	}
+	fmt.Println("Database vacuumed")
+	return nil
+}
+
+func stagesRuns(ctx context.Context, c *client.Client, args []string) error {
+	fs := newFlags("stages runs")
+	stage := fs.String("stage", "", "Only the runs of this stage")
+	limit := fs.Int("limit", 0, "Maximum number of runs, 0 uses the server default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	runs, err := c.StageRuns(ctx, *stage, *limit)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(runs)
+	}
+	tw := newTable()
+	fmt.Fprintln(tw, "STAGE\tSTATUS\tSTARTED\tDURATION\tERROR")
+	for _, run := range runs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%dms\t%s\n", run.Stage, run.Status, run.StartedAt, run.DurationMS, run.Error)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,15 @@
+#!/bin/bash
+projectName="adminClient"
+bin="$projectName.bin"
+exe="$projectName.exe"
+if [ ! -e "go.mod" ]; then
+	go mod init $projectName
+	go work init
+	go work use . ../client
+fi
+
+go env -w GOPATH=`pwd`
+go env -w GO111MODULE='auto'
+
+GOOS=linux GOARCH=amd64 go build -o $bin -ldflags "-w -s" .
+#GOOS=windows GOARCH=amd64 go build -o $exe -ldflags "-w -s" main.go
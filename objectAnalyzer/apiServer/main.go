@@ -1,19 +1,26 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"path/filepath"
+	"time"
 
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"common"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
+// The requests in flight get this long to finish after SIGINT or SIGTERM
+const shutdownTimeout = 30 * time.Second
+
 /** Future Enhancements
 1. Incorporate logging for the connecting IP Addresses and the actions taken
 2. Move the API Key to a database table for better management
@@ -32,6 +39,8 @@ Admin Functions
 
 func main() {
 	ConfigPtr := flag.String("config", "config.json", "Path to configuration file")
+	CheckConfigPtr := flag.Bool("check-config", false, "Print the effective configuration with secrets redacted, validate it and exit")
+	MigratePtr := flag.String("migrate", "", "status shows the database migrations, up applies the pending ones, then exit")
 	flag.Parse()
 
 	// Load the Configuration file
@@ -39,8 +48,41 @@ func main() {
 	configFile := *ConfigPtr
 	log.Println("Loading the following config file: " + configFile + "\n")
 	if err := config.LoadConfig(configFile); err != nil {
-		config.CreateConfig(configFile)
-		log.Fatalf("Created %s, modify the file to customize how the tool functions.\n", configFile)
+		// Only create the default config when it is missing, never overwrite a config that failed to load
+		if errors.Is(err, os.ErrNotExist) && !*CheckConfigPtr {
+			config.CreateConfig(configFile)
+			log.Fatalf("Created %s, modify the file to customize how the tool functions.\n", configFile)
+		}
+		log.Fatalf("Failed to load the config file %s: %v\n", configFile, err)
+	}
+
+	if *CheckConfigPtr {
+		if err := config.PrintCheckConfig(configFile, true); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if err := config.Validate(true); err != nil {
+		if len(config.APIKey) < 16 {
+			generatedKey := common.GenerateRandomString(64)
+			log.Printf("Generated API Key: %s\n", generatedKey)
+		}
+		log.Fatalf("Invalid configuration in %s:\n%v\n", configFile, err)
+	}
+
+	// Show or apply the database migrations and exit
+	if *MigratePtr != "" {
+		server := common.NewServerConfig(config, configFile)
+		if err := server.OpenDatabase(); err != nil {
+			log.Fatalf("database initialization failed: %v", err)
+		}
+		err := server.RunMigrateCommand(*MigratePtr, os.Stdout)
+		server.Store.Close()
+		if err != nil {
+			log.Fatalf("migrate %s failed: %v", *MigratePtr, err)
+		}
+		os.Exit(0)
 	}
 
 	// Verify the TLS Certificate and Key files exist for the https server
@@ -76,23 +118,15 @@ func main() {
 		log.Printf("Database Path from config: %s\n", config.DBPath)
 	}
 
-	if len(config.APIKey) < 16 {
-		log.Println("The API Key is too short.Recommended length of an API key is more than 64 characters")
-		generatedKey := common.GenerateRandomString(64)
-		log.Printf("Generated API Key: %s\n", generatedKey)
-	}
-
 	// Initialize the server with the configuration loaded from the config file
-	server := &common.ServerConfig{
-		Config: config,
-	}
+	server := common.NewServerConfig(config, configFile)
 
 	// Initialize the database
 	err = server.InitDatabase()
 	if err != nil {
 		log.Fatalf("database initialization failed: %v", err)
 	}
-	defer server.DB.Close()
+	defer server.Store.Close()
 
 	// Build appropriate directories for the web server
 	common.CreateDirectory("static")
@@ -101,7 +135,67 @@ func main() {
 	// ** New Enhancement of Validating an API Key for each request ** API Key stored in the database ** Admin function to add the API Keys... API Key for adding trusted IP Addresses
 
 	// Setup the API Routes for the Web Server
-	mux := http.NewServeMux()
+	mux := newMux(server)
+
+	// Reload the configuration on SIGHUP, settings like the listener and TLS paths are reported as needing a restart
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+	go func() {
+		for range reloadSignal {
+			report, err := server.ReloadConfig(true)
+			if err != nil {
+				log.Printf("Config reload on SIGHUP failed: %v\n", err)
+				continue
+			}
+			log.Printf("Config reloaded on SIGHUP: %s\n", report)
+		}
+	}()
+
+	// SIGINT or SIGTERM shuts the server down and stops the certificate checks
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Serve the certificate through GetCertificate so a renewed or replaced certificate is picked up without restarting the listener
+	certManager := common.NewCertManager(config)
+	err = certManager.Load()
+	if err != nil {
+		log.Fatalf("Failed to load the TLS certificate: %v", err)
+	}
+	go certManager.Watch(ctx.Done())
+
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", config.Hostname, config.Port),
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			GetCertificate: certManager.GetCertificate,
+		},
+	}
+
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		log.Printf("Shutting down, waiting up to %s for the requests in flight\n", shutdownTimeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Shutdown did not finish: %v\n", err)
+		}
+	}()
+
+	// Start the HTTP server
+	log.Printf("Starting HTTP with TLS server on %s:%d", config.Hostname, config.Port)
+	err = httpServer.ListenAndServeTLS("", "")
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+	<-shutdown
+	log.Printf("Server stopped\n")
+}
+
+// newMux registers the routes of the apiServer, main_test.go checks them against the OpenAPI document
+func newMux(server *common.ServerConfig) *common.RouteMux {
+	mux := common.NewRouteMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.FileServer(http.Dir("./static")).ServeHTTP(w, r)
 	})
@@ -113,13 +207,47 @@ func main() {
 	mux.HandleFunc("/api/import", server.HandleImport)         // Imports a single object to import
 	mux.HandleFunc("/api/importJSON", server.HandleImportJSON) // Import multiple objects using JSON
 	mux.HandleFunc("/api/importFile", server.HandleImportCSV)
-	mux.HandleFunc("/api/verifyImport", server.HandleVerify) // Verifies that a single object exists in the pending_import table
+	mux.HandleFunc("/api/verifyImport", server.HandleVerify)         // Verifies that a single object exists in the pending_import table
+	mux.HandleFunc("GET /api/import/{id}", server.HandleImportBatch) // Status of an import batch, authenticated with the X-API-Key header
 	// Import IP Addresses that are trusted
 
-	// Start the HTTP server
-	log.Printf("Starting HTTP with TLS server on %s:%d", server.Config.Hostname, server.Config.Port)
-	err = http.ListenAndServeTLS(fmt.Sprintf("%s:%d", server.Config.Hostname, server.Config.Port), server.Config.TLSCert, server.Config.TLSKey, mux)
-	if err != nil {
-		log.Fatalf("Failed to start server: %v", err)
-	}
+	// Lookups and Exports, authenticated with the apiKey in the X-API-Key header
+	mux.HandleFunc("GET /api/object/{object}", server.HandleLookup)                  // Pull a record of an object after processing
+	mux.HandleFunc("GET /api/object/{object}/score", server.HandleScoreHistory)      // Why an object has its risk score
+	mux.HandleFunc("GET /api/object/{object}/verdicts", server.HandleVerdictHistory) // When and why the verdict of an object changed
+	mux.HandleFunc("GET /api/object/{object}/sightings", server.HandleSightingTrend) // Sightings of an object on each day
+	mux.HandleFunc("GET /api/objects", server.HandleListObjects)                     // Objects filtered by verdict
+	mux.HandleFunc("GET /api/export/blocklist", server.HandleExportBlocklist)        // List of objects to block
+
+	// Admin Endpoints, authenticated with the adminApiKey or an admin role key in the X-API-Key header, used by the adminClient
+	mux.HandleFunc("/api/admin/reloadConfig", server.HandleReloadConfig) // Same as sending SIGHUP
+	mux.HandleFunc("POST /api/admin/keys", server.HandleCreateAPIKey)
+	mux.HandleFunc("GET /api/admin/keys", server.HandleListAPIKeys)
+	mux.HandleFunc("DELETE /api/admin/keys/{id}", server.HandleRevokeAPIKey)
+	mux.HandleFunc("POST /api/admin/trusted", server.HandleAddTrusted)
+	mux.HandleFunc("GET /api/admin/trusted", server.HandleListTrusted)
+	mux.HandleFunc("DELETE /api/admin/trusted", server.HandleRemoveTrusted)
+	mux.HandleFunc("GET /api/admin/settings", server.HandleGetSettings)
+	mux.HandleFunc("PUT /api/admin/settings", server.HandleSetSettings) // Severity bands, block durations, scoring weights and batch limits
+	mux.HandleFunc("GET /api/admin/scoring/rules", server.HandleGetScoringRules)
+	mux.HandleFunc("PUT /api/admin/scoring/rules", server.HandleSetScoringRules)
+	mux.HandleFunc("GET /api/admin/pending", server.HandlePendingStats)
+	mux.HandleFunc("DELETE /api/admin/pending", server.HandlePurgePending)
+	mux.HandleFunc("POST /api/admin/objects/{object}/confirm", server.HandleConfirmObject)
+	mux.HandleFunc("POST /api/admin/objects/{object}/untrust", server.HandleUntrustObject)
+	mux.HandleFunc("POST /api/admin/db/backup", server.HandleBackupDB)
+	mux.HandleFunc("GET /api/admin/db/backups", server.HandleListBackups)
+	mux.HandleFunc("POST /api/admin/db/restore", server.HandleRestoreDB)
+	mux.HandleFunc("POST /api/admin/db/vacuum", server.HandleVacuumDB)
+	mux.HandleFunc("POST /api/admin/imports/{id}/rollback", server.HandleRollbackImportBatch)
+	mux.HandleFunc("GET /api/admin/quarantine", server.HandleListQuarantine)
+	mux.HandleFunc("PUT /api/admin/quarantine/{id}", server.HandleFixQuarantined)
+	mux.HandleFunc("POST /api/admin/quarantine/resubmit", server.HandleResubmitQuarantine)
+	mux.HandleFunc("DELETE /api/admin/quarantine", server.HandlePurgeQuarantine)
+	mux.HandleFunc("GET /api/admin/stages/runs", server.HandleStageRuns)
+
+	// API Documentation, every /api route above needs an entry in common/commonOpenAPI.go
+	mux.HandleFunc("GET /api/openapi.json", server.HandleOpenAPI)
+	mux.HandleFunc("GET /api/docs", server.HandleAPIDocs)
+	return mux
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"common"
+)
+
+var pathParameter = regexp.MustCompile(`\{([^}.]+)(\.\.\.)?\}`)
+
+// splitPattern separates the optional method from the path of a mux pattern
+func splitPattern(pattern string) (string, string) {
+	if method, path, found := strings.Cut(pattern, " "); found {
+		return method, strings.TrimSpace(path)
+	}
+	return "", pattern
+}
+
+// Every /api route registered on the mux is in the OpenAPI document and every documented route is served by its pattern
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	var config common.Configuration
+	config.SetDefaults()
+	mux := newMux(common.NewServerConfig(config, ""))
+
+	documented := make(map[string]bool)
+	for _, op := range common.APIOperations() {
+		documented[op.Pattern] = true
+	}
+	registered := make(map[string]bool)
+	for _, pattern := range mux.Patterns() {
+		_, path := splitPattern(pattern)
+		if !strings.HasPrefix(path, "/api/") {
+			continue
+		}
+		registered[pattern] = true
+		if !documented[pattern] {
+			t.Errorf("route %q is registered but missing from the OpenAPI document", pattern)
+		}
+	}
+
+	for _, op := range common.APIOperations() {
+		if !registered[op.Pattern] {
+			t.Errorf("route %q is in the OpenAPI document but not registered", op.Pattern)
+			continue
+		}
+		// Make sure a request for the documented path reaches this pattern and not another one
+		method, path := splitPattern(op.Pattern)
+		if method == "" {
+			method = op.Method
+		}
+		path = pathParameter.ReplaceAllString(path, "example")
+		req := httptest.NewRequest(method, path, nil)
+		if _, matched := mux.Handler(req); matched != op.Pattern {
+			t.Errorf("%s %s is served by %q instead of %q", method, path, matched, op.Pattern)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package client
+
+// Admin endpoints, sent with the key set by WithAdminKey
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+func (c *Client) CreateKey(ctx context.Context, name string, role string) (NewAPIKey, error) {
+	var result NewAPIKey
+	req, err := jsonRequest(http.MethodPost, "/api/admin/keys", createKeyRequest{Name: name, Role: role})
+	if err != nil {
+		return result, err
+	}
+	req.apiKey = c.adminKey
+	err = c.do(ctx, req, &result)
+	return result, err
+}
+
+func (c *Client) ListKeys(ctx context.Context) ([]APIKey, error) {
+	var result []APIKey
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/admin/keys", apiKey: c.adminKey}, &result)
+	return result, err
+}
+
+func (c *Client) RevokeKey(ctx context.Context, id int64) error {
+	path := "/api/admin/keys/" + strconv.FormatInt(id, 10)
+	return c.do(ctx, request{method: http.MethodDelete, path: path, apiKey: c.adminKey}, nil)
+}
+
+// AddTrusted adds or updates trusted objects, the matching objects are marked trusted by the server
+func (c *Client) AddTrusted(ctx context.Context, objs []TrustedObject) (CountResult, error) {
+	var result CountResult
+	req, err := jsonRequest(http.MethodPost, "/api/admin/trusted", trustedRequest{Data: objs})
+	if err != nil {
+		return result, err
+	}
+	req.apiKey = c.adminKey
+	err = c.do(ctx, req, &result)
+	return result, err
+}
+
+func (c *Client) RemoveTrusted(ctx context.Context, object string) error {
+	query := url.Values{"object": {object}}
+	return c.do(ctx, request{method: http.MethodDelete, path: "/api/admin/trusted", query: query, apiKey: c.adminKey}, nil)
+}
+
+func (c *Client) ListTrusted(ctx context.Context) ([]TrustedObject, error) {
+	var result []TrustedObject
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/admin/trusted", apiKey: c.adminKey}, &result)
+	return result, err
+}
+
+func (c *Client) GetSettings(ctx context.Context) (Settings, error) {
+	var result Settings
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/admin/settings", apiKey: c.adminKey}, &result)
+	return result, err
+}
+
+// SetSettings replaces the settings, use GetSettings first to change one value
+func (c *Client) SetSettings(ctx context.Context, settings Settings) (Settings, error) {
+	var result Settings
+	req, err := jsonRequest(http.MethodPut, "/api/admin/settings", settings)
+	if err != nil {
+		return result, err
+	}
+	req.apiKey = c.adminKey
+	err = c.do(ctx, req, &result)
+	return result, err
+}
+
+func (c *Client) GetScoringRules(ctx context.Context) (ScoringRuleSet, error) {
+	var result ScoringRuleSet
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/admin/scoring/rules", apiKey: c.adminKey}, &result)
+	return result, err
+}
+
+// SetScoringRules replaces the scoring rules, every object is rescored by the workerBee
+func (c *Client) SetScoringRules(ctx context.Context, rules ScoringRuleSet) (ScoringRuleSet, error) {
+	var result ScoringRuleSet
+	req, err := jsonRequest(http.MethodPut, "/api/admin/scoring/rules", rules)
+	if err != nil {
+		return result, err
+	}
+	req.apiKey = c.adminKey
+	err = c.do(ctx, req, &result)
+	return result, err
+}
+
+func (c *Client) PendingStats(ctx context.Context) (PendingStats, error) {
+	var result PendingStats
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/admin/pending", apiKey: c.adminKey}, &result)
+	return result, err
+}
+
+func (c *Client) PurgePending(ctx context.Context, opts PurgeOptions) (CountResult, error) {
+	var result CountResult
+	query := url.Values{}
+	if opts.OlderThanDays > 0 {
+		query.Set("older_than_days", strconv.Itoa(opts.OlderThanDays))
+	}
+	if opts.ObjectType != "" {
+		query.Set("object_type", opts.ObjectType)
+	}
+	if opts.Source != "" {
+		query.Set("source", opts.Source)
+	}
+	if opts.All {
+		query.Set("all", "true")
+	}
+	err := c.do(ctx, request{method: http.MethodDelete, path: "/api/admin/pending", query: query, apiKey: c.adminKey}, &result)
+	return result, err
+}
+
+// RollbackImportBatch reverts an import batch, a dry run only reports what would be removed
+func (c *Client) RollbackImportBatch(ctx context.Context, id int64, dryRun bool) (RollbackResult, error) {
+	var result RollbackResult
+	query := url.Values{}
+	if dryRun {
+		query.Set("dry_run", "true")
+	}
+	path := "/api/admin/imports/" + strconv.FormatInt(id, 10) + "/rollback"
+	err := c.do(ctx, request{method: http.MethodPost, path: path, query: query, apiKey: c.adminKey}, &result)
+	return result, err
+}
+
+func (opts QuarantineOptions) query() url.Values {
+	query := url.Values{}
+	if opts.ID > 0 {
+		query.Set("id", strconv.FormatInt(opts.ID, 10))
+	}
+	if opts.BatchID > 0 {
+		query.Set("batch_id", strconv.FormatInt(opts.BatchID, 10))
+	}
+	if opts.Source != "" {
+		query.Set("source", opts.Source)
+	}
+	if opts.ObjectType != "" {
+		query.Set("object_type", opts.ObjectType)
+	}
+	if opts.Reason != "" {
+		query.Set("reason", opts.Reason)
+	}
+	if opts.OlderThanDays > 0 {
+		query.Set("older_than_days", strconv.Itoa(opts.OlderThanDays))
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.All {
+		query.Set("all", "true")
+	}
+	return query
+}
+
+// ListQuarantine lists the rejected import rows, oldest first
+func (c *Client) ListQuarantine(ctx context.Context, opts QuarantineOptions) ([]QuarantinedImport, error) {
+	var result quarantineResponse
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/admin/quarantine", query: opts.query(), apiKey: c.adminKey}, &result)
+	return result.Rows, err
+}
+
+// FixQuarantined corrects the object and object_type of a quarantined row, resubmit it to import it
+func (c *Client) FixQuarantined(ctx context.Context, id int64, object string, objectType string) (QuarantinedImport, error) {
+	var result QuarantinedImport
+	req, err := jsonRequest(http.MethodPut, "/api/admin/quarantine/"+strconv.FormatInt(id, 10), quarantineFixRequest{Object: object, ObjectType: objectType})
+	if err != nil {
+		return result, err
+	}
+	req.apiKey = c.adminKey
+	err = c.do(ctx, req, &result)
+	return result, err
+}
+
+// ResubmitQuarantined moves quarantined rows back to pending_import
+func (c *Client) ResubmitQuarantined(ctx context.Context, opts QuarantineOptions) (CountResult, error) {
+	var result CountResult
+	opts.Limit = 0
+	err := c.do(ctx, request{method: http.MethodPost, path: "/api/admin/quarantine/resubmit", query: opts.query(), apiKey: c.adminKey}, &result)
+	return result, err
+}
+
+func (c *Client) PurgeQuarantine(ctx context.Context, opts QuarantineOptions) (CountResult, error) {
+	var result CountResult
+	opts.Limit = 0
+	err := c.do(ctx, request{method: http.MethodDelete, path: "/api/admin/quarantine", query: opts.query(), apiKey: c.adminKey}, &result)
+	return result, err
+}
+
+// ConfirmObject sets confirmed_risk of a processed object
+func (c *Client) ConfirmObject(ctx context.Context, object string, confirmed bool) (ObjectStatus, error) {
+	var result ObjectStatus
+	req, err := jsonRequest(http.MethodPost, "/api/admin/objects/"+url.PathEscape(object)+"/confirm", confirmRequest{Confirmed: confirmed})
+	if err != nil {
+		return result, err
+	}
+	req.apiKey = c.adminKey
+	err = c.do(ctx, req, &result)
+	return result, err
+}
+
+// UntrustObject clears the trusted flag, CoveredBy is set when a trusted CIDR will mark the object trusted again
+func (c *Client) UntrustObject(ctx context.Context, object string) (ObjectStatus, error) {
+	var result ObjectStatus
+	err := c.do(ctx, request{method: http.MethodPost, path: "/api/admin/objects/" + url.PathEscape(object) + "/untrust", apiKey: c.adminKey}, &result)
+	return result, err
+}
+
+// BackupDB writes a copy of the database on the server, the path is on the server
+func (c *Client) BackupDB(ctx context.Context) (Backup, error) {
+	var result Backup
+	err := c.do(ctx, request{method: http.MethodPost, path: "/api/admin/db/backup", apiKey: c.adminKey}, &result)
+	return result, err
+}
+
+// ListBackups returns the backups on the server, newest first
+func (c *Client) ListBackups(ctx context.Context) (BackupList, error) {
+	var result BackupList
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/admin/db/backups", apiKey: c.adminKey}, &result)
+	return result, err
+}
+
+// StageRuns returns the runs of the workerBee stages, newest first, an empty stage lists every stage and a limit of 0 uses the server default
+func (c *Client) StageRuns(ctx context.Context, stage string, limit int) ([]StageRun, error) {
+	query := url.Values{}
+	if stage != "" {
+		query.Set("stage", stage)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var result stageRunsResponse
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/admin/stages/runs", query: query, apiKey: c.adminKey}, &result)
+	return result.Runs, err
+}
+
+// RestoreDB replaces the database on the server with one of its backups
+func (c *Client) RestoreDB(ctx context.Context, name string) (Restore, error) {
+	var result Restore
+	req, err := jsonRequest(http.MethodPost, "/api/admin/db/restore", restoreRequest{Name: name})
+	if err != nil {
+		return result, err
+	}
+	req.apiKey = c.adminKey
+	err = c.do(ctx, req, &result)
+	return result, err
+}
+
+func (c *Client) VacuumDB(ctx context.Context) error {
+	return c.do(ctx, request{method: http.MethodPost, path: "/api/admin/db/vacuum", apiKey: c.adminKey}, nil)
+}
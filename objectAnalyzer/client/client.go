@@ -0,0 +1,527 @@
+package client
+
+// Go client for the objectAnalyzer apiServer
+//
+// Create a go.work that uses this directory to reference the package, the same
+// as the common package.
+//
+//    c, err := client.New("https://127.0.0.1:9000", apiKey,
+//        client.WithCAFile("keys/tls.crt"),
+//        client.WithServerName("www.example.com"))
+//    result, err := c.Import(ctx, client.ImportObject{Object: "114.6.6.6", ObjectType: "ipv4"})
+//
+// Requests that receive a 429 or 5xx response, or fail to connect, are retried
+// with an exponential backoff.  The apiServer uses a self-signed certificate so
+// add it, or the CA that issued it, with WithCAFile or WithRootCAs.
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout    = 30 * time.Second
+	defaultMaxRetries = 3
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = 10 * time.Second
+)
+
+type Client struct {
+	baseURL     *url.URL
+	apiKey      string
+	adminKey    string
+	httpClient  *http.Client
+	tlsConfig   *tls.Config
+	maxRetries  int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	userAgent   string
+	customHTTP  bool
+	optionError error
+}
+
+type Option func(*Client)
+
+// APIError is returned when the apiServer responds with a status other than 200
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("objectAnalyzer API returned %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports if err is a 404 from the apiServer
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Expired returns the tombstone when err is a 410 from Lookup for an object the retention step expired
+func Expired(err error) (Tombstone, bool) {
+	var apiErr *APIError
+	var tombstone Tombstone
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusGone {
+		return tombstone, false
+	}
+	if json.Unmarshal([]byte(apiErr.Message), &tombstone) != nil {
+		return tombstone, false
+	}
+	return tombstone, true
+}
+
+// WithHTTPClient replaces the http.Client, the TLS options are ignored
+func WithHTTPClient(h *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = h
+		c.customHTTP = true
+	}
+}
+
+// WithRootCAs trusts the certificates in pool instead of the system roots
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(c *Client) {
+		c.tlsConfig.RootCAs = pool
+	}
+}
+
+// WithCAFile trusts the PEM certificates in file, for example the apiServer keys/tls.crt
+func WithCAFile(file string) Option {
+	return func(c *Client) {
+		pemData, err := os.ReadFile(file)
+		if err != nil {
+			c.optionError = fmt.Errorf("failed to read CA file: %w", err)
+			return
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			c.optionError = fmt.Errorf("no certificates found in %s", file)
+			return
+		}
+		c.tlsConfig.RootCAs = pool
+	}
+}
+
+// WithServerName sets the name verified against the certificate when the URL uses an IP address
+func WithServerName(name string) Option {
+	return func(c *Client) {
+		c.tlsConfig.ServerName = name
+	}
+}
+
+// WithAdminKey sets the adminApiKey sent to the /api/admin endpoints
+func WithAdminKey(key string) Option {
+	return func(c *Client) {
+		c.adminKey = key
+	}
+}
+
+// WithRetries sets how many times a request is retried and the backoff range
+func WithRetries(maxRetries int, minBackoff time.Duration, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.minBackoff = minBackoff
+		c.maxBackoff = maxBackoff
+	}
+}
+
+// WithTimeout sets the timeout of each attempt
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.httpClient.Timeout = timeout
+	}
+}
+
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) {
+		c.userAgent = userAgent
+	}
+}
+
+// New creates a client for the apiServer at baseURL, for example https://127.0.0.1:9000
+func New(baseURL string, apiKey string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimRight(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %w", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("invalid base URL %s: scheme must be https", baseURL)
+	}
+
+	c := &Client{
+		baseURL:    u,
+		apiKey:     apiKey,
+		tlsConfig:  &tls.Config{MinVersion: tls.VersionTLS12},
+		httpClient: &http.Client{Timeout: defaultTimeout},
+		maxRetries: defaultMaxRetries,
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+		userAgent:  "objectAnalyzer-client",
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.optionError != nil {
+		return nil, c.optionError
+	}
+	if !c.customHTTP {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = c.tlsConfig
+		c.httpClient.Transport = transport
+	}
+
+	return c, nil
+}
+
+// request describes one API call, the body is kept as bytes so it can be resent on a retry
+type request struct {
+	method      string
+	path        string // Escaped path, for example /api/object/ + url.PathEscape(object)
+	query       url.Values
+	body        []byte
+	contentType string
+	apiKey      string // Sent in the X-API-Key header
+}
+
+// do sends the request, retrying on 429, 5xx and connection errors, and decodes a JSON response into out
+func (c *Client) do(ctx context.Context, req request, out any) error {
+	body, err := c.send(ctx, req)
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	if s, ok := out.(*string); ok {
+		*s = string(body)
+		return nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to decode the response from %s: %w", req.path, err)
+	}
+	return nil
+}
+
+func (c *Client) send(ctx context.Context, req request) ([]byte, error) {
+	// req.path is already escaped
+	u, err := url.Parse(c.baseURL.String() + req.path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request path %s: %w", req.path, err)
+	}
+	if req.query != nil {
+		u.RawQuery = req.query.Encode()
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= c.maxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, c.backoff(attempt, lastErr)); err != nil {
+				return nil, err
+			}
+		}
+
+		httpReq, err := http.NewRequestWithContext(ctx, req.method, u.String(), bytes.NewReader(req.body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		if req.contentType != "" {
+			httpReq.Header.Set("Content-Type", req.contentType)
+		}
+		if req.apiKey != "" {
+			httpReq.Header.Set("X-API-Key", req.apiKey)
+		}
+		httpReq.Header.Set("User-Agent", c.userAgent)
+
+		resp, err := c.httpClient.Do(httpReq)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = fmt.Errorf("failed to read the response: %w", err)
+			continue
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			return body, nil
+		}
+		apiErr := &retryableError{
+			APIError:   &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))},
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return nil, apiErr.APIError
+		}
+		lastErr = apiErr
+	}
+
+	var retryErr *retryableError
+	if errors.As(lastErr, &retryErr) {
+		return nil, retryErr.APIError
+	}
+	return nil, fmt.Errorf("request to %s failed after %d attempts: %w", req.path, c.maxRetries+1, lastErr)
+}
+
+type retryableError struct {
+	*APIError
+	retryAfter time.Duration
+}
+
+// backoff doubles the wait for each attempt with jitter, a Retry-After from the server is used when it is longer
+func (c *Client) backoff(attempt int, lastErr error) time.Duration {
+	wait := c.minBackoff << (attempt - 1)
+	if wait > c.maxBackoff || wait <= 0 {
+		wait = c.maxBackoff
+	}
+	wait = wait/2 + rand.N(wait/2+1)
+
+	var retryErr *retryableError
+	if errors.As(lastErr, &retryErr) && retryErr.retryAfter > wait {
+		wait = min(retryErr.retryAfter, c.maxBackoff)
+	}
+	return wait
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func jsonRequest(method string, path string, v any) (request, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return request{}, fmt.Errorf("failed to encode the request: %w", err)
+	}
+	return request{method: method, path: path, body: body, contentType: "application/json"}, nil
+}
+
+// Import submits a single object to /api/import
+func (c *Client) Import(ctx context.Context, obj ImportObject) (ImportResult, error) {
+	var result ImportResult
+	req, err := jsonRequest(http.MethodPost, "/api/import", importRequest{ImportObject: obj, APIKey: c.apiKey})
+	if err != nil {
+		return result, err
+	}
+	err = c.do(ctx, req, &result)
+	return result, err
+}
+
+// ImportBulk submits multiple objects to /api/importJSON in one request
+func (c *Client) ImportBulk(ctx context.Context, objs []ImportObject) (ImportResult, error) {
+	var result ImportResult
+	req, err := jsonRequest(http.MethodPost, "/api/importJSON", importJSONRequest{APIKey: c.apiKey, ImportData: objs})
+	if err != nil {
+		return result, err
+	}
+	err = c.do(ctx, req, &result)
+	return result, err
+}
+
+// UploadCSV uploads a CSV file to /api/importFile, filename must end in .csv
+// The apiServer responds with an HTML summary which is returned as is
+func (c *Client) UploadCSV(ctx context.Context, filename string, csvData io.Reader) (string, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	if err := writer.WriteField("apiKey", c.apiKey); err != nil {
+		return "", err
+	}
+
+	// The apiServer only accepts a part with the text/csv content type
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="myFile"; filename="%s"`, escapeQuotes(filename)))
+	header.Set("Content-Type", "text/csv")
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(part, csvData); err != nil {
+		return "", fmt.Errorf("failed to read the CSV data: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	var result string
+	err = c.do(ctx, request{method: http.MethodPost, path: "/api/importFile", body: buf.Bytes(), contentType: writer.FormDataContentType()}, &result)
+	return result, err
+}
+
+// UploadCSVFile uploads the CSV file at path
+func (c *Client) UploadCSVFile(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return c.UploadCSV(ctx, filepath.Base(path), f)
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
+
+// Verify returns the row of an object waiting in the pending_import table
+func (c *Client) Verify(ctx context.Context, object string) (PendingImport, error) {
+	var result PendingImport
+	req, err := jsonRequest(http.MethodGet, "/api/verifyImport", verifyRequest{Object: object, APIKey: c.apiKey})
+	if err != nil {
+		return result, err
+	}
+	err = c.do(ctx, req, &result)
+	return result, err
+}
+
+// ImportBatch returns the status of an import batch and its processed rows, an empty outcome lists accepted and rejected rows
+// and a limit of 0 uses the server default
+func (c *Client) ImportBatch(ctx context.Context, id int64, outcome string, limit int) (ImportBatch, error) {
+	var result ImportBatch
+	query := url.Values{}
+	if outcome != "" {
+		query.Set("outcome", outcome)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/import/" + strconv.FormatInt(id, 10), query: query, apiKey: c.apiKey}, &result)
+	return result, err
+}
+
+// Lookup returns the processed record of an object, use IsNotFound to check for an unknown object and Expired for an expired one
+func (c *Client) Lookup(ctx context.Context, object string) (ObjectIntel, error) {
+	var result ObjectIntel
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/object/" + url.PathEscape(object), apiKey: c.apiKey}, &result)
+	return result, err
+}
+
+// ScoreHistory returns the score breakdowns of a processed object, newest first, limit 0 uses the server default
+func (c *Client) ScoreHistory(ctx context.Context, object string, limit int) (ScoreHistory, error) {
+	var result ScoreHistory
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/object/" + url.PathEscape(object) + "/score", query: query, apiKey: c.apiKey}, &result)
+	return result, err
+}
+
+// VerdictHistory returns the verdict changes of a processed object, newest first, limit 0 uses the server default
+func (c *Client) VerdictHistory(ctx context.Context, object string, limit int) (VerdictHistory, error) {
+	var result VerdictHistory
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/object/" + url.PathEscape(object) + "/verdicts", query: query, apiKey: c.apiKey}, &result)
+	return result, err
+}
+
+// SightingTrend returns the sightings of a processed object on each day, days 0 uses the server default
+func (c *Client) SightingTrend(ctx context.Context, object string, days int) (SightingTrend, error) {
+	var result SightingTrend
+	query := url.Values{}
+	if days > 0 {
+		query.Set("days", strconv.Itoa(days))
+	}
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/object/" + url.PathEscape(object) + "/sightings", query: query, apiKey: c.apiKey}, &result)
+	return result, err
+}
+
+// ListObjects returns the processed objects with one of the verdicts, highest score first
+func (c *Client) ListObjects(ctx context.Context, opts ObjectListOptions) (ObjectList, error) {
+	query := url.Values{}
+	if len(opts.Verdicts) > 0 {
+		query.Set("verdict", strings.Join(opts.Verdicts, ","))
+	}
+	if opts.ObjectType != "" {
+		query.Set("object_type", opts.ObjectType)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	var result ObjectList
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/objects", query: query, apiKey: c.apiKey}, &result)
+	return result, err
+}
+
+func (opts BlocklistOptions) query() url.Values {
+	query := url.Values{}
+	if opts.MinScore > 0 {
+		query.Set("min_score", strconv.Itoa(opts.MinScore))
+	}
+	if opts.ObjectType != "" {
+		query.Set("object_type", opts.ObjectType)
+	}
+	if len(opts.Verdicts) > 0 {
+		query.Set("verdict", strings.Join(opts.Verdicts, ","))
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	return query
+}
+
+// ExportBlocklist returns the untrusted objects at or above the minimum risk score
+func (c *Client) ExportBlocklist(ctx context.Context, opts BlocklistOptions) (Blocklist, error) {
+	var result Blocklist
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/export/blocklist", query: opts.query(), apiKey: c.apiKey}, &result)
+	return result, err
+}
+
+// ExportBlocklistText returns the blocklist as one object per line
+func (c *Client) ExportBlocklistText(ctx context.Context, opts BlocklistOptions) (string, error) {
+	query := opts.query()
+	query.Set("format", "text")
+	var result string
+	err := c.do(ctx, request{method: http.MethodGet, path: "/api/export/blocklist", query: query, apiKey: c.apiKey}, &result)
+	return result, err
+}
+
+// ReloadConfig asks the apiServer to reload its config file, requires WithAdminKey
+func (c *Client) ReloadConfig(ctx context.Context) (ConfigReloadReport, error) {
+	var result ConfigReloadReport
+	err := c.do(ctx, request{method: http.MethodPost, path: "/api/admin/reloadConfig", apiKey: c.adminKey}, &result)
+	return result, err
+}
@@ -0,0 +1,499 @@
+package client
+
+// Request and response structs of the objectAnalyzer API
+// The json keys match the structs in common that the apiServer decodes and encodes
+
+// Object submitted to the pending_import table, Object and ObjectType are required
+// ObjectType is one of ipv4, ipv6, domain, url or hash
+type ImportObject struct {
+	Object       string `json:"object"`
+	ObjectType   string `json:"object_type"`
+	Notes        string `json:"notes,omitempty"`
+	Source       string `json:"source,omitempty"`
+	TimeProvided string `json:"time_provided,omitempty"`
+	GeoRegion    string `json:"geo_region,omitempty"`
+	GeoCountry   string `json:"geo_country,omitempty"`
+	GeoOrg       string `json:"geo_org,omitempty"`
+}
+
+type importRequest struct {
+	ImportObject
+	APIKey string `json:"apiKey"`
+}
+
+type importJSONRequest struct {
+	APIKey     string         `json:"apiKey"`
+	ImportData []ImportObject `json:"data"`
+}
+
+type verifyRequest struct {
+	Object string `json:"object"`
+	APIKey string `json:"apiKey"`
+}
+
+// ImportResult has the ID of the import batch to pass to ImportBatch
+type ImportResult struct {
+	Status  string `json:"status"`
+	BatchID int64  `json:"batch_id"`
+	Rows    int    `json:"rows"`
+}
+
+// ImportBatch is the status of an import, queued, processing, done or partially_failed
+type ImportBatch struct {
+	ID           int64            `json:"id"`
+	Source       string           `json:"source"`
+	SubmittedBy  string           `json:"submitted_by"`
+	FileName     string           `json:"file_name,omitempty"`
+	Status       string           `json:"status"`
+	TotalRows    int              `json:"total_rows"`
+	Accepted     int              `json:"accepted"`
+	Rejected     int              `json:"rejected"`
+	Pending      int              `json:"pending"`
+	Purged       int              `json:"purged"`
+	CreatedAt    string           `json:"created_at"`
+	StartedAt    string           `json:"started_at,omitempty"`
+	FinishedAt   string           `json:"finished_at,omitempty"`
+	RolledBackAt string           `json:"rolled_back_at,omitempty"`
+	Rows         []ImportBatchRow `json:"rows"`
+}
+
+// RollbackResult is what rolling back an import batch removed, or would remove in a dry run
+type RollbackResult struct {
+	BatchID        int64            `json:"batch_id"`
+	DryRun         bool             `json:"dry_run"`
+	PendingRows    int64            `json:"pending_rows"`
+	Sightings      int64            `json:"sightings"`
+	ObjectsUpdated int              `json:"objects_updated"`
+	ObjectsDeleted int              `json:"objects_deleted"`
+	Rescored       int              `json:"rescored"`
+	Objects        []RollbackObject `json:"objects"`
+}
+
+type RollbackObject struct {
+	Object          string `json:"object"`
+	Occurrences     int    `json:"occurrences"`
+	OccurrenceCount int    `json:"occurrence_count"`
+	FirstSeen       string `json:"first_seen,omitempty"`
+	LastSeen        string `json:"last_seen,omitempty"`
+	Deleted         bool   `json:"deleted"`
+}
+
+// ImportBatchRow is the outcome of a processed row, accepted or rejected with the reason
+type ImportBatchRow struct {
+	Row         int    `json:"row"`
+	Object      string `json:"object"`
+	ObjectType  string `json:"object_type"`
+	Outcome     string `json:"outcome"`
+	Reason      string `json:"reason,omitempty"`
+	ProcessedAt string `json:"processed_at"`
+}
+
+// Row waiting in the pending_import table
+type PendingImport struct {
+	ID           int    `json:"id"`
+	Object       string `json:"object"`
+	ObjectType   string `json:"object_type"`
+	IPDecimal    int    `json:"ipDecimal"`
+	Notes        string `json:"notes"`
+	Source       string `json:"source"`
+	TimeImported string `json:"time_imported"`
+	TimeProvided string `json:"time_provided"`
+}
+
+// Processed record from the object_intel table
+type ObjectIntel struct {
+	Object               string `json:"object"`
+	ObjectAdditionalInfo string `json:"object_additionalInfo"`
+	ObjectType           string `json:"object_type"`
+	IPDecimal            int64  `json:"ipDecimal"`
+	GeoRegion            string `json:"geo_region"`
+	GeoCountry           string `json:"geo_country"`
+	GeoOrg               string `json:"geo_org"`
+	GeoASN               string `json:"geo_asn"`
+	Notes                string `json:"notes"`
+	Fidelity             string `json:"fidelity"`
+	FirstSeen            string `json:"first_seen"`
+	LastSeen             string `json:"last_seen"`
+	OccurrenceCount      int    `json:"occurrence_count"`
+	RiskScore            int    `json:"risk_score"`
+	RiskScoreLastUpdated string `json:"risk_score_last_updated"`
+	Severity             string `json:"severity"`
+	ConfirmedRisk        bool   `json:"confirmed_risk"`
+	Trusted              bool   `json:"trusted"`
+	Verdict              string `json:"verdict"`
+	EnrichedAt           string `json:"enriched_at,omitempty"`     // When the enrichers of the workerBee last looked up the object
+	EnrichmentInfo       string `json:"enrichment_info,omitempty"` // JSON object of what each enricher returned besides the geo fields, by name
+}
+
+// Last state of an object expired by the retention step, returned by Lookup with a 410
+type Tombstone struct {
+	Object          string `json:"object"`
+	ObjectType      string `json:"object_type"`
+	FirstSeen       string `json:"first_seen"`
+	LastSeen        string `json:"last_seen"`
+	OccurrenceCount int    `json:"occurrence_count"`
+	RiskScore       int    `json:"risk_score"`
+	Verdict         string `json:"verdict"`
+	ExpiredAt       string `json:"expired_at"`
+}
+
+// Verdicts of an object
+const (
+	VerdictMalicious  = "malicious"
+	VerdictSuspicious = "suspicious"
+	VerdictUnknown    = "unknown"
+	VerdictBenign     = "benign"
+	VerdictTrusted    = "trusted"
+)
+
+// Filters for the blocklist export, zero values use the server defaults
+type BlocklistOptions struct {
+	MinScore   int
+	ObjectType string
+	Verdicts   []string // Only export objects with one of these verdicts
+	Limit      int
+}
+
+type BlocklistEntry struct {
+	Object     string `json:"object"`
+	ObjectType string `json:"object_type"`
+	RiskScore  int    `json:"risk_score"`
+	Severity   string `json:"severity"`
+	Verdict    string `json:"verdict"`
+	LastSeen   string `json:"last_seen"`
+}
+
+type Blocklist struct {
+	GeneratedAt string           `json:"generated_at"`
+	MinScore    int              `json:"min_score"`
+	Count       int              `json:"count"`
+	Objects     []BlocklistEntry `json:"objects"`
+}
+
+type ConfigReloadReport struct {
+	Applied         []string `json:"applied"`
+	RequiresRestart []string `json:"requires_restart"`
+}
+
+// API key stored in the api_keys table, the key itself is only returned by CreateKey
+type APIKey struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	KeyPrefix string `json:"key_prefix"`
+	Created   string `json:"created"`
+	Revoked   string `json:"revoked,omitempty"`
+}
+
+type createKeyRequest struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+type NewAPIKey struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+	Key  string `json:"key"`
+}
+
+// ObjectType of a trusted object is one of ipv4, ipv4CIDR or ipv6
+type TrustedObject struct {
+	Object          string `json:"object"`
+	ObjectType      string `json:"object_type"`
+	Notes           string `json:"notes"`
+	Source          string `json:"source"`
+	TimeImported    string `json:"time_imported,omitempty"`
+	LastSeen        string `json:"last_seen,omitempty"`
+	OccurrenceCount int    `json:"occurrence_count,omitempty"`
+}
+
+type trustedRequest struct {
+	Data []TrustedObject `json:"data"`
+}
+
+type CountResult struct {
+	Status string `json:"status"`
+	Count  int64  `json:"count"`
+}
+
+// SeverityBand starts at MinScore and ends at the MinScore of the next band
+type SeverityBand struct {
+	Name      string `json:"name"`
+	MinScore  int    `json:"min_score"`
+	Block     bool   `json:"block"`
+	BlockDays int    `json:"block_days"`
+}
+
+type ScoringWeights struct {
+	CurrentWeek   int `json:"current_week"`
+	LastWeek      int `json:"last_week"`
+	TwoWeeksAgo   int `json:"two_weeks_ago"`
+	ThreeWeeksAgo int `json:"three_weeks_ago"`
+}
+
+type BatchLimits struct {
+	PendingImport int `json:"pending_import"`
+	Rescore       int `json:"rescore"`
+	Export        int `json:"export"`
+}
+
+// Settings changed through the admin API and stored in the database
+// Score bands of the verdicts
+type VerdictRules struct {
+	MaliciousScore       int    `json:"malicious_score"`
+	MaliciousMinFidelity string `json:"malicious_min_fidelity"`
+	SuspiciousScore      int    `json:"suspicious_score"`
+	BenignMaxScore       int    `json:"benign_max_score"`
+}
+
+// Half-lives of the decay scoring factor in hours, a source overrides the object type
+type DecayHalfLives struct {
+	DefaultHours float64            `json:"default_hours"`
+	ObjectTypes  map[string]float64 `json:"object_types,omitempty"`
+	Sources      map[string]float64 `json:"sources,omitempty"`
+	LookbackDays int                `json:"lookback_days"`
+}
+
+// What the workerBee -prune step deletes, 0 keeps everything
+type RetentionSettings struct {
+	SightingDays    int `json:"sighting_days"`
+	ArchiveDays     int `json:"archive_days"`
+	ArchiveMaxMB    int `json:"archive_max_mb"`
+	StaleObjectDays int `json:"stale_object_days"`
+	StaleMaxScore   int `json:"stale_max_score"`
+	StageRunDays    int `json:"stage_run_days"`
+	ImportBatchDays int `json:"import_batch_days"`
+}
+
+// Seconds between the runs of each stage of the workerBee -daemon, 0 does not run the stage
+type StageIntervals struct {
+	ImportCSV      int `json:"import_csv"`
+	ProcessImports int `json:"process_imports"`
+	TrustedCSV     int `json:"trusted_csv"`
+	MarkTrusted    int `json:"mark_trusted"`
+	Rescore        int `json:"rescore"`
+	Prune          int `json:"prune"`
+	Backup         int `json:"backup"`
+	Enrich         int `json:"enrich"`
+}
+
+// Which enrichers of the workerBee run for each object type, in order
+type EnrichmentSettings struct {
+	ObjectTypes  map[string][]string `json:"object_types,omitempty"`
+	TimeoutMS    int                 `json:"timeout_ms"`
+	CacheMinutes int                 `json:"cache_minutes"`
+	RefreshDays  int                 `json:"refresh_days"`
+	BatchLimit   int                 `json:"batch_limit"`
+}
+
+type Settings struct {
+	SeverityBands        []SeverityBand     `json:"severity_bands"`
+	ScoringWeights       ScoringWeights     `json:"scoring_weights"`
+	RescoreIntervalHours int                `json:"rescore_interval_hours"`
+	BatchLimits          BatchLimits        `json:"batch_limits"`
+	VerdictRules         VerdictRules       `json:"verdict_rules"`
+	DecayHalfLives       DecayHalfLives     `json:"decay_half_lives"`
+	Retention            RetentionSettings  `json:"retention"`
+	StageIntervals       StageIntervals     `json:"stage_intervals"`
+	Enrichment           EnrichmentSettings `json:"enrichment"`
+}
+
+type PendingStats struct {
+	Total       int            `json:"total"`
+	Claimed     int            `json:"claimed"` // Rows a workerBee holds a lease on
+	ByType      map[string]int `json:"by_type"`
+	BySource    map[string]int `json:"by_source"`
+	Oldest      string         `json:"oldest"`
+	Newest      string         `json:"newest"`
+	Quarantined int            `json:"quarantined"` // Rejected rows kept in the quarantine
+}
+
+// QuarantinedImport is a pending row the workerBee rejected, kept with the reason
+type QuarantinedImport struct {
+	ID            int64  `json:"id"`
+	Object        string `json:"object"`
+	ObjectType    string `json:"object_type"`
+	Notes         string `json:"notes,omitempty"`
+	Source        string `json:"source,omitempty"`
+	GeoRegion     string `json:"geo_region,omitempty"`
+	GeoCountry    string `json:"geo_country,omitempty"`
+	GeoOrg        string `json:"geo_org,omitempty"`
+	TimeImported  string `json:"time_imported"`
+	TimeProvided  string `json:"time_provided,omitempty"`
+	BatchID       int64  `json:"batch_id,omitempty"`
+	BatchRow      int    `json:"batch_row,omitempty"`
+	Reason        string `json:"reason"`
+	QuarantinedAt string `json:"quarantined_at"`
+	FixedAt       string `json:"fixed_at,omitempty"`
+}
+
+type quarantineResponse struct {
+	Rows []QuarantinedImport `json:"rows"`
+}
+
+type quarantineFixRequest struct {
+	Object     string `json:"object"`
+	ObjectType string `json:"object_type"`
+}
+
+// Filters for the quarantine, zero fields do not filter
+// ResubmitQuarantined and PurgeQuarantine need at least one filter or All
+type QuarantineOptions struct {
+	ID            int64
+	BatchID       int64
+	Source        string
+	ObjectType    string
+	Reason        string
+	OlderThanDays int
+	Limit         int // Only used by ListQuarantine
+	All           bool
+}
+
+// Filters for PurgePending, at least one filter or All is required
+type PurgeOptions struct {
+	OlderThanDays int
+	ObjectType    string
+	Source        string
+	All           bool
+}
+
+type confirmRequest struct {
+	Confirmed bool `json:"confirmed"`
+}
+
+type ObjectStatus struct {
+	Object    string `json:"object"`
+	Status    string `json:"status"`
+	CoveredBy string `json:"covered_by,omitempty"`
+}
+
+type Backup struct {
+	Path       string   `json:"path"`
+	SizeBytes  int64    `json:"size_bytes"`
+	Compressed bool     `json:"compressed"`
+	Removed    []string `json:"removed,omitempty"`
+}
+
+type BackupFile struct {
+	Name       string `json:"name"`
+	SizeBytes  int64  `json:"size_bytes"`
+	CreatedAt  string `json:"created_at"`
+	Compressed bool   `json:"compressed"`
+}
+
+type BackupList struct {
+	Directory string       `json:"directory"`
+	Backups   []BackupFile `json:"backups"`
+}
+
+type restoreRequest struct {
+	Name string `json:"name"`
+}
+
+type Restore struct {
+	Restored          string `json:"restored"`
+	MigrationsApplied int    `json:"migrations_applied"`
+}
+
+// StageRun is a run of a workerBee stage, the status is ok, failed or skipped
+type StageRun struct {
+	Stage      string `json:"stage"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	StartedAt  string `json:"started_at"`
+	FinishedAt string `json:"finished_at"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+type stageRunsResponse struct {
+	Runs []StageRun `json:"runs"`
+}
+
+type ScoringRule struct {
+	Name     string             `json:"name"`
+	Factor   string             `json:"factor"`
+	Op       string             `json:"op"`
+	Weight   float64            `json:"weight"`
+	Cap      float64            `json:"cap,omitempty"`
+	Values   map[string]float64 `json:"values,omitempty"`
+	Disabled bool               `json:"disabled,omitempty"`
+}
+
+// Rules of the risk scoring engine, Version is set by the server when the rules are saved
+type ScoringRuleSet struct {
+	Version     int           `json:"version"`
+	MaxRawScore float64       `json:"max_raw_score"`
+	Rules       []ScoringRule `json:"rules"`
+}
+
+type ScoreContribution struct {
+	Rule   string  `json:"rule"`
+	Factor string  `json:"factor"`
+	Op     string  `json:"op"`
+	Value  float64 `json:"value"`
+	Weight float64 `json:"weight"`
+	Effect float64 `json:"effect"`
+	Points float64 `json:"points"`
+}
+
+type ScoreHistoryEntry struct {
+	ScoredAt    string              `json:"scored_at"`
+	Score       int                 `json:"score"`
+	RawScore    float64             `json:"raw_score"`
+	RuleVersion int                 `json:"rule_version"`
+	Breakdown   []ScoreContribution `json:"breakdown"`
+}
+
+type ScoreHistory struct {
+	Object    string              `json:"object"`
+	RiskScore int                 `json:"risk_score"`
+	Severity  string              `json:"severity"`
+	History   []ScoreHistoryEntry `json:"history"`
+}
+
+type SightingTrendDay struct {
+	Day     string `json:"day"`
+	Count   int    `json:"count"`
+	Sources int    `json:"sources"`
+}
+
+type SightingTrend struct {
+	Object  string             `json:"object"`
+	Days    int                `json:"days"`
+	Total   int                `json:"total"`
+	History []SightingTrendDay `json:"history"`
+}
+
+type VerdictChange struct {
+	ChangedAt  string `json:"changed_at"`
+	OldVerdict string `json:"old_verdict"`
+	NewVerdict string `json:"new_verdict"`
+	Reason     string `json:"reason"`
+}
+
+type VerdictHistory struct {
+	Object  string          `json:"object"`
+	Verdict string          `json:"verdict"`
+	History []VerdictChange `json:"history"`
+}
+
+// Filters for ListObjects, zero values use the server defaults
+type ObjectListOptions struct {
+	Verdicts   []string
+	ObjectType string
+	Limit      int
+}
+
+type ObjectSummary struct {
+	Object     string `json:"object"`
+	ObjectType string `json:"object_type"`
+	RiskScore  int    `json:"risk_score"`
+	Verdict    string `json:"verdict"`
+	LastSeen   string `json:"last_seen"`
+}
+
+type ObjectList struct {
+	Count   int             `json:"count"`
+	Objects []ObjectSummary `json:"objects"`
+}
@@ -0,0 +1,645 @@
+package common
+
+// Admin endpoints used by the adminClient, authenticated with an admin key in the X-API-Key header
+//
+// Admin Functions
+// 1. Add/Revoke API Keys
+// 2. Add/Delete Trusted Objects that should be removed from what is being imported
+// 3. Configure the Thresholds of Severity and Duration of Time to Block, the scoring weights and batch limits
+// 4. Statistics and purging of the pending_import table
+// 5. Confirm the risk of an object or remove the trust of an object
+// 6. Backup, restore and vacuum the database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	APIKeyRoleSubmit = "submit"
+	APIKeyRoleAdmin  = "admin"
+	apiKeyLength     = 64
+	apiKeyPrefixLen  = 8
+)
+
+type APIKeyRecord struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	KeyPrefix string `json:"key_prefix"`
+	Created   string `json:"created"`
+	Revoked   string `json:"revoked,omitempty"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name string `json:"name" required:"true"`
+	Role string `json:"role" enum:"submit,admin"`
+}
+
+// The key is only returned when it is created
+type CreateAPIKeyResponse struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+	Key  string `json:"key"`
+}
+
+type TrustedObject struct {
+	Object          string `json:"object" required:"true"`
+	ObjectType      string `json:"object_type" required:"true" enum:"ipv4,ipv4CIDR,ipv6"`
+	Notes           string `json:"notes"`
+	Source          string `json:"source"`
+	TimeImported    string `json:"time_imported,omitempty"`
+	LastSeen        string `json:"last_seen,omitempty"`
+	OccurrenceCount int    `json:"occurrence_count,omitempty"`
+}
+
+type TrustedObjectsRequest struct {
+	Data []TrustedObject `json:"data" required:"true"`
+}
+
+type CountResponse struct {
+	Status string `json:"status"`
+	Count  int64  `json:"count"`
+}
+
+type PendingStats struct {
+	Total       int            `json:"total"`
+	Claimed     int            `json:"claimed"` // Rows a workerBee holds a lease on
+	ByType      map[string]int `json:"by_type"`
+	BySource    map[string]int `json:"by_source"` // Top 20 sources
+	Oldest      string         `json:"oldest"`
+	Newest      string         `json:"newest"`
+	Quarantined int            `json:"quarantined"` // Rejected rows kept in the quarantine
+}
+
+type ConfirmObjectRequest struct {
+	Confirmed bool `json:"confirmed"`
+}
+
+type ObjectStatusResponse struct {
+	Object    string `json:"object"`
+	Status    string `json:"status"`
+	CoveredBy string `json:"covered_by,omitempty"` // Trusted CIDR that will mark the object trusted again
+}
+
+type BackupResponse struct {
+	Path       string   `json:"path"`
+	SizeBytes  int64    `json:"size_bytes"`
+	Compressed bool     `json:"compressed"`
+	Removed    []string `json:"removed,omitempty"` // Older backups deleted to keep backupKeep
+}
+
+type BackupFile struct {
+	Name       string `json:"name"`
+	SizeBytes  int64  `json:"size_bytes"`
+	CreatedAt  string `json:"created_at"`
+	Compressed bool   `json:"compressed"`
+}
+
+type BackupListResponse struct {
+	Directory string       `json:"directory"`
+	Backups   []BackupFile `json:"backups"` // Newest first
+}
+
+type RestoreRequest struct {
+	Name string `json:"name" required:"true"` // Name of a backup in the backups directory
+}
+
+type RestoreResponse struct {
+	Restored          string `json:"restored"`
+	MigrationsApplied int    `json:"migrations_applied"` // Migrations of this version the backup did not have
+}
+
+func hashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, "Failed to encode result", http.StatusInternalServerError)
+		return
+	}
+}
+
+// CreateAPIKey stores the hash of a new random key and returns the key
+func (s *ServerConfig) CreateAPIKey(name string, role string) (CreateAPIKeyResponse, error) {
+	key := GenerateRandomString(apiKeyLength)
+	id, err := s.Store.CreateAPIKey(name, hashAPIKey(key), key[:apiKeyPrefixLen], role)
+	if err != nil {
+		return CreateAPIKeyResponse{}, err
+	}
+
+	return CreateAPIKeyResponse{ID: id, Name: name, Role: role, Key: key}, nil
+}
+
+func (s *ServerConfig) ListAPIKeys() ([]APIKeyRecord, error) {
+	return s.Store.ListAPIKeys()
+}
+
+// RevokeAPIKey marks a key revoked, false when the key does not exist or is already revoked
+func (s *ServerConfig) RevokeAPIKey(id int64) (bool, error) {
+	return s.Store.RevokeAPIKey(id)
+}
+
+// AddTrustedObjects inserts or updates trusted objects and marks the matching objects in object_intel
+func (s *ServerConfig) AddTrustedObjects(objects []TrustedObject) (int64, error) {
+	count, err := s.Store.AddTrustedObjects(objects)
+	if err != nil {
+		return 0, err
+	}
+	return count, s.MarkTrustedObjects()
+}
+
+func (s *ServerConfig) ListTrustedObjects() ([]TrustedObject, error) {
+	return s.Store.ListTrustedObjects()
+}
+
+// RemoveTrustedObject deletes a trusted object and clears the trusted flag of the objects it covered
+// Objects still covered by another trusted object are marked again
+func (s *ServerConfig) RemoveTrustedObject(object string) (bool, error) {
+	found, err := s.Store.RemoveTrustedObject(object)
+	if err != nil || !found {
+		return false, err
+	}
+	return true, s.MarkTrustedObjects()
+}
+
+func (s *ServerConfig) GetPendingStats() (PendingStats, error) {
+	return s.Store.PendingStats()
+}
+
+// PurgePending deletes rows from pending_import matching every filter that is set
+func (s *ServerConfig) PurgePending(olderThanDays int, objectType string, source string) (int64, error) {
+	var olderThan time.Time
+	if olderThanDays > 0 {
+		olderThan = time.Now().AddDate(0, 0, -olderThanDays)
+	}
+	return s.Store.PurgePending(olderThan, objectType, source)
+}
+
+// ConfirmObjectRisk sets confirmed_risk of an object and its verdict, false when the object is not in object_intel
+func (s *ServerConfig) ConfirmObjectRisk(object string, confirmed bool) (bool, error) {
+	settings, err := s.GetSettings()
+	if err != nil {
+		return false, fmt.Errorf("failed to load settings: %w", err)
+	}
+	return s.Store.ConfirmObject(object, confirmed, settings.VerdictRules)
+}
+
+// UntrustObject clears the trusted flag of an object and removes it from trusted_objects
+// The trusted CIDR that still covers an ipv4 object is returned, MarkTrustedObjects will trust it again
+func (s *ServerConfig) UntrustObject(object string) (bool, string, error) {
+	settings, err := s.GetSettings()
+	if err != nil {
+		return false, "", fmt.Errorf("failed to load settings: %w", err)
+	}
+	return s.Store.UntrustObject(object, settings.VerdictRules)
+}
+
+func (s *ServerConfig) VacuumDatabase() error {
+	return s.Store.Vacuum()
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/keys" -X POST -H "X-API-Key: theadminapikey" -d '{"name": "firewall connector", "role": "submit"}'
+func (s *ServerConfig) HandleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	var data CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	data.Name = strings.TrimSpace(data.Name)
+	if data.Name == "" {
+		http.Error(w, "Missing name", http.StatusBadRequest)
+		return
+	}
+	if data.Role == "" {
+		data.Role = APIKeyRoleSubmit
+	}
+	if data.Role != APIKeyRoleSubmit && data.Role != APIKeyRoleAdmin {
+		http.Error(w, "Invalid role.  Valid roles are: submit, admin", http.StatusBadRequest)
+		return
+	}
+
+	key, err := s.CreateAPIKey(data.Name, data.Role)
+	if err != nil {
+		log.Printf("Failed to create API key: %v\n", err)
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("API key %d (%s, %s) created by %s\n", key.ID, key.Name, key.Role, r.RemoteAddr)
+
+	writeJSON(w, key)
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/keys" -H "X-API-Key: theadminapikey"
+func (s *ServerConfig) HandleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	keys, err := s.ListAPIKeys()
+	if err != nil {
+		http.Error(w, "Failed to retrieve API keys", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, keys)
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/keys/1" -X DELETE -H "X-API-Key: theadminapikey"
+func (s *ServerConfig) HandleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid key id", http.StatusBadRequest)
+		return
+	}
+	revoked, err := s.RevokeAPIKey(id)
+	if err != nil {
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "No active key found for the given id", http.StatusNotFound)
+		return
+	}
+	log.Printf("API key %d revoked by %s\n", id, r.RemoteAddr)
+
+	writeJSON(w, CountResponse{Status: "revoked", Count: 1})
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/trusted" -X POST -H "X-API-Key: theadminapikey" -d '{"data": [{"object": "4.5.6.0/24", "object_type": "ipv4CIDR", "notes": "office"}]}'
+func (s *ServerConfig) HandleAddTrusted(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	var data TrustedObjectsRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	for _, obj := range data.Data {
+		if obj.ObjectType != "ipv4" && obj.ObjectType != "ipv4CIDR" && obj.ObjectType != "ipv6" {
+			http.Error(w, fmt.Sprintf("Invalid object_type for %s.  Valid Object Types are: ipv4, ipv4CIDR, ipv6", obj.Object), http.StatusBadRequest)
+			return
+		}
+	}
+
+	count, err := s.AddTrustedObjects(data.Data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, CountResponse{Status: "trusted", Count: count})
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/trusted" -H "X-API-Key: theadminapikey"
+func (s *ServerConfig) HandleListTrusted(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	objects, err := s.ListTrustedObjects()
+	if err != nil {
+		http.Error(w, "Failed to retrieve trusted objects", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, objects)
+}
+
+// The object is a query parameter because a CIDR contains a slash
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/trusted?object=4.5.6.0/24" -X DELETE -H "X-API-Key: theadminapikey"
+func (s *ServerConfig) HandleRemoveTrusted(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	object := strings.TrimSpace(r.URL.Query().Get("object"))
+	if object == "" {
+		http.Error(w, "Missing object", http.StatusBadRequest)
+		return
+	}
+	removed, err := s.RemoveTrustedObject(object)
+	if err != nil {
+		http.Error(w, "Failed to remove trusted object", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "No trusted object found for the given object", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, CountResponse{Status: "removed", Count: 1})
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/settings" -H "X-API-Key: theadminapikey"
+func (s *ServerConfig) HandleGetSettings(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	settings, err := s.GetSettings()
+	if err != nil {
+		http.Error(w, "Failed to retrieve settings", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, settings)
+}
+
+// Only the keys sent are changed, severity_bands is replaced as a whole
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/settings" -X PUT -H "X-API-Key: theadminapikey" -d '{"rescore_interval_hours": 24, "scoring_weights": {"current_week": 5}}'
+func (s *ServerConfig) HandleSetSettings(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	settings, err := s.GetSettings()
+	if err != nil {
+		http.Error(w, "Failed to retrieve settings", http.StatusInternalServerError)
+		return
+	}
+	previousRules := settings.VerdictRules
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&settings); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := settings.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.SaveSettings(settings); err != nil {
+		log.Printf("Failed to save settings: %v\n", err)
+		http.Error(w, "Failed to save settings", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Settings changed by %s\n", r.RemoteAddr)
+
+	// Every verdict depends on the verdict rules
+	if settings.VerdictRules != previousRules {
+		changed, err := s.RefreshVerdicts("")
+		if err != nil {
+			log.Printf("Failed to refresh verdicts: %v\n", err)
+			http.Error(w, "Settings saved but refreshing the verdicts failed", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Verdict rules changed, updated the verdict of %d objects\n", changed)
+	}
+
+	writeJSON(w, settings)
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/pending" -H "X-API-Key: theadminapikey"
+func (s *ServerConfig) HandlePendingStats(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	stats, err := s.GetPendingStats()
+	if err != nil {
+		http.Error(w, "Failed to retrieve pending_import statistics", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+// At least one filter or all=true is required so a typo does not empty the table
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/pending?older_than_days=30" -X DELETE -H "X-API-Key: theadminapikey"
+func (s *ServerConfig) HandlePurgePending(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	var olderThanDays int
+	if value := query.Get("older_than_days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "older_than_days must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		olderThanDays = n
+	}
+	objectType := query.Get("object_type")
+	source := query.Get("source")
+	if olderThanDays == 0 && objectType == "" && source == "" && query.Get("all") != "true" {
+		http.Error(w, "Set older_than_days, object_type, source or all=true", http.StatusBadRequest)
+		return
+	}
+
+	count, err := s.PurgePending(olderThanDays, objectType, source)
+	if err != nil {
+		http.Error(w, "Failed to purge pending_import", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Purged %d rows from pending_import requested by %s\n", count, r.RemoteAddr)
+
+	writeJSON(w, CountResponse{Status: "purged", Count: count})
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/objects/114.6.6.6/confirm" -X POST -H "X-API-Key: theadminapikey" -d '{"confirmed": true}'
+func (s *ServerConfig) HandleConfirmObject(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	data := ConfirmObjectRequest{Confirmed: true}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+			return
+		}
+	}
+
+	object := r.PathValue("object")
+	found, err := s.ConfirmObjectRisk(object, data.Confirmed)
+	if err != nil {
+		http.Error(w, "Failed to confirm object", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "No data found for the given object", http.StatusNotFound)
+		return
+	}
+
+	status := "confirmed"
+	if !data.Confirmed {
+		status = "unconfirmed"
+	}
+	writeJSON(w, ObjectStatusResponse{Object: object, Status: status})
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/objects/4.5.7.5/untrust" -X POST -H "X-API-Key: theadminapikey"
+func (s *ServerConfig) HandleUntrustObject(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	object := r.PathValue("object")
+	found, coveredBy, err := s.UntrustObject(object)
+	if err != nil {
+		http.Error(w, "Failed to untrust object", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "No data found for the given object", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, ObjectStatusResponse{Object: object, Status: "untrusted", CoveredBy: coveredBy})
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/db/backup" -X POST -H "X-API-Key: theadminapikey"
+func (s *ServerConfig) HandleBackupDB(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	backup, err := s.BackupDatabase()
+	if errors.Is(err, errors.ErrUnsupported) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		log.Printf("Database backup failed: %v\n", err)
+		http.Error(w, "Failed to backup the database", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Database backed up to %s by %s\n", backup.Path, r.RemoteAddr)
+
+	writeJSON(w, backup)
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/db/backups" -H "X-API-Key: theadminapikey"
+func (s *ServerConfig) HandleListBackups(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	backups, err := s.ListBackups()
+	if err != nil {
+		log.Printf("Listing the backups failed: %v\n", err)
+		http.Error(w, "Failed to list the backups", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, BackupListResponse{Directory: backupDirectory(s.Config()), Backups: backups})
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/db/restore" -X POST -H "X-API-Key: theadminapikey" -d '{"name": "threatintel_20250101_120000.sqlite.gz"}'
+func (s *ServerConfig) HandleRestoreDB(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	var data RestoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	// Only the backups in the backups directory can be restored
+	path, err := s.BackupPath(strings.TrimSpace(data.Name))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "No backup with that name, list them with /api/admin/db/backups", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to list the backups", http.StatusInternalServerError)
+		return
+	}
+
+	restored, err := s.RestoreDatabase(path)
+	if errors.Is(err, errors.ErrUnsupported) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if errors.Is(err, ErrSchemaTooNew) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Database restore failed: %v\n", err)
+		http.Error(w, "Failed to restore the database", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Database restored from %s by %s\n", path, r.RemoteAddr)
+
+	writeJSON(w, restored)
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/db/vacuum" -X POST -H "X-API-Key: theadminapikey"
+func (s *ServerConfig) HandleVacuumDB(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	if err := s.VacuumDatabase(); err != nil {
+		log.Printf("Database vacuum failed: %v\n", err)
+		http.Error(w, "Failed to vacuum the database", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, StatusResponse{Status: "vacuumed"})
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/scoring/rules" -H "X-API-Key: theadminapikey"
+func (s *ServerConfig) HandleGetScoringRules(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	rules, err := s.GetScoringRules()
+	if err != nil {
+		http.Error(w, "Failed to retrieve scoring rules", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, rules)
+}
+
+// The rules are replaced as a whole, the version is set by the server
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/scoring/rules" -X PUT -H "X-API-Key: theadminapikey" -d @rules.json
+func (s *ServerConfig) HandleSetScoringRules(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	var rules ScoringRuleSet
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rules); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := rules.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rules, err := s.SaveScoringRules(rules)
+	if err != nil {
+		log.Printf("Failed to save scoring rules: %v\n", err)
+		http.Error(w, "Failed to save scoring rules", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Scoring rules version %d saved by %s\n", rules.Version, r.RemoteAddr)
+
+	writeJSON(w, rules)
+}
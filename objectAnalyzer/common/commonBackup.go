@@ -0,0 +1,217 @@
+package common
+
+// Backups of the database in the backups directory next to dbPath
+//
+// Each backup is named <database>_<YYYYMMDD_HHMMSS>.sqlite, with .gz added when
+// backupGzip is set.  The integrity of a backup is checked after it is written
+// and only the newest backupKeep are kept.  A restore refuses a backup made by
+// a newer version and applies the migrations a backup of an older one misses.
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultBackupKeep = 7
+	backupTimeLayout  = "20060102_150405"
+)
+
+// backupDirectory is the backups directory next to the database
+func backupDirectory(c Configuration) string {
+	return filepath.Join(filepath.Dir(c.DBPath), "backups")
+}
+
+// backupPattern matches the backups of the database, the time is the first group
+func backupPattern(c Configuration) *regexp.Regexp {
+	name := strings.TrimSuffix(filepath.Base(c.DBPath), filepath.Ext(c.DBPath))
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(name) + `_([0-9]{8}_[0-9]{6})\.sqlite(\.gz)?$`)
+}
+
+// BackupDatabase writes a copy of the database to the backups directory and removes the backups past backupKeep
+// errors.ErrUnsupported is returned by the stores that cannot write a copy
+func (s *ServerConfig) BackupDatabase() (BackupResponse, error) {
+	cfg := s.Config()
+	backupDir := backupDirectory(cfg)
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		return BackupResponse{}, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	name := strings.TrimSuffix(filepath.Base(cfg.DBPath), filepath.Ext(cfg.DBPath))
+	backupPath := filepath.Join(backupDir, name+"_"+time.Now().Format(backupTimeLayout)+".sqlite")
+	if _, err := os.Stat(backupPath + ".gz"); err == nil {
+		return BackupResponse{}, fmt.Errorf("backup %s.gz already exists", backupPath)
+	}
+
+	if err := s.Store.Backup(backupPath); err != nil {
+		return BackupResponse{}, err
+	}
+	if cfg.BackupGzip {
+		if err := gzipFile(backupPath, backupPath+".gz"); err != nil {
+			os.Remove(backupPath)
+			return BackupResponse{}, err
+		}
+		os.Remove(backupPath)
+		backupPath += ".gz"
+	}
+	info, err := os.Stat(backupPath)
+	if err != nil {
+		return BackupResponse{}, fmt.Errorf("failed to stat the backup: %w", err)
+	}
+	response := BackupResponse{Path: backupPath, SizeBytes: info.Size(), Compressed: cfg.BackupGzip}
+
+	if cfg.BackupKeep > 0 {
+		backups, err := s.ListBackups()
+		if err != nil {
+			return response, err
+		}
+		for i := cfg.BackupKeep; i < len(backups); i++ {
+			if err := os.Remove(filepath.Join(backupDir, backups[i].Name)); err != nil {
+				return response, fmt.Errorf("failed to remove the old backup %s: %w", backups[i].Name, err)
+			}
+			response.Removed = append(response.Removed, backups[i].Name)
+		}
+	}
+	return response, nil
+}
+
+// gzipFile writes the compressed copy of src to dest, the copy is renamed into place once complete
+func gzipFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer in.Close()
+
+	tmp := dest + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to compress %s: %w", src, err)
+	}
+	return nil
+}
+
+// ListBackups returns the backups of the database in the backups directory, newest first
+func (s *ServerConfig) ListBackups() ([]BackupFile, error) {
+	cfg := s.Config()
+	entries, err := os.ReadDir(backupDirectory(cfg))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []BackupFile{}, nil
+		}
+		return nil, fmt.Errorf("failed to read the backup directory: %w", err)
+	}
+
+	pattern := backupPattern(cfg)
+	backups := []BackupFile{}
+	for _, entry := range entries {
+		match := pattern.FindStringSubmatch(entry.Name())
+		if match == nil || !entry.Type().IsRegular() {
+			continue
+		}
+		created, err := time.ParseInLocation(backupTimeLayout, match[1], time.Local)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %w", entry.Name(), err)
+		}
+		backups = append(backups, BackupFile{Name: entry.Name(), SizeBytes: info.Size(), CreatedAt: created.Format(time.RFC3339), Compressed: match[2] != ""})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt > backups[j].CreatedAt })
+	return backups, nil
+}
+
+// BackupPath returns the path of a backup listed by ListBackups, ErrNotFound for any other name
+func (s *ServerConfig) BackupPath(name string) (string, error) {
+	backups, err := s.ListBackups()
+	if err != nil {
+		return "", err
+	}
+	for _, backup := range backups {
+		if backup.Name == name {
+			return filepath.Join(backupDirectory(s.Config()), name), nil
+		}
+	}
+	return "", fmt.Errorf("backup %s: %w", name, ErrNotFound)
+}
+
+// RestoreDatabase replaces the database with the backup at path and applies the migrations it misses
+func (s *ServerConfig) RestoreDatabase(path string) (RestoreResponse, error) {
+	response := RestoreResponse{Restored: path}
+	restorePath := path
+	if strings.HasSuffix(path, ".gz") {
+		tmp, err := gunzipTemp(path)
+		if err != nil {
+			return response, err
+		}
+		defer os.Remove(tmp)
+		restorePath = tmp
+	}
+
+	if err := s.Store.Restore(restorePath); err != nil {
+		return response, err
+	}
+	log.Printf("Database restored from %s\n", path)
+
+	applied, err := s.Store.Migrate()
+	if err != nil {
+		return response, fmt.Errorf("the backup was restored, migrating it failed: %w", err)
+	}
+	response.MigrationsApplied = applied
+	return response, nil
+}
+
+// gunzipTemp decompresses a backup next to it and returns the path of the copy, the caller removes it
+func gunzipTemp(path string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open the backup: %w", err)
+	}
+	defer in.Close()
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return "", fmt.Errorf("failed to decompress %s: %w", path, err)
+	}
+	defer zr.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".restore-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to decompress %s: %w", path, err)
+	}
+	_, err = io.Copy(out, zr)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", fmt.Errorf("failed to decompress %s: %w", path, err)
+	}
+	return out.Name(), nil
+}
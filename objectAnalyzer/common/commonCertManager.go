@@ -0,0 +1,199 @@
+package common
+
+// The CertManager serves the TLS certificate to the https server through
+// tls.Config.GetCertificate so the certificate can be swapped without
+// restarting the listener.  The certificate and key files are polled for
+// changes and a self-signed certificate is re-issued when it enters the
+// renewal window.
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCertRenewDays    = 30
+	defaultCertWarnDays     = 45
+	defaultCertCheckSeconds = 60
+)
+
+type CertManager struct {
+	TLSConfig     string
+	CertFile      string
+	KeyFile       string
+	RenewBefore   time.Duration // Re-issue a self-signed certificate this long before it expires
+	WarnBefore    time.Duration // Log an expiry warning this long before the certificate expires
+	CheckInterval time.Duration // How often the certificate and key files are checked
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+	lastWarn time.Time
+}
+
+func NewCertManager(c Configuration) *CertManager {
+	renewDays := c.CertRenewDays
+	if renewDays <= 0 {
+		renewDays = defaultCertRenewDays
+	}
+	warnDays := c.CertWarnDays
+	if warnDays <= 0 {
+		warnDays = defaultCertWarnDays
+	}
+	checkSeconds := c.CertCheckSeconds
+	if checkSeconds <= 0 {
+		checkSeconds = defaultCertCheckSeconds
+	}
+
+	return &CertManager{
+		TLSConfig:     c.TLSConfig,
+		CertFile:      c.TLSCert,
+		KeyFile:       c.TLSKey,
+		RenewBefore:   time.Duration(renewDays) * 24 * time.Hour,
+		WarnBefore:    time.Duration(warnDays) * 24 * time.Hour,
+		CheckInterval: time.Duration(checkSeconds) * time.Second,
+	}
+}
+
+// Load reads the certificate and key from disk and makes them the active pair
+func (m *CertManager) Load() error {
+	certInfo, err := os.Stat(m.CertFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat certificate %s: %w", m.CertFile, err)
+	}
+	keyInfo, err := os.Stat(m.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat key %s: %w", m.KeyFile, err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(m.CertFile, m.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate and key: %w", err)
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse certificate: %w", err)
+		}
+	}
+
+	m.mu.Lock()
+	m.cert = &cert
+	m.certMod = certInfo.ModTime()
+	m.keyMod = keyInfo.ModTime()
+	m.mu.Unlock()
+
+	log.Printf("Loaded TLS certificate %s (serial %s) valid until %s\n", m.CertFile, cert.Leaf.SerialNumber.Text(16), cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate
+func (m *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.cert == nil {
+		return nil, fmt.Errorf("no TLS certificate loaded")
+	}
+	return m.cert, nil
+}
+
+// NotAfter returns the expiration of the active certificate
+func (m *CertManager) NotAfter() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.cert == nil || m.cert.Leaf == nil {
+		return time.Time{}
+	}
+	return m.cert.Leaf.NotAfter
+}
+
+// Watch checks the certificate on every CheckInterval until stop is closed
+// Only one Watch should be running for a CertManager
+func (m *CertManager) Watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(m.CheckInterval)
+	defer ticker.Stop()
+
+	m.Check()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.Check()
+		}
+	}
+}
+
+// Check reloads the pair if either file changed on disk, then warns about or
+// renews a certificate that is close to expiring.  Errors are logged and the
+// current certificate keeps being served.
+func (m *CertManager) Check() {
+	if m.filesChanged() {
+		if err := m.Load(); err != nil {
+			// The key and certificate may be in the middle of being replaced, try again on the next check
+			log.Printf("Keeping the current TLS certificate, reload failed: %v\n", err)
+		}
+	}
+
+	m.mu.RLock()
+	cert := m.cert
+	m.mu.RUnlock()
+	if cert == nil || cert.Leaf == nil {
+		return
+	}
+
+	remaining := time.Until(cert.Leaf.NotAfter)
+	if remaining <= m.RenewBefore {
+		if !isSelfSigned(cert.Leaf) {
+			log.Printf("WARNING: TLS certificate %s expires in %s and was not issued by this server, replace it manually\n", m.CertFile, remaining.Round(time.Hour))
+			return
+		}
+		log.Printf("TLS certificate %s expires in %s, re-issuing a self-signed certificate\n", m.CertFile, remaining.Round(time.Hour))
+		if err := GenerateCerts(m.TLSConfig, m.CertFile, m.KeyFile); err != nil {
+			log.Printf("Failed to renew the TLS certificate: %v\n", err)
+			return
+		}
+		if err := m.Load(); err != nil {
+			log.Printf("Failed to load the renewed TLS certificate: %v\n", err)
+		}
+		return
+	}
+
+	// Warn once a day instead of on every check
+	if remaining <= m.WarnBefore && time.Since(m.lastWarn) >= 24*time.Hour {
+		m.lastWarn = time.Now()
+		log.Printf("WARNING: TLS certificate %s expires on %s (%s remaining)\n", m.CertFile, cert.Leaf.NotAfter.Format(time.RFC3339), remaining.Round(time.Hour))
+	}
+}
+
+func (m *CertManager) filesChanged() bool {
+	certInfo, err := os.Stat(m.CertFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(m.KeyFile)
+	if err != nil {
+		return false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return !certInfo.ModTime().Equal(m.certMod) || !keyInfo.ModTime().Equal(m.keyMod)
+}
+
+// CheckSignatureFrom is not used because the generated certificates are not marked as a CA
+func isSelfSigned(cert *x509.Certificate) bool {
+	if !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		return false
+	}
+	return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
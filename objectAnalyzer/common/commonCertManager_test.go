@@ -0,0 +1,219 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+const testCertConfig = `{"DNSNames": ["www.example.com"], "Org": "Example Inc", "CommonName": "example.com", "Country": "US", "Email": "admin@example.com"}`
+
+// newTestCertManager generates a self-signed pair in a temporary working directory, GenerateCerts writes relative to it
+func newTestCertManager(t *testing.T, renewBefore time.Duration) *CertManager {
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("certConfig.json", []byte(testCertConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateCerts("certConfig.json", "server.crt", "server.key"); err != nil {
+		t.Fatalf("GenerateCerts: %v", err)
+	}
+	m := &CertManager{
+		TLSConfig:     "certConfig.json",
+		CertFile:      "server.crt",
+		KeyFile:       "server.key",
+		RenewBefore:   renewBefore,
+		WarnBefore:    renewBefore,
+		CheckInterval: time.Minute,
+	}
+	if err := m.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return m
+}
+
+func serial(t *testing.T, m *CertManager) string {
+	t.Helper()
+	cert, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	return cert.Leaf.SerialNumber.String()
+}
+
+// touch moves the modification time of the files forward so Check sees them as changed
+func touch(t *testing.T, files ...string) {
+	t.Helper()
+	later := time.Now().Add(time.Minute)
+	for _, f := range files {
+		if err := os.Chtimes(f, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertManagerRenewsInWindow(t *testing.T) {
+	m := newTestCertManager(t, defaultCertRenewDays*24*time.Hour)
+	before := serial(t, m)
+	m.Check()
+	if serial(t, m) != before {
+		t.Fatal("a certificate outside the renewal window was re-issued")
+	}
+
+	// A window longer than the lifetime puts the generated certificate in it
+	m.RenewBefore = (certLifetimeDays + 1) * 24 * time.Hour
+	m.Check()
+	after := serial(t, m)
+	if after == before {
+		t.Fatal("a self-signed certificate in the renewal window was not re-issued")
+	}
+	if left := time.Until(m.NotAfter()); left < (certLifetimeDays-1)*24*time.Hour {
+		t.Errorf("the re-issued certificate expires in %s", left)
+	}
+}
+
+func TestCertManagerKeepsCurrentOnBadPair(t *testing.T) {
+	m := newTestCertManager(t, defaultCertRenewDays*24*time.Hour)
+	before := serial(t, m)
+
+	// A key that does not match, as when only one of the files was replaced yet
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("server.key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, "server.key")
+	m.Check()
+	if serial(t, m) != before {
+		t.Fatal("the certificate changed after a failed reload")
+	}
+
+	// A complete new pair is reloaded once the files change
+	if err := GenerateCerts("certConfig.json", "server.crt", "server.key"); err != nil {
+		t.Fatalf("GenerateCerts: %v", err)
+	}
+	touch(t, "server.crt", "server.key")
+	m.Check()
+	if serial(t, m) == before {
+		t.Fatal("the replaced pair was not reloaded")
+	}
+}
+
+func TestCertManagerKeepsCertificateOfAnotherCA(t *testing.T) {
+	m := newTestCertManager(t, defaultCertRenewDays*24*time.Hour)
+	caKey, caCert := testCertificate(t, nil, nil, true)
+	leafKey, leaf := testCertificate(t, caKey, caCert, false)
+	writePair(t, leafKey, leaf)
+	touch(t, "server.crt", "server.key")
+	m.Check()
+	if serial(t, m) != leaf.SerialNumber.String() {
+		t.Fatal("the certificate issued by another CA was not loaded")
+	}
+	crt, err := os.ReadFile("server.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only warned about in the renewal window, the files are left alone
+	m.RenewBefore = (certLifetimeDays + 1) * 24 * time.Hour
+	m.Check()
+	if serial(t, m) != leaf.SerialNumber.String() {
+		t.Fatal("a certificate issued by another CA was re-issued")
+	}
+	if after, err := os.ReadFile("server.crt"); err != nil || string(after) != string(crt) {
+		t.Fatalf("the certificate file was rewritten, %v", err)
+	}
+}
+
+func TestIsSelfSigned(t *testing.T) {
+	_, selfSigned := testCertificate(t, nil, nil, false)
+	caKey, caCert := testCertificate(t, nil, nil, true)
+	_, issued := testCertificate(t, caKey, caCert, false)
+
+	// Same subject and issuer, but signed by another key
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, forged := testCertificate(t, otherKey, &x509.Certificate{RawSubject: selfSigned.RawSubject}, false)
+
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want bool
+	}{
+		{"self-signed", selfSigned, true},
+		{"self-signed CA", caCert, true},
+		{"issued by a CA", issued, false},
+		{"issuer is the subject, signed by another key", forged, false},
+	}
+	for _, test := range tests {
+		if got := isSelfSigned(test.cert); got != test.want {
+			t.Errorf("isSelfSigned(%s) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// testCertificate creates a certificate for example.com signed by parentKey, self-signed when parent is nil
+func testCertificate(t *testing.T, parentKey *ecdsa.PrivateKey, parent *x509.Certificate, isCA bool) (*ecdsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialNumber, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: "example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(90 * 24 * time.Hour),
+		DNSNames:              []string{"www.example.com"},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.Subject.CommonName = "Example CA"
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+func writePair(t *testing.T, key *ecdsa.PrivateKey, cert *x509.Certificate) {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("server.key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("server.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,311 @@
+package common
+
+// Validation, environment overrides and redaction for the Configuration
+//
+// Any field can be overridden with an environment variable named OA_ followed by
+// the json key in upper snake case, for example:
+//    apiKey              -> OA_API_KEY
+//    dbPath              -> OA_DB_PATH
+//    trustedCSVDirectory -> OA_TRUSTED_CSV_DIRECTORY
+// This keeps secrets out of config.json when running in a container.
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	envPrefix       = "OA_"
+	defaultAPIKey   = "changeThisAPIKeyToSomethingSecure"
+	minAPIKeyLength = 16
+	redactedValue   = "[REDACTED]"
+)
+
+// EnvName returns the environment variable that overrides the json key
+func EnvName(jsonKey string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	runes := []rune(jsonKey)
+	for i, r := range runes {
+		// Start a new word on a lower to upper change or at the end of an acronym (CSVDirectory -> CSV_DIRECTORY)
+		if i > 0 && unicode.IsUpper(r) {
+			prevLower := unicode.IsLower(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || (unicode.IsUpper(runes[i-1]) && nextLower) {
+				b.WriteRune('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// configFields calls fn for each exported field of the Configuration with its json key
+func configFields(v reflect.Value, fn func(jsonKey string, field reflect.StructField, value reflect.Value) error) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		jsonKey := strings.Split(field.Tag.Get("json"), ",")[0]
+		if jsonKey == "" || jsonKey == "-" || !field.IsExported() {
+			continue
+		}
+		if err := fn(jsonKey, field, v.Field(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyEnvOverrides replaces fields with the values of their OA_* environment variables
+func (c *Configuration) ApplyEnvOverrides() error {
+	return configFields(reflect.ValueOf(c).Elem(), func(jsonKey string, field reflect.StructField, value reflect.Value) error {
+		envName := EnvName(jsonKey)
+		envValue, ok := os.LookupEnv(envName)
+		if !ok {
+			return nil
+		}
+		switch value.Kind() {
+		case reflect.String:
+			value.SetString(envValue)
+		case reflect.Int:
+			n, err := strconv.Atoi(strings.TrimSpace(envValue))
+			if err != nil {
+				return fmt.Errorf("%s must be an integer: %w", envName, err)
+			}
+			value.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(strings.TrimSpace(envValue))
+			if err != nil {
+				return fmt.Errorf("%s must be true or false: %w", envName, err)
+			}
+			value.SetBool(b)
+		default:
+			return fmt.Errorf("%s can not be set from the environment", envName)
+		}
+		return nil
+	})
+}
+
+// EnvOverrides returns the names of the OA_* variables that are set
+func EnvOverrides() []string {
+	var names []string
+	configFields(reflect.ValueOf(Configuration{}), func(jsonKey string, field reflect.StructField, value reflect.Value) error {
+		if _, ok := os.LookupEnv(EnvName(jsonKey)); ok {
+			names = append(names, EnvName(jsonKey))
+		}
+		return nil
+	})
+	return names
+}
+
+// HasEnvOverrides reports if any OA_* variable matching a configuration field is set
+func HasEnvOverrides() bool {
+	return len(EnvOverrides()) > 0
+}
+
+// Redacted returns a copy of the configuration with the fields tagged secret:"true" masked
+func (c Configuration) Redacted() Configuration {
+	v := reflect.ValueOf(&c).Elem()
+	configFields(v, func(jsonKey string, field reflect.StructField, value reflect.Value) error {
+		if field.Tag.Get("secret") == "true" && value.Kind() == reflect.String && value.String() != "" {
+			value.SetString(redactedValue)
+		}
+		return nil
+	})
+	return c
+}
+
+// Validate checks the settings used by every program.  The API keys, listener
+// and TLS settings are only checked when server is true (apiServer).
+// All problems are returned together.
+func (c *Configuration) Validate(server bool) error {
+	var errs []error
+
+	store := storeName(*c)
+	if !slices.Contains(StoreBackends(), store) {
+		errs = append(errs, fmt.Errorf("store %s is not in this build, available: %s", store, strings.Join(StoreBackends(), ", ")))
+	}
+	switch store {
+	case "sqlite":
+		if strings.TrimSpace(c.DBPath) == "" {
+			errs = append(errs, errors.New("dbPath is required"))
+		} else if err := isDirectory(filepath.Dir(c.DBPath)); err != nil {
+			errs = append(errs, fmt.Errorf("dbPath directory: %w", err))
+		}
+		if c.DBBusyTimeout < 0 {
+			errs = append(errs, errors.New("dbBusyTimeoutSeconds can not be negative"))
+		}
+		if c.BackupKeep < 0 {
+			errs = append(errs, errors.New("backupKeep can not be negative"))
+		}
+	case "postgres":
+		if strings.TrimSpace(c.DatabaseURL) == "" {
+			errs = append(errs, errors.New("databaseURL is required for the postgres store"))
+		}
+	}
+
+	if c.PendingLease < 0 {
+		errs = append(errs, errors.New("pendingLeaseSeconds can not be negative"))
+	}
+	if c.PipelineWorkers < 0 {
+		errs = append(errs, errors.New("pipelineWorkers can not be negative"))
+	}
+	if c.EnrichGeoCSV != "" {
+		if info, err := os.Stat(c.EnrichGeoCSV); err != nil {
+			errs = append(errs, fmt.Errorf("enrichGeoCSV: %w", err))
+		} else if info.IsDir() {
+			errs = append(errs, fmt.Errorf("enrichGeoCSV %s is a directory", c.EnrichGeoCSV))
+		}
+	}
+
+	dirs := [][2]string{
+		{"trustedCSVDirectory", c.TrustedCSVLocation},
+		{"importCSVDirectory", c.ImportCSVLocation},
+		{"archiveCSVDirectory", c.ArchiveCSVLocation},
+	}
+	for _, dir := range dirs {
+		if strings.TrimSpace(dir[1]) == "" {
+			errs = append(errs, fmt.Errorf("%s is required", dir[0]))
+			continue
+		}
+		// The directories are created when missing, an existing file in the way is an error
+		if info, err := os.Stat(dir[1]); err == nil && !info.IsDir() {
+			errs = append(errs, fmt.Errorf("%s %s is not a directory", dir[0], dir[1]))
+		}
+	}
+
+	if server {
+		if len(c.APIKey) < minAPIKeyLength {
+			errs = append(errs, fmt.Errorf("apiKey must be at least %d characters, recommended length is more than 64 characters", minAPIKeyLength))
+		} else if c.APIKey == defaultAPIKey {
+			errs = append(errs, fmt.Errorf("apiKey is still the default value, set it in the config file or with %s", EnvName("apiKey")))
+		}
+		// The admin endpoints are disabled when adminApiKey is empty
+		if c.AdminAPIKey != "" {
+			if len(c.AdminAPIKey) < minAPIKeyLength {
+				errs = append(errs, fmt.Errorf("adminApiKey must be at least %d characters", minAPIKeyLength))
+			} else if c.AdminAPIKey == c.APIKey {
+				errs = append(errs, errors.New("adminApiKey must be different from apiKey"))
+			}
+		}
+		if strings.TrimSpace(c.Hostname) == "" {
+			errs = append(errs, errors.New("hostname is required"))
+		}
+		if c.Port < 1 || c.Port > 65535 {
+			errs = append(errs, fmt.Errorf("port %d must be between 1 and 65535", c.Port))
+		}
+		tlsPaths := [][2]string{{"tlsConfig", c.TLSConfig}, {"tlsCert", c.TLSCert}, {"tlsKey", c.TLSKey}}
+		for _, path := range tlsPaths {
+			if strings.TrimSpace(path[1]) == "" {
+				errs = append(errs, fmt.Errorf("%s is required", path[0]))
+			}
+		}
+		if c.CertRenewDays < 0 || c.CertWarnDays < 0 || c.CertCheckSeconds < 0 {
+			errs = append(errs, errors.New("certRenewDays, certWarnDays and certCheckSeconds can not be negative"))
+		} else {
+			// 0 is the default, as in NewCertManager
+			renewDays, warnDays := cmp.Or(c.CertRenewDays, defaultCertRenewDays), cmp.Or(c.CertWarnDays, defaultCertWarnDays)
+			// A renewed certificate would be in the renewal window again and be re-issued on every check
+			if renewDays >= certLifetimeDays {
+				errs = append(errs, fmt.Errorf("certRenewDays %d must be less than the %d days a generated certificate is valid", renewDays, certLifetimeDays))
+			}
+			// The certificate would be renewed before the warning is due
+			if warnDays < renewDays {
+				errs = append(errs, fmt.Errorf("certWarnDays %d can not be less than certRenewDays %d", warnDays, renewDays))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func isDirectory(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// PrintCheckConfig writes the effective configuration with secrets redacted and
+// the result of the validation.  It returns the validation error.
+func (c *Configuration) PrintCheckConfig(configFile string, server bool) error {
+	fmt.Printf("Config file: %s\n", configFile)
+	if overrides := EnvOverrides(); len(overrides) > 0 {
+		fmt.Printf("Environment overrides: %s\n", strings.Join(overrides, ", "))
+	}
+
+	jsonData, err := json.MarshalIndent(c.Redacted(), "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(jsonData))
+
+	if err := c.Validate(server); err != nil {
+		fmt.Printf("\nConfiguration is invalid:\n%v\n", err)
+		return err
+	}
+	fmt.Println("\nConfiguration is valid")
+	return nil
+}
+
+// ConfigReloadReport lists the json keys that changed during a reload
+type ConfigReloadReport struct {
+	Applied         []string `json:"applied"`          // Live for the next request
+	RequiresRestart []string `json:"requires_restart"` // Changed in the file, the running value is kept until a restart
+}
+
+func (r ConfigReloadReport) String() string {
+	if len(r.Applied) == 0 && len(r.RequiresRestart) == 0 {
+		return "no settings changed"
+	}
+	return fmt.Sprintf("applied immediately: [%s], requires a restart: [%s]", strings.Join(r.Applied, ", "), strings.Join(r.RequiresRestart, ", "))
+}
+
+// ReloadConfig loads ConfigPath again, validates it and swaps in a new snapshot.
+// Fields tagged reload:"restart" keep their running value because the listener,
+// database and certificate were built from them at startup.  The current
+// configuration is kept when the new one fails to load or validate.
+func (s *ServerConfig) ReloadConfig(server bool) (ConfigReloadReport, error) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	var report ConfigReloadReport
+	var next Configuration
+	if err := next.LoadConfig(s.ConfigPath); err != nil {
+		return report, fmt.Errorf("keeping the current configuration: %w", err)
+	}
+	if err := next.Validate(server); err != nil {
+		return report, fmt.Errorf("keeping the current configuration, the new configuration is invalid:\n%w", err)
+	}
+
+	current := reflect.ValueOf(s.Config())
+	configFields(reflect.ValueOf(&next).Elem(), func(jsonKey string, field reflect.StructField, value reflect.Value) error {
+		running := current.FieldByIndex(field.Index)
+		if reflect.DeepEqual(running.Interface(), value.Interface()) {
+			return nil
+		}
+		if field.Tag.Get("reload") == "restart" {
+			report.RequiresRestart = append(report.RequiresRestart, jsonKey)
+			value.Set(running)
+			return nil
+		}
+		report.Applied = append(report.Applied, jsonKey)
+		return nil
+	})
+
+	s.config.Store(&next)
+	return report, nil
+}
@@ -0,0 +1,245 @@
+package common
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// validConfig returns a configuration Validate accepts for the apiServer, with its directories in a temporary directory
+func validConfig(t *testing.T) Configuration {
+	dir := t.TempDir()
+	var c Configuration
+	c.SetDefaults()
+	c.Store = "memory"
+	c.DBPath = filepath.Join(dir, "threatintel.sqlite")
+	c.APIKey = "a-test-api-key-long-enough"
+	c.AdminAPIKey = "a-test-admin-api-key-long-enough"
+	c.TrustedCSVLocation = filepath.Join(dir, "trustedCSV")
+	c.ImportCSVLocation = filepath.Join(dir, "importCSV")
+	c.ArchiveCSVLocation = filepath.Join(dir, "archiveCSV")
+	if err := c.Validate(true); err != nil {
+		t.Fatalf("the valid config failed validation: %v", err)
+	}
+	return c
+}
+
+func TestValidateCertDays(t *testing.T) {
+	tests := []struct {
+		name      string
+		renewDays int
+		warnDays  int
+		want      string // Part of the error, "" when the config is valid
+	}{
+		{"defaults", 0, 0, ""},
+		{"warning before the renewal", 30, 45, ""},
+		{"warning with the renewal", 60, 60, ""},
+		{"longest renewal window", certLifetimeDays - 1, certLifetimeDays, ""},
+		{"renewal window as long as the lifetime", certLifetimeDays, certLifetimeDays, "certRenewDays"},
+		{"renewal window longer than the lifetime", 400, 400, "certRenewDays"},
+		{"warning after the renewal", 60, 45, "certWarnDays 45 can not be less than certRenewDays 60"},
+		{"default warning after the renewal", 60, 0, "certWarnDays 45"},
+		{"negative", -1, 45, "can not be negative"},
+	}
+	for _, test := range tests {
+		c := validConfig(t)
+		c.CertRenewDays, c.CertWarnDays = test.renewDays, test.warnDays
+		err := c.Validate(true)
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%s: got %v, want an error with %q", test.name, err, test.want)
+		}
+		// The workerBee does not serve the certificate
+		if err := c.Validate(false); err != nil {
+			t.Errorf("%s: Validate(false) = %v", test.name, err)
+		}
+	}
+}
+
+// The environment variable of every key, a new key of the Configuration needs a line here
+var configEnvNames = map[string]string{
+	"hostname":             "OA_HOSTNAME",
+	"port":                 "OA_PORT",
+	"store":                "OA_STORE",
+	"dbPath":               "OA_DB_PATH",
+	"dbBusyTimeoutSeconds": "OA_DB_BUSY_TIMEOUT_SECONDS",
+	"databaseURL":          "OA_DATABASE_URL",
+	"backupKeep":           "OA_BACKUP_KEEP",
+	"backupGzip":           "OA_BACKUP_GZIP",
+	"workerID":             "OA_WORKER_ID",
+	"pendingLeaseSeconds":  "OA_PENDING_LEASE_SECONDS",
+	"pipelineWorkers":      "OA_PIPELINE_WORKERS",
+	"enrichGeoCSV":         "OA_ENRICH_GEO_CSV",
+	"tlsConfig":            "OA_TLS_CONFIG",
+	"tlsCert":              "OA_TLS_CERT",
+	"tlsKey":               "OA_TLS_KEY",
+	"apiKey":               "OA_API_KEY",
+	"adminApiKey":          "OA_ADMIN_API_KEY",
+	"debug":                "OA_DEBUG",
+	"trustedCSVDirectory":  "OA_TRUSTED_CSV_DIRECTORY",
+	"importCSVDirectory":   "OA_IMPORT_CSV_DIRECTORY",
+	"archiveCSVDirectory":  "OA_ARCHIVE_CSV_DIRECTORY",
+	"certRenewDays":        "OA_CERT_RENEW_DAYS",
+	"certWarnDays":         "OA_CERT_WARN_DAYS",
+	"certCheckSeconds":     "OA_CERT_CHECK_SECONDS",
+}
+
+func TestEnvName(t *testing.T) {
+	keys := map[string]bool{}
+	configFields(reflect.ValueOf(Configuration{}), func(jsonKey string, field reflect.StructField, value reflect.Value) error {
+		keys[jsonKey] = true
+		want, ok := configEnvNames[jsonKey]
+		if !ok {
+			t.Errorf("json key %s has no environment variable in configEnvNames", jsonKey)
+		} else if got := EnvName(jsonKey); got != want {
+			t.Errorf("EnvName(%q) = %s, want %s", jsonKey, got, want)
+		}
+		return nil
+	})
+	for jsonKey := range configEnvNames {
+		if !keys[jsonKey] {
+			t.Errorf("configEnvNames has %s, the Configuration does not", jsonKey)
+		}
+	}
+
+	// The acronym rules on keys the Configuration does not have yet
+	for jsonKey, want := range map[string]string{
+		"a":                 "OA_A",
+		"ID":                "OA_ID",
+		"csv":               "OA_CSV",
+		"CSVDirectory":      "OA_CSV_DIRECTORY",
+		"parseHTTPResponse": "OA_PARSE_HTTP_RESPONSE",
+		"useTLS":            "OA_USE_TLS",
+		"aB":                "OA_A_B",
+	} {
+		if got := EnvName(jsonKey); got != want {
+			t.Errorf("EnvName(%q) = %s, want %s", jsonKey, got, want)
+		}
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	t.Setenv("OA_PORT", " 8443 ")
+	t.Setenv("OA_DEBUG", "true")
+	t.Setenv("OA_API_KEY", "from-the-environment")
+	t.Setenv("OA_TRUSTED_CSV_DIRECTORY", "/data/trusted")
+	var c Configuration
+	c.SetDefaults()
+	if err := c.ApplyEnvOverrides(); err != nil {
+		t.Fatalf("ApplyEnvOverrides: %v", err)
+	}
+	if c.Port != 8443 || !c.Debug || c.APIKey != "from-the-environment" || c.TrustedCSVLocation != "/data/trusted" || c.Hostname != "localhost" {
+		t.Errorf("config after the overrides = %+v", c)
+	}
+	overrides := EnvOverrides()
+	slices.Sort(overrides)
+	if want := []string{"OA_API_KEY", "OA_DEBUG", "OA_PORT", "OA_TRUSTED_CSV_DIRECTORY"}; !slices.Equal(overrides, want) {
+		t.Errorf("EnvOverrides = %v, want %v", overrides, want)
+	}
+
+	for name, value := range map[string]string{
+		"OA_PORT":           "nine thousand",
+		"OA_CERT_WARN_DAYS": "1.5",
+		"OA_DEBUG":          "maybe",
+		"OA_BACKUP_GZIP":    "",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			var c Configuration
+			err := c.ApplyEnvOverrides()
+			if err == nil || !strings.HasPrefix(err.Error(), name+" must be") {
+				t.Errorf("%s=%q: got %v", name, value, err)
+			}
+		})
+	}
+}
+
+// Every problem is reported at once, the apiServer settings only when server is true
+func TestValidateJoinsErrors(t *testing.T) {
+	c := validConfig(t)
+	notADirectory := filepath.Join(t.TempDir(), "importCSV")
+	if err := os.WriteFile(notADirectory, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.PendingLease = -1
+	c.PipelineWorkers = -1
+	c.EnrichGeoCSV = filepath.Join(t.TempDir(), "missing.csv")
+	c.TrustedCSVLocation = " "
+	c.ImportCSVLocation = notADirectory
+	shared := []string{
+		"pendingLeaseSeconds can not be negative",
+		"pipelineWorkers can not be negative",
+		"enrichGeoCSV:",
+		"trustedCSVDirectory is required",
+		"importCSVDirectory " + notADirectory + " is not a directory",
+	}
+
+	c.APIKey = "short"
+	c.AdminAPIKey = "short"
+	c.Hostname = ""
+	c.Port = 0
+	c.TLSCert = ""
+	c.CertCheckSeconds = -1
+	server := []string{
+		"apiKey must be at least",
+		"adminApiKey must be at least",
+		"hostname is required",
+		"port 0 must be between 1 and 65535",
+		"tlsCert is required",
+		"certRenewDays, certWarnDays and certCheckSeconds can not be negative",
+	}
+
+	checkErrors(t, "Validate(false)", c.Validate(false), shared, server)
+	checkErrors(t, "Validate(true)", c.Validate(true), append(shared, server...), nil)
+
+	// The keys are only compared when both are long enough
+	c = validConfig(t)
+	c.APIKey = defaultAPIKey
+	c.AdminAPIKey = defaultAPIKey
+	checkErrors(t, "default keys", c.Validate(true), []string{"apiKey is still the default value, set it in the config file or with OA_API_KEY", "adminApiKey must be different from apiKey"}, nil)
+
+	c = validConfig(t)
+	c.Store = "postgres"
+	c.DatabaseURL = ""
+	if err := c.Validate(false); err == nil || !strings.Contains(err.Error(), "databaseURL is required for the postgres store") {
+		t.Errorf("postgres without a databaseURL: %v", err)
+	}
+
+	if slices.Contains(StoreBackends(), "sqlite") {
+		c = validConfig(t)
+		c.Store = "sqlite"
+		c.DBPath = filepath.Join(t.TempDir(), "missing", "threatintel.sqlite")
+		c.DBBusyTimeout = -1
+		c.BackupKeep = -1
+		checkErrors(t, "sqlite", c.Validate(false), []string{"dbPath directory:", "dbBusyTimeoutSeconds can not be negative", "backupKeep can not be negative"}, nil)
+	}
+}
+
+// checkErrors checks that err joins exactly one error starting with each of want and none starting with unwanted
+func checkErrors(t *testing.T, name string, err error, want []string, unwanted []string) {
+	t.Helper()
+	var joined interface{ Unwrap() []error }
+	if !errors.As(err, &joined) {
+		t.Fatalf("%s: %v is not joined", name, err)
+	}
+	errs := joined.Unwrap()
+	if len(errs) != len(want) {
+		t.Errorf("%s: %d errors, want %d:\n%v", name, len(errs), len(want), err)
+	}
+	for _, prefix := range want {
+		if !slices.ContainsFunc(errs, func(e error) bool { return strings.HasPrefix(e.Error(), prefix) }) {
+			t.Errorf("%s: no error starting with %q in:\n%v", name, prefix, err)
+		}
+	}
+	for _, prefix := range unwanted {
+		if slices.ContainsFunc(errs, func(e error) bool { return strings.HasPrefix(e.Error(), prefix) }) {
+			t.Errorf("%s: unexpected error starting with %q", name, prefix)
+		}
+	}
+}
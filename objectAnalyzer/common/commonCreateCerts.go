@@ -44,6 +44,11 @@ import (
 	"time"
 )
 
+const (
+	certBackdateDays = 37                     // The NotBefore of a generated certificate is this far in the past
+	certLifetimeDays = 365 - certBackdateDays // Days a generated certificate is valid from when it is issued
+)
+
 type certConfig struct {
 	DNSNames   []string `json:"DNSNames"`
 	Org        string   `json:"Org"`
@@ -79,6 +84,15 @@ func CreateCertConfigFile(f string) {
 }
 
 func CreateCerts(c string, cert string, key string) {
+	err := GenerateCerts(c, cert, key)
+	CheckError("Failed to generate the certificate and private key", err, true)
+	fmt.Println("\nCertificate and private key generated successfully!")
+}
+
+// GenerateCerts creates a self-signed certificate and key from the JSON config c.
+// The files are written to a temporary name and renamed into place so a running
+// server watching them never reads a half written pair.
+func GenerateCerts(c string, cert string, key string) error {
 	//ConfigPtr := flag.String("config", "certConfig.json", "Location of the configuration file for certificate generation")
 	//flag.Parse()
 
@@ -87,26 +101,34 @@ func CreateCerts(c string, cert string, key string) {
 
 	// Read the configuration file
 	configFile, err := os.ReadFile(configLocation)
-	CheckError("Failed to read configuration file", err, true)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %w", err)
+	}
 
 	// Parse the configuration file
 	var certConfig certConfig
 	err = json.Unmarshal(configFile, &certConfig)
-	CheckError("Failed to parse configuration file", err, true)
+	if err != nil {
+		return fmt.Errorf("failed to parse configuration file: %w", err)
+	}
+	if len(certConfig.DNSNames) == 0 {
+		return fmt.Errorf("no DNSNames listed in %s", c)
+	}
 
 	fmt.Printf("Generating certificate and private key from %s...", c)
 
 	// Generate a new private key
 	privateKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
-	CheckError("Failed to generate private key", err, true)
+	if err != nil {
+		return fmt.Errorf("failed to generate private key: %w", err)
+	}
 
 	// Generate values for the below options in the x509 Cert
 	// Evaluated how evilginx2 did it in certdb.go
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		fmt.Printf("Failed to generate serial number: %v\n", err)
-		return
+		return fmt.Errorf("failed to generate serial number: %w", err)
 	}
 
 	// Create a certificate template with DNSNames (FQDN)
@@ -120,10 +142,10 @@ func CreateCerts(c string, cert string, key string) {
 			Province:           []string{certConfig.State},   // State
 			Country:            []string{certConfig.Country}, // Country,
 		},
-		NotBefore:             time.Now().Add(-37 * 24 * time.Hour),
-		NotAfter:              time.Now().Add((365 - 37) * 24 * time.Hour), // Valid for 1 year
+		NotBefore:             time.Now().Add(-certBackdateDays * 24 * time.Hour),
+		NotAfter:              time.Now().Add(certLifetimeDays * 24 * time.Hour), // Valid for 1 year
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		DNSNames:              []string{certConfig.DNSNames[0], certConfig.DNSNames[1]},
+		DNSNames:              certConfig.DNSNames,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 		EmailAddresses:        []string{certConfig.Email},
@@ -131,22 +153,35 @@ func CreateCerts(c string, cert string, key string) {
 
 	// Create a self-signed certificate
 	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
-	CheckError("Failed to create certificate: %v\n", err, true)
-
-	// Save the private key to a file
-	privateKeyFile, err := os.Create(currentDir + "/" + key)
-	CheckError("Failed to create private key file: %v\n", err, true)
-	defer privateKeyFile.Close()
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %w", err)
+	}
 
 	// Save the private key to a file
-	privKeyBytes, _ := x509.MarshalECPrivateKey(privateKey)
-	pem.Encode(privateKeyFile, &pem.Block{Type: "EC PRIVATE KEY", Bytes: privKeyBytes})
+	privKeyBytes, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to marshal private key: %w", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privKeyBytes})
+	if err := writeFileAtomic(currentDir+"/"+key, keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to save private key file: %w", err)
+	}
 
 	// Save the certificate to a file
-	certificateFile, err := os.Create(currentDir + "/" + cert)
-	CheckError("Failed to create certificate file: %v\n", err, true)
-	defer certificateFile.Close()
-	pem.Encode(certificateFile, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	if err := writeFileAtomic(currentDir+"/"+cert, certPEM, 0644); err != nil {
+		return fmt.Errorf("failed to save certificate file: %w", err)
+	}
 	fmt.Println("Saved the certificate and key")
-	fmt.Println("\nCertificate and private key generated successfully!")
+
+	return nil
+}
+
+// writeFileAtomic writes data next to f and renames it over f
+func writeFileAtomic(f string, data []byte, perm os.FileMode) error {
+	tmpFile := f + ".tmp"
+	if err := os.WriteFile(tmpFile, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, f)
 }
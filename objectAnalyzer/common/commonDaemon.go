@@ -0,0 +1,313 @@
+package common
+
+// The stages of the workerBee and the scheduler of workerBee -daemon
+//
+// A one-shot run goes through the stages selected by its flags in the order of
+// Stages.  The daemon runs each stage on its interval in the stage_intervals
+// setting, read again whenever a stage is due, so an interval changed through
+// the admin API applies without a restart.  A stage still running when it is
+// due again is skipped, a failed stage is retried after a backoff that doubles
+// with each failure.  Every run is recorded in stage_runs.
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	StageImportCSV      = "import_csv"
+	StageProcessImports = "process_imports"
+	StageTrustedCSV     = "trusted_csv"
+	StageMarkTrusted    = "mark_trusted"
+	StageRescore        = "rescore"
+	StagePrune          = "prune"
+	StageBackup         = "backup"
+	StageEnrich         = "enrich"
+
+	StageStatusOK      = "ok"
+	StageStatusFailed  = "failed"
+	StageStatusSkipped = "skipped" // The previous run was still going
+
+	daemonTick          = time.Second
+	daemonMaxBackoff    = time.Hour   // The longest wait after a failure, unless the interval is longer
+	daemonDisabledCheck = time.Minute // How often a stage with an interval of 0 is checked again
+
+	defaultStageRunLimit = 50
+	maxStageRunLimit     = 1000
+)
+
+var stageNames = []string{StageImportCSV, StageProcessImports, StageTrustedCSV, StageMarkTrusted, StageEnrich, StageRescore, StagePrune, StageBackup}
+
+type StageRunsResponse struct {
+	Runs []StageRun `json:"runs"`
+}
+
+// Stage is a step of the workerBee, only process_imports stops early when ctx is cancelled
+type Stage struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// withoutContext runs a stage that always runs to the end
+func withoutContext(run func() error) func(context.Context) error {
+	return func(context.Context) error { return run() }
+}
+
+// StageRun is a run of a stage recorded in stage_runs
+type StageRun struct {
+	Stage      string `json:"stage"`
+	Status     string `json:"status" enum:"ok,failed,skipped"`
+	Error      string `json:"error,omitempty"`
+	StartedAt  string `json:"started_at"`
+	FinishedAt string `json:"finished_at"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// Stages returns the stages of the workerBee in the order of a one-shot run
+func (s *ServerConfig) Stages() []Stage {
+	return []Stage{
+		{Name: StageImportCSV, Run: withoutContext(func() error {
+			if err := createCSVDirectory(s.Config().ImportCSVLocation); err != nil {
+				return err
+			}
+			return s.LoadImportObjectsFromCSV()
+		})},
+		{Name: StageProcessImports, Run: s.ProcessPendingImports},
+		{Name: StageTrustedCSV, Run: withoutContext(func() error {
+			if err := createCSVDirectory(s.Config().TrustedCSVLocation); err != nil {
+				return err
+			}
+			return s.LoadTrustedObjectsFromCSV()
+		})},
+		{Name: StageMarkTrusted, Run: withoutContext(s.MarkTrustedObjects)},
+		{Name: StageEnrich, Run: s.EnrichObjects},
+		{Name: StageRescore, Run: withoutContext(s.UpdateObjectIntelRiskScores)},
+		{Name: StagePrune, Run: withoutContext(func() error {
+			_, err := s.Prune(false)
+			return err
+		})},
+		{Name: StageBackup, Run: withoutContext(func() error {
+			backup, err := s.BackupDatabase()
+			if err != nil {
+				return err
+			}
+			log.Printf("Database backed up to %s (%d bytes)\n", backup.Path, backup.SizeBytes)
+			for _, name := range backup.Removed {
+				log.Printf("Removed the old backup %s\n", name)
+			}
+			return nil
+		})},
+	}
+}
+
+// isStage reports whether name is one of the stages
+func isStage(name string) bool {
+	for _, stage := range stageNames {
+		if stage == name {
+			return true
+		}
+	}
+	return false
+}
+
+// createCSVDirectory creates a CSV directory, unlike CreateDirectory it returns the error instead of exiting
+func createCSVDirectory(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create the directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+// RunStage runs a stage and records it in stage_runs, a panic of the stage is returned as an error
+func (s *ServerConfig) RunStage(ctx context.Context, stage Stage) (err error) {
+	started := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+		finished := time.Now()
+		run := StageRun{
+			Stage:      stage.Name,
+			Status:     StageStatusOK,
+			StartedAt:  formatSightingTime(started),
+			FinishedAt: formatSightingTime(finished),
+			DurationMS: finished.Sub(started).Milliseconds(),
+		}
+		if err != nil {
+			run.Status = StageStatusFailed
+			run.Error = err.Error()
+			log.Printf("Stage %s failed after %s: %v\n", stage.Name, finished.Sub(started).Round(time.Millisecond), err)
+		} else if s.Config().Debug {
+			log.Printf("Stage %s finished in %s\n", stage.Name, finished.Sub(started).Round(time.Millisecond))
+		}
+		if recordErr := s.Store.RecordStageRun(run); recordErr != nil {
+			log.Printf("Failed to record the run of stage %s: %v\n", stage.Name, recordErr)
+		}
+	}()
+	return stage.Run(ctx)
+}
+
+// stageBackoff is the wait before retrying a stage that failed failures times in a row
+func stageBackoff(interval time.Duration, failures int) time.Duration {
+	limit := max(interval, daemonMaxBackoff)
+	backoff := interval
+	for i := 0; i < failures && backoff < limit; i++ {
+		backoff *= 2
+	}
+	return min(backoff, limit)
+}
+
+// lastStageStart returns when a stage last started, the zero time when it never ran
+func (s *ServerConfig) lastStageStart(stage string) time.Time {
+	runs, err := s.Store.StageRuns(stage, 1)
+	if err != nil || len(runs) == 0 {
+		return time.Time{}
+	}
+	for _, layout := range []string{sightingTimeLayout, time.RFC3339Nano} {
+		if started, err := time.ParseInLocation(layout, runs[0].StartedAt, time.UTC); err == nil {
+			return started
+		}
+	}
+	return time.Time{}
+}
+
+type daemonStage struct {
+	stage    Stage
+	next     time.Time     // When the stage is due
+	interval time.Duration // The interval of the current or last run
+	failures int           // Failed runs in a row
+	running  bool
+}
+
+// RunDaemon runs each stage on its interval until ctx is cancelled, then waits for the running stages to finish
+// process_imports stops at the next batch and releases the rows it claimed
+// A stage that already ran is next due an interval after its last recorded start, so a restart does not repeat a daily prune or backup
+func (s *ServerConfig) RunDaemon(ctx context.Context) error {
+	initial, err := s.GetSettings()
+	if err != nil {
+		return fmt.Errorf("failed to load settings: %w", err)
+	}
+	var stages []*daemonStage
+	for _, stage := range s.Stages() {
+		next := time.Now()
+		if last := s.lastStageStart(stage.Name); !last.IsZero() {
+			next = last.Add(initial.StageIntervals.Interval(stage.Name))
+		}
+		stages = append(stages, &daemonStage{stage: stage, next: next})
+	}
+
+	results := make(chan *daemonStage)
+	running := 0
+	ticker := time.NewTicker(daemonTick)
+	defer ticker.Stop()
+	log.Printf("workerBee daemon started with %d stages\n", len(stages))
+
+	for {
+		select {
+		case <-ctx.Done():
+			if running > 0 {
+				log.Printf("Stopping, waiting for %d running stages to finish\n", running)
+			}
+			for ; running > 0; running-- {
+				<-results
+			}
+			log.Println("workerBee daemon stopped")
+			return nil
+
+		case ds := <-results:
+			running--
+			ds.running = false
+			if ds.failures == 0 {
+				continue
+			}
+			ds.next = time.Now().Add(stageBackoff(ds.interval, ds.failures))
+			log.Printf("Stage %s failed %d times in a row, retrying at %s\n", ds.stage.Name, ds.failures, ds.next.Format(time.TimeOnly))
+
+		case now := <-ticker.C:
+			var settings *Settings
+			for _, ds := range stages {
+				if now.Before(ds.next) {
+					continue
+				}
+				if settings == nil {
+					loaded, err := s.GetSettings()
+					if err != nil {
+						log.Printf("Failed to load settings, the due stages wait for %s: %v\n", daemonDisabledCheck, err)
+						for _, due := range stages {
+							if !now.Before(due.next) {
+								due.next = now.Add(daemonDisabledCheck)
+							}
+						}
+						break
+					}
+					settings = &loaded
+				}
+
+				interval := settings.StageIntervals.Interval(ds.stage.Name)
+				if interval == 0 {
+					ds.next = now.Add(daemonDisabledCheck)
+					continue
+				}
+				// Runs are an interval apart from their start, a run that takes longer skips the next one
+				ds.next = now.Add(interval)
+				if ds.running {
+					log.Printf("Skipping stage %s, the previous run is still going\n", ds.stage.Name)
+					run := StageRun{Stage: ds.stage.Name, Status: StageStatusSkipped, StartedAt: formatSightingTime(now), FinishedAt: formatSightingTime(now)}
+					if err := s.Store.RecordStageRun(run); err != nil {
+						log.Printf("Failed to record the run of stage %s: %v\n", ds.stage.Name, err)
+					}
+					continue
+				}
+
+				ds.interval = interval
+				ds.running = true
+				running++
+				go func(ds *daemonStage) {
+					if err := s.RunStage(ctx, ds.stage); err != nil {
+						ds.failures++
+					} else {
+						ds.failures = 0
+					}
+					results <- ds
+				}(ds)
+			}
+		}
+	}
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/stages/runs?stage=rescore&limit=10" -H "X-API-Key: theadminapikey"
+func (s *ServerConfig) HandleStageRuns(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	stage := strings.TrimSpace(query.Get("stage"))
+	if stage != "" && !isStage(stage) {
+		http.Error(w, fmt.Sprintf("stage must be one of %s", strings.Join(stageNames, ", ")), http.StatusBadRequest)
+		return
+	}
+	limit := defaultStageRunLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxStageRunLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxStageRunLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	runs, err := s.Store.StageRuns(stage, limit)
+	if err != nil {
+		log.Printf("Listing the stage runs failed: %v\n", err)
+		http.Error(w, "Failed to list the stage runs", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, StageRunsResponse{Runs: runs})
+}
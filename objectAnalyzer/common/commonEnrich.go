@@ -0,0 +1,383 @@
+package common
+
+// Enrichers add attributes to the objects, like the geo fields and the ASN
+//
+// An Enricher is registered by name, the workerBee/processor package registers
+// the ones of the workerBee.  The enrichment setting enables them for each
+// object type, in order, and sets the timeout of a lookup and how long its
+// result is cached.  The workerBee enriches the rows it processes and the
+// enrich stage looks up again the objects enriched refresh_days ago.
+//
+// The first enricher to return a geo field sets it, the fields no enricher
+// returned are left as they are.  The Info of each enricher is saved in
+// enrichment_info as a JSON object under its name, object_additionalInfo is
+// only set by the submitter.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const maxEnrichCacheEntries = 100000 // Lookups cached across the enrichers
+
+// Attributes is what an enricher found about an object, an empty field is left as it is
+type Attributes struct {
+	GeoRegion  string
+	GeoCountry string
+	GeoOrg     string
+	GeoASN     string
+	Info       map[string]string // Saved in enrichment_info under the name of the enricher
+}
+
+// Enricher looks up an object, it should return when ctx is done
+type Enricher interface {
+	Name() string
+	Enrich(ctx context.Context, object string, objectType string) (Attributes, error)
+}
+
+// EnricherOpener creates an enricher from the configuration of the workerBee
+type EnricherOpener func(c Configuration) (Enricher, error)
+
+var (
+	enrichersMu sync.RWMutex
+	enrichers   = map[string]EnricherOpener{}
+)
+
+// RegisterEnricher adds an enricher that the enrichment setting can name, an existing enricher with the same name is replaced
+func RegisterEnricher(name string, open EnricherOpener) {
+	enrichersMu.Lock()
+	defer enrichersMu.Unlock()
+	enrichers[name] = open
+}
+
+// EnricherNames lists the enrichers in this build
+func EnricherNames() []string {
+	enrichersMu.RLock()
+	defer enrichersMu.RUnlock()
+	names := make([]string, 0, len(enrichers))
+	for name := range enrichers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Enrichment is the combined attributes of the enrichers of an object
+type Enrichment struct {
+	GeoRegion  string
+	GeoCountry string
+	GeoOrg     string
+	GeoASN     string
+	Info       string // JSON object of the Info of each enricher by name, empty when none returned any
+}
+
+// ObjectEnrichment is the enrichment of an object saved by the enrich stage
+type ObjectEnrichment struct {
+	Object string
+	Enrichment
+}
+
+// ObjectRef names an object the enrich stage looks up
+type ObjectRef struct {
+	Object     string
+	ObjectType string
+}
+
+// enrichState is kept by the ServerConfig across the runs of the workerBee -daemon
+type enrichState struct {
+	mu     sync.Mutex
+	opened map[string]Enricher
+	failed map[string]bool // Enrichers that failed to open, logged once
+	cache  map[string]enrichCacheEntry
+}
+
+type enrichCacheEntry struct {
+	attributes Attributes
+	expires    time.Time
+}
+
+// enricher returns the opened enricher of a name, nil when it is not in this build or failed to open
+func (s *ServerConfig) enricher(name string) Enricher {
+	st := &s.enrich
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if e, ok := st.opened[name]; ok {
+		return e
+	}
+	if st.failed[name] {
+		return nil
+	}
+	if st.opened == nil {
+		st.opened = map[string]Enricher{}
+		st.failed = map[string]bool{}
+	}
+
+	enrichersMu.RLock()
+	open, ok := enrichers[name]
+	enrichersMu.RUnlock()
+	if !ok {
+		log.Printf("Enricher %s is not in this build, available: %v\n", name, EnricherNames())
+		st.failed[name] = true
+		return nil
+	}
+	e, err := open(s.Config())
+	if err != nil {
+		log.Printf("Enricher %s failed to open and is skipped: %v\n", name, err)
+		st.failed[name] = true
+		return nil
+	}
+	st.opened[name] = e
+	return e
+}
+
+func (s *ServerConfig) cachedAttributes(key string) (Attributes, bool) {
+	st := &s.enrich
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	entry, ok := st.cache[key]
+	if !ok || time.Now().After(entry.expires) {
+		return Attributes{}, false
+	}
+	return entry.attributes, true
+}
+
+func (s *ServerConfig) cacheAttributes(key string, attributes Attributes, ttl time.Duration) {
+	st := &s.enrich
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.cache == nil {
+		st.cache = map[string]enrichCacheEntry{}
+	}
+	if len(st.cache) >= maxEnrichCacheEntries {
+		now := time.Now()
+		for k, entry := range st.cache {
+			if now.After(entry.expires) {
+				delete(st.cache, k)
+			}
+		}
+		// Still full of live entries, start over rather than track their use
+		if len(st.cache) >= maxEnrichCacheEntries {
+			clear(st.cache)
+		}
+	}
+	st.cache[key] = enrichCacheEntry{attributes: attributes, expires: time.Now().Add(ttl)}
+}
+
+// enrichRun runs the enrichers of a stage run and counts the lookups that failed
+type enrichRun struct {
+	s        *ServerConfig
+	byType   map[string][]Enricher
+	timeout  time.Duration
+	cacheTTL time.Duration
+	failures atomic.Int64
+	timeouts atomic.Int64
+}
+
+// newEnrichRun opens the enrichers enabled in the settings, nil when none are enabled
+func (s *ServerConfig) newEnrichRun(settings EnrichmentSettings) *enrichRun {
+	run := &enrichRun{
+		s:        s,
+		byType:   map[string][]Enricher{},
+		timeout:  time.Duration(settings.TimeoutMS) * time.Millisecond,
+		cacheTTL: time.Duration(settings.CacheMinutes) * time.Minute,
+	}
+	for objectType, names := range settings.ObjectTypes {
+		for _, name := range names {
+			if e := s.enricher(name); e != nil {
+				run.byType[objectType] = append(run.byType[objectType], e)
+			}
+		}
+	}
+	if len(run.byType) == 0 {
+		return nil
+	}
+	return run
+}
+
+// lookup runs an enricher with the timeout, even when it does not watch ctx
+func (run *enrichRun) lookup(ctx context.Context, e Enricher, object string, objectType string) (Attributes, error) {
+	key := e.Name() + "\x00" + objectType + "\x00" + object
+	if run.cacheTTL > 0 {
+		if attributes, ok := run.s.cachedAttributes(key); ok {
+			return attributes, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, run.timeout)
+	defer cancel()
+	type result struct {
+		attributes Attributes
+		err        error
+	}
+	done := make(chan result, 1)
+	go func() {
+		attributes, err := e.Enrich(ctx, object, objectType)
+		done <- result{attributes, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return r.attributes, r.err
+		}
+		if run.cacheTTL > 0 {
+			run.s.cacheAttributes(key, r.attributes, run.cacheTTL)
+		}
+		return r.attributes, nil
+	case <-ctx.Done():
+		return Attributes{}, ctx.Err()
+	}
+}
+
+// enrich runs the enrichers of the object type in order, nil when the type has none or every lookup failed
+func (run *enrichRun) enrich(ctx context.Context, object string, objectType string) *Enrichment {
+	list := run.byType[objectType]
+	if len(list) == 0 {
+		return nil
+	}
+	var enrichment Enrichment
+	info := map[string]map[string]string{}
+	found := false
+	for _, e := range list {
+		attributes, err := run.lookup(ctx, e, object, objectType)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				run.timeouts.Add(1)
+			} else {
+				run.failures.Add(1)
+			}
+			if run.s.Config().Debug {
+				log.Printf("Enricher %s failed on %s: %v\n", e.Name(), object, err)
+			}
+			continue
+		}
+		found = true
+		for _, field := range []struct {
+			value string
+			dest  *string
+		}{
+			{attributes.GeoRegion, &enrichment.GeoRegion},
+			{attributes.GeoCountry, &enrichment.GeoCountry},
+			{attributes.GeoOrg, &enrichment.GeoOrg},
+			{attributes.GeoASN, &enrichment.GeoASN},
+		} {
+			if *field.dest == "" {
+				*field.dest = field.value
+			}
+		}
+		if len(attributes.Info) > 0 {
+			info[e.Name()] = attributes.Info
+		}
+	}
+	if !found {
+		return nil
+	}
+	if len(info) > 0 {
+		data, err := json.Marshal(info)
+		if err == nil {
+			enrichment.Info = string(data)
+		}
+	}
+	return &enrichment
+}
+
+// logFailures reports the lookups of the run that failed or timed out
+func (run *enrichRun) logFailures() {
+	if failures, timeouts := run.failures.Load(), run.timeouts.Load(); failures > 0 || timeouts > 0 {
+		log.Printf("%d enrichment lookups failed and %d timed out after %s\n", failures, timeouts, run.timeout)
+	}
+}
+
+// EnrichObjects looks up again the objects of the enabled object types that were never enriched
+// or enriched more than refresh_days ago, up to the batch limit of the enrichment setting
+func (s *ServerConfig) EnrichObjects(ctx context.Context) error {
+	settings, err := s.GetSettings()
+	if err != nil {
+		return fmt.Errorf("failed to load settings: %w", err)
+	}
+	run := s.newEnrichRun(settings.Enrichment)
+	if run == nil {
+		if s.Config().Debug {
+			log.Println("No enrichers are enabled")
+		}
+		return nil
+	}
+
+	// A refresh_days of 0 only enriches the objects never enriched
+	var before time.Time
+	if days := settings.Enrichment.RefreshDays; days > 0 {
+		before = time.Now().AddDate(0, 0, -days)
+	}
+	objects, err := s.Store.ObjectsToEnrich(sortedKeys(run.byType), before, settings.Enrichment.BatchLimit)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return nil
+	}
+
+	started := time.Now()
+	in := make(chan ObjectRef)
+	out := make(chan ObjectEnrichment, pipelineBuffer)
+	var wg sync.WaitGroup
+	for i := 0; i < s.pipelineWorkers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ref := range in {
+				if enrichment := run.enrich(ctx, ref.Object, ref.ObjectType); enrichment != nil {
+					out <- ObjectEnrichment{Object: ref.Object, Enrichment: *enrichment}
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(in)
+		for _, ref := range objects {
+			select {
+			case in <- ref:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	// The objects every enricher failed on are not saved, so they are looked up again on the next run
+	saved := 0
+	var batch []ObjectEnrichment
+	var saveErr error
+	for enrichment := range out {
+		if saveErr != nil {
+			continue
+		}
+		batch = append(batch, enrichment)
+		if len(batch) == pipelineWriteSize {
+			saveErr = s.Store.SaveEnrichments(batch, time.Now())
+			saved += len(batch)
+			batch = batch[:0]
+		}
+	}
+	if saveErr == nil && len(batch) > 0 {
+		saveErr = s.Store.SaveEnrichments(batch, time.Now())
+		saved += len(batch)
+	}
+	run.logFailures()
+	if saveErr != nil {
+		return saveErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	log.Printf("Enriched %d of %d objects in %s\n", saved, len(objects), time.Since(started).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,258 @@
+package common
+
+// Import batches, every import request, upload and CSV file loaded by the workerBee
+//
+// The rows of a batch wait in pending_import with its batch_id.  A workerBee
+// records the outcome of each row in import_batch_rows as it applies them and
+// marks the batch finished when none of its rows are left pending.
+//
+// An admin can roll back a batch of a bad feed.  Its pending rows and
+// sightings are deleted, the occurrences it added are taken off its objects
+// and first_seen and last_seen are taken from the sightings left.  An object
+// only seen in the batch is deleted with its history.  The notes and geo
+// fields the batch overwrote are not restored.
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	ImportSourceAPI    = "api"
+	ImportSourceJSON   = "json"
+	ImportSourceUpload = "upload"
+	ImportSourceCSV    = "csv"
+
+	ImportStatusQueued          = "queued"
+	ImportStatusProcessing      = "processing"
+	ImportStatusDone            = "done"
+	ImportStatusPartiallyFailed = "partially_failed"
+	ImportStatusRolledBack      = "rolled_back"
+
+	ImportRowAccepted = "accepted"
+	ImportRowRejected = "rejected"
+
+	defaultImportRowLimit = 1000
+	maxImportRowLimit     = 100000
+)
+
+// ErrRolledBack is returned when rolling back a batch that was already rolled back
+var ErrRolledBack = errors.New("the import batch was already rolled back")
+
+type ImportBatch struct {
+	ID           int64  `json:"id"`
+	Source       string `json:"source" enum:"api,json,upload,csv"`
+	SubmittedBy  string `json:"submitted_by"` // Prefix of the API key, apiKey or adminApiKey for the keys of the config, workerBee for its CSV directory
+	FileName     string `json:"file_name,omitempty"`
+	Status       string `json:"status" enum:"queued,processing,done,partially_failed,rolled_back"`
+	TotalRows    int    `json:"total_rows"`
+	Accepted     int    `json:"accepted"`
+	Rejected     int    `json:"rejected"`
+	Pending      int    `json:"pending"`
+	Purged       int    `json:"purged"` // Deleted from pending_import by an admin before a workerBee processed them
+	CreatedAt    string `json:"created_at"`
+	StartedAt    string `json:"started_at,omitempty"`
+	FinishedAt   string `json:"finished_at,omitempty"`
+	RolledBackAt string `json:"rolled_back_at,omitempty"`
+}
+
+// ImportBatchRow is the outcome of a row, Row counts from 1 in the order the rows were sent
+type ImportBatchRow struct {
+	Row         int    `json:"row"`
+	Object      string `json:"object"`
+	ObjectType  string `json:"object_type"`
+	Outcome     string `json:"outcome" enum:"accepted,rejected"`
+	Reason      string `json:"reason,omitempty"`
+	ProcessedAt string `json:"processed_at"`
+}
+
+type ImportBatchResponse struct {
+	ImportBatch
+	Rows []ImportBatchRow `json:"rows"`
+}
+
+// ImportResponse is returned by the import endpoints, poll GET /api/import/{batch_id} for the outcome
+type ImportResponse struct {
+	Status  string `json:"status"`
+	BatchID int64  `json:"batch_id"`
+	Rows    int    `json:"rows"`
+}
+
+// RollbackResult is what rolling back a batch removed, or would remove in a dry run
+type RollbackResult struct {
+	BatchID        int64            `json:"batch_id"`
+	DryRun         bool             `json:"dry_run"`
+	PendingRows    int64            `json:"pending_rows"` // Rows of the batch no workerBee had processed yet
+	Sightings      int64            `json:"sightings"`
+	ObjectsUpdated int              `json:"objects_updated"`
+	ObjectsDeleted int              `json:"objects_deleted"` // Objects only seen in the batch
+	Rescored       int              `json:"rescored"`        // Updated objects scored again after the rollback
+	Objects        []RollbackObject `json:"objects"`
+}
+
+// RollbackObject is an object an accepted row of the batch added an occurrence to
+type RollbackObject struct {
+	Object          string `json:"object"`
+	Occurrences     int    `json:"occurrences"`      // Occurrences taken off
+	OccurrenceCount int    `json:"occurrence_count"` // Left after the rollback
+	FirstSeen       string `json:"first_seen,omitempty"`
+	LastSeen        string `json:"last_seen,omitempty"`
+	Deleted         bool   `json:"deleted"`
+}
+
+// RejectedImport is a pending row the workerBee did not accept and why
+type RejectedImport struct {
+	PendingImport
+	Reason string
+}
+
+// setStatus derives the status and the purged rows from the counts and times of the batch
+func (b *ImportBatch) setStatus() {
+	b.Purged = max(0, b.TotalRows-b.Accepted-b.Rejected-b.Pending)
+	switch {
+	case b.RolledBackAt != "":
+		b.Status = ImportStatusRolledBack
+	case b.FinishedAt == "" && b.StartedAt == "":
+		b.Status = ImportStatusQueued
+	case b.FinishedAt == "":
+		b.Status = ImportStatusProcessing
+	case b.Rejected > 0 || b.Purged > 0:
+		b.Status = ImportStatusPartiallyFailed
+	default:
+		b.Status = ImportStatusDone
+	}
+}
+
+// submitter names the key of an import in its batch without storing the key
+func (s *ServerConfig) submitter(apiKey string) string {
+	cfg := s.Config()
+	if subtle.ConstantTimeCompare([]byte(apiKey), []byte(cfg.APIKey)) == 1 {
+		return "apiKey"
+	}
+	if cfg.AdminAPIKey != "" && subtle.ConstantTimeCompare([]byte(apiKey), []byte(cfg.AdminAPIKey)) == 1 {
+		return "adminApiKey"
+	}
+	// The prefix listed by GET /api/admin/keys
+	if len(apiKey) > apiKeyPrefixLen {
+		return apiKey[:apiKeyPrefixLen]
+	}
+	return "unknown"
+}
+
+// writeImportResponse answers an import with the ID of its batch
+func writeImportResponse(w http.ResponseWriter, batchID int64, rows int) {
+	writeJSON(w, ImportResponse{Status: "import successful", BatchID: batchID, Rows: rows})
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/import/12?outcome=rejected" -H "X-API-Key: testingtheapikey"
+func (s *ServerConfig) HandleImportBatch(w http.ResponseWriter, r *http.Request) {
+	if !s.apiKeyAuthorized(w, r) {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		http.Error(w, "Invalid batch ID", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	outcome := strings.TrimSpace(query.Get("outcome"))
+	if outcome != "" && outcome != ImportRowAccepted && outcome != ImportRowRejected {
+		http.Error(w, "outcome must be accepted or rejected", http.StatusBadRequest)
+		return
+	}
+	limit := defaultImportRowLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > maxImportRowLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 0 and %d", maxImportRowLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	batch, err := s.Store.ImportBatch(id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "No import batch with this ID", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to read import batch %d: %v\n", id, err)
+		http.Error(w, "Failed to retrieve the import batch", http.StatusInternalServerError)
+		return
+	}
+	response := ImportBatchResponse{ImportBatch: batch, Rows: []ImportBatchRow{}}
+	if limit > 0 {
+		if response.Rows, err = s.Store.ImportBatchRows(id, outcome, limit); err != nil {
+			log.Printf("Failed to read the rows of import batch %d: %v\n", id, err)
+			http.Error(w, "Failed to retrieve the import batch", http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, response)
+}
+
+// RollbackImportBatch reverts a batch and scores the objects it changed again, a dry run only reports the impact
+// Objects that fail to score are left for the rescore stage of the workerBee
+func (s *ServerConfig) RollbackImportBatch(id int64, dryRun bool) (RollbackResult, error) {
+	result, err := s.Store.RollbackImportBatch(id, dryRun)
+	if err != nil || dryRun {
+		return result, err
+	}
+	log.Printf("Rolled back import batch %d: %d pending rows, %d sightings, %d objects updated and %d deleted\n",
+		id, result.PendingRows, result.Sightings, result.ObjectsUpdated, result.ObjectsDeleted)
+
+	var objects []string
+	for _, object := range result.Objects {
+		if !object.Deleted {
+			objects = append(objects, object.Object)
+		}
+	}
+	settings, err := s.GetSettings()
+	if err == nil {
+		err = s.rescoreObjects(settings, objects)
+	}
+	if err != nil {
+		log.Printf("Rescoring the objects of import batch %d failed, the workerBee rescores them: %v\n", id, err)
+		return result, nil
+	}
+	result.Rescored = len(objects)
+	return result, nil
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/imports/12/rollback?dry_run=true" -X POST -H "X-API-Key: theadminapikey"
+func (s *ServerConfig) HandleRollbackImportBatch(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		http.Error(w, "Invalid batch ID", http.StatusBadRequest)
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	result, err := s.RollbackImportBatch(id, dryRun)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrNotFound):
+			http.Error(w, "No import batch with this ID", http.StatusNotFound)
+		case errors.Is(err, ErrRolledBack):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			log.Printf("Rolling back import batch %d failed: %v\n", id, err)
+			http.Error(w, "Failed to roll back the import batch", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !dryRun {
+		log.Printf("Import batch %d rolled back, requested by %s\n", id, r.RemoteAddr)
+	}
+	writeJSON(w, result)
+}
@@ -0,0 +1,75 @@
+package common
+
+// Leases on the pending_import rows, so several workerBees can share the table
+//
+// A worker claims a batch of rows for pendingLeaseSeconds and extends the
+// lease while it works on them.  A row is only applied by the worker that
+// still holds its claim, in the transaction that deletes it, so a row is never
+// counted twice.  The rows of a worker that stops before applying them are
+// claimed again by the next worker once the lease has passed.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	defaultPendingLeaseSeconds = 300
+	pendingClaimSize           = 1000 // Rows claimed at a time, the other workers claim the ones after them
+)
+
+// defaultWorkerID is the host name and process ID, unique for each workerBee running
+var defaultWorkerID = func() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "workerBee"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}()
+
+// WorkerID names this workerBee in the claims of the pending rows
+func (s *ServerConfig) WorkerID() string {
+	if id := s.Config().WorkerID; id != "" {
+		return id
+	}
+	return defaultWorkerID
+}
+
+// pendingLease is how long a claim on pending rows lasts without a heartbeat
+func (s *ServerConfig) pendingLease() time.Duration {
+	seconds := s.Config().PendingLease
+	if seconds == 0 {
+		seconds = defaultPendingLeaseSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// holdLease extends the lease of worker every third of the lease until the returned function is called
+func (s *ServerConfig) holdLease(worker string, lease time.Duration) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				held, err := s.Store.ExtendPendingLease(worker, lease)
+				if err != nil {
+					log.Printf("Failed to extend the lease of %s: %v\n", worker, err)
+				} else if held == 0 {
+					log.Printf("%s no longer holds any pending rows, another worker claimed them\n", worker)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
@@ -0,0 +1,438 @@
+package common
+
+// Versioned schema migrations
+//
+// Migrations are the SQL files in migrations/, embedded in the binary, and the
+// Go functions in goMigrations for changes SQL cannot make safely, like adding
+// a column that a database may already have.  They are applied in order of
+// their version, each in a transaction with its row in schema_migrations.
+// Migrations are up only, a change to the schema is a new migration and an
+// applied migration is never edited, its checksum is verified on every start.
+//
+// The apiServer and workerBee apply the pending migrations when they start,
+// holding the row in schema_lock so only one process migrates at a time.  A
+// database migrated by a newer version is refused.
+//
+// Each SQL backend has its own migrations, PostgreSQL starts from the current
+// schema in migrations/postgres.  The memory store has no schema to migrate.
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	migrationLockTimeout = 2 * time.Minute  // Wait this long for another process to finish migrating
+	migrationLockStale   = 30 * time.Minute // A lock older than this was left by a process that died
+
+	MigrationApplied  = "applied"
+	MigrationPending  = "pending"
+	MigrationModified = "modified" // Applied, but the migration in this build has a different checksum
+	MigrationUnknown  = "unknown"  // Applied by a newer version
+)
+
+// The SQLite migrations, the PostgreSQL ones in migrations/postgres are only embedded by builds with -tags postgres
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var migrationFilePattern = regexp.MustCompile(`^([0-9]+)_([a-z0-9_]+)\.sql$`)
+
+var ErrSchemaTooNew = errors.New("the database schema is newer than this version")
+
+type migration struct {
+	Version  int
+	Name     string
+	Checksum string
+	SQL      string
+	Func     func(tx sqlTx) error
+}
+
+// Migrations of SQLite written in Go, the checksum is of the version and name because the code cannot be hashed
+var goMigrations = []migration{
+	{Version: 2, Name: "verdicts", Func: migrateVerdicts},
+	{Version: 3, Name: "sightings", Func: migrateSightings},
+}
+
+type MigrationState struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	State     string `json:"state" enum:"applied,pending,modified,unknown"`
+	Checksum  string `json:"checksum"`
+	AppliedAt string `json:"applied_at,omitempty"`
+}
+
+// loadMigrations returns the SQL migrations in dir and the Go migrations ordered by version
+func loadMigrations(files fs.FS, dir string, goMigrations []migration) ([]migration, error) {
+	var migrations []migration
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the embedded migrations: %w", err)
+	}
+	for _, file := range entries {
+		if file.IsDir() {
+			continue
+		}
+		match := migrationFilePattern.FindStringSubmatch(file.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>.sql", file.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		data, err := fs.ReadFile(files, path.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", file.Name(), err)
+		}
+		sum := sha256.Sum256(data)
+		migrations = append(migrations, migration{Version: version, Name: match[2], Checksum: hex.EncodeToString(sum[:]), SQL: string(data)})
+	}
+	for _, m := range goMigrations {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("go:%d:%s", m.Version, m.Name)))
+		m.Checksum = hex.EncodeToString(sum[:])
+		migrations = append(migrations, m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("migrations %s and %s have the same version %d", migrations[i-1].Name, migrations[i].Name, migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+// ensureMigrationTables creates the tables that track the migrations, they are never migrated themselves
+func ensureMigrationTables(db sqlDB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER NOT NULL PRIMARY KEY,
+			name VARCHAR NOT NULL,
+			checksum VARCHAR NOT NULL,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_lock (
+			id INTEGER NOT NULL PRIMARY KEY CHECK (id = 1),
+			holder VARCHAR NOT NULL,
+			acquired_at TIMESTAMP NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_lock table: %w", err)
+	}
+	return nil
+}
+
+// acquireMigrationLock waits for the row in schema_lock, other processes migrating the same database hold it
+func acquireMigrationLock(db sqlDB) (func(), error) {
+	hostname, _ := os.Hostname()
+	holder := fmt.Sprintf("%s:%d", hostname, os.Getpid())
+	deadline := time.Now().Add(migrationLockTimeout)
+	for {
+		_, err := db.Exec(`DELETE FROM schema_lock WHERE acquired_at < ?`, formatSightingTime(time.Now().Add(-migrationLockStale)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to clear a stale schema_lock: %w", err)
+		}
+		result, err := db.Exec(`INSERT INTO schema_lock (id, holder, acquired_at) VALUES (1, ?, CURRENT_TIMESTAMP) ON CONFLICT (id) DO NOTHING`, holder)
+		if err != nil {
+			return nil, fmt.Errorf("failed to acquire schema_lock: %w", err)
+		}
+		if n, err := result.RowsAffected(); err == nil && n == 1 {
+			release := func() {
+				if _, err := db.Exec(`DELETE FROM schema_lock WHERE id = 1 AND holder = ?`, holder); err != nil {
+					log.Printf("Failed to release schema_lock: %v\n", err)
+				}
+			}
+			return release, nil
+		}
+
+		var current string
+		db.QueryRow(`SELECT holder FROM schema_lock WHERE id = 1`).Scan(&current)
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for schema_lock held by %s", current)
+		}
+		log.Printf("Waiting for %s to finish migrating the database\n", current)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+type appliedMigration struct {
+	name, checksum, appliedAt string
+}
+
+func appliedMigrations(db sqlDB) (map[int]appliedMigration, error) {
+	rows, err := db.Query(`SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var version int
+		var m appliedMigration
+		var appliedAt sql.NullString
+		if err := rows.Scan(&version, &m.name, &m.checksum, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		m.appliedAt = appliedAt.String
+		applied[version] = m
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return applied, nil
+}
+
+// migrationStates compares the migrations of this build with the ones applied to the database
+func migrationStates(migrations []migration, applied map[int]appliedMigration) []MigrationState {
+	var states []MigrationState
+	known := make(map[int]bool)
+	for _, m := range migrations {
+		known[m.Version] = true
+		state := MigrationState{Version: m.Version, Name: m.Name, State: MigrationPending, Checksum: m.Checksum}
+		if a, ok := applied[m.Version]; ok {
+			state.State = MigrationApplied
+			state.AppliedAt = a.appliedAt
+			if a.checksum != m.Checksum {
+				state.State = MigrationModified
+			}
+		}
+		states = append(states, state)
+	}
+	for version, a := range applied {
+		if !known[version] {
+			states = append(states, MigrationState{Version: version, Name: a.name, State: MigrationUnknown, Checksum: a.checksum, AppliedAt: a.appliedAt})
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Version < states[j].Version })
+	return states
+}
+
+// checkMigrationStates refuses a database migrated by a newer version or with a modified migration
+func checkMigrationStates(states []MigrationState) error {
+	var errs []error
+	for _, state := range states {
+		switch state.State {
+		case MigrationUnknown:
+			errs = append(errs, fmt.Errorf("%w: migration %d %s is not in this build", ErrSchemaTooNew, state.Version, state.Name))
+		case MigrationModified:
+			errs = append(errs, fmt.Errorf("migration %d %s was changed after it was applied", state.Version, state.Name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// MigrationStatus returns the state of every migration without applying any
+func (st *sqlStore) MigrationStatus() ([]MigrationState, error) {
+	var states []MigrationState
+	err := st.write(func(db sqlDB) error {
+		if err := ensureMigrationTables(db); err != nil {
+			return err
+		}
+		applied, err := appliedMigrations(db)
+		if err != nil {
+			return err
+		}
+		states = migrationStates(st.migrations, applied)
+		return nil
+	})
+	return states, err
+}
+
+// Migrate applies the pending migrations in order and returns how many were applied
+// It runs on the writer goroutine, the writes queued meanwhile wait for the schema
+func (st *sqlStore) Migrate() (int, error) {
+	count := 0
+	err := st.write(func(db sqlDB) error {
+		if err := ensureMigrationTables(db); err != nil {
+			return err
+		}
+		release, err := acquireMigrationLock(db)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		// Read after the lock so the migrations applied by the process that held it are seen
+		applied, err := appliedMigrations(db)
+		if err != nil {
+			return err
+		}
+		if err := checkMigrationStates(migrationStates(st.migrations, applied)); err != nil {
+			return err
+		}
+
+		for _, m := range st.migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			start := time.Now()
+			if err := applyMigration(db, m); err != nil {
+				return err
+			}
+			log.Printf("Applied migration %d %s in %s\n", m.Version, m.Name, time.Since(start).Round(time.Millisecond))
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+func applyMigration(db sqlDB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if m.Func != nil {
+		err = m.Func(tx)
+	} else {
+		_, err = tx.Exec(m.SQL)
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %d %s failed: %w", m.Version, m.Name, err)
+	}
+	_, err = tx.Exec(`INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)`, m.Version, m.Name, m.Checksum)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to record migration %d %s: %w", m.Version, m.Name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %d %s: %w", m.Version, m.Name, err)
+	}
+	return nil
+}
+
+// RunMigrateCommand runs the -migrate flag of the apiServer and workerBee, status or up
+func (s *ServerConfig) RunMigrateCommand(command string, w io.Writer) error {
+	switch command {
+	case "status":
+	case "up":
+		count, err := s.Store.Migrate()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Applied %d migrations\n\n", count)
+	default:
+		return fmt.Errorf("unknown -migrate command %q, use status or up", command)
+	}
+
+	states, err := s.Store.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tSTATE\tAPPLIED")
+	for _, state := range states {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", state.Version, state.Name, state.State, state.AppliedAt)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	return checkMigrationStates(states)
+}
+
+// addColumnIfMissing adds a column to a table created by an older version, definition is a constant of the caller
+func addColumnIfMissing(tx sqlTx, tableName string, column string, definition string) error {
+	table, err := tableIdent(tableName)
+	if err != nil {
+		return err
+	}
+	columnName, err := columnIdent(column)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT name FROM pragma_table_info(?)`, tableName)
+	if err != nil {
+		return fmt.Errorf("failed to read the columns of %s: %w", tableName, err)
+	}
+	found := false
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		if strings.EqualFold(name, column) {
+			found = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating over rows: %w", err)
+	}
+	if found {
+		return nil
+	}
+
+	if _, err := tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + columnName + ` ` + definition); err != nil {
+		return fmt.Errorf("failed to add column %s to %s: %w", column, tableName, err)
+	}
+	return nil
+}
+
+// migrateVerdicts adds the verdict of each object, databases created before migrations were versioned may have it
+func migrateVerdicts(tx sqlTx) error {
+	if err := addColumnIfMissing(tx, "object_intel", "verdict", "VARCHAR DEFAULT 'unknown'"); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_object_intel_verdict ON object_intel (verdict);
+		CREATE TABLE IF NOT EXISTS verdict_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			object VARCHAR NOT NULL,
+			old_verdict VARCHAR,
+			new_verdict VARCHAR NOT NULL,
+			reason TEXT,
+			changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_verdict_history_object ON verdict_history (object, changed_at);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create verdict_history table: %w", err)
+	}
+	return nil
+}
+
+// migrateSightings creates the sightings table and folds the weekly objects tables into it
+func migrateSightings(tx sqlTx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS sightings (
+			id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			object VARCHAR NOT NULL,
+			object_type VARCHAR NOT NULL,
+			ipDecimal INTEGER,
+			notes TEXT,
+			source VARCHAR,
+			observed_at TIMESTAMP NOT NULL,
+			time_imported TIMESTAMP NOT NULL,
+			time_provided TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_sightings_object ON sightings (object, observed_at);
+		CREATE INDEX IF NOT EXISTS idx_sightings_observed ON sightings (observed_at);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create sightings table: %w", err)
+	}
+	return migrateWeeklyTables(tx)
+}
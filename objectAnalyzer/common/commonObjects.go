@@ -0,0 +1,283 @@
+package common
+
+// Lookups of processed objects in the object_intel table and the blocklist export
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultBlockScore  = 10    // MinScore of the first severity band that is blocked in the default settings
+	defaultExportLimit = 10000 // Default export batch limit, due to performance issues this limit may need to be modified
+
+	defaultScoreHistoryLimit = 20
+	maxScoreHistoryLimit     = 1000
+)
+
+type ObjectIntel struct {
+	Object               string `json:"object"`
+	ObjectAdditionalInfo string `json:"object_additionalInfo"`
+	ObjectType           string `json:"object_type"`
+	IPDecimal            int64  `json:"ipDecimal"`
+	GeoRegion            string `json:"geo_region"`
+	GeoCountry           string `json:"geo_country"`
+	GeoOrg               string `json:"geo_org"`
+	GeoASN               string `json:"geo_asn"`
+	Notes                string `json:"notes"`
+	Fidelity             string `json:"fidelity"`
+	FirstSeen            string `json:"first_seen"`
+	LastSeen             string `json:"last_seen"`
+	OccurrenceCount      int    `json:"occurrence_count"`
+	RiskScore            int    `json:"risk_score"`
+	RiskScoreLastUpdated string `json:"risk_score_last_updated"`
+	Severity             string `json:"severity"` // Severity band of the risk_score in the settings
+	ConfirmedRisk        bool   `json:"confirmed_risk"`
+	Trusted              bool   `json:"trusted"`
+	Verdict              string `json:"verdict" enum:"malicious,suspicious,unknown,benign,trusted"`
+	EnrichedAt           string `json:"enriched_at,omitempty"`     // When the enrichers of the workerBee last looked up the object
+	EnrichmentInfo       string `json:"enrichment_info,omitempty"` // JSON object of what each enricher returned besides the geo fields, by name
+}
+
+type ScoreHistoryEntry struct {
+	ScoredAt    string              `json:"scored_at"`
+	Score       int                 `json:"score"`
+	RawScore    float64             `json:"raw_score"`
+	RuleVersion int                 `json:"rule_version"` // Version of the scoring rules
+	Breakdown   []ScoreContribution `json:"breakdown"`
+}
+
+type ScoreHistoryResponse struct {
+	Object    string              `json:"object"`
+	RiskScore int                 `json:"risk_score"`
+	Severity  string              `json:"severity"`
+	History   []ScoreHistoryEntry `json:"history"` // Newest first
+}
+
+type BlocklistEntry struct {
+	Object     string `json:"object"`
+	ObjectType string `json:"object_type"`
+	RiskScore  int    `json:"risk_score"`
+	Severity   string `json:"severity"`
+	Verdict    string `json:"verdict" enum:"malicious,suspicious,unknown,benign,trusted"`
+	LastSeen   string `json:"last_seen"`
+}
+
+type BlocklistResponse struct {
+	GeneratedAt string           `json:"generated_at"`
+	MinScore    int              `json:"min_score"`
+	Count       int              `json:"count"`
+	Objects     []BlocklistEntry `json:"objects"`
+}
+
+// GetObjectIntel returns the object_intel row of an object, ErrNotFound when it has not been processed
+func (s *ServerConfig) GetObjectIntel(object string) (ObjectIntel, error) {
+	return s.Store.ObjectIntel(object)
+}
+
+// GetScoreHistory returns the score breakdowns of an object, newest first
+func (s *ServerConfig) GetScoreHistory(object string, limit int) ([]ScoreHistoryEntry, error) {
+	return s.Store.ScoreHistory(object, limit)
+}
+
+// GetBlocklist returns the untrusted objects with a risk_score of at least minScore, highest score first
+// Objects in a severity band with block_days are left out once last_seen is older than the band allows
+// When verdicts are given only objects with one of them are returned
+func (s *ServerConfig) GetBlocklist(settings Settings, minScore int, objectType string, verdictList []string, limit int) ([]BlocklistEntry, error) {
+	entries, err := s.Store.Blocklist(BlocklistFilter{
+		MinScore:   minScore,
+		ObjectType: objectType,
+		Verdicts:   verdictList,
+		Expiries:   blockExpiries(settings.Bands(), time.Now()),
+		Limit:      limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].Severity = settings.Severity(entries[i].RiskScore)
+	}
+	return entries, nil
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/object/114.6.6.6" -H "X-API-Key: testingtheapikey"
+func (s *ServerConfig) HandleLookup(w http.ResponseWriter, r *http.Request) {
+	if !s.apiKeyAuthorized(w, r) {
+		return
+	}
+
+	object := strings.TrimSpace(r.PathValue("object"))
+	if object == "" {
+		http.Error(w, "Missing object", http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.GetObjectIntel(object)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			s.lookupNotFound(w, object)
+			return
+		}
+		http.Error(w, "Failed to retrieve data", http.StatusInternalServerError)
+		return
+	}
+	if settings, err := s.GetSettings(); err == nil {
+		result.Severity = settings.Severity(result.RiskScore)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, "Failed to encode result", http.StatusInternalServerError)
+		return
+	}
+}
+
+// lookupNotFound answers 410 with the tombstone of an object the retention step expired, otherwise 404
+func (s *ServerConfig) lookupNotFound(w http.ResponseWriter, object string) {
+	tombstone, err := s.Store.Tombstone(object)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("Failed to read the tombstone of %s: %v\n", object, err)
+		}
+		http.Error(w, "No data found for the given object", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusGone)
+	json.NewEncoder(w).Encode(tombstone)
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/object/114.6.6.6/score?limit=5" -H "X-API-Key: testingtheapikey"
+func (s *ServerConfig) HandleScoreHistory(w http.ResponseWriter, r *http.Request) {
+	if !s.apiKeyAuthorized(w, r) {
+		return
+	}
+
+	object := strings.TrimSpace(r.PathValue("object"))
+	if object == "" {
+		http.Error(w, "Missing object", http.StatusBadRequest)
+		return
+	}
+	limit := defaultScoreHistoryLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxScoreHistoryLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxScoreHistoryLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	intel, err := s.GetObjectIntel(object)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "No data found for the given object", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to retrieve data", http.StatusInternalServerError)
+		return
+	}
+	history, err := s.GetScoreHistory(object, limit)
+	if err != nil {
+		http.Error(w, "Failed to retrieve the score history", http.StatusInternalServerError)
+		return
+	}
+
+	response := ScoreHistoryResponse{Object: intel.Object, RiskScore: intel.RiskScore, History: history}
+	if settings, err := s.GetSettings(); err == nil {
+		response.Severity = settings.Severity(intel.RiskScore)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, "Failed to encode result", http.StatusInternalServerError)
+		return
+	}
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/export/blocklist?min_score=20&object_type=ipv4&format=text" -H "X-API-Key: testingtheapikey"
+func (s *ServerConfig) HandleExportBlocklist(w http.ResponseWriter, r *http.Request) {
+	if !s.apiKeyAuthorized(w, r) {
+		return
+	}
+
+	settings, err := s.GetSettings()
+	if err != nil {
+		http.Error(w, "Failed to retrieve settings", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	verdictList, err := parseVerdicts(query.Get("verdict"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The verdict already includes the score, min_score only narrows it when it is set
+	minScore := settings.BlockScore()
+	if len(verdictList) > 0 {
+		minScore = 0
+	}
+	if value := query.Get("min_score"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "min_score must be an integer", http.StatusBadRequest)
+			return
+		}
+		minScore = n
+	}
+	limit := settings.BatchLimits.Export
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > settings.BatchLimits.Export {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", settings.BatchLimits.Export), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	objectType := query.Get("object_type")
+	if objectType != "" && !isValidObjectType(objectType) {
+		http.Error(w, "Invalid object_type.  Valid Object Types are: ipv4, ipv6, domain, url, hash", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := s.GetBlocklist(settings, minScore, objectType, verdictList, limit)
+	if err != nil {
+		http.Error(w, "Failed to retrieve the blocklist", http.StatusInternalServerError)
+		return
+	}
+
+	// A plain list of objects, one per line, for firewalls that read a URL
+	if query.Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, entry := range entries {
+			fmt.Fprintln(w, entry.Object)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := BlocklistResponse{
+		GeneratedAt: time.Now().UTC().Format(time.RFC3339),
+		MinScore:    minScore,
+		Count:       len(entries),
+		Objects:     entries,
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, "Failed to encode result", http.StatusInternalServerError)
+		return
+	}
+}
+
+func isValidObjectType(objectType string) bool {
+	switch objectType {
+	case "ipv4", "ipv6", "domain", "url", "hash":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,407 @@
+package common
+
+// OpenAPI 3 document for the apiServer
+//
+// Every /api route registered in apiServer/main.go needs an entry in
+// apiOperations.  The request and response schemas are generated from the Go
+// structs the handlers decode and encode.  The tests of the apiServer compare
+// the entries against the patterns registered on its RouteMux so the document
+// can not drift from the code.
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:embed apidocs.html
+var apiDocsHTML []byte
+
+const openAPIVersion = "3.0.3"
+
+type APIOperation struct {
+	Pattern     string // Pattern registered on the mux, for example "GET /api/object/{object}"
+	Method      string // Method for patterns registered without one
+	Summary     string
+	Description string
+	Tag         string
+	Auth        string // "apiKey" (in the body or form), "apiKeyHeader" or "adminKey" (X-API-Key header) or "" for none
+	Request     any    // Value of the JSON body decoded by the handler
+	Form        any    // Value describing a multipart/form-data body
+	Response    any    // Value of the JSON response
+	ContentType string // Response content type when it is not application/json
+	Query       []APIParameter
+}
+
+type APIParameter struct {
+	Name        string
+	Description string
+	Required    bool
+	Type        string
+}
+
+// multipart/form-data fields accepted by HandleImportCSV
+type ImportCSVForm struct {
+	APIKey string `json:"apiKey" required:"true"`
+	MyFile string `json:"myFile" required:"true" format:"binary"`
+}
+
+var apiOperations = []APIOperation{
+	{Pattern: "/api/config", Method: http.MethodGet, Tag: "config", Summary: "Running configuration with the API keys redacted", Response: Configuration{}},
+	{Pattern: "/api/import", Method: http.MethodPost, Tag: "import", Auth: "apiKey", Summary: "Import a single object into the pending_import table", Description: "The response has the ID of the import batch, GET /api/import/{id} reports its outcome.", Request: InsertPendingImportStruct{}, Response: ImportResponse{}},
+	{Pattern: "/api/importJSON", Method: http.MethodPost, Tag: "import", Auth: "apiKey", Summary: "Import multiple objects into the pending_import table", Description: "The objects are one import batch, GET /api/import/{id} reports its outcome.", Request: ImportJSONRequest{}, Response: ImportResponse{}},
+	{Pattern: "/api/importFile", Method: http.MethodPost, Tag: "import", Auth: "apiKey", Summary: "Upload a CSV file of objects", Description: "Column headers of object, object_type, notes, source, time_provided, geo_region, geo_country and geo_org.  object and object_type are required.  The page shows the ID of the import batch of the file.", Form: ImportCSVForm{}, ContentType: "text/html"},
+	{Pattern: "/api/verifyImport", Method: http.MethodGet, Tag: "import", Auth: "apiKey", Summary: "Verify an object is waiting in the pending_import table", Description: "The JSON body is sent with the GET request.", Request: VerifyImportRequest{}, Response: VerifyImportResult{}},
+	{Pattern: "GET /api/import/{id}", Tag: "import", Auth: "apiKeyHeader", Summary: "Status of an import batch and the outcome of its rows", Description: "A batch is queued until a workerBee claims its rows, processing until none are pending, then done, or partially_failed when rows were rejected or purged before being processed.  Rows are listed once processed, in the order they were sent.", Response: ImportBatchResponse{}, Query: []APIParameter{
+		{Name: "outcome", Description: "Only list the accepted or the rejected rows"},
+		{Name: "limit", Type: "integer", Description: fmt.Sprintf("Maximum number of rows, defaults to %d, 0 only returns the counts", defaultImportRowLimit)},
+	}},
+	{Pattern: "GET /api/object/{object}", Tag: "lookup", Auth: "apiKeyHeader", Summary: "Processed record of an object from the object_intel table", Description: "An object expired by the retention step of the workerBee returns 410 with its tombstone until it is seen again.", Response: ObjectIntel{}},
+	{Pattern: "GET /api/object/{object}/score", Tag: "lookup", Auth: "apiKeyHeader", Summary: "Score breakdowns of an object, newest first", Description: "Each scoring run records the value, weight and points of every rule and the version of the scoring rules.", Response: ScoreHistoryResponse{}, Query: []APIParameter{
+		{Name: "limit", Type: "integer", Description: fmt.Sprintf("Maximum number of breakdowns, defaults to %d", defaultScoreHistoryLimit)},
+	}},
+	{Pattern: "GET /api/object/{object}/verdicts", Tag: "lookup", Auth: "apiKeyHeader", Summary: "Verdict changes of an object, newest first", Response: VerdictHistoryResponse{}, Query: []APIParameter{
+		{Name: "limit", Type: "integer", Description: fmt.Sprintf("Maximum number of changes, defaults to %d", defaultScoreHistoryLimit)},
+	}},
+	{Pattern: "GET /api/object/{object}/sightings", Tag: "lookup", Auth: "apiKeyHeader", Summary: "Sightings of an object on each day, oldest first", Response: SightingTrendResponse{}, Query: []APIParameter{
+		{Name: "days", Type: "integer", Description: fmt.Sprintf("Number of days back to count, defaults to %d", defaultTrendDays)},
+	}},
+	{Pattern: "GET /api/objects", Tag: "lookup", Auth: "apiKeyHeader", Summary: "Objects with a verdict, highest score first", Response: ObjectListResponse{}, Query: []APIParameter{
+		{Name: "verdict", Description: "Comma separated verdicts: malicious, suspicious, unknown, benign or trusted.  Every verdict when it is not set"},
+		{Name: "object_type", Description: "Only list one object type: ipv4, ipv6, domain, url or hash"},
+		{Name: "limit", Type: "integer", Description: "Maximum number of objects, defaults to the export batch limit"},
+	}},
+	{Pattern: "GET /api/export/blocklist", Tag: "export", Auth: "apiKeyHeader", Summary: "Untrusted objects at or above a risk score, highest score first", Response: BlocklistResponse{}, Query: []APIParameter{
+		{Name: "min_score", Type: "integer", Description: "Minimum risk_score, defaults to the lowest severity band that is blocked or 0 when verdict is set"},
+		{Name: "verdict", Description: "Comma separated verdicts to export, for example malicious,suspicious"},
+		{Name: "object_type", Description: "Only export one object type: ipv4, ipv6, domain, url or hash"},
+		{Name: "limit", Type: "integer", Description: "Maximum number of objects, defaults to the export batch limit"},
+		{Name: "format", Description: "json (default) or text for one object per line"},
+	}},
+	{Pattern: "/api/admin/reloadConfig", Method: http.MethodPost, Tag: "admin", Auth: "adminKey", Summary: "Reload the config file, the same as sending SIGHUP", Response: ConfigReloadReport{}},
+	{Pattern: "POST /api/admin/keys", Tag: "admin", Auth: "adminKey", Summary: "Create an API key", Description: "The key is only returned in this response, the database stores its sha256.", Request: CreateAPIKeyRequest{}, Response: CreateAPIKeyResponse{}},
+	{Pattern: "GET /api/admin/keys", Tag: "admin", Auth: "adminKey", Summary: "List the API keys without the keys", Response: []APIKeyRecord{}},
+	{Pattern: "DELETE /api/admin/keys/{id}", Tag: "admin", Auth: "adminKey", Summary: "Revoke an API key", Response: CountResponse{}},
+	{Pattern: "POST /api/admin/trusted", Tag: "admin", Auth: "adminKey", Summary: "Add or update trusted objects and mark the matching objects trusted", Request: TrustedObjectsRequest{}, Response: CountResponse{}},
+	{Pattern: "GET /api/admin/trusted", Tag: "admin", Auth: "adminKey", Summary: "List the trusted objects", Response: []TrustedObject{}},
+	{Pattern: "DELETE /api/admin/trusted", Tag: "admin", Auth: "adminKey", Summary: "Remove a trusted object and clear the trusted flag of the objects it covered", Response: CountResponse{}, Query: []APIParameter{
+		{Name: "object", Required: true, Description: "Trusted object, a CIDR contains a slash so it is sent as a query parameter"},
+	}},
+	{Pattern: "GET /api/admin/settings", Tag: "admin", Auth: "adminKey", Summary: "Severity bands, block durations, scoring weights, rescore interval and batch limits", Response: Settings{}},
+	{Pattern: "PUT /api/admin/settings", Tag: "admin", Auth: "adminKey", Summary: "Change the settings, keys that are not sent are not changed", Description: "severity_bands is replaced as a whole.  The workerBee uses the new settings on its next run.", Request: Settings{}, Response: Settings{}},
+	{Pattern: "GET /api/admin/scoring/rules", Tag: "admin", Auth: "adminKey", Summary: "Rules of the risk scoring engine", Response: ScoringRuleSet{}},
+	{Pattern: "PUT /api/admin/scoring/rules", Tag: "admin", Auth: "adminKey", Summary: "Replace the scoring rules", Description: "Add rules are applied before multiply rules, the raw score is capped at max_raw_score and normalised to 0-100.  The version is incremented by the server and every object is rescored by the workerBee.", Request: ScoringRuleSet{}, Response: ScoringRuleSet{}},
+	{Pattern: "GET /api/admin/pending", Tag: "admin", Auth: "adminKey", Summary: "Statistics of the pending_import table", Response: PendingStats{}},
+	{Pattern: "DELETE /api/admin/pending", Tag: "admin", Auth: "adminKey", Summary: "Purge rows from the pending_import table", Description: "At least one filter or all=true is required.", Response: CountResponse{}, Query: []APIParameter{
+		{Name: "older_than_days", Type: "integer", Description: "Only purge rows imported more than this many days ago"},
+		{Name: "object_type", Description: "Only purge one object type"},
+		{Name: "source", Description: "Only purge rows from one source"},
+		{Name: "all", Description: "true to purge every row"},
+	}},
+	{Pattern: "POST /api/admin/objects/{object}/confirm", Tag: "admin", Auth: "adminKey", Summary: "Set confirmed_risk of an object", Description: "An empty body confirms the object.", Request: ConfirmObjectRequest{}, Response: ObjectStatusResponse{}},
+	{Pattern: "POST /api/admin/objects/{object}/untrust", Tag: "admin", Auth: "adminKey", Summary: "Clear the trusted flag of an object and remove it from trusted_objects", Response: ObjectStatusResponse{}},
+	{Pattern: "POST /api/admin/db/backup", Tag: "admin", Auth: "adminKey", Summary: "Write a copy of the database to the backups directory next to it", Description: "The copy is made with the online backup API of SQLite while the database is in use, its integrity is checked and only the newest backupKeep backups are kept.", Response: BackupResponse{}},
+	{Pattern: "GET /api/admin/db/backups", Tag: "admin", Auth: "adminKey", Summary: "Backups in the backups directory, newest first", Response: BackupListResponse{}},
+	{Pattern: "POST /api/admin/db/restore", Tag: "admin", Auth: "adminKey", Summary: "Replace the database with a backup", Description: "A backup made by a newer version is refused with 409, the migrations a backup of an older version misses are applied.", Request: RestoreRequest{}, Response: RestoreResponse{}},
+	{Pattern: "POST /api/admin/db/vacuum", Tag: "admin", Auth: "adminKey", Summary: "Vacuum the database", Response: StatusResponse{}},
+	{Pattern: "POST /api/admin/imports/{id}/rollback", Tag: "admin", Auth: "adminKey", Summary: "Roll back an import batch", Description: "Deletes the pending rows and sightings of the batch, takes its occurrences off its objects and rebuilds their first_seen and last_seen from the sightings left.  Objects only seen in the batch are deleted, the others are scored again.  A batch can only be rolled back once, again returns 409.", Response: RollbackResult{}, Query: []APIParameter{
+		{Name: "dry_run", Description: "true to report what would be removed without removing it"},
+	}},
+	{Pattern: "GET /api/admin/quarantine", Tag: "admin", Auth: "adminKey", Summary: "List the rejected import rows kept in the quarantine, oldest first", Response: QuarantineResponse{}, Query: []APIParameter{
+		{Name: "id", Type: "integer", Description: "Only one quarantined row"},
+		{Name: "batch_id", Type: "integer", Description: "Only the rows of one import batch"},
+		{Name: "source", Description: "Only the rows from one source"},
+		{Name: "object_type", Description: "Only one object type"},
+		{Name: "reason", Description: "Only the rows rejected for this reason, for example invalid IPv4 address"},
+		{Name: "older_than_days", Type: "integer", Description: "Only the rows quarantined more than this many days ago"},
+		{Name: "limit", Type: "integer", Description: fmt.Sprintf("Maximum number of rows, defaults to %d", defaultQuarantineLimit)},
+	}},
+	{Pattern: "PUT /api/admin/quarantine/{id}", Tag: "admin", Auth: "adminKey", Summary: "Correct the object or object_type of a quarantined row", Description: "The row stays in the quarantine until it is resubmitted.", Request: QuarantineFixRequest{}, Response: QuarantinedImport{}},
+	{Pattern: "POST /api/admin/quarantine/resubmit", Tag: "admin", Auth: "adminKey", Summary: "Move quarantined rows back to the pending_import table", Description: "A row goes back in its import batch, which is processing again until the workerBee applies it.  The row of a rolled back or pruned batch is resubmitted without a batch.  At least one filter or all=true is required.", Response: CountResponse{}, Query: []APIParameter{
+		{Name: "id", Type: "integer", Description: "Only one quarantined row"},
+		{Name: "batch_id", Type: "integer", Description: "Only the rows of one import batch"},
+		{Name: "source", Description: "Only the rows from one source"},
+		{Name: "object_type", Description: "Only one object type"},
+		{Name: "reason", Description: "Only the rows rejected for this reason"},
+		{Name: "older_than_days", Type: "integer", Description: "Only the rows quarantined more than this many days ago"},
+		{Name: "all", Description: "true to resubmit every row"},
+	}},
+	{Pattern: "DELETE /api/admin/quarantine", Tag: "admin", Auth: "adminKey", Summary: "Purge rows from the quarantine", Description: "At least one filter or all=true is required.", Response: CountResponse{}, Query: []APIParameter{
+		{Name: "id", Type: "integer", Description: "Only one quarantined row"},
+		{Name: "batch_id", Type: "integer", Description: "Only the rows of one import batch"},
+		{Name: "source", Description: "Only the rows from one source"},
+		{Name: "object_type", Description: "Only one object type"},
+		{Name: "reason", Description: "Only the rows rejected for this reason"},
+		{Name: "older_than_days", Type: "integer", Description: "Only the rows quarantined more than this many days ago"},
+		{Name: "all", Description: "true to purge every row"},
+	}},
+	{Pattern: "GET /api/admin/stages/runs", Tag: "admin", Auth: "adminKey", Summary: "Runs of the workerBee stages, newest first", Description: "A run is ok, failed with its error, or skipped when the workerBee -daemon found the previous run of the stage still going.", Response: StageRunsResponse{}, Query: []APIParameter{
+		{Name: "stage", Type: "string", Description: "Only the runs of this stage, " + strings.Join(stageNames, ", ")},
+		{Name: "limit", Type: "integer", Description: fmt.Sprintf("Maximum number of runs, defaults to %d", defaultStageRunLimit)},
+	}},
+	{Pattern: "GET /api/openapi.json", Tag: "docs", Summary: "This OpenAPI document", Response: map[string]any{}},
+	{Pattern: "GET /api/docs", Tag: "docs", Summary: "Interactive API documentation", ContentType: "text/html"},
+}
+
+// RouteMux records the patterns registered so they can be checked against the OpenAPI document
+type RouteMux struct {
+	*http.ServeMux
+	patterns []string
+}
+
+func NewRouteMux() *RouteMux {
+	return &RouteMux{ServeMux: http.NewServeMux()}
+}
+
+func (m *RouteMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.patterns = append(m.patterns, pattern)
+	m.ServeMux.HandleFunc(pattern, handler)
+}
+
+func (m *RouteMux) Handle(pattern string, handler http.Handler) {
+	m.patterns = append(m.patterns, pattern)
+	m.ServeMux.Handle(pattern, handler)
+}
+
+func (m *RouteMux) Patterns() []string {
+	return append([]string(nil), m.patterns...)
+}
+
+// splitPattern separates the optional method from the path of a mux pattern
+func splitPattern(pattern string) (string, string) {
+	if method, path, found := strings.Cut(pattern, " "); found {
+		return method, strings.TrimSpace(path)
+	}
+	return "", pattern
+}
+
+var pathParameter = regexp.MustCompile(`\{([^}.]+)(\.\.\.)?\}`)
+
+// APIOperations returns the documented routes, apiServer/main_test.go checks them against the mux
+func APIOperations() []APIOperation {
+	return append([]APIOperation(nil), apiOperations...)
+}
+
+// BuildOpenAPI generates the OpenAPI document from apiOperations
+func BuildOpenAPI() map[string]any {
+	schemas := make(map[string]any)
+	paths := make(map[string]map[string]any)
+
+	for _, op := range apiOperations {
+		method, path := splitPattern(op.Pattern)
+		if method == "" {
+			method = op.Method
+		}
+
+		operation := map[string]any{
+			"summary":     op.Summary,
+			"operationId": operationID(method, path),
+		}
+		if op.Description != "" {
+			operation["description"] = op.Description
+		}
+		if op.Tag != "" {
+			operation["tags"] = []string{op.Tag}
+		}
+
+		var parameters []any
+		for _, match := range pathParameter.FindAllStringSubmatch(path, -1) {
+			parameters = append(parameters, map[string]any{"name": match[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+		}
+		for _, q := range op.Query {
+			qType := q.Type
+			if qType == "" {
+				qType = "string"
+			}
+			parameters = append(parameters, map[string]any{"name": q.Name, "in": "query", "required": q.Required, "description": q.Description, "schema": map[string]any{"type": qType}})
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+
+		switch op.Auth {
+		case "adminKey", "apiKeyHeader":
+			operation["security"] = []any{map[string]any{op.Auth: []string{}}}
+		case "apiKey":
+			operation["description"] = strings.TrimSpace(op.Description + "  The apiKey is sent in the request body.")
+		}
+
+		if op.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": schemaRef(reflect.TypeOf(op.Request), schemas)}},
+			}
+		} else if op.Form != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"multipart/form-data": map[string]any{"schema": schemaRef(reflect.TypeOf(op.Form), schemas)}},
+			}
+		}
+
+		responses := map[string]any{}
+		if op.ContentType != "" {
+			responses["200"] = map[string]any{"description": "OK", "content": map[string]any{op.ContentType: map[string]any{"schema": map[string]any{"type": "string"}}}}
+		} else if op.Response != nil {
+			responses["200"] = map[string]any{"description": "OK", "content": map[string]any{"application/json": map[string]any{"schema": schemaRef(reflect.TypeOf(op.Response), schemas)}}}
+		} else {
+			responses["200"] = map[string]any{"description": "OK"}
+		}
+		responses["400"] = map[string]any{"description": "Invalid request"}
+		if op.Auth != "" {
+			responses["401"] = map[string]any{"description": "Invalid API Key"}
+		}
+		responses["405"] = map[string]any{"description": "Method not allowed"}
+		operation["responses"] = responses
+
+		if paths[path] == nil {
+			paths[path] = make(map[string]any)
+		}
+		paths[path][strings.ToLower(method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": openAPIVersion,
+		"info": map[string]any{
+			"title":       "Object Analyzer API",
+			"description": "Submit IP addresses, hashes and other objects to be evaluated and risk scored.",
+			"version":     "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"apiKeyHeader": map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key", "description": "The apiKey, the adminApiKey or a key created with the admin API"},
+				"adminKey":     map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key", "description": "The adminApiKey or a key created with the admin role"},
+			},
+		},
+	}
+}
+
+func operationID(method string, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '{' || r == '}' || r == '.' || r == '_' }) {
+		if part == "api" {
+			continue
+		}
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaRef returns the schema of t, named structs are added to components and referenced
+func schemaRef(t reflect.Type, schemas map[string]any) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		if _, ok := schemas[t.Name()]; !ok {
+			schemas[t.Name()] = map[string]any{} // Placeholder for recursive types
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	case t.Kind() == reflect.Struct:
+		return structSchema(t, schemas)
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": schemaRef(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaRef(t.Elem(), schemas)}
+	}
+	return map[string]any{}
+}
+
+func structSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	properties := make(map[string]any)
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		// The fields of an embedded struct are encoded as fields of the outer struct
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			embedded := structSchema(field.Type, schemas)
+			for key, value := range embedded["properties"].(map[string]any) {
+				properties[key] = value
+			}
+			if names, ok := embedded["required"].([]string); ok {
+				required = append(required, names...)
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := schemaRef(field.Type, schemas)
+		if enum := field.Tag.Get("enum"); enum != "" {
+			schema["enum"] = strings.Split(enum, ",")
+		}
+		if format := field.Tag.Get("format"); format != "" {
+			schema["format"] = format
+		}
+		if field.Tag.Get("secret") == "true" {
+			schema["description"] = "Always " + redactedValue + " in responses"
+		}
+		properties[name] = schema
+		if field.Tag.Get("required") == "true" {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/openapi.json"
+func (s *ServerConfig) HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(BuildOpenAPI()); err != nil {
+		http.Error(w, "Failed to encode the OpenAPI document", http.StatusInternalServerError)
+		return
+	}
+}
+
+// Documentation page that renders /api/openapi.json without loading anything from the internet
+func (s *ServerConfig) HandleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(apiDocsHTML)
+}
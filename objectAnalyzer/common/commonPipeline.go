@@ -0,0 +1,253 @@
+package common
+
+// The pipeline of the process_imports stage
+//
+// A reader claims the pending rows, validators check and normalise them in
+// parallel and a writer applies them to object_intel in batches, one
+// transaction each.  The channels between the stages are bounded, so a
+// backlog of millions of rows is never held in memory at once.
+//
+// The validators also run the enrichers enabled in the settings on the rows
+// they accept, so the lookups of a run are made in parallel.
+//
+// The writer applies the rows in the order they were claimed.  A failed claim
+// stops the reader, the rows already read are still applied.  A failed write
+// or a cancelled context stops every stage, and the rows left claimed are
+// released for the next run.  Errors are returned in the order of the stages.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pipelineWriteSize = 500              // Rows applied in one transaction
+	pipelineBuffer    = pendingClaimSize // Rows waiting between two stages
+)
+
+// pipelineRow is a claimed row, seq is its position in the order of the claims
+type pipelineRow struct {
+	seq    int
+	row    PendingImport
+	reason string // Why the row is rejected, empty when it is accepted
+}
+
+// pipelineStats counts the rows of a run for its log line
+type pipelineStats struct {
+	processed, reclaimed, accepted, rejected int
+}
+
+// pipelineWorkers is the number of validators, pipelineWorkers in the config or the CPUs
+func (s *ServerConfig) pipelineWorkers() int {
+	if n := s.Config().PipelineWorkers; n > 0 {
+		return n
+	}
+	return runtime.NumCPU()
+}
+
+// ProcessPendingImports claims the pending rows, up to the pending_import batch limit in the settings,
+// and moves them to object_intel.  Other workerBees claim the rows after the ones this worker holds.
+func (s *ServerConfig) ProcessPendingImports(ctx context.Context) error {
+	settings, err := s.GetSettings()
+	if err != nil {
+		return fmt.Errorf("failed to load settings: %w", err)
+	}
+
+	worker := s.WorkerID()
+	lease := s.pendingLease()
+	workers := s.pipelineWorkers()
+	release := s.holdLease(worker, lease)
+	enrich := s.newEnrichRun(settings.Enrichment)
+	started := time.Now()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	claimed := make(chan pipelineRow, pipelineBuffer)
+	validated := make(chan pipelineRow, pipelineBuffer)
+	var stats pipelineStats
+	var readErr error
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		readErr = s.readPending(ctx, worker, lease, settings.BatchLimits.PendingImport, claimed, &stats)
+	}()
+	var validators sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		validators.Add(1)
+		go func() {
+			defer validators.Done()
+			validatePending(ctx, enrich, claimed, validated)
+		}()
+	}
+	go func() {
+		validators.Wait()
+		close(validated)
+	}()
+	writeErr := s.writePending(ctx, worker, validated, &stats)
+	if writeErr != nil {
+		cancel()
+	}
+	wg.Wait()
+	release()
+	if enrich != nil {
+		enrich.logFailures()
+	}
+
+	// The reader stopped by a failed write or the same cancellation has nothing to add
+	if writeErr != nil && errors.Is(readErr, context.Canceled) {
+		readErr = nil
+	}
+	if err := errors.Join(readErr, writeErr); err != nil {
+		// Released so another worker does not wait for the lease to retry them
+		if releaseErr := s.Store.ReleasePendingImports(worker); releaseErr != nil {
+			log.Printf("Failed to release the pending rows of %s: %v\n", worker, releaseErr)
+		}
+		return err
+	}
+
+	if stats.reclaimed > 0 {
+		log.Printf("Claimed %d pending rows again after the lease of another worker passed\n", stats.reclaimed)
+	}
+	if stats.processed > 0 {
+		log.Printf("Processed %d pending rows in %s with %d validators, %d accepted and %d quarantined\n",
+			stats.processed, time.Since(started).Round(time.Millisecond), workers, stats.accepted, stats.rejected)
+	}
+	return nil
+}
+
+// readPending claims rows until limit rows were read or none are left and sends them in order
+func (s *ServerConfig) readPending(ctx context.Context, worker string, lease time.Duration, limit int, out chan<- pipelineRow, stats *pipelineStats) error {
+	defer close(out)
+	seq := 0
+	for seq < limit {
+		pending, err := s.Store.ClaimPendingImports(worker, min(pendingClaimSize, limit-seq), lease)
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		for _, row := range pending {
+			if row.Claims > 1 {
+				stats.reclaimed++
+			}
+			select {
+			case out <- pipelineRow{seq: seq, row: row}:
+				seq++
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+// validatePending checks and normalises the rows of in until it is closed or ctx is cancelled,
+// and enriches the accepted rows when enrich is not nil
+func validatePending(ctx context.Context, enrich *enrichRun, in <-chan pipelineRow, out chan<- pipelineRow) {
+	for item := range in {
+		item.row, item.reason = validateImport(item.row)
+		if enrich != nil && item.reason == "" {
+			item.row.Enrichment = enrich.enrich(ctx, item.row.Object, item.row.ObjectType)
+		}
+		select {
+		case out <- item:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// validateImport returns the row to apply, or why it is rejected
+func validateImport(row PendingImport) (PendingImport, string) {
+	row.Object = strings.TrimSpace(row.Object)
+	row.IPDecimal = 0
+	if row.Object == "" {
+		return row, "empty object"
+	}
+	switch row.ObjectType {
+	case "ipv4":
+		if !IsValidIPv4(row.Object) {
+			return row, "invalid IPv4 address"
+		}
+		row.IPDecimal, _ = ipv4ToDecimal(row.Object)
+	case "ipv6":
+		if !IsValidIPv6(row.Object) {
+			return row, "invalid IPv6 address"
+		}
+	}
+	return row, ""
+}
+
+// writePending applies the validated rows in the order they were claimed, pipelineWriteSize rows at a time
+func (s *ServerConfig) writePending(ctx context.Context, worker string, in <-chan pipelineRow, stats *pipelineStats) error {
+	// The validators finish out of order, a row waits here until the rows claimed before it arrived
+	waiting := map[int]pipelineRow{}
+	next := 0
+	var batch []pipelineRow
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		debug := s.Config().Debug
+		var accepted []PendingImport
+		var rejected []RejectedImport
+		for _, item := range batch {
+			if item.reason != "" {
+				if debug {
+					log.Printf("Quarantining invalid object with ID %d: %s\n", item.row.ID, item.reason)
+				}
+				rejected = append(rejected, RejectedImport{PendingImport: item.row, Reason: item.reason})
+				continue
+			}
+			accepted = append(accepted, item.row)
+		}
+		lost, err := s.Store.ApplyPendingImports(worker, accepted, rejected)
+		if err != nil {
+			return fmt.Errorf("failed to apply the pending rows with IDs %d to %d: %w", batch[0].row.ID, batch[len(batch)-1].row.ID, err)
+		}
+		if lost > 0 {
+			log.Printf("%d pending rows were claimed by another worker after the lease of %s passed, they were left to it\n", lost, worker)
+		}
+		stats.processed += len(batch)
+		stats.accepted += len(accepted)
+		stats.rejected += len(rejected)
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case item, ok := <-in:
+			if !ok {
+				return flush()
+			}
+			waiting[item.seq] = item
+			for {
+				ready, found := waiting[next]
+				if !found {
+					break
+				}
+				delete(waiting, next)
+				next++
+				batch = append(batch, ready)
+				if len(batch) == pipelineWriteSize {
+					if err := flush(); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package common
+
+// Quarantine of the pending rows the workerBee rejects
+//
+// A rejected row is moved to the quarantine table with the reason in the
+// transaction that applies the rest of its claim, so the evidence of a bad
+// feed stays visible.  An admin can correct the object or object_type of a
+// row, resubmit rows to pending_import in their import batch, or purge them.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultQuarantineLimit = 100
+	maxQuarantineLimit     = 10000
+)
+
+type QuarantinedImport struct {
+	ID            int64  `json:"id"`
+	Object        string `json:"object"`
+	ObjectType    string `json:"object_type"`
+	Notes         string `json:"notes,omitempty"`
+	Source        string `json:"source,omitempty"`
+	GeoRegion     string `json:"geo_region,omitempty"`
+	GeoCountry    string `json:"geo_country,omitempty"`
+	GeoOrg        string `json:"geo_org,omitempty"`
+	TimeImported  string `json:"time_imported"`
+	TimeProvided  string `json:"time_provided,omitempty"`
+	BatchID       int64  `json:"batch_id,omitempty"`
+	BatchRow      int    `json:"batch_row,omitempty"`
+	Reason        string `json:"reason"`
+	QuarantinedAt string `json:"quarantined_at"`
+	FixedAt       string `json:"fixed_at,omitempty"` // When an admin last corrected the row
+}
+
+type QuarantineResponse struct {
+	Rows []QuarantinedImport `json:"rows"` // Oldest first
+}
+
+type QuarantineFixRequest struct {
+	Object     string `json:"object" required:"true"`
+	ObjectType string `json:"object_type" required:"true"`
+}
+
+// QuarantineFilter selects quarantined rows, a zero field does not filter
+type QuarantineFilter struct {
+	ID         int64
+	BatchID    int64
+	Source     string
+	ObjectType string
+	Reason     string
+	OlderThan  time.Time // Quarantined before this
+	Limit      int       // Only used when listing
+}
+
+func (f QuarantineFilter) empty() bool {
+	return f.ID == 0 && f.BatchID == 0 && f.Source == "" && f.ObjectType == "" && f.Reason == "" && f.OlderThan.IsZero()
+}
+
+// parseQuarantineFilter reads the id, batch_id, source, object_type, reason and older_than_days query parameters
+func parseQuarantineFilter(query url.Values) (QuarantineFilter, error) {
+	var filter QuarantineFilter
+	for _, param := range []struct {
+		name  string
+		value *int64
+	}{
+		{"id", &filter.ID},
+		{"batch_id", &filter.BatchID},
+	} {
+		if value := query.Get(param.name); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 1 {
+				return filter, fmt.Errorf("%s must be a positive integer", param.name)
+			}
+			*param.value = n
+		}
+	}
+	if value := query.Get("older_than_days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return filter, errors.New("older_than_days must be a positive integer")
+		}
+		filter.OlderThan = time.Now().AddDate(0, 0, -n)
+	}
+	filter.Source = query.Get("source")
+	filter.ObjectType = query.Get("object_type")
+	filter.Reason = query.Get("reason")
+	return filter, nil
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/quarantine?batch_id=12&limit=50" -H "X-API-Key: theadminapikey"
+func (s *ServerConfig) HandleListQuarantine(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	filter, err := parseQuarantineFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Limit = defaultQuarantineLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxQuarantineLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxQuarantineLimit), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = n
+	}
+
+	rows, err := s.Store.ListQuarantine(filter)
+	if err != nil {
+		log.Printf("Listing the quarantine failed: %v\n", err)
+		http.Error(w, "Failed to list the quarantine", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, QuarantineResponse{Rows: rows})
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/quarantine/3" -X PUT -H "X-API-Key: theadminapikey" -d '{"object": "114.6.6.6", "object_type": "ipv4"}'
+func (s *ServerConfig) HandleFixQuarantined(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id < 1 {
+		http.Error(w, "Invalid quarantine ID", http.StatusBadRequest)
+		return
+	}
+	var data QuarantineFixRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+		return
+	}
+	data.Object = strings.TrimSpace(data.Object)
+	if data.Object == "" || !isValidObjectType(data.ObjectType) {
+		http.Error(w, "object is required and object_type must be one of ipv4, ipv6, domain, url, hash", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.Store.FixQuarantined(id, data.Object, data.ObjectType); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "No quarantined row with this ID", http.StatusNotFound)
+			return
+		}
+		log.Printf("Fixing quarantined row %d failed: %v\n", id, err)
+		http.Error(w, "Failed to fix the quarantined row", http.StatusInternalServerError)
+		return
+	}
+	rows, err := s.Store.ListQuarantine(QuarantineFilter{ID: id, Limit: 1})
+	if err != nil || len(rows) == 0 {
+		http.Error(w, "Failed to retrieve the quarantined row", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, rows[0])
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/quarantine/resubmit?batch_id=12" -X POST -H "X-API-Key: theadminapikey"
+func (s *ServerConfig) HandleResubmitQuarantine(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	filter, err := parseQuarantineFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.empty() && r.URL.Query().Get("all") != "true" {
+		http.Error(w, "Set id, batch_id, source, object_type, reason, older_than_days or all=true", http.StatusBadRequest)
+		return
+	}
+
+	count, err := s.Store.ResubmitQuarantined(filter)
+	if err != nil {
+		log.Printf("Resubmitting quarantined rows failed: %v\n", err)
+		http.Error(w, "Failed to resubmit the quarantined rows", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Resubmitted %d quarantined rows to pending_import requested by %s\n", count, r.RemoteAddr)
+	writeJSON(w, CountResponse{Status: "resubmitted", Count: count})
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/quarantine?older_than_days=30" -X DELETE -H "X-API-Key: theadminapikey"
+func (s *ServerConfig) HandlePurgeQuarantine(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	filter, err := parseQuarantineFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.empty() && r.URL.Query().Get("all") != "true" {
+		http.Error(w, "Set id, batch_id, source, object_type, reason, older_than_days or all=true", http.StatusBadRequest)
+		return
+	}
+
+	count, err := s.Store.PurgeQuarantine(filter)
+	if err != nil {
+		log.Printf("Purging the quarantine failed: %v\n", err)
+		http.Error(w, "Failed to purge the quarantine", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Purged %d quarantined rows requested by %s\n", count, r.RemoteAddr)
+	writeJSON(w, CountResponse{Status: "purged", Count: count})
+}
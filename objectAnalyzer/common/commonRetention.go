@@ -0,0 +1,145 @@
+package common
+
+// Retention of sightings, archived CSV files and stale objects
+//
+// The workerBee -prune step deletes what the retention settings no longer keep.
+// An expired object leaves a row in object_tombstones, so a lookup answers 410
+// instead of 404 until the object is seen again.  With -dry-run nothing is
+// deleted and the report shows what would be.
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Tombstone is the last state of an object expired by the retention step
+type Tombstone struct {
+	Object          string `json:"object"`
+	ObjectType      string `json:"object_type"`
+	FirstSeen       string `json:"first_seen"`
+	LastSeen        string `json:"last_seen"`
+	OccurrenceCount int    `json:"occurrence_count"`
+	RiskScore       int    `json:"risk_score"`
+	Verdict         string `json:"verdict"`
+	ExpiredAt       string `json:"expired_at"`
+}
+
+type PruneReport struct {
+	DryRun bool
+	PruneResult
+	ArchiveFiles []string // Archived CSV files deleted, oldest first
+	ArchiveBytes int64
+}
+
+type archiveFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// expiredArchiveFiles returns the files in dir older than maxAge and then the oldest files until the rest fit in maxBytes, 0 has no limit
+func expiredArchiveFiles(dir string, maxAge time.Duration, maxBytes int64, now time.Time) ([]archiveFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read the archive directory: %w", err)
+	}
+
+	var files []archiveFile
+	var total int64
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %w", entry.Name(), err)
+		}
+		files = append(files, archiveFile{path: filepath.Join(dir, entry.Name()), size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	expired := 0
+	for expired < len(files) {
+		file := files[expired]
+		tooOld := maxAge > 0 && now.Sub(file.modTime) > maxAge
+		tooBig := maxBytes > 0 && total > maxBytes
+		if !tooOld && !tooBig {
+			break
+		}
+		total -= file.size
+		expired++
+	}
+	return files[:expired], nil
+}
+
+// Prune deletes the sightings, archived CSV files and stale objects the retention settings no longer keep
+func (s *ServerConfig) Prune(dryRun bool) (PruneReport, error) {
+	report := PruneReport{DryRun: dryRun}
+	settings, err := s.GetSettings()
+	if err != nil {
+		return report, fmt.Errorf("failed to load settings: %w", err)
+	}
+	retention := settings.Retention
+
+	now := time.Now()
+	policy := PrunePolicy{StaleMaxScore: retention.StaleMaxScore, DryRun: dryRun}
+	if retention.SightingDays > 0 {
+		policy.SightingsBefore = now.AddDate(0, 0, -retention.SightingDays)
+	}
+	if retention.StaleObjectDays > 0 {
+		policy.StaleBefore = now.AddDate(0, 0, -retention.StaleObjectDays)
+	}
+	if retention.StageRunDays > 0 {
+		policy.StageRunsBefore = now.AddDate(0, 0, -retention.StageRunDays)
+	}
+	if retention.ImportBatchDays > 0 {
+		policy.BatchesBefore = now.AddDate(0, 0, -retention.ImportBatchDays)
+	}
+	if report.PruneResult, err = s.Store.Prune(policy); err != nil {
+		return report, err
+	}
+
+	files, err := expiredArchiveFiles(s.Config().ArchiveCSVLocation, time.Duration(retention.ArchiveDays)*24*time.Hour, int64(retention.ArchiveMaxMB)<<20, now)
+	if err != nil {
+		return report, err
+	}
+	for _, file := range files {
+		if !dryRun {
+			if err := os.Remove(file.path); err != nil {
+				return report, fmt.Errorf("failed to delete %s: %w", file.path, err)
+			}
+		}
+		report.ArchiveFiles = append(report.ArchiveFiles, file.path)
+		report.ArchiveBytes += file.size
+	}
+
+	if !dryRun {
+		log.Printf("Pruned %d sightings, %d stale objects, %d stage runs, %d import batches and %d archived files\n", report.Sightings, report.Objects, report.StageRuns, report.ImportBatches, len(report.ArchiveFiles))
+	}
+	return report, nil
+}
+
+// Print lists what Prune deleted, or would delete in a dry run
+func (r PruneReport) Print(w io.Writer) {
+	verb := "Deleted"
+	if r.DryRun {
+		verb = "Would delete"
+	}
+	fmt.Fprintf(w, "%s %d sightings\n", verb, r.Sightings)
+	fmt.Fprintf(w, "%s %d stale objects, leaving a tombstone for each\n", verb, r.Objects)
+	fmt.Fprintf(w, "%s %d runs of the workerBee stages\n", verb, r.StageRuns)
+	fmt.Fprintf(w, "%s %d finished import batches with the outcomes of their rows\n", verb, r.ImportBatches)
+	fmt.Fprintf(w, "%s %d archived CSV files, %d bytes\n", verb, len(r.ArchiveFiles), r.ArchiveBytes)
+	for _, path := range r.ArchiveFiles {
+		fmt.Fprintf(w, "    %s\n", path)
+	}
+}
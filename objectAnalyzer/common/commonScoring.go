@@ -0,0 +1,388 @@
+package common
+
+// Rule based risk scoring of the objects in the object_intel table
+//
+// A rule reads one factor of an object, like how often or how recently it was
+// seen, and either adds to the raw score or multiplies it.  The decay factor
+// counts every sighting by its timestamp, halving its value every half-life of
+// the object type or source, so a score fades smoothly instead of dropping at
+// the end of a week.  Every add rule is applied first and then every multiply
+// rule, so the order of the rules does not change the score.  The raw score is
+// capped at max_raw_score and normalised to 0-100.
+//
+// The rules are kept in the settings table and changed with the admin API, or
+// loaded from a JSON file with the workerBee -rules flag.  New factors are
+// added with RegisterScoringFactor.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	settingScoringRules = "scoring_rules"
+	scoringWeeks        = 4 // Weeks counted by the frequency factor, the current week and the 3 before it
+
+	ScoringOpAdd      = "add"
+	ScoringOpMultiply = "multiply"
+)
+
+// ScoringRule adds Weight * factor to the raw score, or multiplies the raw score by 1 + Weight * factor
+type ScoringRule struct {
+	Name     string             `json:"name" required:"true"`
+	Factor   string             `json:"factor" required:"true"` // decay, recency, frequency, distinct_sources, source_reliability, fidelity, geo, asn, confirmation, object_type or a registered factor
+	Op       string             `json:"op" required:"true" enum:"add,multiply"`
+	Weight   float64            `json:"weight"`
+	Cap      float64            `json:"cap,omitempty"`    // Maximum contribution of an add rule or multiplier of a multiply rule, 0 has no cap
+	Values   map[string]float64 `json:"values,omitempty"` // Value of each source, fidelity, country, ASN or object type, "default" for the rest
+	Disabled bool               `json:"disabled,omitempty"`
+}
+
+type ScoringRuleSet struct {
+	Version     int           `json:"version"`       // Incremented every time the rules are saved
+	MaxRawScore float64       `json:"max_raw_score"` // The raw score is capped here and normalised so this is 100
+	Rules       []ScoringRule `json:"rules"`
+}
+
+// Sighting is a report of an object, Time is when the source saw it or else when it was imported
+type Sighting struct {
+	Time   time.Time
+	Source string
+	Count  int // Reports by the source at the same time
+}
+
+// ObjectFacts are what the factors know about an object
+type ObjectFacts struct {
+	Object        string
+	ObjectType    string
+	Fidelity      string
+	GeoCountry    string
+	GeoASN        string
+	LastSeen      time.Time
+	ConfirmedRisk bool
+	Sightings     []Sighting     // Within the lookback_days of the settings
+	Sources       []string       // Distinct sources of the sightings
+	Weights       ScoringWeights // Multipliers of each week from the settings
+	HalfLives     DecayHalfLives // Half-lives of the decay factor from the settings
+	Now           time.Time
+}
+
+// ScoringFactor returns the value of a factor for an object, the rule gives access to its Values
+type ScoringFactor func(facts ObjectFacts, rule ScoringRule) float64
+
+type ScoreContribution struct {
+	Rule   string  `json:"rule"`
+	Factor string  `json:"factor"`
+	Op     string  `json:"op"`
+	Value  float64 `json:"value"`  // Raw value of the factor
+	Weight float64 `json:"weight"` // Weight of the rule
+	Effect float64 `json:"effect"` // Amount added, or the multiplier
+	Points float64 `json:"points"` // Change of the raw score
+}
+
+type ScoreResult struct {
+	Score         int                 `json:"score"` // 0-100
+	RawScore      float64             `json:"raw_score"`
+	RuleVersion   int                 `json:"rule_version"`
+	Contributions []ScoreContribution `json:"contributions"`
+}
+
+var (
+	scoringFactorsMu sync.RWMutex
+	scoringFactors   = map[string]ScoringFactor{
+		"decay":              decayFactor,
+		"recency":            recencyFactor,
+		"frequency":          frequencyFactor,
+		"distinct_sources":   distinctSourcesFactor,
+		"source_reliability": sourceReliabilityFactor,
+		"fidelity":           func(f ObjectFacts, r ScoringRule) float64 { return lookupValue(r, f.Fidelity) },
+		"geo":                func(f ObjectFacts, r ScoringRule) float64 { return lookupValue(r, f.GeoCountry) },
+		"asn":                func(f ObjectFacts, r ScoringRule) float64 { return lookupValue(r, f.GeoASN) },
+		"object_type":        func(f ObjectFacts, r ScoringRule) float64 { return lookupValue(r, f.ObjectType) },
+		"confirmation":       confirmationFactor,
+	}
+)
+
+// RegisterScoringFactor adds a factor that rules can use, an existing factor with the same name is replaced
+func RegisterScoringFactor(name string, factor ScoringFactor) {
+	scoringFactorsMu.Lock()
+	defer scoringFactorsMu.Unlock()
+	scoringFactors[name] = factor
+}
+
+func scoringFactor(name string) (ScoringFactor, bool) {
+	scoringFactorsMu.RLock()
+	defer scoringFactorsMu.RUnlock()
+	factor, ok := scoringFactors[name]
+	return factor, ok
+}
+
+// recencyFactor is 1 when the object was seen now and falls to 0 at Values["window_days"], 28 days by default
+func recencyFactor(f ObjectFacts, r ScoringRule) float64 {
+	if f.LastSeen.IsZero() {
+		return 0
+	}
+	window := 28.0
+	if days, ok := r.Values["window_days"]; ok && days > 0 {
+		window = days
+	}
+	age := f.Now.Sub(f.LastSeen).Hours() / 24
+	if age < 0 {
+		age = 0
+	}
+	return math.Max(0, 1-age/window)
+}
+
+// decayFactor is the number of sightings, each halved for every half-life that has passed since it was seen
+func decayFactor(f ObjectFacts, r ScoringRule) float64 {
+	total := 0.0
+	for _, sighting := range f.Sightings {
+		halfLife := f.HalfLives.HalfLife(f.ObjectType, sighting.Source)
+		if halfLife <= 0 {
+			continue
+		}
+		age := f.Now.Sub(sighting.Time)
+		if age < 0 {
+			age = 0
+		}
+		total += float64(sighting.Count) * math.Exp2(-age.Hours()/halfLife.Hours())
+	}
+	return total
+}
+
+// frequencyFactor is the sightings of each ISO week multiplied by the scoring weights of the settings
+// The weight of a sighting drops a tier when the week ends, the decay factor does not
+func frequencyFactor(f ObjectFacts, r ScoringRule) float64 {
+	weights := [scoringWeeks]int{f.Weights.CurrentWeek, f.Weights.LastWeek, f.Weights.TwoWeeksAgo, f.Weights.ThreeWeeksAgo}
+	total := 0
+	for _, sighting := range f.Sightings {
+		if week := weeksBefore(f.Now, sighting.Time); week >= 0 && week < scoringWeeks {
+			total += sighting.Count * weights[week]
+		}
+	}
+	return float64(total)
+}
+
+// weeksBefore returns how many ISO weeks t is before the week of now, 0 for the same week
+func weeksBefore(now time.Time, t time.Time) int {
+	monday := func(t time.Time) time.Time {
+		t = t.In(now.Location())
+		return time.Date(t.Year(), t.Month(), t.Day()-(int(t.Weekday())+6)%7, 0, 0, 0, 0, now.Location())
+	}
+	return int(math.Round(monday(now).Sub(monday(t)).Hours() / (24 * 7)))
+}
+
+func distinctSourcesFactor(f ObjectFacts, r ScoringRule) float64 {
+	return float64(len(f.Sources))
+}
+
+// sourceReliabilityFactor is the highest value of the sources that reported the object
+func sourceReliabilityFactor(f ObjectFacts, r ScoringRule) float64 {
+	best := 0.0
+	for i, source := range f.Sources {
+		value := lookupValue(r, source)
+		if i == 0 || value > best {
+			best = value
+		}
+	}
+	return best
+}
+
+func confirmationFactor(f ObjectFacts, r ScoringRule) float64 {
+	if f.ConfirmedRisk {
+		return 1
+	}
+	return 0
+}
+
+// lookupValue matches the key without regard to case and falls back to Values["default"]
+func lookupValue(r ScoringRule, key string) float64 {
+	if value, ok := r.Values[key]; ok {
+		return value
+	}
+	for k, value := range r.Values {
+		if strings.EqualFold(k, key) {
+			return value
+		}
+	}
+	return r.Values["default"]
+}
+
+func DefaultScoringRules() ScoringRuleSet {
+	return ScoringRuleSet{
+		Version:     1,
+		MaxRawScore: 100,
+		Rules: []ScoringRule{
+			{Name: "decayed sightings", Factor: "decay", Op: ScoringOpAdd, Weight: 4, Cap: 60},
+			{Name: "seen recently", Factor: "recency", Op: ScoringOpAdd, Weight: 10, Values: map[string]float64{"window_days": 28}},
+			{Name: "reported by several sources", Factor: "distinct_sources", Op: ScoringOpAdd, Weight: 5, Cap: 20},
+			{Name: "analyst confirmed", Factor: "confirmation", Op: ScoringOpAdd, Weight: 50},
+			{Name: "fidelity", Factor: "fidelity", Op: ScoringOpMultiply, Weight: 1, Values: map[string]float64{"High": 0.5, "Medium": 0.25, "Low": 0}},
+			{Name: "source reliability", Factor: "source_reliability", Op: ScoringOpMultiply, Weight: 1, Values: map[string]float64{"default": 0}},
+		},
+	}
+}
+
+func (rs ScoringRuleSet) Validate() error {
+	var errs []error
+	if rs.MaxRawScore <= 0 {
+		errs = append(errs, fmt.Errorf("max_raw_score must be greater than 0"))
+	}
+	names := make(map[string]bool)
+	for i, rule := range rs.Rules {
+		if strings.TrimSpace(rule.Name) == "" {
+			errs = append(errs, fmt.Errorf("rules[%d] is missing the name", i))
+		} else if names[rule.Name] {
+			errs = append(errs, fmt.Errorf("rules[%d] %s is a duplicate name", i, rule.Name))
+		}
+		names[rule.Name] = true
+		if _, ok := scoringFactor(rule.Factor); !ok {
+			errs = append(errs, fmt.Errorf("rules[%d] %s has an unknown factor %q", i, rule.Name, rule.Factor))
+		}
+		if rule.Op != ScoringOpAdd && rule.Op != ScoringOpMultiply {
+			errs = append(errs, fmt.Errorf("rules[%d] %s op must be add or multiply", i, rule.Name))
+		}
+		if rule.Cap < 0 {
+			errs = append(errs, fmt.Errorf("rules[%d] %s cap must not be negative", i, rule.Name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Score applies the rules to the facts of an object
+func (rs ScoringRuleSet) Score(facts ObjectFacts) ScoreResult {
+	result := ScoreResult{RuleVersion: rs.Version, Contributions: []ScoreContribution{}}
+
+	raw := 0.0
+	for _, op := range []string{ScoringOpAdd, ScoringOpMultiply} {
+		for _, rule := range rs.Rules {
+			if rule.Disabled || rule.Op != op {
+				continue
+			}
+			factor, ok := scoringFactor(rule.Factor)
+			if !ok {
+				continue
+			}
+			value := factor(facts, rule)
+			var effect float64
+			before := raw
+			if op == ScoringOpAdd {
+				effect = rule.Weight * value
+				if rule.Cap > 0 {
+					effect = math.Min(effect, rule.Cap)
+				}
+				raw += effect
+			} else {
+				effect = 1 + rule.Weight*value
+				if rule.Cap > 0 {
+					effect = math.Min(effect, rule.Cap)
+				}
+				raw *= effect
+			}
+			result.Contributions = append(result.Contributions, ScoreContribution{Rule: rule.Name, Factor: rule.Factor, Op: op, Value: value, Weight: rule.Weight, Effect: effect, Points: raw - before})
+		}
+	}
+
+	result.RawScore = raw
+	capped := math.Max(0, math.Min(raw, rs.MaxRawScore))
+	result.Score = int(math.Round(capped / rs.MaxRawScore * 100))
+	return result
+}
+
+// LoadScoringRules reads a rule set from a JSON file
+func LoadScoringRules(f string) (ScoringRuleSet, error) {
+	var rules ScoringRuleSet
+	data, err := os.ReadFile(f)
+	if err != nil {
+		return rules, err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rules); err != nil {
+		return rules, fmt.Errorf("failed to decode %s: %w", f, err)
+	}
+	if err := rules.Validate(); err != nil {
+		return rules, fmt.Errorf("invalid scoring rules in %s: %w", f, err)
+	}
+	return rules, nil
+}
+
+// GetScoringRules returns the rules saved in the settings table or the defaults
+func (s *ServerConfig) GetScoringRules() (ScoringRuleSet, error) {
+	rules := DefaultScoringRules()
+	if _, err := s.GetSetting(settingScoringRules, &rules); err != nil {
+		return DefaultScoringRules(), err
+	}
+	return rules, nil
+}
+
+// SaveScoringRules validates the rules, saves them with the next version and marks every object to be rescored
+func (s *ServerConfig) SaveScoringRules(rules ScoringRuleSet) (ScoringRuleSet, error) {
+	if err := rules.Validate(); err != nil {
+		return rules, err
+	}
+	current, err := s.GetScoringRules()
+	if err != nil {
+		return rules, err
+	}
+	rules.Version = current.Version + 1
+	if err := s.SetSetting(settingScoringRules, rules); err != nil {
+		return rules, err
+	}
+
+	// Every object is due to be rescored with the new rules, the workerBee works through them in batches
+	if err := s.Store.MarkAllForRescore(); err != nil {
+		return rules, err
+	}
+	return rules, nil
+}
+
+// ScoringFactors lists the names of the registered factors
+func ScoringFactors() []string {
+	scoringFactorsMu.RLock()
+	defer scoringFactorsMu.RUnlock()
+	names := make([]string, 0, len(scoringFactors))
+	for name := range scoringFactors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseTimestamp reads the timestamps stored by the importers and by SQLite
+func parseTimestamp(value string) time.Time {
+	layouts := []string{
+		"2006-01-02 15:04:05.999999999-07:00",
+		time.RFC3339Nano,
+		"2006-01-02 15:04:05",
+		"2006-01-02T15:04:05",
+		"2006-01-02",
+	}
+	value = strings.TrimSpace(value)
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// GetObjectFacts reads the object_intel row of an object and its sightings since the lookback
+func (s *ServerConfig) GetObjectFacts(object string, lookback time.Time) (ObjectFacts, error) {
+	return s.Store.ObjectFacts(object, lookback)
+}
+
+// scoringRules returns the rules from ScoringRulesFile when it is set, otherwise the rules in the settings table
+func (s *ServerConfig) scoringRules() (ScoringRuleSet, error) {
+	if s.ScoringRulesFile != "" {
+		return LoadScoringRules(s.ScoringRulesFile)
+	}
+	return s.GetScoringRules()
+}
@@ -0,0 +1,154 @@
+package common
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// constantRule is a rule on the object_type factor, which is value for an object of any type
+func constantRule(name string, op string, weight float64, value float64, limit float64) ScoringRule {
+	return ScoringRule{Name: name, Factor: "object_type", Op: op, Weight: weight, Cap: limit, Values: map[string]float64{"default": value}}
+}
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		name  string
+		max   float64
+		rules []ScoringRule
+		raw   float64
+		score int
+	}{
+		{"no rules", 100, nil, 0, 0},
+		{"add", 100, []ScoringRule{constantRule("a", ScoringOpAdd, 10, 2, 0), constantRule("b", ScoringOpAdd, 1, 5, 0)}, 25, 25},
+		{"multiply listed before add", 100, []ScoringRule{constantRule("m", ScoringOpMultiply, 1, 1, 0), constantRule("a", ScoringOpAdd, 10, 1, 0)}, 20, 20},
+		{"multiply listed after add", 100, []ScoringRule{constantRule("a", ScoringOpAdd, 10, 1, 0), constantRule("m", ScoringOpMultiply, 1, 1, 0)}, 20, 20},
+		{"multiply only", 100, []ScoringRule{constantRule("m", ScoringOpMultiply, 2, 3, 0), constantRule("n", ScoringOpMultiply, 1, 1, 0)}, 0, 0},
+		{"add cap", 100, []ScoringRule{constantRule("a", ScoringOpAdd, 10, 5, 20)}, 20, 20},
+		{"add under the cap", 100, []ScoringRule{constantRule("a", ScoringOpAdd, 10, 1, 20)}, 10, 10},
+		{"multiply cap", 100, []ScoringRule{constantRule("a", ScoringOpAdd, 10, 1, 0), constantRule("m", ScoringOpMultiply, 1, 5, 3)}, 30, 30},
+		{"multiply by 0", 100, []ScoringRule{constantRule("a", ScoringOpAdd, 10, 1, 0), constantRule("m", ScoringOpMultiply, 1, -1, 0)}, 0, 0},
+		{"disabled", 100, []ScoringRule{constantRule("a", ScoringOpAdd, 10, 1, 0), {Name: "off", Factor: "object_type", Op: ScoringOpAdd, Weight: 50, Values: map[string]float64{"default": 1}, Disabled: true}}, 10, 10},
+		{"unknown factor", 100, []ScoringRule{constantRule("a", ScoringOpAdd, 10, 1, 0), {Name: "unknown", Factor: "no_such_factor", Op: ScoringOpAdd, Weight: 50}}, 10, 10},
+		{"normalised to max_raw_score", 200, []ScoringRule{constantRule("a", ScoringOpAdd, 1, 50, 0)}, 50, 25},
+		{"rounded down", 3, []ScoringRule{constantRule("a", ScoringOpAdd, 1, 1, 0)}, 1, 33},
+		{"rounded up", 3, []ScoringRule{constantRule("a", ScoringOpAdd, 1, 2, 0)}, 2, 67},
+		{"raw score above max_raw_score", 100, []ScoringRule{constantRule("a", ScoringOpAdd, 10, 15, 0)}, 150, 100},
+		{"negative raw score", 100, []ScoringRule{constantRule("a", ScoringOpAdd, -5, 2, 0)}, -10, 0},
+	}
+	for _, test := range tests {
+		rules := ScoringRuleSet{Version: 7, MaxRawScore: test.max, Rules: test.rules}
+		result := rules.Score(ObjectFacts{ObjectType: "ipv4"})
+		if result.RawScore != test.raw || result.Score != test.score || result.RuleVersion != 7 {
+			t.Errorf("%s: raw %v score %d version %d, want raw %v score %d", test.name, result.RawScore, result.Score, result.RuleVersion, test.raw, test.score)
+		}
+		points := 0.0
+		for _, c := range result.Contributions {
+			points += c.Points
+		}
+		if points != result.RawScore {
+			t.Errorf("%s: the contributions add up to %v, the raw score is %v", test.name, points, result.RawScore)
+		}
+	}
+}
+
+// The contributions are listed in the order the rules were applied, every add rule before the multiply rules
+func TestScoreContributions(t *testing.T) {
+	rules := ScoringRuleSet{MaxRawScore: 100, Rules: []ScoringRule{
+		constantRule("m", ScoringOpMultiply, 0.5, 1, 0),
+		constantRule("a", ScoringOpAdd, 4, 5, 15),
+		constantRule("b", ScoringOpAdd, 1, 5, 0),
+	}}
+	want := []ScoreContribution{
+		{Rule: "a", Factor: "object_type", Op: ScoringOpAdd, Value: 5, Weight: 4, Effect: 15, Points: 15},
+		{Rule: "b", Factor: "object_type", Op: ScoringOpAdd, Value: 5, Weight: 1, Effect: 5, Points: 5},
+		{Rule: "m", Factor: "object_type", Op: ScoringOpMultiply, Value: 1, Weight: 0.5, Effect: 1.5, Points: 10},
+	}
+	result := rules.Score(ObjectFacts{ObjectType: "ipv4"})
+	if len(result.Contributions) != len(want) {
+		t.Fatalf("contributions = %+v", result.Contributions)
+	}
+	for i := range want {
+		if result.Contributions[i] != want[i] {
+			t.Errorf("contribution %d = %+v, want %+v", i, result.Contributions[i], want[i])
+		}
+	}
+	if result.RawScore != 30 || result.Score != 30 {
+		t.Errorf("raw %v score %d, want 30", result.RawScore, result.Score)
+	}
+}
+
+func TestDecayFactor(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	halfLives := DecayHalfLives{DefaultHours: 24, ObjectTypes: map[string]float64{"hash": 48}, Sources: map[string]float64{"fast": 12, "off": 0, "broken": -24}}
+	tests := []struct {
+		name       string
+		objectType string
+		sightings  []Sighting
+		want       float64
+	}{
+		{"no sightings", "ipv4", nil, 0},
+		{"seen now", "ipv4", []Sighting{{Time: now, Source: "feed", Count: 3}}, 3},
+		{"one half-life ago", "ipv4", []Sighting{{Time: now.Add(-24 * time.Hour), Source: "feed", Count: 1}}, 0.5},
+		{"two half-lives ago", "ipv4", []Sighting{{Time: now.Add(-48 * time.Hour), Source: "feed", Count: 4}}, 1},
+		{"half-life of the object type", "hash", []Sighting{{Time: now.Add(-48 * time.Hour), Source: "feed", Count: 1}}, 0.5},
+		{"half-life of the source before the object type", "hash", []Sighting{{Time: now.Add(-24 * time.Hour), Source: "fast", Count: 1}}, 0.25},
+		{"seen in the future", "ipv4", []Sighting{{Time: now.Add(time.Hour), Source: "feed", Count: 2}}, 2},
+		{"zero half-life", "ipv4", []Sighting{{Time: now, Source: "off", Count: 5}, {Time: now, Source: "feed", Count: 1}}, 1},
+		{"negative half-life", "ipv4", []Sighting{{Time: now, Source: "broken", Count: 5}, {Time: now, Source: "feed", Count: 1}}, 1},
+		{"summed", "ipv4", []Sighting{{Time: now, Source: "feed", Count: 1}, {Time: now.Add(-24 * time.Hour), Source: "feed", Count: 1}, {Time: now.Add(-24 * time.Hour), Source: "fast", Count: 1}}, 1.75},
+	}
+	for _, test := range tests {
+		facts := ObjectFacts{ObjectType: test.objectType, Sightings: test.sightings, HalfLives: halfLives, Now: now}
+		if got := decayFactor(facts, ScoringRule{}); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: decayFactor = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// Without half-lives nothing is counted
+	facts := ObjectFacts{Sightings: []Sighting{{Time: now, Count: 1}}, Now: now}
+	if got := decayFactor(facts, ScoringRule{}); got != 0 {
+		t.Errorf("decayFactor without half-lives = %v", got)
+	}
+}
+
+func TestWeeksBefore(t *testing.T) {
+	// Monday 19 October 2026
+	monday := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	now := monday.Add(36 * time.Hour)
+	plus2 := time.FixedZone("UTC+2", 2*60*60)
+	tests := []struct {
+		name string
+		now  time.Time
+		t    time.Time
+		want int
+	}{
+		{"now", now, now, 0},
+		{"start of the week", now, monday, 0},
+		{"end of the week", now, monday.Add(7*24*time.Hour - time.Second), 0},
+		{"end of last week", now, monday.Add(-time.Second), 1},
+		{"start of last week", now, monday.Add(-7 * 24 * time.Hour), 1},
+		{"a week ago", now, now.Add(-7 * 24 * time.Hour), 1},
+		{"three weeks ago", now, monday.Add(-15 * 24 * time.Hour), 3},
+		{"four weeks ago", now, monday.Add(-28 * 24 * time.Hour), 4},
+		{"next week", now, monday.Add(7 * 24 * time.Hour), -1},
+		{"across the new year", time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC), time.Date(2025, 12, 29, 0, 0, 0, 0, time.UTC), 0},
+		{"last week of the old year", time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC), time.Date(2025, 12, 28, 23, 0, 0, 0, time.UTC), 1},
+		{"Monday in another zone is Sunday here", monday.Add(time.Hour), time.Date(2026, 10, 19, 0, 30, 0, 0, plus2), 1},
+		{"Sunday here is Monday in the zone of now", time.Date(2026, 10, 19, 0, 30, 0, 0, plus2), monday.Add(-time.Hour), 0},
+	}
+	if amsterdam, err := time.LoadLocation("Europe/Amsterdam"); err == nil {
+		// The week of the clock change is an hour longer
+		tests = append(tests, struct {
+			name string
+			now  time.Time
+			t    time.Time
+			want int
+		}{"across the end of summer time", time.Date(2026, 11, 2, 9, 0, 0, 0, amsterdam), time.Date(2026, 10, 19, 9, 0, 0, 0, amsterdam), 2})
+	}
+	for _, test := range tests {
+		if got := weeksBefore(test.now, test.t); got != test.want {
+			t.Errorf("%s: weeksBefore(%s, %s) = %d, want %d", test.name, test.now, test.t, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package common
+
+// Settings changed through the admin API, stored as JSON values in the settings table
+//
+// Each top level key of Settings is a row in the settings table.  Keys that have
+// not been saved use the defaults, so tuning the scoring or the blocklist does
+// not need a rebuild.  A field added to a key after it was saved also uses its
+// default, the maps and lists of a saved key replace the default ones.  The workerBee reads the settings at the start of each run,
+// in -daemon mode before each stage, and the apiServer on every export.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	maxBatchLimit   = 1000000
+	maxLookbackDays = 3650
+)
+
+// SeverityBand starts at MinScore and ends at the MinScore of the next band
+type SeverityBand struct {
+	Name      string `json:"name" required:"true"`
+	MinScore  int    `json:"min_score"`
+	Block     bool   `json:"block"`      // Exported to the blocklist by default
+	BlockDays int    `json:"block_days"` // Only exported while last_seen is within this many days, 0 has no limit
+}
+
+// Multipliers of the sightings in each week of the risk score
+type ScoringWeights struct {
+	CurrentWeek   int `json:"current_week"`
+	LastWeek      int `json:"last_week"`
+	TwoWeeksAgo   int `json:"two_weeks_ago"`
+	ThreeWeeksAgo int `json:"three_weeks_ago"`
+}
+
+// Maximum number of rows read in a single run, due to performance issues these may need to be modified
+type BatchLimits struct {
+	PendingImport int `json:"pending_import"` // Rows moved from pending_import per run
+	Rescore       int `json:"rescore"`        // Objects rescored per run
+	Export        int `json:"export"`         // Maximum limit of the blocklist export
+}
+
+// Half-life of a sighting in the decay scoring factor, a source overrides the object type
+type DecayHalfLives struct {
+	DefaultHours float64            `json:"default_hours"`          // Half-life when neither the source nor the object type is listed
+	ObjectTypes  map[string]float64 `json:"object_types,omitempty"` // Hours for each object_type
+	Sources      map[string]float64 `json:"sources,omitempty"`      // Hours for each source
+	LookbackDays int                `json:"lookback_days"`          // Sightings older than this are not read
+}
+
+// HalfLife returns the half-life of a sighting of an object type reported by a source
+func (hl DecayHalfLives) HalfLife(objectType string, source string) time.Duration {
+	hours := hl.DefaultHours
+	if value, ok := hl.ObjectTypes[objectType]; ok {
+		hours = value
+	}
+	if value, ok := hl.Sources[source]; ok && source != "" {
+		hours = value
+	}
+	return time.Duration(hours * float64(time.Hour))
+}
+
+// What the prune step of the workerBee deletes, 0 keeps everything
+type RetentionSettings struct {
+	SightingDays    int `json:"sighting_days"`     // Sightings observed longer ago are deleted, at least lookback_days
+	ArchiveDays     int `json:"archive_days"`      // Archived CSV files older than this are deleted
+	ArchiveMaxMB    int `json:"archive_max_mb"`    // The oldest archived CSV files are deleted until the archive fits
+	StaleObjectDays int `json:"stale_object_days"` // Untrusted, unconfirmed objects not seen for this many days
+	StaleMaxScore   int `json:"stale_max_score"`   // and scored at or below this are expired with a tombstone
+	StageRunDays    int `json:"stage_run_days"`    // Runs of the workerBee stages started longer ago are deleted
+	ImportBatchDays int `json:"import_batch_days"` // Import batches finished longer ago are deleted with the outcomes of their rows
+}
+
+// Seconds between the runs of each stage of the workerBee -daemon, 0 does not run the stage
+type StageIntervals struct {
+	ImportCSV      int `json:"import_csv"`
+	ProcessImports int `json:"process_imports"`
+	TrustedCSV     int `json:"trusted_csv"`
+	MarkTrusted    int `json:"mark_trusted"`
+	Rescore        int `json:"rescore"`
+	Prune          int `json:"prune"`
+	Backup         int `json:"backup"`
+	Enrich         int `json:"enrich"`
+}
+
+// Interval returns the time between the runs of a stage, 0 when it is not run or unknown
+func (si StageIntervals) Interval(stage string) time.Duration {
+	seconds := map[string]int{
+		StageImportCSV:      si.ImportCSV,
+		StageProcessImports: si.ProcessImports,
+		StageTrustedCSV:     si.TrustedCSV,
+		StageMarkTrusted:    si.MarkTrusted,
+		StageRescore:        si.Rescore,
+		StagePrune:          si.Prune,
+		StageBackup:         si.Backup,
+		StageEnrich:         si.Enrich,
+	}[stage]
+	return time.Duration(seconds) * time.Second
+}
+
+// Which enrichers of the workerBee run for each object type, see commonEnrich.go
+type EnrichmentSettings struct {
+	ObjectTypes  map[string][]string `json:"object_types,omitempty"` // Names of the enrichers for each object_type, run in order
+	TimeoutMS    int                 `json:"timeout_ms"`             // Longest a lookup of one enricher may take
+	CacheMinutes int                 `json:"cache_minutes"`          // How long a lookup is reused, 0 does not cache
+	RefreshDays  int                 `json:"refresh_days"`           // The enrich stage looks up objects enriched longer ago, 0 only never enriched objects
+	BatchLimit   int                 `json:"batch_limit"`            // Objects looked up per run of the enrich stage
+}
+
+type Settings struct {
+	SeverityBands        []SeverityBand     `json:"severity_bands"`
+	ScoringWeights       ScoringWeights     `json:"scoring_weights"`
+	RescoreIntervalHours int                `json:"rescore_interval_hours"` // Objects are rescored when their score is older than this
+	BatchLimits          BatchLimits        `json:"batch_limits"`
+	VerdictRules         VerdictRules       `json:"verdict_rules"`
+	DecayHalfLives       DecayHalfLives     `json:"decay_half_lives"`
+	Retention            RetentionSettings  `json:"retention"`
+	StageIntervals       StageIntervals     `json:"stage_intervals"`
+	Enrichment           EnrichmentSettings `json:"enrichment"`
+}
+
+func DefaultSettings() Settings {
+	return Settings{
+		SeverityBands: []SeverityBand{
+			{Name: "low", MinScore: 0},
+			{Name: "medium", MinScore: defaultBlockScore, Block: true, BlockDays: 7},
+			{Name: "high", MinScore: 20, Block: true, BlockDays: 30},
+			{Name: "critical", MinScore: 40, Block: true, BlockDays: 90},
+		},
+		ScoringWeights:       ScoringWeights{CurrentWeek: 4, LastWeek: 2, TwoWeeksAgo: 1, ThreeWeeksAgo: 1},
+		RescoreIntervalHours: 48,
+		BatchLimits:          BatchLimits{PendingImport: 10000, Rescore: 10000, Export: defaultExportLimit},
+		VerdictRules:         DefaultVerdictRules(),
+		DecayHalfLives: DecayHalfLives{
+			DefaultHours: 168,
+			// Addresses are reassigned within days, domains and hashes stay bad for longer
+			ObjectTypes:  map[string]float64{"ipv4": 72, "ipv6": 72, "url": 336, "domain": 720, "hash": 2160},
+			LookbackDays: 180,
+		},
+		// Objects below the first blocked band that have not been seen for a year are expired
+		Retention: RetentionSettings{SightingDays: 365, ArchiveDays: 90, ArchiveMaxMB: 1024, StaleObjectDays: 365, StaleMaxScore: defaultBlockScore - 1, StageRunDays: 30, ImportBatchDays: 30},
+		StageIntervals: StageIntervals{
+			ImportCSV:      60,
+			ProcessImports: 60,
+			TrustedCSV:     300,
+			MarkTrusted:    300,
+			Rescore:        900,
+			Prune:          86400,
+			Backup:         86400,
+			Enrich:         3600,
+		},
+		// No enricher is enabled until an admin lists them for an object type
+		Enrichment: EnrichmentSettings{TimeoutMS: 2000, CacheMinutes: 60, RefreshDays: 30, BatchLimit: 10000},
+	}
+}
+
+func (st Settings) Validate() error {
+	var errs []error
+	if len(st.SeverityBands) == 0 {
+		errs = append(errs, fmt.Errorf("severity_bands must have at least one band"))
+	}
+	names := make(map[string]bool)
+	scores := make(map[int]bool)
+	for i, band := range st.SeverityBands {
+		if strings.TrimSpace(band.Name) == "" {
+			errs = append(errs, fmt.Errorf("severity_bands[%d] is missing the name", i))
+		} else if names[band.Name] {
+			errs = append(errs, fmt.Errorf("severity_bands[%d] %s is a duplicate name", i, band.Name))
+		}
+		names[band.Name] = true
+		if band.MinScore < 0 {
+			errs = append(errs, fmt.Errorf("severity_bands[%d] %s min_score must not be negative", i, band.Name))
+		} else if scores[band.MinScore] {
+			errs = append(errs, fmt.Errorf("severity_bands[%d] %s min_score %d is used by another band", i, band.Name, band.MinScore))
+		}
+		scores[band.MinScore] = true
+		if band.BlockDays < 0 {
+			errs = append(errs, fmt.Errorf("severity_bands[%d] %s block_days must not be negative", i, band.Name))
+		}
+	}
+
+	weights := []struct {
+		name  string
+		value int
+	}{
+		{"current_week", st.ScoringWeights.CurrentWeek},
+		{"last_week", st.ScoringWeights.LastWeek},
+		{"two_weeks_ago", st.ScoringWeights.TwoWeeksAgo},
+		{"three_weeks_ago", st.ScoringWeights.ThreeWeeksAgo},
+	}
+	for _, weight := range weights {
+		if weight.value < 0 {
+			errs = append(errs, fmt.Errorf("scoring_weights.%s must not be negative", weight.name))
+		}
+	}
+
+	if st.RescoreIntervalHours < 1 {
+		errs = append(errs, fmt.Errorf("rescore_interval_hours must be at least 1"))
+	}
+
+	limits := []struct {
+		name  string
+		value int
+	}{
+		{"pending_import", st.BatchLimits.PendingImport},
+		{"rescore", st.BatchLimits.Rescore},
+		{"export", st.BatchLimits.Export},
+	}
+	for _, limit := range limits {
+		if limit.value < 1 || limit.value > maxBatchLimit {
+			errs = append(errs, fmt.Errorf("batch_limits.%s must be between 1 and %d", limit.name, maxBatchLimit))
+		}
+	}
+
+	if err := st.VerdictRules.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if st.DecayHalfLives.DefaultHours <= 0 {
+		errs = append(errs, fmt.Errorf("decay_half_lives.default_hours must be greater than 0"))
+	}
+	for _, objectType := range sortedKeys(st.DecayHalfLives.ObjectTypes) {
+		if !isValidObjectType(objectType) {
+			errs = append(errs, fmt.Errorf("decay_half_lives.object_types has an unknown object type %q", objectType))
+		} else if st.DecayHalfLives.ObjectTypes[objectType] <= 0 {
+			errs = append(errs, fmt.Errorf("decay_half_lives.object_types.%s must be greater than 0", objectType))
+		}
+	}
+	for _, source := range sortedKeys(st.DecayHalfLives.Sources) {
+		if st.DecayHalfLives.Sources[source] <= 0 {
+			errs = append(errs, fmt.Errorf("decay_half_lives.sources.%s must be greater than 0", source))
+		}
+	}
+	if st.DecayHalfLives.LookbackDays < 1 || st.DecayHalfLives.LookbackDays > maxLookbackDays {
+		errs = append(errs, fmt.Errorf("decay_half_lives.lookback_days must be between 1 and %d", maxLookbackDays))
+	}
+
+	retention := []struct {
+		name  string
+		value int
+	}{
+		{"sighting_days", st.Retention.SightingDays},
+		{"archive_days", st.Retention.ArchiveDays},
+		{"archive_max_mb", st.Retention.ArchiveMaxMB},
+		{"stale_object_days", st.Retention.StaleObjectDays},
+		{"stale_max_score", st.Retention.StaleMaxScore},
+		{"stage_run_days", st.Retention.StageRunDays},
+		{"import_batch_days", st.Retention.ImportBatchDays},
+	}
+	for _, setting := range retention {
+		if setting.value < 0 {
+			errs = append(errs, fmt.Errorf("retention.%s must not be negative", setting.name))
+		}
+	}
+	// Scoring reads the sightings back to lookback_days
+	if st.Retention.SightingDays > 0 && st.Retention.SightingDays < st.DecayHalfLives.LookbackDays {
+		errs = append(errs, fmt.Errorf("retention.sighting_days must be 0 or at least decay_half_lives.lookback_days %d", st.DecayHalfLives.LookbackDays))
+	}
+
+	intervals := []struct {
+		name  string
+		value int
+	}{
+		{StageImportCSV, st.StageIntervals.ImportCSV},
+		{StageProcessImports, st.StageIntervals.ProcessImports},
+		{StageTrustedCSV, st.StageIntervals.TrustedCSV},
+		{StageMarkTrusted, st.StageIntervals.MarkTrusted},
+		{StageRescore, st.StageIntervals.Rescore},
+		{StagePrune, st.StageIntervals.Prune},
+		{StageBackup, st.StageIntervals.Backup},
+		{StageEnrich, st.StageIntervals.Enrich},
+	}
+	for _, interval := range intervals {
+		if interval.value < 0 {
+			errs = append(errs, fmt.Errorf("stage_intervals.%s must not be negative", interval.name))
+		}
+	}
+
+	// The enricher names are checked by the workerBee, the apiServer is built without them
+	for _, objectType := range sortedKeys(st.Enrichment.ObjectTypes) {
+		if !isValidObjectType(objectType) {
+			errs = append(errs, fmt.Errorf("enrichment.object_types has an unknown object type %q", objectType))
+		}
+		for i, name := range st.Enrichment.ObjectTypes[objectType] {
+			if strings.TrimSpace(name) == "" {
+				errs = append(errs, fmt.Errorf("enrichment.object_types.%s[%d] is missing the name", objectType, i))
+			}
+		}
+	}
+	if st.Enrichment.TimeoutMS < 1 {
+		errs = append(errs, fmt.Errorf("enrichment.timeout_ms must be at least 1"))
+	}
+	if st.Enrichment.CacheMinutes < 0 {
+		errs = append(errs, fmt.Errorf("enrichment.cache_minutes must not be negative"))
+	}
+	if st.Enrichment.RefreshDays < 0 {
+		errs = append(errs, fmt.Errorf("enrichment.refresh_days must not be negative"))
+	}
+	if st.Enrichment.BatchLimit < 1 || st.Enrichment.BatchLimit > maxBatchLimit {
+		errs = append(errs, fmt.Errorf("enrichment.batch_limit must be between 1 and %d", maxBatchLimit))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Bands returns the severity bands ordered by MinScore, lowest first
+func (st Settings) Bands() []SeverityBand {
+	bands := append([]SeverityBand(nil), st.SeverityBands...)
+	sort.Slice(bands, func(i, j int) bool { return bands[i].MinScore < bands[j].MinScore })
+	return bands
+}
+
+// Severity returns the name of the band a score falls in, "" below the lowest band
+func (st Settings) Severity(score int) string {
+	severity := ""
+	for _, band := range st.Bands() {
+		if score >= band.MinScore {
+			severity = band.Name
+		}
+	}
+	return severity
+}
+
+// BlockScore is the lowest MinScore of the bands that are blocked, the default min_score of the blocklist export
+func (st Settings) BlockScore() int {
+	for _, band := range st.Bands() {
+		if band.Block {
+			return band.MinScore
+		}
+	}
+	// No band is blocked, only export objects above every band
+	bands := st.Bands()
+	if len(bands) == 0 {
+		return defaultBlockScore
+	}
+	return bands[len(bands)-1].MinScore + 1
+}
+
+// sortedKeys returns the keys of a map in order so validation errors are stable
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// settingKeys returns the json key of each top level field of Settings
+func settingKeys() []string {
+	var keys []string
+	t := reflect.TypeOf(Settings{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		keys = append(keys, name)
+	}
+	return keys
+}
+
+// GetSetting decodes the value of a setting into v, false when the setting has not been saved
+func (s *ServerConfig) GetSetting(key string, v any) (bool, error) {
+	value, ok, err := s.Store.Setting(key)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return false, fmt.Errorf("failed to decode setting %s: %w", key, err)
+	}
+	return true, nil
+}
+
+func (s *ServerConfig) SetSetting(key string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode setting %s: %w", key, err)
+	}
+	return s.Store.SaveSettings(map[string]string{key: string(value)})
+}
+
+// GetSettings returns the saved settings, keys that have not been saved use the defaults
+func (s *ServerConfig) GetSettings() (Settings, error) {
+	values, err := s.Store.Settings()
+	if err != nil {
+		return DefaultSettings(), err
+	}
+	saved := make(map[string]json.RawMessage, len(values))
+	for key, value := range values {
+		saved[key] = json.RawMessage(value)
+	}
+
+	// Rows of other keys, like the ones the admin API does not manage, are ignored
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return DefaultSettings(), err
+	}
+	settings := DefaultSettings()
+	// A saved key is decoded over its default, so a field added since it was saved keeps its default
+	v := reflect.ValueOf(&settings).Elem()
+	for i, key := range settingKeys() {
+		if _, ok := saved[key]; ok {
+			resetCollections(v.Field(i))
+		}
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return DefaultSettings(), fmt.Errorf("failed to decode settings: %w", err)
+	}
+	return settings, nil
+}
+
+// resetCollections clears the maps and slices of a default, otherwise their entries would be merged back into the saved ones
+func resetCollections(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice:
+		v.SetZero()
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				resetCollections(v.Field(i))
+			}
+		}
+	}
+}
+
+// SaveSettings validates the settings and saves every key in a single transaction
+func (s *ServerConfig) SaveSettings(settings Settings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("failed to encode settings: %w", err)
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("failed to encode settings: %w", err)
+	}
+
+	saved := make(map[string]string)
+	for _, key := range settingKeys() {
+		saved[key] = string(values[key])
+	}
+	return s.Store.SaveSettings(saved)
+}
@@ -0,0 +1,216 @@
+package common
+
+// Sightings of each object in a single table keyed by object and observed time
+//
+// Every row moved out of pending_import adds a sighting.  Scoring and the trend
+// of an object are range scans of the (object, observed_at) index, so nothing
+// depends on a table existing for the current week.  The objects_<week>_<year>
+// tables of older versions are folded into sightings and dropped by the
+// sightings migration.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sightingTimeLayout      = "2006-01-02 15:04:05" // UTC, the format of CURRENT_TIMESTAMP so the values sort and compare as text
+	defaultTrendDays        = 30
+	maxTrendDays            = 3650
+	weeklyTableMigrateBatch = 10000 // Rows of a weekly table read at a time
+)
+
+// Tables created by older versions for each week, objects_<week>_<year>
+var weeklyTablePattern = regexp.MustCompile(`^objects_[0-9]{1,2}_[0-9]{4}$`)
+
+// observedAt is when the source saw the object, the import time when it was not provided, cannot be read or is later
+func observedAt(timeProvided string, timeImported string) time.Time {
+	seen := parseTimestamp(timeProvided)
+	imported := parseTimestamp(timeImported)
+	if seen.IsZero() || (!imported.IsZero() && seen.After(imported)) {
+		seen = imported
+	}
+	if seen.IsZero() {
+		seen = time.Now()
+	}
+	return seen.UTC()
+}
+
+func formatSightingTime(t time.Time) string {
+	return t.UTC().Format(sightingTimeLayout)
+}
+
+// insertSighting adds a sighting of an object in the transaction of the caller, the weekly table migration
+// runs before sightings had batch_id
+func insertSighting(tx sqlTx, object string, objectType string, ipDecimal int, notes string, source string, timeImported string, timeProvided string) error {
+	_, err := tx.Exec(`
+		INSERT INTO sightings (object, object_type, ipDecimal, notes, source, observed_at, time_imported, time_provided)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, object, objectType, ipDecimal, notes, source, formatSightingTime(observedAt(timeProvided, timeImported)), timeImported, timeProvided)
+	if err != nil {
+		return fmt.Errorf("failed to insert into sightings: %w", err)
+	}
+	return nil
+}
+
+// insertImportSighting adds the sighting of an applied pending row with the import batch of the row
+func insertImportSighting(tx sqlTx, row PendingImport) error {
+	_, err := tx.Exec(`
+		INSERT INTO sightings (object, object_type, ipDecimal, notes, source, observed_at, time_imported, time_provided, batch_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, row.Object, row.ObjectType, row.IPDecimal, row.Notes, row.Source, formatSightingTime(observedAt(row.TimeProvided, row.TimeImported)),
+		row.TimeImported, row.TimeProvided, sql.NullInt64{Int64: row.BatchID, Valid: row.BatchID != 0})
+	if err != nil {
+		return fmt.Errorf("failed to insert into sightings: %w", err)
+	}
+	return nil
+}
+
+// weeklyTables lists the objects_<week>_<year> tables left by older versions
+func weeklyTables(tx sqlTx) ([]string, error) {
+	rows, err := tx.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name LIKE 'objects\_%' ESCAPE '\' ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the weekly tables: %w", err)
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if weeklyTablePattern.MatchString(name) {
+			tables = append(tables, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return tables, nil
+}
+
+// migrateWeeklyTables copies the rows of each weekly table into sightings and drops the table
+func migrateWeeklyTables(tx sqlTx) error {
+	tables, err := weeklyTables(tx)
+	if err != nil {
+		return err
+	}
+
+	type weeklyRow struct {
+		id, ipDecimal                                                 int
+		object, objectType, notes, source, timeImported, timeProvided string
+	}
+	for _, table := range tables {
+		ident, err := tableIdent(table)
+		if err != nil {
+			return err
+		}
+		migrated := 0
+		for lastID := 0; ; {
+			rows, err := tx.Query(`SELECT id, object, object_type, COALESCE(ipDecimal, 0), COALESCE(notes, ''), COALESCE(source, ''),
+				COALESCE(time_imported, ''), COALESCE(time_provided, '') FROM `+ident+` WHERE id > ? ORDER BY id LIMIT ?`, lastID, weeklyTableMigrateBatch)
+			if err != nil {
+				return fmt.Errorf("failed to query %s: %w", table, err)
+			}
+			var batch []weeklyRow
+			for rows.Next() {
+				var row weeklyRow
+				if err := rows.Scan(&row.id, &row.object, &row.objectType, &row.ipDecimal, &row.notes, &row.source, &row.timeImported, &row.timeProvided); err != nil {
+					rows.Close()
+					return fmt.Errorf("failed to scan row of %s: %w", table, err)
+				}
+				batch = append(batch, row)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return fmt.Errorf("error iterating over rows of %s: %w", table, err)
+			}
+			if len(batch) == 0 {
+				break
+			}
+
+			for _, row := range batch {
+				if err := insertSighting(tx, row.object, row.objectType, row.ipDecimal, row.notes, row.source, row.timeImported, row.timeProvided); err != nil {
+					return fmt.Errorf("failed to migrate %s: %w", table, err)
+				}
+				lastID = row.id
+			}
+			migrated += len(batch)
+		}
+		if _, err := tx.Exec(`DROP TABLE ` + ident); err != nil {
+			return fmt.Errorf("failed to drop %s: %w", table, err)
+		}
+		log.Printf("Migrated %d rows of %s into sightings\n", migrated, table)
+	}
+	return nil
+}
+
+type SightingTrendDay struct {
+	Day     string `json:"day"` // YYYY-MM-DD in UTC
+	Count   int    `json:"count"`
+	Sources int    `json:"sources"` // Distinct sources that day
+}
+
+type SightingTrendResponse struct {
+	Object  string             `json:"object"`
+	Days    int                `json:"days"`
+	Total   int                `json:"total"`
+	History []SightingTrendDay `json:"history"` // Oldest first, days without sightings are left out
+}
+
+// GetSightingTrend counts the sightings of an object on each day since the start
+func (s *ServerConfig) GetSightingTrend(object string, since time.Time) ([]SightingTrendDay, error) {
+	return s.Store.SightingTrend(object, since)
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/object/114.6.6.6/sightings?days=30" -H "X-API-Key: testingtheapikey"
+func (s *ServerConfig) HandleSightingTrend(w http.ResponseWriter, r *http.Request) {
+	if !s.apiKeyAuthorized(w, r) {
+		return
+	}
+
+	object := strings.TrimSpace(r.PathValue("object"))
+	days := defaultTrendDays
+	if value := r.URL.Query().Get("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxTrendDays {
+			http.Error(w, fmt.Sprintf("days must be between 1 and %d", maxTrendDays), http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	intel, err := s.GetObjectIntel(object)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "No data found for the given object", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to retrieve data", http.StatusInternalServerError)
+		return
+	}
+	trend, err := s.GetSightingTrend(object, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		http.Error(w, "Failed to retrieve the sightings", http.StatusInternalServerError)
+		return
+	}
+
+	response := SightingTrendResponse{Object: intel.Object, Days: days, History: trend}
+	for _, day := range trend {
+		response.Total += day.Count
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, "Failed to encode result", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,220 @@
+package common
+
+// Storage of the objects, pending imports, sightings, trusted objects, API keys and settings
+//
+// The handlers and the workerBee only use the Store interface, the backend is
+// chosen with the store key of the config:
+//    sqlite   - The database file at dbPath, the default (not in builds with -tags nosqlite)
+//    memory   - Kept in memory and lost on exit, for tests and demos
+//    postgres - The database at databaseURL (only in builds with -tags postgres)
+// Building with -tags nosqlite leaves out go-sqlite3 so the programs build without cgo.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultStore = "sqlite"
+
+// ErrNotFound is returned when the object, pending import or key asked for does not exist
+var ErrNotFound = errors.New("not found")
+
+// PendingImport is a row of pending_import waiting for the workerBee
+type PendingImport struct {
+	ID           int
+	Object       string
+	ObjectType   string
+	IPDecimal    int
+	Notes        string
+	Source       string
+	TimeImported string
+	TimeProvided string
+	GeoRegion    string
+	GeoCountry   string
+	GeoOrg       string
+	Claims       int   // Times the row was claimed, this claim included
+	BatchID      int64 // 0 for a row added before import batches
+	BatchRow     int
+	Enrichment   *Enrichment // Set by the pipeline when an enricher looked up the object
+}
+
+// BlockExpiry leaves out the objects scored from MinScore up to MaxScore, 0 has no upper limit,
+// when they were last seen before LastSeenBefore
+type BlockExpiry struct {
+	MinScore       int
+	MaxScore       int
+	LastSeenBefore time.Time
+}
+
+type BlocklistFilter struct {
+	MinScore   int
+	ObjectType string   // Empty for every object type
+	Verdicts   []string // Empty for every verdict
+	Expiries   []BlockExpiry
+	Limit      int
+}
+
+// PrunePolicy is what the retention step deletes, a zero time deletes nothing
+type PrunePolicy struct {
+	SightingsBefore time.Time // Sightings observed before this
+	StaleBefore     time.Time // Untrusted and unconfirmed objects last seen before this
+	StaleMaxScore   int       // and scored at or below this are expired with a tombstone
+	StageRunsBefore time.Time // Runs of the workerBee stages started before this
+	BatchesBefore   time.Time // Import batches finished before this, with the outcomes of their rows
+	DryRun          bool      // Only count what would be deleted
+}
+
+type PruneResult struct {
+	Sightings     int64 `json:"sightings"`
+	Objects       int64 `json:"objects"`
+	StageRuns     int64 `json:"stage_runs"`
+	ImportBatches int64 `json:"import_batches"`
+}
+
+type Store interface {
+	Backend() string
+	Migrate() (int, error) // Applies the pending migrations and returns how many were applied
+	MigrationStatus() ([]MigrationState, error)
+	Backup(path string) error  // Writes a copy of the database to path and checks its integrity
+	Restore(path string) error // Replaces the database with the copy at path, refused when its schema is newer
+	Vacuum() error
+	Close() error
+
+	// API keys, only the sha256 of a key is stored
+	CreateAPIKey(name string, keyHash string, keyPrefix string, role string) (int64, error)
+	ListAPIKeys() ([]APIKeyRecord, error)
+	RevokeAPIKey(id int64) (bool, error)
+	APIKeyRole(keyHash string) (string, error) // "" when the key does not exist or is revoked
+
+	// Settings, the values are JSON
+	Setting(key string) (string, bool, error)
+	Settings() (map[string]string, error)
+	SaveSettings(values map[string]string) error // Every value is saved or none
+
+	// Pending imports
+	// AddPendingImports adds the rows as a new batch and returns its ID, every row is added or none
+	AddPendingImports(batch ImportBatch, rows []InsertPendingImportStruct) (int64, error)
+	FindPendingImport(object string) (VerifyImportResult, error)
+	// ClaimPendingImports claims up to limit rows for worker until the lease passes, rows of a lapsed lease are claimed again
+	ClaimPendingImports(worker string, limit int, lease time.Duration) ([]PendingImport, error)
+	ExtendPendingLease(worker string, lease time.Duration) (int64, error) // Returns how many rows worker still holds
+	ReleasePendingImports(worker string) error                            // The rows of worker can be claimed right away
+	// ApplyPendingImports moves the accepted rows into object_intel and sightings and deletes the rejected ones,
+	// a row claimed by another worker since is left to it and counted in the rows returned as lost.
+	// The outcome of each row is recorded in its batch, a batch without pending rows left is finished.
+	ApplyPendingImports(worker string, accepted []PendingImport, rejected []RejectedImport) (int, error)
+	PendingStats() (PendingStats, error)
+	PurgePending(olderThan time.Time, objectType string, source string) (int64, error) // A zero time or empty string does not filter
+
+	// Quarantine of the rejected pending rows
+	ListQuarantine(filter QuarantineFilter) ([]QuarantinedImport, error) // Oldest first
+	FixQuarantined(id int64, object string, objectType string) error     // ErrNotFound when the row does not exist
+	// ResubmitQuarantined moves the rows back to pending_import, in their import batch unless it was rolled back or pruned
+	ResubmitQuarantined(filter QuarantineFilter) (int64, error)
+	PurgeQuarantine(filter QuarantineFilter) (int64, error)
+
+	// Import batches
+	ImportBatch(id int64) (ImportBatch, error)
+	ImportBatchRows(id int64, outcome string, limit int) ([]ImportBatchRow, error) // In row order, an empty outcome lists both
+	// RollbackImportBatch removes what a batch added and marks its objects for rescoring, a dry run changes nothing.
+	// ErrRolledBack when the batch was already rolled back.
+	RollbackImportBatch(id int64, dryRun bool) (RollbackResult, error)
+
+	// Objects, the verdict rules are passed to the changes that recompute the verdict of an object
+	ObjectIntel(object string) (ObjectIntel, error)
+	ObjectFacts(object string, lookback time.Time) (ObjectFacts, error)
+	ObjectsToRescore(scoredBefore time.Time, limit int) ([]string, error)
+	SaveRiskScore(object string, result ScoreResult, rules VerdictRules) error
+	MarkAllForRescore() error
+	ConfirmObject(object string, confirmed bool, rules VerdictRules) (bool, error)
+	UntrustObject(object string, rules VerdictRules) (bool, string, error) // Returns the trusted CIDR that still covers the object
+	RefreshVerdicts(rules VerdictRules, object string) (int, error)        // An empty object refreshes every object
+	ScoreHistory(object string, limit int) ([]ScoreHistoryEntry, error)
+	VerdictHistory(object string, limit int) ([]VerdictChange, error)
+	ListObjects(verdicts []string, objectType string, limit int) ([]ObjectSummary, error)
+	Blocklist(filter BlocklistFilter) ([]BlocklistEntry, error)
+	SightingTrend(object string, since time.Time) ([]SightingTrendDay, error)
+	// ObjectsToEnrich lists the objects of the types never enriched or enriched before enrichedBefore, never enriched first
+	ObjectsToEnrich(objectTypes []string, enrichedBefore time.Time, limit int) ([]ObjectRef, error)
+	SaveEnrichments(enrichments []ObjectEnrichment, enrichedAt time.Time) error // Every object is saved or none
+
+	// Trusted objects
+	AddTrustedObjects(objects []TrustedObject) (int64, error) // Every object is added or none
+	ListTrustedObjects() ([]TrustedObject, error)
+	RemoveTrustedObject(object string) (bool, error)
+	MarkTrustedObjects(rules VerdictRules) (int, error) // Returns how many verdicts changed
+
+	// Retention
+	Prune(policy PrunePolicy) (PruneResult, error)
+	Tombstone(object string) (Tombstone, error) // ErrNotFound when the object was never expired
+
+	// Runs of the workerBee stages
+	RecordStageRun(run StageRun) error
+	StageRuns(stage string, limit int) ([]StageRun, error) // Newest first, an empty stage lists every stage
+}
+
+// StoreOpener opens the store of a backend with the configuration
+type StoreOpener func(c Configuration) (Store, error)
+
+var (
+	storesMu sync.RWMutex
+	stores   = map[string]StoreOpener{}
+)
+
+// RegisterStore adds a backend that the store key of the config can name, an existing backend with the same name is replaced
+func RegisterStore(name string, open StoreOpener) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	stores[name] = open
+}
+
+// StoreBackends lists the backends in this build
+func StoreBackends() []string {
+	storesMu.RLock()
+	defer storesMu.RUnlock()
+	names := make([]string, 0, len(stores))
+	for name := range stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func storeName(c Configuration) string {
+	if c.Store == "" {
+		return defaultStore
+	}
+	return c.Store
+}
+
+// OpenStore opens the backend named by the store key of the config without migrating it
+func OpenStore(c Configuration) (Store, error) {
+	name := storeName(c)
+	storesMu.RLock()
+	open, ok := stores[name]
+	storesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("store %s is not in this build, available: %s", name, strings.Join(StoreBackends(), ", "))
+	}
+	return open(c)
+}
+
+// blockExpiries turns the block_days of the severity bands into the filter of the blocklist
+func blockExpiries(bands []SeverityBand, now time.Time) []BlockExpiry {
+	var expiries []BlockExpiry
+	for i, band := range bands {
+		if band.BlockDays == 0 {
+			continue
+		}
+		expiry := BlockExpiry{MinScore: band.MinScore, LastSeenBefore: now.AddDate(0, 0, -band.BlockDays)}
+		if i+1 < len(bands) {
+			expiry.MaxScore = bands[i+1].MinScore
+		}
+		expiries = append(expiries, expiry)
+	}
+	return expiries
+}
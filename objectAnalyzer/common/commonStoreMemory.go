@@ -0,0 +1,1396 @@
+package common
+
+// The memory store keeps everything in maps and is lost when the program exits
+//
+// It needs no database or cgo, for tests and demos of the apiServer.  The
+// workerBee only sees its own memory store, so imports are not processed
+// unless both run in the same program.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryAPIKey struct {
+	APIKeyRecord
+	keyHash string
+}
+
+type memoryTrustedObject struct {
+	TrustedObject
+	ipDecimal, startIPDecimal, endIPDecimal int
+}
+
+type memorySighting struct {
+	Source       string
+	ObservedAt   time.Time
+	TimeImported string
+	BatchID      int64
+}
+
+type memoryStore struct {
+	mu             sync.RWMutex
+	keys           []memoryAPIKey
+	settings       map[string]string
+	pending        []PendingImport // In the order they were added
+	nextPendingID  int
+	objects        map[string]*ObjectIntel
+	scored         map[string]bool // Objects with a risk_score, MarkAllForRescore keeps the score
+	sightings      map[string][]memorySighting
+	scoreHistory   map[string][]ScoreHistoryEntry // Oldest first
+	verdictHistory map[string][]VerdictChange     // Oldest first
+	trusted        map[string]*memoryTrustedObject
+	tombstones     map[string]Tombstone
+	stageRuns      []StageRun // Oldest first
+	claims         map[int]memoryClaim
+	batches        map[int64]*ImportBatch // Pending and Status are derived when read
+	batchRows      map[int64][]ImportBatchRow
+	nextBatchID    int64
+	quarantine     []QuarantinedImport // Oldest first
+	nextQuarantine int64
+}
+
+// memoryClaim is the lease of a worker on a pending row
+type memoryClaim struct {
+	worker  string
+	expires string
+	count   int
+}
+
+func init() {
+	RegisterStore("memory", func(c Configuration) (Store, error) { return NewMemoryStore(), nil })
+}
+
+// NewMemoryStore returns an empty store, it has no migrations to apply
+func NewMemoryStore() Store {
+	return &memoryStore{
+		settings:       map[string]string{},
+		objects:        map[string]*ObjectIntel{},
+		scored:         map[string]bool{},
+		sightings:      map[string][]memorySighting{},
+		scoreHistory:   map[string][]ScoreHistoryEntry{},
+		verdictHistory: map[string][]VerdictChange{},
+		trusted:        map[string]*memoryTrustedObject{},
+		tombstones:     map[string]Tombstone{},
+		claims:         map[int]memoryClaim{},
+		batches:        map[int64]*ImportBatch{},
+		batchRows:      map[int64][]ImportBatchRow{},
+	}
+}
+
+// memoryNow is the time of a change in the format of CURRENT_TIMESTAMP
+func memoryNow() string {
+	return formatSightingTime(time.Now())
+}
+
+func (m *memoryStore) Backend() string {
+	return "memory"
+}
+
+func (m *memoryStore) Migrate() (int, error) {
+	return 0, nil
+}
+
+func (m *memoryStore) MigrationStatus() ([]MigrationState, error) {
+	return []MigrationState{}, nil
+}
+
+func (m *memoryStore) Backup(path string) error {
+	return fmt.Errorf("%w: the memory store is not written to disk", errors.ErrUnsupported)
+}
+
+func (m *memoryStore) Restore(path string) error {
+	return fmt.Errorf("%w: the memory store is not written to disk", errors.ErrUnsupported)
+}
+
+func (m *memoryStore) Vacuum() error {
+	return nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+func (m *memoryStore) CreateAPIKey(name string, keyHash string, keyPrefix string, role string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range m.keys {
+		if key.keyHash == keyHash {
+			return 0, errors.New("failed to insert api key: the key hash already exists")
+		}
+	}
+	id := int64(len(m.keys) + 1)
+	m.keys = append(m.keys, memoryAPIKey{
+		APIKeyRecord: APIKeyRecord{ID: id, Name: name, Role: role, KeyPrefix: keyPrefix, Created: memoryNow()},
+		keyHash:      keyHash,
+	})
+	return id, nil
+}
+
+func (m *memoryStore) ListAPIKeys() ([]APIKeyRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := []APIKeyRecord{}
+	for _, key := range m.keys {
+		keys = append(keys, key.APIKeyRecord)
+	}
+	return keys, nil
+}
+
+func (m *memoryStore) RevokeAPIKey(id int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.keys {
+		if m.keys[i].ID == id && m.keys[i].Revoked == "" {
+			m.keys[i].Revoked = memoryNow()
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryStore) APIKeyRole(keyHash string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, key := range m.keys {
+		if key.keyHash == keyHash && key.Revoked == "" {
+			return key.Role, nil
+		}
+	}
+	return "", nil
+}
+
+func (m *memoryStore) Setting(key string) (string, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	value, ok := m.settings[key]
+	return value, ok, nil
+}
+
+func (m *memoryStore) Settings() (map[string]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	values := make(map[string]string, len(m.settings))
+	for key, value := range m.settings {
+		values[key] = value
+	}
+	return values, nil
+}
+
+func (m *memoryStore) SaveSettings(values map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, value := range values {
+		m.settings[key] = value
+	}
+	return nil
+}
+
+func (m *memoryStore) AddPendingImports(batch ImportBatch, rows []InsertPendingImportStruct) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := memoryNow()
+	m.nextBatchID++
+	m.batches[m.nextBatchID] = &ImportBatch{
+		ID:          m.nextBatchID,
+		Source:      batch.Source,
+		SubmittedBy: batch.SubmittedBy,
+		FileName:    batch.FileName,
+		TotalRows:   len(rows),
+		CreatedAt:   now,
+	}
+	if len(rows) == 0 {
+		m.batches[m.nextBatchID].FinishedAt = now
+	}
+	for i, row := range rows {
+		var ipDecimal int
+		if row.ObjectType == "ipv4" {
+			ipDecimal, _ = ipv4ToDecimal(row.Object)
+		}
+		m.nextPendingID++
+		m.pending = append(m.pending, PendingImport{
+			ID:           m.nextPendingID,
+			Object:       row.Object,
+			ObjectType:   row.ObjectType,
+			IPDecimal:    ipDecimal,
+			Notes:        row.Notes,
+			Source:       row.Source,
+			TimeImported: now,
+			TimeProvided: row.TimeProvided,
+			GeoRegion:    row.GeoRegion,
+			GeoCountry:   row.GeoCountry,
+			GeoOrg:       row.GeoOrg,
+			BatchID:      m.nextBatchID,
+			BatchRow:     i + 1,
+		})
+	}
+	return m.nextBatchID, nil
+}
+
+func (m *memoryStore) FindPendingImport(object string) (VerifyImportResult, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, row := range m.pending {
+		if row.Object == object {
+			return VerifyImportResult{
+				ID:           row.ID,
+				Object:       row.Object,
+				ObjectType:   row.ObjectType,
+				IPDecimal:    row.IPDecimal,
+				Notes:        row.Notes,
+				Source:       row.Source,
+				TimeImported: row.TimeImported,
+				TimeProvided: row.TimeProvided,
+			}, nil
+		}
+	}
+	return VerifyImportResult{}, ErrNotFound
+}
+
+func (m *memoryStore) ClaimPendingImports(worker string, limit int, lease time.Duration) ([]PendingImport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	claimed := []PendingImport{}
+	for _, row := range m.pending {
+		if len(claimed) == limit {
+			break
+		}
+		claim, ok := m.claims[row.ID]
+		if ok && claim.worker != "" && claim.expires >= formatSightingTime(now) {
+			continue
+		}
+		claim = memoryClaim{worker: worker, expires: formatSightingTime(now.Add(lease)), count: claim.count + 1}
+		m.claims[row.ID] = claim
+		row.Claims = claim.count
+		claimed = append(claimed, row)
+		if batch := m.batches[row.BatchID]; batch != nil && batch.StartedAt == "" {
+			batch.StartedAt = formatSightingTime(now)
+		}
+	}
+	return claimed, nil
+}
+
+func (m *memoryStore) ExtendPendingLease(worker string, lease time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	for id, claim := range m.claims {
+		if claim.worker == worker {
+			claim.expires = formatSightingTime(time.Now().Add(lease))
+			m.claims[id] = claim
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryStore) ReleasePendingImports(worker string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, claim := range m.claims {
+		if claim.worker == worker {
+			m.claims[id] = memoryClaim{count: claim.count}
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) ApplyPendingImports(worker string, accepted []PendingImport, rejected []RejectedImport) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lost := 0
+	processed := memoryNow()
+	done := make(map[int]bool)
+	held := func(row PendingImport, outcome string, reason string) bool {
+		if m.claims[row.ID].worker != worker || done[row.ID] {
+			lost++
+			return false
+		}
+		done[row.ID] = true
+		if batch := m.batches[row.BatchID]; batch != nil {
+			if outcome == ImportRowAccepted {
+				batch.Accepted++
+			} else {
+				batch.Rejected++
+			}
+			m.batchRows[row.BatchID] = append(m.batchRows[row.BatchID], ImportBatchRow{
+				Row:         row.BatchRow,
+				Object:      row.Object,
+				ObjectType:  row.ObjectType,
+				Outcome:     outcome,
+				Reason:      reason,
+				ProcessedAt: processed,
+			})
+		}
+		return true
+	}
+	for _, row := range accepted {
+		if !held(row, ImportRowAccepted, "") {
+			continue
+		}
+		if obj, ok := m.objects[row.Object]; ok {
+			obj.Notes = row.Notes
+			obj.LastSeen = row.TimeImported
+			obj.OccurrenceCount++
+		} else {
+			m.objects[row.Object] = &ObjectIntel{
+				Object:          row.Object,
+				ObjectType:      row.ObjectType,
+				IPDecimal:       int64(row.IPDecimal),
+				GeoRegion:       row.GeoRegion,
+				GeoCountry:      row.GeoCountry,
+				GeoOrg:          row.GeoOrg,
+				Notes:           row.Notes,
+				Fidelity:        "Low",
+				FirstSeen:       row.TimeImported,
+				LastSeen:        row.TimeImported,
+				OccurrenceCount: 1,
+				Verdict:         VerdictUnknown,
+			}
+		}
+		if row.Enrichment != nil {
+			m.objects[row.Object].enrich(*row.Enrichment, processed)
+		}
+		m.sightings[row.Object] = append(m.sightings[row.Object], memorySighting{Source: row.Source, ObservedAt: observedAt(row.TimeProvided, row.TimeImported), TimeImported: row.TimeImported, BatchID: row.BatchID})
+		delete(m.tombstones, row.Object)
+	}
+	for _, row := range rejected {
+		if !held(row.PendingImport, ImportRowRejected, row.Reason) {
+			continue
+		}
+		m.nextQuarantine++
+		m.quarantine = append(m.quarantine, QuarantinedImport{
+			ID:            m.nextQuarantine,
+			Object:        row.Object,
+			ObjectType:    row.ObjectType,
+			Notes:         row.Notes,
+			Source:        row.Source,
+			GeoRegion:     row.GeoRegion,
+			GeoCountry:    row.GeoCountry,
+			GeoOrg:        row.GeoOrg,
+			TimeImported:  row.TimeImported,
+			TimeProvided:  row.TimeProvided,
+			BatchID:       row.BatchID,
+			BatchRow:      row.BatchRow,
+			Reason:        row.Reason,
+			QuarantinedAt: processed,
+		})
+	}
+
+	pending := m.pending[:0]
+	for _, row := range m.pending {
+		if !done[row.ID] {
+			pending = append(pending, row)
+		}
+	}
+	m.pending = pending
+	for id := range done {
+		delete(m.claims, id)
+	}
+	m.finishImportBatches(processed)
+	return lost, nil
+}
+
+// finishImportBatches marks the batches without pending rows left as finished
+func (m *memoryStore) finishImportBatches(finished string) {
+	pending := map[int64]bool{}
+	for _, row := range m.pending {
+		pending[row.BatchID] = true
+	}
+	for id, batch := range m.batches {
+		if batch.FinishedAt == "" && !pending[id] {
+			batch.FinishedAt = finished
+		}
+	}
+}
+
+func (m *memoryStore) PendingStats() (PendingStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := PendingStats{ByType: map[string]int{}, BySource: map[string]int{}}
+	sources := map[string]int{}
+	now := memoryNow()
+	for _, row := range m.pending {
+		stats.Total++
+		if claim := m.claims[row.ID]; claim.worker != "" && claim.expires >= now {
+			stats.Claimed++
+		}
+		if stats.Oldest == "" || row.TimeImported < stats.Oldest {
+			stats.Oldest = row.TimeImported
+		}
+		if row.TimeImported > stats.Newest {
+			stats.Newest = row.TimeImported
+		}
+		stats.ByType[row.ObjectType]++
+		sources[row.Source]++
+	}
+
+	// Top 20 sources
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if sources[names[i]] != sources[names[j]] {
+			return sources[names[i]] > sources[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	for i, name := range names {
+		if i == 20 {
+			break
+		}
+		stats.BySource[name] = sources[name]
+	}
+	stats.Quarantined = len(m.quarantine)
+	return stats, nil
+}
+
+func (m *memoryStore) PurgePending(olderThan time.Time, objectType string, source string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := formatSightingTime(olderThan)
+	var count int64
+	pending := m.pending[:0]
+	for _, row := range m.pending {
+		if (olderThan.IsZero() || row.TimeImported < cutoff) && (objectType == "" || row.ObjectType == objectType) && (source == "" || row.Source == source) {
+			delete(m.claims, row.ID)
+			count++
+			continue
+		}
+		pending = append(pending, row)
+	}
+	m.pending = pending
+	m.finishImportBatches(memoryNow())
+	return count, nil
+}
+
+// matches is the condition of a filter on the quarantine for the memory store
+func (f QuarantineFilter) matches(row QuarantinedImport) bool {
+	return (f.ID == 0 || row.ID == f.ID) &&
+		(f.BatchID == 0 || row.BatchID == f.BatchID) &&
+		(f.Source == "" || row.Source == f.Source) &&
+		(f.ObjectType == "" || row.ObjectType == f.ObjectType) &&
+		(f.Reason == "" || row.Reason == f.Reason) &&
+		(f.OlderThan.IsZero() || row.QuarantinedAt < formatSightingTime(f.OlderThan))
+}
+
+func (m *memoryStore) ListQuarantine(filter QuarantineFilter) ([]QuarantinedImport, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := []QuarantinedImport{}
+	for _, row := range m.quarantine {
+		if len(result) == filter.Limit {
+			break
+		}
+		if filter.matches(row) {
+			result = append(result, row)
+		}
+	}
+	return result, nil
+}
+
+func (m *memoryStore) FixQuarantined(id int64, object string, objectType string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.quarantine {
+		if m.quarantine[i].ID == id {
+			m.quarantine[i].Object = object
+			m.quarantine[i].ObjectType = objectType
+			m.quarantine[i].FixedAt = memoryNow()
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *memoryStore) ResubmitQuarantined(filter QuarantineFilter) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int64
+	kept := m.quarantine[:0]
+	for _, row := range m.quarantine {
+		if !filter.matches(row) {
+			kept = append(kept, row)
+			continue
+		}
+		// The row goes back in its batch unless the batch was rolled back or pruned
+		batch := m.batches[row.BatchID]
+		if batch != nil && batch.RolledBackAt == "" {
+			rows := m.batchRows[row.BatchID][:0]
+			for _, batchRow := range m.batchRows[row.BatchID] {
+				if batchRow.Row == row.BatchRow && batchRow.Outcome == ImportRowRejected {
+					batch.Rejected--
+					continue
+				}
+				rows = append(rows, batchRow)
+			}
+			m.batchRows[row.BatchID] = rows
+			batch.FinishedAt = ""
+		} else {
+			row.BatchID, row.BatchRow = 0, 0
+		}
+
+		var ipDecimal int
+		if row.ObjectType == "ipv4" {
+			ipDecimal, _ = ipv4ToDecimal(row.Object)
+		}
+		m.nextPendingID++
+		m.pending = append(m.pending, PendingImport{
+			ID:           m.nextPendingID,
+			Object:       row.Object,
+			ObjectType:   row.ObjectType,
+			IPDecimal:    ipDecimal,
+			Notes:        row.Notes,
+			Source:       row.Source,
+			TimeImported: row.TimeImported,
+			TimeProvided: row.TimeProvided,
+			GeoRegion:    row.GeoRegion,
+			GeoCountry:   row.GeoCountry,
+			GeoOrg:       row.GeoOrg,
+			BatchID:      row.BatchID,
+			BatchRow:     row.BatchRow,
+		})
+		count++
+	}
+	m.quarantine = kept
+	return count, nil
+}
+
+func (m *memoryStore) PurgeQuarantine(filter QuarantineFilter) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int64
+	kept := m.quarantine[:0]
+	for _, row := range m.quarantine {
+		if filter.matches(row) {
+			count++
+			continue
+		}
+		kept = append(kept, row)
+	}
+	m.quarantine = kept
+	return count, nil
+}
+
+func (m *memoryStore) ImportBatch(id int64) (ImportBatch, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	batch, ok := m.batches[id]
+	if !ok {
+		return ImportBatch{}, ErrNotFound
+	}
+	result := *batch
+	for _, row := range m.pending {
+		if row.BatchID == id {
+			result.Pending++
+		}
+	}
+	result.setStatus()
+	return result, nil
+}
+
+func (m *memoryStore) ImportBatchRows(id int64, outcome string, limit int) ([]ImportBatchRow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rows := []ImportBatchRow{}
+	for _, row := range m.batchRows[id] {
+		if outcome == "" || row.Outcome == outcome {
+			rows = append(rows, row)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Row < rows[j].Row })
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+	return rows, nil
+}
+
+// seenWithoutBatch returns the first and last import of an object from the sightings kept or, when none are,
+// from its accepted rows in the other batches not rolled back.  Both are "" when neither is left.
+func (m *memoryStore) seenWithoutBatch(object string, id int64, kept []memorySighting) (string, string) {
+	var first, last string
+	seen := func(at string) {
+		if first == "" || at < first {
+			first = at
+		}
+		last = max(last, at)
+	}
+	for _, sighting := range kept {
+		seen(sighting.TimeImported)
+	}
+	if first != "" {
+		return first, last
+	}
+	for batchID, rows := range m.batchRows {
+		if batch := m.batches[batchID]; batchID == id || batch == nil || batch.RolledBackAt != "" {
+			continue
+		}
+		for _, row := range rows {
+			if row.Object == object && row.Outcome == ImportRowAccepted {
+				seen(row.ProcessedAt)
+			}
+		}
+	}
+	return first, last
+}
+
+func (m *memoryStore) RollbackImportBatch(id int64, dryRun bool) (RollbackResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := RollbackResult{BatchID: id, DryRun: dryRun, Objects: []RollbackObject{}}
+	batch, ok := m.batches[id]
+	if !ok {
+		return result, ErrNotFound
+	}
+	if batch.RolledBackAt != "" {
+		return result, ErrRolledBack
+	}
+
+	var pending []PendingImport
+	var removed []int
+	for _, row := range m.pending {
+		if row.BatchID == id {
+			removed = append(removed, row.ID)
+			continue
+		}
+		pending = append(pending, row)
+	}
+	result.PendingRows = int64(len(removed))
+	if !dryRun {
+		m.pending = pending
+		for _, pendingID := range removed {
+			delete(m.claims, pendingID)
+		}
+	}
+
+	occurrences := map[string]int{}
+	for _, row := range m.batchRows[id] {
+		if row.Outcome == ImportRowAccepted {
+			occurrences[row.Object]++
+		}
+	}
+	names := make([]string, 0, len(occurrences))
+	for name := range occurrences {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var kept []memorySighting
+		var span [2]string
+		for _, sighting := range m.sightings[name] {
+			if sighting.BatchID != id {
+				kept = append(kept, sighting)
+				continue
+			}
+			result.Sightings++
+			if span[0] == "" || sighting.TimeImported < span[0] {
+				span[0] = sighting.TimeImported
+			}
+			if sighting.TimeImported > span[1] {
+				span[1] = sighting.TimeImported
+			}
+		}
+		obj, ok := m.objects[name]
+		if !ok {
+			if !dryRun {
+				m.sightings[name] = kept
+			}
+			continue
+		}
+
+		object := RollbackObject{Object: name, Occurrences: occurrences[name], OccurrenceCount: max(0, obj.OccurrenceCount-occurrences[name])}
+		if object.OccurrenceCount == 0 {
+			object.Deleted = true
+			result.ObjectsDeleted++
+			result.Objects = append(result.Objects, object)
+			if !dryRun {
+				delete(m.objects, name)
+				delete(m.scored, name)
+				delete(m.sightings, name)
+				delete(m.scoreHistory, name)
+				delete(m.verdictHistory, name)
+			}
+			continue
+		}
+
+		// When the batch gave the object its first_seen or last_seen they are taken from what is left without it
+		object.FirstSeen = obj.FirstSeen
+		object.LastSeen = obj.LastSeen
+		if span[0] != "" {
+			first, last := m.seenWithoutBatch(name, id, kept)
+			// With nothing left to take them from the times of the batch are kept, as in the SQL stores
+			if first != "" && object.FirstSeen >= span[0] {
+				object.FirstSeen = first
+			}
+			if last != "" && object.LastSeen <= span[1] {
+				object.LastSeen = last
+			}
+		}
+		result.ObjectsUpdated++
+		result.Objects = append(result.Objects, object)
+		if !dryRun {
+			m.sightings[name] = kept
+			obj.OccurrenceCount = object.OccurrenceCount
+			obj.FirstSeen = object.FirstSeen
+			obj.LastSeen = object.LastSeen
+			obj.RiskScoreLastUpdated = ""
+		}
+	}
+
+	if !dryRun {
+		now := memoryNow()
+		batch.RolledBackAt = now
+		if batch.FinishedAt == "" {
+			batch.FinishedAt = now
+		}
+	}
+	return result, nil
+}
+
+func (m *memoryStore) ObjectIntel(object string) (ObjectIntel, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	obj, ok := m.objects[object]
+	if !ok {
+		return ObjectIntel{}, ErrNotFound
+	}
+	return *obj, nil
+}
+
+func (m *memoryStore) ObjectFacts(object string, lookback time.Time) (ObjectFacts, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	facts := ObjectFacts{Object: object, Now: time.Now()}
+	obj, ok := m.objects[object]
+	if !ok {
+		return facts, fmt.Errorf("failed to query object_intel for %s: %w", object, ErrNotFound)
+	}
+	facts.ObjectType = obj.ObjectType
+	facts.Fidelity = obj.Fidelity
+	facts.GeoCountry = obj.GeoCountry
+	facts.GeoASN = obj.GeoASN
+	facts.LastSeen = parseTimestamp(obj.LastSeen)
+	facts.ConfirmedRisk = obj.ConfirmedRisk
+
+	sources := make(map[string]bool)
+	for _, sighting := range m.sightings[object] {
+		if sighting.ObservedAt.Before(lookback) {
+			continue
+		}
+		facts.Sightings = append(facts.Sightings, Sighting{Time: sighting.ObservedAt, Source: sighting.Source, Count: 1})
+		if sighting.Source != "" {
+			sources[sighting.Source] = true
+		}
+	}
+	for source := range sources {
+		facts.Sources = append(facts.Sources, source)
+	}
+	sort.Strings(facts.Sources)
+	return facts, nil
+}
+
+func (m *memoryStore) ObjectsToRescore(scoredBefore time.Time, limit int) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	cutoff := formatSightingTime(scoredBefore)
+	var objects []string
+	for _, obj := range m.sortedObjects() {
+		if len(objects) == limit {
+			break
+		}
+		if !obj.Trusted && (obj.RiskScoreLastUpdated == "" || obj.RiskScoreLastUpdated <= cutoff) {
+			objects = append(objects, obj.Object)
+		}
+	}
+	return objects, nil
+}
+
+// sortedObjects returns the objects in order of the object so the results are stable, the caller holds m.mu
+func (m *memoryStore) sortedObjects() []*ObjectIntel {
+	objects := make([]*ObjectIntel, 0, len(m.objects))
+	for _, obj := range m.objects {
+		objects = append(objects, obj)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Object < objects[j].Object })
+	return objects
+}
+
+// refreshVerdicts computes the verdict of the objects matching the condition and records every change, the caller holds m.mu
+func (m *memoryStore) refreshVerdicts(rules VerdictRules, condition func(obj *ObjectIntel) bool) int {
+	changed := 0
+	for _, obj := range m.sortedObjects() {
+		if !condition(obj) {
+			continue
+		}
+		verdict, reason := rules.Verdict(VerdictInput{
+			RiskScore:     obj.RiskScore,
+			Scored:        m.scored[obj.Object] && obj.RiskScoreLastUpdated != "",
+			Fidelity:      obj.Fidelity,
+			ConfirmedRisk: obj.ConfirmedRisk,
+			Trusted:       obj.Trusted,
+		})
+		if verdict == obj.Verdict {
+			continue
+		}
+		m.verdictHistory[obj.Object] = append(m.verdictHistory[obj.Object], VerdictChange{
+			ChangedAt:  memoryNow(),
+			OldVerdict: obj.Verdict,
+			NewVerdict: verdict,
+			Reason:     reason,
+		})
+		obj.Verdict = verdict
+		changed++
+	}
+	return changed
+}
+
+func isObject(object string) func(obj *ObjectIntel) bool {
+	return func(obj *ObjectIntel) bool { return obj.Object == object }
+}
+
+func (m *memoryStore) SaveRiskScore(object string, result ScoreResult, rules VerdictRules) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := memoryNow()
+	if obj, ok := m.objects[object]; ok {
+		obj.RiskScore = result.Score
+		obj.RiskScoreLastUpdated = now
+		m.scored[object] = true
+	}
+	// Copy the breakdown the same as reading it back from the database would
+	data, err := json.Marshal(result.Contributions)
+	if err != nil {
+		return fmt.Errorf("failed to encode the score breakdown: %w", err)
+	}
+	entry := ScoreHistoryEntry{ScoredAt: now, Score: result.Score, RawScore: result.RawScore, RuleVersion: result.RuleVersion, Breakdown: []ScoreContribution{}}
+	if err := json.Unmarshal(data, &entry.Breakdown); err != nil {
+		return fmt.Errorf("failed to decode the score breakdown: %w", err)
+	}
+	m.scoreHistory[object] = append(m.scoreHistory[object], entry)
+	m.refreshVerdicts(rules, isObject(object))
+	return nil
+}
+
+func (m *memoryStore) MarkAllForRescore() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, obj := range m.objects {
+		obj.RiskScoreLastUpdated = ""
+	}
+	return nil
+}
+
+func (m *memoryStore) ConfirmObject(object string, confirmed bool, rules VerdictRules) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj, ok := m.objects[object]
+	if !ok {
+		return false, nil
+	}
+	obj.ConfirmedRisk = confirmed
+	m.refreshVerdicts(rules, isObject(object))
+	return true, nil
+}
+
+func (m *memoryStore) UntrustObject(object string, rules VerdictRules) (bool, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj, found := m.objects[object]
+	if found {
+		obj.Trusted = false
+	}
+	delete(m.trusted, object)
+
+	var coveredBy string
+	if ipDecimal, err := ipv4ToDecimal(object); err == nil {
+		for _, trusted := range m.sortedTrusted() {
+			if trusted.ObjectType == "ipv4CIDR" && ipDecimal >= trusted.startIPDecimal && ipDecimal <= trusted.endIPDecimal {
+				coveredBy = trusted.Object
+				break
+			}
+		}
+	}
+	m.refreshVerdicts(rules, isObject(object))
+	return found, coveredBy, nil
+}
+
+func (m *memoryStore) RefreshVerdicts(rules VerdictRules, object string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	condition := func(obj *ObjectIntel) bool { return true }
+	if object != "" {
+		condition = isObject(object)
+	}
+	return m.refreshVerdicts(rules, condition), nil
+}
+
+func (m *memoryStore) ScoreHistory(object string, limit int) ([]ScoreHistoryEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	history := []ScoreHistoryEntry{}
+	entries := m.scoreHistory[object]
+	for i := len(entries) - 1; i >= 0 && len(history) < limit; i-- {
+		history = append(history, entries[i])
+	}
+	return history, nil
+}
+
+func (m *memoryStore) VerdictHistory(object string, limit int) ([]VerdictChange, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	history := []VerdictChange{}
+	changes := m.verdictHistory[object]
+	for i := len(changes) - 1; i >= 0 && len(history) < limit; i-- {
+		history = append(history, changes[i])
+	}
+	return history, nil
+}
+
+// byScore orders objects by risk_score, highest first, then by object
+func byScore(objects []*ObjectIntel) {
+	sort.SliceStable(objects, func(i, j int) bool {
+		if objects[i].RiskScore != objects[j].RiskScore {
+			return objects[i].RiskScore > objects[j].RiskScore
+		}
+		return objects[i].Object < objects[j].Object
+	})
+}
+
+func hasVerdict(verdicts []string, verdict string) bool {
+	if len(verdicts) == 0 {
+		return true
+	}
+	for _, v := range verdicts {
+		if v == verdict {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memoryStore) ListObjects(verdicts []string, objectType string, limit int) ([]ObjectSummary, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	matched := []*ObjectIntel{}
+	for _, obj := range m.objects {
+		if (objectType == "" || obj.ObjectType == objectType) && hasVerdict(verdicts, obj.Verdict) {
+			matched = append(matched, obj)
+		}
+	}
+	byScore(matched)
+
+	objects := []ObjectSummary{}
+	for _, obj := range matched {
+		if len(objects) == limit {
+			break
+		}
+		objects = append(objects, ObjectSummary{Object: obj.Object, ObjectType: obj.ObjectType, RiskScore: obj.RiskScore, Verdict: obj.Verdict, LastSeen: obj.LastSeen})
+	}
+	return objects, nil
+}
+
+// blockExpired checks the object against the block_days of its severity band
+func blockExpired(obj *ObjectIntel, expiries []BlockExpiry) bool {
+	lastSeen := obj.LastSeen
+	if lastSeen == "" {
+		lastSeen = obj.FirstSeen
+	}
+	for _, expiry := range expiries {
+		if obj.RiskScore >= expiry.MinScore && (expiry.MaxScore == 0 || obj.RiskScore < expiry.MaxScore) &&
+			lastSeen < formatSightingTime(expiry.LastSeenBefore) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memoryStore) Blocklist(filter BlocklistFilter) ([]BlocklistEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	matched := []*ObjectIntel{}
+	for _, obj := range m.objects {
+		if obj.Trusted || obj.RiskScore < filter.MinScore || !m.scored[obj.Object] {
+			continue
+		}
+		if (filter.ObjectType == "" || obj.ObjectType == filter.ObjectType) && hasVerdict(filter.Verdicts, obj.Verdict) && !blockExpired(obj, filter.Expiries) {
+			matched = append(matched, obj)
+		}
+	}
+	byScore(matched)
+
+	entries := []BlocklistEntry{}
+	for _, obj := range matched {
+		if len(entries) == filter.Limit {
+			break
+		}
+		entries = append(entries, BlocklistEntry{Object: obj.Object, ObjectType: obj.ObjectType, RiskScore: obj.RiskScore, Verdict: obj.Verdict, LastSeen: obj.LastSeen})
+	}
+	return entries, nil
+}
+
+func (m *memoryStore) SightingTrend(object string, since time.Time) ([]SightingTrendDay, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	counts := map[string]int{}
+	sources := map[string]map[string]bool{}
+	for _, sighting := range m.sightings[object] {
+		if sighting.ObservedAt.Before(since) {
+			continue
+		}
+		day := sighting.ObservedAt.UTC().Format("2006-01-02")
+		counts[day]++
+		if sources[day] == nil {
+			sources[day] = map[string]bool{}
+		}
+		if sighting.Source != "" {
+			sources[day][sighting.Source] = true
+		}
+	}
+
+	trend := []SightingTrendDay{}
+	for day, count := range counts {
+		trend = append(trend, SightingTrendDay{Day: day, Count: count, Sources: len(sources[day])})
+	}
+	sort.Slice(trend, func(i, j int) bool { return trend[i].Day < trend[j].Day })
+	return trend, nil
+}
+
+func (m *memoryStore) ObjectsToEnrich(objectTypes []string, enrichedBefore time.Time, limit int) ([]ObjectRef, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	types := map[string]bool{}
+	for _, objectType := range objectTypes {
+		types[objectType] = true
+	}
+	cutoff := formatSightingTime(enrichedBefore)
+	var never, stale []*ObjectIntel
+	for _, obj := range m.sortedObjects() {
+		if !types[obj.ObjectType] {
+			continue
+		}
+		if obj.EnrichedAt == "" {
+			never = append(never, obj)
+		} else if obj.EnrichedAt < cutoff {
+			stale = append(stale, obj)
+		}
+	}
+	sort.SliceStable(stale, func(i, j int) bool { return stale[i].EnrichedAt < stale[j].EnrichedAt })
+
+	var objects []ObjectRef
+	for _, obj := range append(never, stale...) {
+		if len(objects) == limit {
+			break
+		}
+		objects = append(objects, ObjectRef{Object: obj.Object, ObjectType: obj.ObjectType})
+	}
+	return objects, nil
+}
+
+func (m *memoryStore) SaveEnrichments(enrichments []ObjectEnrichment, enrichedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	at := formatSightingTime(enrichedAt)
+	for _, e := range enrichments {
+		if obj, ok := m.objects[e.Object]; ok {
+			obj.enrich(e.Enrichment, at)
+		}
+	}
+	return nil
+}
+
+// enrich sets the fields an enricher returned, the caller holds m.mu
+func (obj *ObjectIntel) enrich(e Enrichment, enrichedAt string) {
+	for _, field := range []struct {
+		value string
+		dest  *string
+	}{
+		{e.GeoRegion, &obj.GeoRegion},
+		{e.GeoCountry, &obj.GeoCountry},
+		{e.GeoOrg, &obj.GeoOrg},
+		{e.GeoASN, &obj.GeoASN},
+		{e.Info, &obj.EnrichmentInfo},
+	} {
+		if field.value != "" {
+			*field.dest = field.value
+		}
+	}
+	obj.EnrichedAt = enrichedAt
+}
+
+func (m *memoryStore) AddTrustedObjects(objects []TrustedObject) (int64, error) {
+	// Check every object first so none are added when one is invalid
+	decimals := make([][3]int, len(objects))
+	for i, obj := range objects {
+		ipv4Decimal, startIPDecimal, endIPDecimal, err := trustedObjectDecimals(obj.Object, obj.ObjectType)
+		if err != nil {
+			return 0, fmt.Errorf("invalid trusted object %d %s: %w", i, obj.Object, err)
+		}
+		decimals[i] = [3]int{ipv4Decimal, startIPDecimal, endIPDecimal}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := memoryNow()
+	for i, obj := range objects {
+		if trusted, ok := m.trusted[obj.Object]; ok {
+			trusted.Notes = obj.Notes
+			trusted.Source = obj.Source
+			trusted.LastSeen = now
+			trusted.OccurrenceCount++
+			continue
+		}
+		m.trusted[obj.Object] = &memoryTrustedObject{
+			TrustedObject: TrustedObject{
+				Object:          obj.Object,
+				ObjectType:      obj.ObjectType,
+				Notes:           obj.Notes,
+				Source:          obj.Source,
+				TimeImported:    now,
+				LastSeen:        now,
+				OccurrenceCount: 1,
+			},
+			ipDecimal:      decimals[i][0],
+			startIPDecimal: decimals[i][1],
+			endIPDecimal:   decimals[i][2],
+		}
+	}
+	return int64(len(objects)), nil
+}
+
+// sortedTrusted returns the trusted objects in order of the object type and object, the caller holds m.mu
+func (m *memoryStore) sortedTrusted() []*memoryTrustedObject {
+	trusted := make([]*memoryTrustedObject, 0, len(m.trusted))
+	for _, obj := range m.trusted {
+		trusted = append(trusted, obj)
+	}
+	sort.Slice(trusted, func(i, j int) bool {
+		if trusted[i].ObjectType != trusted[j].ObjectType {
+			return trusted[i].ObjectType < trusted[j].ObjectType
+		}
+		return trusted[i].Object < trusted[j].Object
+	})
+	return trusted
+}
+
+func (m *memoryStore) ListTrustedObjects() ([]TrustedObject, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	objects := []TrustedObject{}
+	for _, obj := range m.sortedTrusted() {
+		objects = append(objects, obj.TrustedObject)
+	}
+	return objects, nil
+}
+
+func (m *memoryStore) RemoveTrustedObject(object string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	trusted, ok := m.trusted[object]
+	if !ok {
+		return false, nil
+	}
+	delete(m.trusted, object)
+	for _, obj := range m.objects {
+		if trusted.ObjectType == "ipv4CIDR" {
+			if obj.ObjectType == "ipv4" && int(obj.IPDecimal) >= trusted.startIPDecimal && int(obj.IPDecimal) <= trusted.endIPDecimal {
+				obj.Trusted = false
+			}
+		} else if obj.Object == object {
+			obj.Trusted = false
+		}
+	}
+	return true, nil
+}
+
+func (m *memoryStore) MarkTrustedObjects(rules VerdictRules) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, trusted := range m.sortedTrusted() {
+		switch trusted.ObjectType {
+		case "ipv4", "ipv6":
+			if obj, ok := m.objects[trusted.Object]; ok && obj.ObjectType == trusted.ObjectType {
+				obj.Trusted = true
+			}
+		case "ipv4CIDR":
+			for _, obj := range m.objects {
+				if obj.ObjectType == "ipv4" && int(obj.IPDecimal) >= trusted.startIPDecimal && int(obj.IPDecimal) <= trusted.endIPDecimal {
+					obj.Trusted = true
+				}
+			}
+		}
+	}
+
+	// Objects that became trusted, or were trusted before RemoveTrustedObject cleared them
+	return m.refreshVerdicts(rules, func(obj *ObjectIntel) bool {
+		return obj.Trusted != strings.EqualFold(obj.Verdict, VerdictTrusted)
+	}), nil
+}
+
+// stale matches the objects expired by Prune
+func stale(obj *ObjectIntel, policy PrunePolicy) bool {
+	lastSeen := obj.LastSeen
+	if lastSeen == "" {
+		lastSeen = obj.FirstSeen
+	}
+	return !obj.Trusted && !obj.ConfirmedRisk && obj.RiskScore <= policy.StaleMaxScore && lastSeen < formatSightingTime(policy.StaleBefore)
+}
+
+func (m *memoryStore) Prune(policy PrunePolicy) (PruneResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var result PruneResult
+	if !policy.SightingsBefore.IsZero() {
+		for object, sightings := range m.sightings {
+			var kept []memorySighting
+			for _, sighting := range sightings {
+				if sighting.ObservedAt.Before(policy.SightingsBefore) {
+					result.Sightings++
+					continue
+				}
+				kept = append(kept, sighting)
+			}
+			if !policy.DryRun {
+				m.sightings[object] = kept
+			}
+		}
+	}
+	if !policy.StageRunsBefore.IsZero() {
+		before := formatSightingTime(policy.StageRunsBefore)
+		var kept []StageRun
+		for _, run := range m.stageRuns {
+			if run.StartedAt < before {
+				result.StageRuns++
+				continue
+			}
+			kept = append(kept, run)
+		}
+		if !policy.DryRun {
+			m.stageRuns = kept
+		}
+	}
+	if !policy.BatchesBefore.IsZero() {
+		before := formatSightingTime(policy.BatchesBefore)
+		for id, batch := range m.batches {
+			if batch.FinishedAt == "" || batch.FinishedAt >= before {
+				continue
+			}
+			result.ImportBatches++
+			if !policy.DryRun {
+				delete(m.batches, id)
+				delete(m.batchRows, id)
+			}
+		}
+	}
+	if policy.StaleBefore.IsZero() {
+		return result, nil
+	}
+
+	now := memoryNow()
+	for _, obj := range m.sortedObjects() {
+		if !stale(obj, policy) {
+			continue
+		}
+		result.Objects++
+		if policy.DryRun {
+			continue
+		}
+		m.tombstones[obj.Object] = Tombstone{
+			Object:          obj.Object,
+			ObjectType:      obj.ObjectType,
+			FirstSeen:       obj.FirstSeen,
+			LastSeen:        obj.LastSeen,
+			OccurrenceCount: obj.OccurrenceCount,
+			RiskScore:       obj.RiskScore,
+			Verdict:         obj.Verdict,
+			ExpiredAt:       now,
+		}
+		delete(m.objects, obj.Object)
+		delete(m.scored, obj.Object)
+		delete(m.sightings, obj.Object)
+		delete(m.scoreHistory, obj.Object)
+		delete(m.verdictHistory, obj.Object)
+	}
+	return result, nil
+}
+
+func (m *memoryStore) Tombstone(object string) (Tombstone, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tombstone, ok := m.tombstones[object]
+	if !ok {
+		return Tombstone{}, ErrNotFound
+	}
+	return tombstone, nil
+}
+
+func (m *memoryStore) RecordStageRun(run StageRun) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stageRuns = append(m.stageRuns, run)
+	return nil
+}
+
+func (m *memoryStore) StageRuns(stage string, limit int) ([]StageRun, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	runs := []StageRun{}
+	for i := len(m.stageRuns) - 1; i >= 0 && len(runs) < limit; i-- {
+		if stage == "" || m.stageRuns[i].Stage == stage {
+			runs = append(runs, m.stageRuns[i])
+		}
+	}
+	return runs, nil
+}
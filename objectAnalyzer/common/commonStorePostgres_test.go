@@ -0,0 +1,68 @@
+//go:build postgres
+
+package common
+
+// OA_TEST_DATABASE_URL names a database the test may create schemas in, the
+// test is skipped when it is not set:
+//
+//	OA_TEST_DATABASE_URL=postgres://localhost/objectanalyzer_test go test -tags postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostgresStore(t *testing.T) {
+	databaseURL := os.Getenv("OA_TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("OA_TEST_DATABASE_URL is not set")
+	}
+	admin, err := sql.Open("pgx", databaseURL)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", databaseURL, err)
+	}
+	defer admin.Close()
+
+	storeContract(t, func(t *testing.T) Store {
+		// Each store gets its own schema so it starts empty
+		schema := fmt.Sprintf("contract_%d", time.Now().UnixNano())
+		if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+			t.Fatalf("failed to create the schema %s: %v", schema, err)
+		}
+		t.Cleanup(func() {
+			if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+				t.Errorf("failed to drop the schema %s: %v", schema, err)
+			}
+		})
+
+		st, err := OpenPostgresStore(Configuration{DatabaseURL: withSearchPath(t, databaseURL, schema)})
+		if err != nil {
+			t.Fatalf("OpenPostgresStore: %v", err)
+		}
+		t.Cleanup(func() { st.Close() })
+		if _, err := st.Migrate(); err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		return st
+	})
+}
+
+// withSearchPath sets the search_path of the connections to schema, in a URL or a keyword/value connection string
+func withSearchPath(t *testing.T, databaseURL string, schema string) string {
+	if !strings.Contains(databaseURL, "://") {
+		return databaseURL + " search_path=" + schema
+	}
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		t.Fatalf("failed to parse OA_TEST_DATABASE_URL: %v", err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
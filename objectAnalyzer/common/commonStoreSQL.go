@@ -0,0 +1,1917 @@
+package common
+
+// The Store of the SQL backends, SQLite and PostgreSQL
+//
+// The queries are written once with ? placeholders and rebound for the
+// database.  Times are compared as the UTC text of formatSightingTime, the
+// format of CURRENT_TIMESTAMP, so no query depends on the date functions of
+// one database.  What still differs is in sqlDialect.
+//
+// Every write is queued to a single writer goroutine that owns the write
+// connection, so the writes of a process never contend with each other.
+// Queries use the read pool and do not wait for the writes, with SQLite in WAL
+// mode they see the last commit while a write transaction is open.  Another
+// process writing the same database is waited for up to the busy timeout.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqlDialect holds what differs between the databases behind sqlStore
+type sqlDialect struct {
+	name     string
+	numbered bool   // Placeholders are $1, $2, ... instead of ?
+	dayExpr  string // The UTC day of observed_at as YYYY-MM-DD
+	vacuum   string
+	// Added to the select of the pending rows to claim, SQLite needs nothing as the claim holds the only write lock
+	skipLocked string
+}
+
+// rebind numbers the ? placeholders outside of string literals for the databases that need it
+func (d sqlDialect) rebind(query string) string {
+	if !d.numbered || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	inString := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			inString = !inString
+		case r == '?' && !inString:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// sqlDB and sqlTx rebind every query for the dialect
+type sqlDB struct {
+	*sql.DB
+	dialect sqlDialect
+}
+
+func (db sqlDB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.DB.Exec(db.dialect.rebind(query), args...)
+}
+
+func (db sqlDB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.DB.Query(db.dialect.rebind(query), args...)
+}
+
+func (db sqlDB) QueryRow(query string, args ...any) *sql.Row {
+	return db.DB.QueryRow(db.dialect.rebind(query), args...)
+}
+
+func (db sqlDB) Begin() (sqlTx, error) {
+	tx, err := db.DB.Begin()
+	return sqlTx{Tx: tx, dialect: db.dialect}, err
+}
+
+type sqlTx struct {
+	*sql.Tx
+	dialect sqlDialect
+}
+
+func (tx sqlTx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.rebind(query), args...)
+}
+
+func (tx sqlTx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.dialect.rebind(query), args...)
+}
+
+func (tx sqlTx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRow(tx.dialect.rebind(query), args...)
+}
+
+func (tx sqlTx) Prepare(query string) (*sql.Stmt, error) {
+	return tx.Tx.Prepare(tx.dialect.rebind(query))
+}
+
+// execer is satisfied by sqlDB and sqlTx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// querier is satisfied by sqlDB and sqlTx, so the same reads run on the read pool or in a transaction
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// sqlTime returns a TIMESTAMP read from the database in the format of formatSightingTime, the drivers return RFC 3339
+func sqlTime(value sql.NullString) string {
+	if t := parseTimestamp(value.String); !t.IsZero() {
+		return formatSightingTime(t)
+	}
+	return value.String
+}
+
+const (
+	defaultDBBusyTimeoutSeconds = 30 // Wait for the write lock held by another process, a pending_import batch can take a while
+	writeQueueSize              = 64 // Writes waiting for the writer goroutine before the callers block
+)
+
+var errStoreClosed = errors.New("the store is closed")
+
+type writeRequest struct {
+	fn     func(db sqlDB) error
+	result chan error
+}
+
+type sqlStore struct {
+	db         sqlDB // Read pool, only used for queries
+	writer     sqlDB // Only used by the writer goroutine
+	writes     chan writeRequest
+	done       chan struct{} // Closed when the writer goroutine exits
+	closeMu    sync.RWMutex  // Held by the callers of write so Close waits for them
+	closed     bool
+	migrations []migration
+}
+
+// newSQLStore starts the writer goroutine, reader and writer may be the same pool when the database allows concurrent writers
+func newSQLStore(reader *sql.DB, writer *sql.DB, dialect sqlDialect, migrations []migration) *sqlStore {
+	st := &sqlStore{
+		db:         sqlDB{DB: reader, dialect: dialect},
+		writer:     sqlDB{DB: writer, dialect: dialect},
+		writes:     make(chan writeRequest, writeQueueSize),
+		done:       make(chan struct{}),
+		migrations: migrations,
+	}
+	go st.runWriter()
+	return st
+}
+
+func (st *sqlStore) runWriter() {
+	defer close(st.done)
+	for req := range st.writes {
+		req.result <- req.fn(st.writer)
+	}
+}
+
+// write queues fn for the writer goroutine and waits for it to run
+func (st *sqlStore) write(fn func(db sqlDB) error) error {
+	st.closeMu.RLock()
+	defer st.closeMu.RUnlock()
+	if st.closed {
+		return errStoreClosed
+	}
+
+	result := make(chan error, 1)
+	st.writes <- writeRequest{fn: fn, result: result}
+	return <-result
+}
+
+func (st *sqlStore) Backend() string {
+	return st.db.dialect.name
+}
+
+// Close waits for the queued writes and closes both pools
+func (st *sqlStore) Close() error {
+	st.closeMu.Lock()
+	if st.closed {
+		st.closeMu.Unlock()
+		return nil
+	}
+	st.closed = true
+	close(st.writes)
+	st.closeMu.Unlock()
+	<-st.done
+
+	err := st.writer.Close()
+	if st.db.DB != st.writer.DB {
+		err = errors.Join(err, st.db.Close())
+	}
+	return err
+}
+
+// update runs fn in a transaction of the writer goroutine, it is rolled back when fn fails
+func (st *sqlStore) update(fn func(tx sqlTx) error) error {
+	return st.write(func(db sqlDB) error {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		if err := fn(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		return nil
+	})
+}
+
+// Backup and Restore are replaced by the backends that can copy the database file
+func (st *sqlStore) Backup(path string) error {
+	return fmt.Errorf("%w: back up the %s database with its own tools", errors.ErrUnsupported, st.Backend())
+}
+
+func (st *sqlStore) Restore(path string) error {
+	return fmt.Errorf("%w: restore the %s database with its own tools", errors.ErrUnsupported, st.Backend())
+}
+
+func (st *sqlStore) Vacuum() error {
+	return st.write(func(db sqlDB) error {
+		if _, err := db.Exec(db.dialect.vacuum); err != nil {
+			return fmt.Errorf("failed to vacuum the database: %w", err)
+		}
+		return nil
+	})
+}
+
+func (st *sqlStore) CreateAPIKey(name string, keyHash string, keyPrefix string, role string) (int64, error) {
+	var id int64
+	err := st.write(func(db sqlDB) error {
+		err := db.QueryRow(`
+			INSERT INTO api_keys (name, key_hash, key_prefix, role, created)
+			VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+			RETURNING id
+		`, name, keyHash, keyPrefix, role).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("failed to insert api key: %w", err)
+		}
+		return nil
+	})
+	return id, err
+}
+
+func (st *sqlStore) ListAPIKeys() ([]APIKeyRecord, error) {
+	rows, err := st.db.Query(`SELECT id, name, role, key_prefix, created, revoked FROM api_keys ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query api_keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []APIKeyRecord{}
+	for rows.Next() {
+		var key APIKeyRecord
+		var created, revoked sql.NullString
+		if err := rows.Scan(&key.ID, &key.Name, &key.Role, &key.KeyPrefix, &created, &revoked); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		key.Created = created.String
+		key.Revoked = revoked.String
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return keys, nil
+}
+
+func (st *sqlStore) RevokeAPIKey(id int64) (bool, error) {
+	var n int64
+	err := st.write(func(db sqlDB) error {
+		result, err := db.Exec(`UPDATE api_keys SET revoked = CURRENT_TIMESTAMP WHERE id = ? AND revoked IS NULL`, id)
+		if err != nil {
+			return fmt.Errorf("failed to revoke api key: %w", err)
+		}
+		n, err = result.RowsAffected()
+		return err
+	})
+	return n > 0, err
+}
+
+func (st *sqlStore) APIKeyRole(keyHash string) (string, error) {
+	var role string
+	err := st.db.QueryRow(`SELECT role FROM api_keys WHERE key_hash = ? AND revoked IS NULL`, keyHash).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up api key: %w", err)
+	}
+	return role, nil
+}
+
+func (st *sqlStore) Setting(key string) (string, bool, error) {
+	var value string
+	err := st.db.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to query setting %s: %w", key, err)
+	}
+	return value, true, nil
+}
+
+func (st *sqlStore) Settings() (map[string]string, error) {
+	rows, err := st.db.Query(`SELECT key, value FROM settings`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query settings: %w", err)
+	}
+	defer rows.Close()
+
+	values := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		values[key] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return values, nil
+}
+
+func (st *sqlStore) SaveSettings(values map[string]string) error {
+	return st.update(func(tx sqlTx) error {
+		for key, value := range values {
+			if err := upsertSetting(tx, key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func upsertSetting(db execer, key string, value string) error {
+	_, err := db.Exec(`
+		INSERT INTO settings (key, value, last_updated) VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(key) DO UPDATE SET value=excluded.value, last_updated=CURRENT_TIMESTAMP
+	`, key, value)
+	if err != nil {
+		return fmt.Errorf("failed to save setting %s: %w", key, err)
+	}
+	return nil
+}
+
+func (st *sqlStore) AddPendingImports(batch ImportBatch, rows []InsertPendingImportStruct) (int64, error) {
+	var batchID int64
+	err := st.update(func(tx sqlTx) error {
+		// A batch without rows has nothing to wait for
+		created := formatSightingTime(time.Now())
+		finished := sql.NullString{String: created, Valid: len(rows) == 0}
+		err := tx.QueryRow(`
+			INSERT INTO import_batches (source, submitted_by, file_name, total_rows, created_at, finished_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+			RETURNING id
+		`, batch.Source, batch.SubmittedBy, sql.NullString{String: batch.FileName, Valid: batch.FileName != ""}, len(rows), created, finished).Scan(&batchID)
+		if err != nil {
+			return fmt.Errorf("failed to insert import batch: %w", err)
+		}
+
+		stmt, err := tx.Prepare(`
+			INSERT INTO pending_import (object, object_type, ipDecimal, notes, source, time_imported, time_provided, geo_region, geo_country, geo_org, batch_id, batch_row)
+			VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?)
+		`)
+		if err != nil {
+			return fmt.Errorf("failed to prepare statement: %w", err)
+		}
+		defer stmt.Close()
+
+		for i, row := range rows {
+			// ipDecimal is returned by HandleVerify, ProcessPendingImports validates the address again
+			var ipDecimal int
+			if row.ObjectType == "ipv4" {
+				ipDecimal, _ = ipv4ToDecimal(row.Object)
+			}
+			if _, err := stmt.Exec(row.Object, row.ObjectType, ipDecimal, row.Notes, row.Source, row.TimeProvided, row.GeoRegion, row.GeoCountry, row.GeoOrg, batchID, i+1); err != nil {
+				return fmt.Errorf("failed to insert into pending_import in row %s - %s: %w", row.Object, row.TimeProvided, err)
+			}
+		}
+		return nil
+	})
+	return batchID, err
+}
+
+func (st *sqlStore) FindPendingImport(object string) (VerifyImportResult, error) {
+	var result VerifyImportResult
+	var ipDecimal sql.NullInt64
+	var notes, source, timeImported, timeProvided sql.NullString
+	err := st.db.QueryRow(`
+		SELECT id, object, object_type, ipDecimal, notes, source, time_imported, time_provided
+		FROM pending_import
+		WHERE object = ?
+		ORDER BY id
+		LIMIT 1
+	`, object).Scan(&result.ID, &result.Object, &result.ObjectType, &ipDecimal, &notes, &source, &timeImported, &timeProvided)
+	if err == sql.ErrNoRows {
+		return result, ErrNotFound
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to query pending_import: %w", err)
+	}
+	result.IPDecimal = int(ipDecimal.Int64)
+	result.Notes = notes.String
+	result.Source = source.String
+	result.TimeImported = timeImported.String
+	result.TimeProvided = timeProvided.String
+	return result, nil
+}
+
+func (st *sqlStore) ClaimPendingImports(worker string, limit int, lease time.Duration) ([]PendingImport, error) {
+	now := time.Now()
+	var pending []PendingImport
+	err := st.update(func(tx sqlTx) error {
+		rows, err := tx.Query(`
+			UPDATE pending_import
+			SET claimed_by = ?, lease_expires = ?, claims = claims + 1
+			WHERE id IN (
+				SELECT id
+				FROM pending_import
+				WHERE claimed_by IS NULL OR lease_expires < ?
+				ORDER BY id
+				LIMIT ?`+tx.dialect.skipLocked+`
+			)
+			RETURNING id, object, object_type, notes, source, time_imported, time_provided, geo_region, geo_country, geo_org, claims, batch_id, batch_row
+		`, worker, formatSightingTime(now.Add(lease)), formatSightingTime(now), limit)
+		if err != nil {
+			return fmt.Errorf("failed to claim pending_import rows: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var row PendingImport
+			var notes, source, timeImported, timeProvided, geoRegion, geoCountry, geoOrg sql.NullString
+			var batchID, batchRow sql.NullInt64
+			if err := rows.Scan(&row.ID, &row.Object, &row.ObjectType, &notes, &source, &timeImported, &timeProvided, &geoRegion, &geoCountry, &geoOrg, &row.Claims, &batchID, &batchRow); err != nil {
+				return fmt.Errorf("failed to scan row: %w", err)
+			}
+			row.BatchID = batchID.Int64
+			row.BatchRow = int(batchRow.Int64)
+			row.Notes = notes.String
+			row.Source = source.String
+			// The drivers return the TIMESTAMP as RFC 3339, it becomes the last_seen compared as text with formatSightingTime
+			row.TimeImported = timeImported.String
+			if imported := parseTimestamp(timeImported.String); !imported.IsZero() {
+				row.TimeImported = formatSightingTime(imported)
+			}
+			row.TimeProvided = timeProvided.String
+			row.GeoRegion = geoRegion.String
+			row.GeoCountry = geoCountry.String
+			row.GeoOrg = geoOrg.String
+			pending = append(pending, row)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating over rows: %w", err)
+		}
+		rows.Close()
+
+		// The batches of the claimed rows are being processed
+		_, err = tx.Exec(`
+			UPDATE import_batches SET started_at = ?
+			WHERE started_at IS NULL AND id IN (SELECT batch_id FROM pending_import WHERE claimed_by = ?)
+		`, formatSightingTime(now), worker)
+		if err != nil {
+			return fmt.Errorf("failed to start import batches: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// RETURNING does not keep the order of the select
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID < pending[j].ID })
+	return pending, nil
+}
+
+func (st *sqlStore) ExtendPendingLease(worker string, lease time.Duration) (int64, error) {
+	var n int64
+	err := st.write(func(db sqlDB) error {
+		result, err := db.Exec(`UPDATE pending_import SET lease_expires = ? WHERE claimed_by = ?`, formatSightingTime(time.Now().Add(lease)), worker)
+		if err != nil {
+			return fmt.Errorf("failed to extend the lease of %s: %w", worker, err)
+		}
+		n, err = result.RowsAffected()
+		return err
+	})
+	return n, err
+}
+
+func (st *sqlStore) ReleasePendingImports(worker string) error {
+	return st.write(func(db sqlDB) error {
+		if _, err := db.Exec(`UPDATE pending_import SET claimed_by = NULL, lease_expires = NULL WHERE claimed_by = ?`, worker); err != nil {
+			return fmt.Errorf("failed to release the pending rows of %s: %w", worker, err)
+		}
+		return nil
+	})
+}
+
+func (st *sqlStore) ApplyPendingImports(worker string, accepted []PendingImport, rejected []RejectedImport) (int, error) {
+	lost := 0
+	err := st.update(func(tx sqlTx) error {
+		lost = 0
+		processed := formatSightingTime(time.Now())
+		counts := map[int64]*ImportBatch{}
+		// A row is only applied by the worker that still holds its claim, deleting it first decides which one
+		claimed := func(row PendingImport, outcome string, reason string) (bool, error) {
+			result, err := tx.Exec(`DELETE FROM pending_import WHERE id = ? AND claimed_by = ?`, row.ID, worker)
+			if err != nil {
+				return false, fmt.Errorf("failed to delete from pending_import: %w", err)
+			}
+			n, err := result.RowsAffected()
+			if err != nil || n == 0 {
+				lost++
+				return false, err
+			}
+			if row.BatchID == 0 {
+				return true, nil
+			}
+			_, err = tx.Exec(`
+				INSERT INTO import_batch_rows (batch_id, batch_row, object, object_type, outcome, reason, processed_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?)
+			`, row.BatchID, row.BatchRow, row.Object, row.ObjectType, outcome, sql.NullString{String: reason, Valid: reason != ""}, processed)
+			if err != nil {
+				return false, fmt.Errorf("failed to insert into import_batch_rows: %w", err)
+			}
+			if counts[row.BatchID] == nil {
+				counts[row.BatchID] = &ImportBatch{}
+			}
+			if outcome == ImportRowAccepted {
+				counts[row.BatchID].Accepted++
+			} else {
+				counts[row.BatchID].Rejected++
+			}
+			return true, nil
+		}
+
+		for _, row := range accepted {
+			if ok, err := claimed(row, ImportRowAccepted, ""); err != nil || !ok {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			_, err := tx.Exec(`
+				INSERT INTO object_intel (object, object_type, ipDecimal, notes, first_seen, last_seen, occurrence_count, geo_region, geo_country, geo_org)
+				VALUES (?, ?, ?, ?, ?, ?, 1, ?, ?, ?)
+				ON CONFLICT(object) DO UPDATE SET
+					notes=excluded.notes,
+					last_seen=excluded.last_seen,
+					occurrence_count = object_intel.occurrence_count + 1
+			`, row.Object, row.ObjectType, row.IPDecimal, row.Notes, row.TimeImported, row.TimeImported, row.GeoRegion, row.GeoCountry, row.GeoOrg)
+			if err != nil {
+				return fmt.Errorf("failed to insert/update object_intel: %w", err)
+			}
+			if err := insertImportSighting(tx, row); err != nil {
+				return err
+			}
+			if row.Enrichment != nil {
+				if err := saveEnrichment(tx, row.Object, *row.Enrichment, processed); err != nil {
+					return err
+				}
+			}
+			// An expired object that is seen again is no longer expired
+			if _, err := tx.Exec(`DELETE FROM object_tombstones WHERE object = ?`, row.Object); err != nil {
+				return fmt.Errorf("failed to delete from object_tombstones: %w", err)
+			}
+		}
+		for _, row := range rejected {
+			if ok, err := claimed(row.PendingImport, ImportRowRejected, row.Reason); err != nil || !ok {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if err := insertQuarantine(tx, row, processed); err != nil {
+				return err
+			}
+		}
+
+		for id, count := range counts {
+			_, err := tx.Exec(`UPDATE import_batches SET accepted = accepted + ?, rejected = rejected + ? WHERE id = ?`, count.Accepted, count.Rejected, id)
+			if err != nil {
+				return fmt.Errorf("failed to update import batch %d: %w", id, err)
+			}
+		}
+		return finishImportBatches(tx, processed)
+	})
+	return lost, err
+}
+
+// finishImportBatches marks the batches without pending rows left as finished
+func finishImportBatches(tx sqlTx, finished string) error {
+	_, err := tx.Exec(`
+		UPDATE import_batches SET finished_at = ?
+		WHERE finished_at IS NULL AND NOT EXISTS (SELECT 1 FROM pending_import WHERE pending_import.batch_id = import_batches.id)
+	`, finished)
+	if err != nil {
+		return fmt.Errorf("failed to finish import batches: %w", err)
+	}
+	return nil
+}
+
+func (st *sqlStore) PendingStats() (PendingStats, error) {
+	stats := PendingStats{ByType: map[string]int{}, BySource: map[string]int{}}
+	var oldest, newest sql.NullString
+	err := st.db.QueryRow(`
+		SELECT COUNT(*), COUNT(CASE WHEN claimed_by IS NOT NULL AND lease_expires >= ? THEN 1 END), MIN(time_imported), MAX(time_imported)
+		FROM pending_import
+	`, formatSightingTime(time.Now())).Scan(&stats.Total, &stats.Claimed, &oldest, &newest)
+	if err != nil {
+		return stats, fmt.Errorf("failed to query pending_import: %w", err)
+	}
+	stats.Oldest = oldest.String
+	stats.Newest = newest.String
+	if err := st.db.QueryRow(`SELECT COUNT(*) FROM quarantine`).Scan(&stats.Quarantined); err != nil {
+		return stats, fmt.Errorf("failed to query quarantine: %w", err)
+	}
+
+	groups := []struct {
+		query  string
+		counts map[string]int
+	}{
+		{`SELECT object_type, COUNT(*) FROM pending_import GROUP BY object_type`, stats.ByType},
+		{`SELECT COALESCE(source, ''), COUNT(*) FROM pending_import GROUP BY source ORDER BY COUNT(*) DESC LIMIT 20`, stats.BySource},
+	}
+	for _, group := range groups {
+		rows, err := st.db.Query(group.query)
+		if err != nil {
+			return stats, fmt.Errorf("failed to query pending_import: %w", err)
+		}
+		for rows.Next() {
+			var name string
+			var count int
+			if err := rows.Scan(&name, &count); err != nil {
+				rows.Close()
+				return stats, fmt.Errorf("failed to scan row: %w", err)
+			}
+			group.counts[name] = count
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return stats, fmt.Errorf("error iterating over rows: %w", err)
+		}
+	}
+	return stats, nil
+}
+
+func (st *sqlStore) PurgePending(olderThan time.Time, objectType string, source string) (int64, error) {
+	query := `DELETE FROM pending_import WHERE 1 = 1`
+	var args []any
+	if !olderThan.IsZero() {
+		query += ` AND time_imported < ?`
+		args = append(args, formatSightingTime(olderThan))
+	}
+	if objectType != "" {
+		query += ` AND object_type = ?`
+		args = append(args, objectType)
+	}
+	if source != "" {
+		query += ` AND source = ?`
+		args = append(args, source)
+	}
+
+	var n int64
+	err := st.update(func(tx sqlTx) error {
+		result, err := tx.Exec(query, args...)
+		if err != nil {
+			return fmt.Errorf("failed to purge pending_import: %w", err)
+		}
+		if n, err = result.RowsAffected(); err != nil {
+			return err
+		}
+		// A batch left without pending rows is finished, its purged rows make it partially failed
+		return finishImportBatches(tx, formatSightingTime(time.Now()))
+	})
+	return n, err
+}
+
+// insertQuarantine keeps a rejected row with the reason
+func insertQuarantine(tx sqlTx, row RejectedImport, quarantined string) error {
+	_, err := tx.Exec(`
+		INSERT INTO quarantine (object, object_type, notes, source, geo_region, geo_country, geo_org, time_imported, time_provided, batch_id, batch_row, reason, quarantined_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, row.Object, row.ObjectType, row.Notes, row.Source, row.GeoRegion, row.GeoCountry, row.GeoOrg, row.TimeImported, row.TimeProvided,
+		sql.NullInt64{Int64: row.BatchID, Valid: row.BatchID != 0}, sql.NullInt64{Int64: int64(row.BatchRow), Valid: row.BatchID != 0}, row.Reason, quarantined)
+	if err != nil {
+		return fmt.Errorf("failed to insert into quarantine: %w", err)
+	}
+	return nil
+}
+
+// quarantineWhere is the condition of a filter on the quarantine table
+func quarantineWhere(filter QuarantineFilter) (string, []any) {
+	where := `WHERE 1 = 1`
+	var args []any
+	if filter.ID != 0 {
+		where += ` AND id = ?`
+		args = append(args, filter.ID)
+	}
+	if filter.BatchID != 0 {
+		where += ` AND batch_id = ?`
+		args = append(args, filter.BatchID)
+	}
+	if filter.Source != "" {
+		where += ` AND source = ?`
+		args = append(args, filter.Source)
+	}
+	if filter.ObjectType != "" {
+		where += ` AND object_type = ?`
+		args = append(args, filter.ObjectType)
+	}
+	if filter.Reason != "" {
+		where += ` AND reason = ?`
+		args = append(args, filter.Reason)
+	}
+	if !filter.OlderThan.IsZero() {
+		where += ` AND quarantined_at < ?`
+		args = append(args, formatSightingTime(filter.OlderThan))
+	}
+	return where, args
+}
+
+const quarantineColumns = `id, object, object_type, notes, source, geo_region, geo_country, geo_org, time_imported, time_provided, batch_id, batch_row, reason, quarantined_at, fixed_at`
+
+// scanQuarantine reads the rows of a select of all the columns of quarantine
+func scanQuarantine(rows *sql.Rows) ([]QuarantinedImport, error) {
+	result := []QuarantinedImport{}
+	for rows.Next() {
+		var row QuarantinedImport
+		var notes, source, geoRegion, geoCountry, geoOrg, timeProvided, fixedAt sql.NullString
+		var batchID, batchRow sql.NullInt64
+		if err := rows.Scan(&row.ID, &row.Object, &row.ObjectType, &notes, &source, &geoRegion, &geoCountry, &geoOrg, &row.TimeImported, &timeProvided,
+			&batchID, &batchRow, &row.Reason, &row.QuarantinedAt, &fixedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		row.Notes = notes.String
+		row.Source = source.String
+		row.GeoRegion = geoRegion.String
+		row.GeoCountry = geoCountry.String
+		row.GeoOrg = geoOrg.String
+		row.TimeProvided = timeProvided.String
+		row.BatchID = batchID.Int64
+		row.BatchRow = int(batchRow.Int64)
+		row.FixedAt = fixedAt.String
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return result, nil
+}
+
+func (st *sqlStore) ListQuarantine(filter QuarantineFilter) ([]QuarantinedImport, error) {
+	where, args := quarantineWhere(filter)
+	rows, err := st.db.Query(`SELECT `+quarantineColumns+` FROM quarantine `+where+` ORDER BY id LIMIT ?`, append(args, filter.Limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query quarantine: %w", err)
+	}
+	defer rows.Close()
+	return scanQuarantine(rows)
+}
+
+func (st *sqlStore) FixQuarantined(id int64, object string, objectType string) error {
+	return st.write(func(db sqlDB) error {
+		result, err := db.Exec(`UPDATE quarantine SET object = ?, object_type = ?, fixed_at = ? WHERE id = ?`, object, objectType, formatSightingTime(time.Now()), id)
+		if err != nil {
+			return fmt.Errorf("failed to update quarantine: %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (st *sqlStore) ResubmitQuarantined(filter QuarantineFilter) (int64, error) {
+	where, args := quarantineWhere(filter)
+	var n int64
+	err := st.update(func(tx sqlTx) error {
+		n = 0
+		rows, err := tx.Query(`SELECT `+quarantineColumns+` FROM quarantine `+where+` ORDER BY id`, args...)
+		if err != nil {
+			return fmt.Errorf("failed to query quarantine: %w", err)
+		}
+		quarantined, err := scanQuarantine(rows)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, row := range quarantined {
+			// The row goes back in its batch unless the batch was rolled back or pruned
+			batchID := sql.NullInt64{Int64: row.BatchID, Valid: row.BatchID != 0}
+			if batchID.Valid {
+				var rolledBackAt sql.NullString
+				err := tx.QueryRow(`SELECT rolled_back_at FROM import_batches WHERE id = ?`, row.BatchID).Scan(&rolledBackAt)
+				if err != nil && err != sql.ErrNoRows {
+					return fmt.Errorf("failed to query import_batches: %w", err)
+				}
+				batchID.Valid = err == nil && !rolledBackAt.Valid
+			}
+			if batchID.Valid {
+				result, err := tx.Exec(`DELETE FROM import_batch_rows WHERE batch_id = ? AND batch_row = ? AND outcome = ?`, row.BatchID, row.BatchRow, ImportRowRejected)
+				if err != nil {
+					return fmt.Errorf("failed to delete from import_batch_rows: %w", err)
+				}
+				deleted, err := result.RowsAffected()
+				if err != nil {
+					return err
+				}
+				if _, err := tx.Exec(`UPDATE import_batches SET rejected = rejected - ?, finished_at = NULL WHERE id = ?`, deleted, row.BatchID); err != nil {
+					return fmt.Errorf("failed to update import batch %d: %w", row.BatchID, err)
+				}
+			}
+
+			var ipDecimal int
+			if row.ObjectType == "ipv4" {
+				ipDecimal, _ = ipv4ToDecimal(row.Object)
+			}
+			_, err := tx.Exec(`
+				INSERT INTO pending_import (object, object_type, ipDecimal, notes, source, time_imported, time_provided, geo_region, geo_country, geo_org, batch_id, batch_row)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			`, row.Object, row.ObjectType, ipDecimal, row.Notes, row.Source, row.TimeImported, row.TimeProvided, row.GeoRegion, row.GeoCountry, row.GeoOrg,
+				batchID, sql.NullInt64{Int64: int64(row.BatchRow), Valid: batchID.Valid})
+			if err != nil {
+				return fmt.Errorf("failed to insert into pending_import in row %s: %w", row.Object, err)
+			}
+			if _, err := tx.Exec(`DELETE FROM quarantine WHERE id = ?`, row.ID); err != nil {
+				return fmt.Errorf("failed to delete from quarantine: %w", err)
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (st *sqlStore) PurgeQuarantine(filter QuarantineFilter) (int64, error) {
+	where, args := quarantineWhere(filter)
+	var n int64
+	err := st.write(func(db sqlDB) error {
+		result, err := db.Exec(`DELETE FROM quarantine `+where, args...)
+		if err != nil {
+			return fmt.Errorf("failed to purge quarantine: %w", err)
+		}
+		n, err = result.RowsAffected()
+		return err
+	})
+	return n, err
+}
+
+func (st *sqlStore) ImportBatch(id int64) (ImportBatch, error) {
+	var batch ImportBatch
+	var fileName, startedAt, finishedAt, rolledBackAt sql.NullString
+	err := st.db.QueryRow(`
+		SELECT id, source, submitted_by, file_name, total_rows, accepted, rejected, created_at, started_at, finished_at, rolled_back_at,
+			(SELECT COUNT(*) FROM pending_import WHERE batch_id = import_batches.id)
+		FROM import_batches
+		WHERE id = ?
+	`, id).Scan(&batch.ID, &batch.Source, &batch.SubmittedBy, &fileName, &batch.TotalRows, &batch.Accepted, &batch.Rejected,
+		&batch.CreatedAt, &startedAt, &finishedAt, &rolledBackAt, &batch.Pending)
+	if err == sql.ErrNoRows {
+		return batch, ErrNotFound
+	}
+	if err != nil {
+		return batch, fmt.Errorf("failed to query import_batches: %w", err)
+	}
+	batch.FileName = fileName.String
+	batch.StartedAt = startedAt.String
+	batch.FinishedAt = finishedAt.String
+	batch.RolledBackAt = rolledBackAt.String
+	batch.setStatus()
+	return batch, nil
+}
+
+func (st *sqlStore) ImportBatchRows(id int64, outcome string, limit int) ([]ImportBatchRow, error) {
+	rows, err := st.db.Query(`
+		SELECT batch_row, object, object_type, outcome, reason, processed_at
+		FROM import_batch_rows
+		WHERE batch_id = ? AND (? = '' OR outcome = ?)
+		ORDER BY batch_row
+		LIMIT ?
+	`, id, outcome, outcome, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query import_batch_rows: %w", err)
+	}
+	defer rows.Close()
+
+	result := []ImportBatchRow{}
+	for rows.Next() {
+		var row ImportBatchRow
+		var reason sql.NullString
+		if err := rows.Scan(&row.Row, &row.Object, &row.ObjectType, &row.Outcome, &reason, &row.ProcessedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		row.Reason = reason.String
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return result, nil
+}
+
+func (st *sqlStore) RollbackImportBatch(id int64, dryRun bool) (RollbackResult, error) {
+	if dryRun {
+		// Only reads from the read pool, a dry run does not wait for the writes or hold them up
+		return planRollback(st.db, id, true)
+	}
+	var result RollbackResult
+	err := st.update(func(tx sqlTx) error {
+		var err error
+		if result, err = planRollback(tx, id, false); err != nil {
+			return err
+		}
+		return applyRollback(tx, result)
+	})
+	return result, err
+}
+
+// planRollback reads what rolling back the batch changes, the rollback applies it in the same transaction
+func planRollback(q querier, id int64, dryRun bool) (RollbackResult, error) {
+	result := RollbackResult{BatchID: id, DryRun: dryRun, Objects: []RollbackObject{}}
+	var rolledBackAt sql.NullString
+	err := q.QueryRow(`SELECT rolled_back_at FROM import_batches WHERE id = ?`, id).Scan(&rolledBackAt)
+	if err == sql.ErrNoRows {
+		return result, ErrNotFound
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to query import_batches: %w", err)
+	}
+	if rolledBackAt.Valid {
+		return result, ErrRolledBack
+	}
+
+	if err := q.QueryRow(`SELECT COUNT(*) FROM pending_import WHERE batch_id = ?`, id).Scan(&result.PendingRows); err != nil {
+		return result, fmt.Errorf("failed to count pending_import rows: %w", err)
+	}
+	if err := q.QueryRow(`SELECT COUNT(*) FROM sightings WHERE batch_id = ?`, id).Scan(&result.Sightings); err != nil {
+		return result, fmt.Errorf("failed to count sightings: %w", err)
+	}
+
+	// The accepted rows count the occurrences, the sightings of the batch may have been pruned
+	rows, err := q.Query(`
+		SELECT object, COUNT(*)
+		FROM import_batch_rows
+		WHERE batch_id = ? AND outcome = ?
+		GROUP BY object
+		ORDER BY object
+	`, id, ImportRowAccepted)
+	if err != nil {
+		return result, fmt.Errorf("failed to query import_batch_rows: %w", err)
+	}
+	for rows.Next() {
+		var object RollbackObject
+		if err := rows.Scan(&object.Object, &object.Occurrences); err != nil {
+			rows.Close()
+			return result, fmt.Errorf("failed to scan row: %w", err)
+		}
+		result.Objects = append(result.Objects, object)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("error iterating over rows: %w", err)
+	}
+
+	// When the batch gave an object its first_seen or last_seen they are taken from what is left without it
+	spans := map[string][2]string{}
+	rows, err = q.Query(`SELECT object, MIN(time_imported), MAX(time_imported) FROM sightings WHERE batch_id = ? GROUP BY object`, id)
+	if err != nil {
+		return result, fmt.Errorf("failed to query sightings: %w", err)
+	}
+	for rows.Next() {
+		var object string
+		var first, last sql.NullString
+		if err := rows.Scan(&object, &first, &last); err != nil {
+			rows.Close()
+			return result, fmt.Errorf("failed to scan row: %w", err)
+		}
+		spans[object] = [2]string{sqlTime(first), sqlTime(last)}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("error iterating over rows: %w", err)
+	}
+
+	objects := result.Objects[:0]
+	for _, object := range result.Objects {
+		var occurrences int
+		var firstSeen, lastSeen sql.NullString
+		err := q.QueryRow(`SELECT occurrence_count, first_seen, last_seen FROM object_intel WHERE object = ?`, object.Object).Scan(&occurrences, &firstSeen, &lastSeen)
+		if err == sql.ErrNoRows {
+			continue // Expired or rolled back with another batch
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to query object_intel: %w", err)
+		}
+
+		object.OccurrenceCount = max(0, occurrences-object.Occurrences)
+		if object.OccurrenceCount == 0 {
+			object.Deleted = true
+			result.ObjectsDeleted++
+			objects = append(objects, object)
+			continue
+		}
+
+		object.FirstSeen = sqlTime(firstSeen)
+		object.LastSeen = sqlTime(lastSeen)
+		if span, ok := spans[object.Object]; ok && (object.FirstSeen >= span[0] || object.LastSeen <= span[1]) {
+			first, last, err := seenWithoutBatch(q, object.Object, id)
+			if err != nil {
+				return result, err
+			}
+			// With nothing left to take them from the times of the batch are kept, the columns are NOT NULL
+			if first != "" && object.FirstSeen >= span[0] {
+				object.FirstSeen = first
+			}
+			if last != "" && object.LastSeen <= span[1] {
+				object.LastSeen = last
+			}
+		}
+		result.ObjectsUpdated++
+		objects = append(objects, object)
+	}
+	result.Objects = objects
+	return result, nil
+}
+
+// seenWithoutBatch returns the first and last import of an object from the sightings of the other batches or,
+// when none are left, from its accepted rows in the batches not rolled back.  Both are "" when neither is left.
+func seenWithoutBatch(q querier, object string, id int64) (string, string, error) {
+	var first, last sql.NullString
+	err := q.QueryRow(`
+		SELECT MIN(time_imported), MAX(time_imported)
+		FROM sightings
+		WHERE object = ? AND (batch_id IS NULL OR batch_id <> ?)
+	`, object, id).Scan(&first, &last)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to query sightings: %w", err)
+	}
+	if first.Valid {
+		return sqlTime(first), sqlTime(last), nil
+	}
+
+	err = q.QueryRow(`
+		SELECT MIN(r.processed_at), MAX(r.processed_at)
+		FROM import_batch_rows r
+		JOIN import_batches b ON b.id = r.batch_id
+		WHERE r.object = ? AND r.outcome = ? AND r.batch_id <> ? AND b.rolled_back_at IS NULL
+	`, object, ImportRowAccepted, id).Scan(&first, &last)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to query import_batch_rows: %w", err)
+	}
+	return sqlTime(first), sqlTime(last), nil
+}
+
+// applyRollback deletes what the batch added and writes the objects of the plan
+func applyRollback(tx sqlTx, result RollbackResult) error {
+	for _, query := range []string{
+		`DELETE FROM pending_import WHERE batch_id = ?`,
+		`DELETE FROM sightings WHERE batch_id = ?`,
+	} {
+		if _, err := tx.Exec(query, result.BatchID); err != nil {
+			return fmt.Errorf("failed to roll back import batch %d: %w", result.BatchID, err)
+		}
+	}
+
+	for _, object := range result.Objects {
+		if object.Deleted {
+			for _, query := range []string{
+				`DELETE FROM sightings WHERE object = ?`,
+				`DELETE FROM score_history WHERE object = ?`,
+				`DELETE FROM verdict_history WHERE object = ?`,
+				`DELETE FROM object_intel WHERE object = ?`,
+			} {
+				if _, err := tx.Exec(query, object.Object); err != nil {
+					return fmt.Errorf("failed to delete object %s: %w", object.Object, err)
+				}
+			}
+			continue
+		}
+		_, err := tx.Exec(`
+			UPDATE object_intel
+			SET occurrence_count = ?, first_seen = ?, last_seen = ?, risk_score_last_updated = NULL
+			WHERE object = ?
+		`, object.OccurrenceCount, object.FirstSeen, object.LastSeen, object.Object)
+		if err != nil {
+			return fmt.Errorf("failed to update object_intel: %w", err)
+		}
+	}
+
+	now := formatSightingTime(time.Now())
+	_, err := tx.Exec(`UPDATE import_batches SET rolled_back_at = ?, finished_at = COALESCE(finished_at, ?) WHERE id = ?`, now, now, result.BatchID)
+	if err != nil {
+		return fmt.Errorf("failed to update import batch %d: %w", result.BatchID, err)
+	}
+	return nil
+}
+
+func (st *sqlStore) ObjectIntel(object string) (ObjectIntel, error) {
+	var result ObjectIntel
+	var additionalInfo, geoRegion, geoCountry, geoOrg, geoASN, notes, fidelity, firstSeen, lastSeen, riskScoreLastUpdated, verdict, enrichedAt, enrichmentInfo sql.NullString
+	var ipDecimal, occurrenceCount, riskScore sql.NullInt64
+	var confirmedRisk, trusted sql.NullBool
+
+	err := st.db.QueryRow(`
+		SELECT object, object_additionalInfo, object_type, IPDecimal, geo_region, geo_country, geo_org, geo_asn, notes, fidelity,
+			first_seen, last_seen, occurrence_count, risk_score, risk_score_last_updated, confirmed_risk, trusted, verdict, enriched_at, enrichment_info
+		FROM object_intel
+		WHERE object = ?
+	`, object).Scan(&result.Object, &additionalInfo, &result.ObjectType, &ipDecimal, &geoRegion, &geoCountry, &geoOrg, &geoASN, &notes, &fidelity,
+		&firstSeen, &lastSeen, &occurrenceCount, &riskScore, &riskScoreLastUpdated, &confirmedRisk, &trusted, &verdict, &enrichedAt, &enrichmentInfo)
+	if err == sql.ErrNoRows {
+		return result, ErrNotFound
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to query object_intel: %w", err)
+	}
+
+	result.ObjectAdditionalInfo = additionalInfo.String
+	result.IPDecimal = ipDecimal.Int64
+	result.GeoRegion = geoRegion.String
+	result.GeoCountry = geoCountry.String
+	result.GeoOrg = geoOrg.String
+	result.GeoASN = geoASN.String
+	result.Notes = notes.String
+	result.Fidelity = fidelity.String
+	result.FirstSeen = firstSeen.String
+	result.LastSeen = lastSeen.String
+	result.OccurrenceCount = int(occurrenceCount.Int64)
+	result.RiskScore = int(riskScore.Int64)
+	result.RiskScoreLastUpdated = riskScoreLastUpdated.String
+	result.ConfirmedRisk = confirmedRisk.Bool
+	result.Trusted = trusted.Bool
+	result.Verdict = verdict.String
+	result.EnrichedAt = enrichedAt.String
+	result.EnrichmentInfo = enrichmentInfo.String
+	return result, nil
+}
+
+func (st *sqlStore) ObjectFacts(object string, lookback time.Time) (ObjectFacts, error) {
+	facts := ObjectFacts{Object: object, Now: time.Now()}
+	var fidelity, geoCountry, geoASN, lastSeen sql.NullString
+	var confirmedRisk sql.NullBool
+	err := st.db.QueryRow(`
+		SELECT object_type, fidelity, geo_country, geo_asn, last_seen, confirmed_risk
+		FROM object_intel
+		WHERE object = ?
+	`, object).Scan(&facts.ObjectType, &fidelity, &geoCountry, &geoASN, &lastSeen, &confirmedRisk)
+	if err == sql.ErrNoRows {
+		return facts, fmt.Errorf("failed to query object_intel for %s: %w", object, ErrNotFound)
+	}
+	if err != nil {
+		return facts, fmt.Errorf("failed to query object_intel for %s: %w", object, err)
+	}
+	facts.Fidelity = fidelity.String
+	facts.GeoCountry = geoCountry.String
+	facts.GeoASN = geoASN.String
+	facts.LastSeen = parseTimestamp(lastSeen.String)
+	facts.ConfirmedRisk = confirmedRisk.Bool
+
+	rows, err := st.db.Query(`
+		SELECT COALESCE(source, ''), observed_at, COUNT(*)
+		FROM sightings
+		WHERE object = ? AND observed_at >= ?
+		GROUP BY source, observed_at
+	`, object, formatSightingTime(lookback))
+	if err != nil {
+		return facts, fmt.Errorf("failed to query sightings for %s: %w", object, err)
+	}
+	defer rows.Close()
+
+	sources := make(map[string]bool)
+	for rows.Next() {
+		var source, observed string
+		var count int
+		if err := rows.Scan(&source, &observed, &count); err != nil {
+			return facts, fmt.Errorf("failed to scan row: %w", err)
+		}
+		facts.Sightings = append(facts.Sightings, Sighting{Time: parseTimestamp(observed), Source: source, Count: count})
+		if source != "" {
+			sources[source] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return facts, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	for source := range sources {
+		facts.Sources = append(facts.Sources, source)
+	}
+	sort.Strings(facts.Sources)
+	return facts, nil
+}
+
+func (st *sqlStore) ObjectsToRescore(scoredBefore time.Time, limit int) ([]string, error) {
+	rows, err := st.db.Query(`
+		SELECT object
+		FROM object_intel
+		WHERE (risk_score_last_updated <= ? OR risk_score_last_updated IS NULL) AND trusted = FALSE
+		LIMIT ?
+	`, formatSightingTime(scoredBefore), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query object_intel: %w", err)
+	}
+	defer rows.Close()
+
+	var objects []string
+	for rows.Next() {
+		var object string
+		if err := rows.Scan(&object); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		objects = append(objects, strings.TrimSpace(object))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return objects, nil
+}
+
+func (st *sqlStore) SaveRiskScore(object string, result ScoreResult, rules VerdictRules) error {
+	breakdown, err := json.Marshal(result.Contributions)
+	if err != nil {
+		return fmt.Errorf("failed to encode the score breakdown: %w", err)
+	}
+
+	return st.update(func(tx sqlTx) error {
+		_, err := tx.Exec(`
+			UPDATE object_intel
+			SET risk_score = ?, risk_score_last_updated = CURRENT_TIMESTAMP
+			WHERE object = ?
+		`, result.Score, object)
+		if err != nil {
+			return fmt.Errorf("failed to update risk score: %w", err)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO score_history (object, score, raw_score, rule_version, breakdown, scored_at)
+			VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		`, object, result.Score, result.RawScore, result.RuleVersion, string(breakdown))
+		if err != nil {
+			return fmt.Errorf("failed to insert into score_history: %w", err)
+		}
+		_, err = refreshVerdicts(tx, rules, `object = ?`, object)
+		return err
+	})
+}
+
+func (st *sqlStore) MarkAllForRescore() error {
+	return st.write(func(db sqlDB) error {
+		if _, err := db.Exec(`UPDATE object_intel SET risk_score_last_updated = NULL`); err != nil {
+			return fmt.Errorf("failed to mark objects for rescoring: %w", err)
+		}
+		return nil
+	})
+}
+
+func (st *sqlStore) ConfirmObject(object string, confirmed bool, rules VerdictRules) (bool, error) {
+	var found bool
+	err := st.update(func(tx sqlTx) error {
+		result, err := tx.Exec(`UPDATE object_intel SET confirmed_risk = ? WHERE object = ?`, confirmed, object)
+		if err != nil {
+			return fmt.Errorf("failed to update confirmed_risk: %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		found = n > 0
+		_, err = refreshVerdicts(tx, rules, `object = ?`, object)
+		return err
+	})
+	return found, err
+}
+
+func (st *sqlStore) UntrustObject(object string, rules VerdictRules) (bool, string, error) {
+	var found bool
+	var coveredBy string
+	err := st.update(func(tx sqlTx) error {
+		result, err := tx.Exec(`UPDATE object_intel SET trusted = FALSE WHERE object = ?`, object)
+		if err != nil {
+			return fmt.Errorf("failed to update trusted: %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		found = n > 0
+		if _, err := tx.Exec(`DELETE FROM trusted_objects WHERE object = ?`, object); err != nil {
+			return fmt.Errorf("failed to delete trusted object: %w", err)
+		}
+
+		if ipDecimal, err := ipv4ToDecimal(object); err == nil {
+			err = tx.QueryRow(`
+				SELECT object FROM trusted_objects
+				WHERE object_type = 'ipv4CIDR' AND ? BETWEEN startIPDecimal AND endIPDecimal
+				LIMIT 1
+			`, ipDecimal).Scan(&coveredBy)
+			if err != nil && err != sql.ErrNoRows {
+				return fmt.Errorf("failed to query trusted CIDRs: %w", err)
+			}
+		}
+		_, err = refreshVerdicts(tx, rules, `object = ?`, object)
+		return err
+	})
+	return found, coveredBy, err
+}
+
+func (st *sqlStore) RefreshVerdicts(rules VerdictRules, object string) (int, error) {
+	condition, args := `1 = 1`, []any{}
+	if object != "" {
+		condition, args = `object = ?`, []any{object}
+	}
+	var changed int
+	err := st.update(func(tx sqlTx) error {
+		var err error
+		changed, err = refreshVerdicts(tx, rules, condition, args...)
+		return err
+	})
+	return changed, err
+}
+
+func (st *sqlStore) ScoreHistory(object string, limit int) ([]ScoreHistoryEntry, error) {
+	rows, err := st.db.Query(`
+		SELECT scored_at, score, raw_score, rule_version, breakdown
+		FROM score_history
+		WHERE object = ?
+		ORDER BY scored_at DESC, id DESC
+		LIMIT ?
+	`, object, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query score_history: %w", err)
+	}
+	defer rows.Close()
+
+	history := []ScoreHistoryEntry{}
+	for rows.Next() {
+		var entry ScoreHistoryEntry
+		var scoredAt, breakdown sql.NullString
+		var rawScore sql.NullFloat64
+		var ruleVersion sql.NullInt64
+		if err := rows.Scan(&scoredAt, &entry.Score, &rawScore, &ruleVersion, &breakdown); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		entry.ScoredAt = scoredAt.String
+		entry.RawScore = rawScore.Float64
+		entry.RuleVersion = int(ruleVersion.Int64)
+		entry.Breakdown = []ScoreContribution{}
+		if breakdown.String != "" {
+			if err := json.Unmarshal([]byte(breakdown.String), &entry.Breakdown); err != nil {
+				return nil, fmt.Errorf("failed to decode the breakdown of %s: %w", object, err)
+			}
+		}
+		history = append(history, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return history, nil
+}
+
+func (st *sqlStore) VerdictHistory(object string, limit int) ([]VerdictChange, error) {
+	rows, err := st.db.Query(`
+		SELECT changed_at, old_verdict, new_verdict, reason
+		FROM verdict_history
+		WHERE object = ?
+		ORDER BY changed_at DESC, id DESC
+		LIMIT ?
+	`, object, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query verdict_history: %w", err)
+	}
+	defer rows.Close()
+
+	history := []VerdictChange{}
+	for rows.Next() {
+		var change VerdictChange
+		var changedAt, oldVerdict, reason sql.NullString
+		if err := rows.Scan(&changedAt, &oldVerdict, &change.NewVerdict, &reason); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		change.ChangedAt = changedAt.String
+		change.OldVerdict = oldVerdict.String
+		change.Reason = reason.String
+		history = append(history, change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return history, nil
+}
+
+func (st *sqlStore) ListObjects(verdicts []string, objectType string, limit int) ([]ObjectSummary, error) {
+	query := `
+		SELECT object, object_type, risk_score, verdict, last_seen
+		FROM object_intel
+		WHERE (? = '' OR object_type = ?)`
+	args := []any{objectType, objectType}
+	if condition, verdictArgs := verdictFilter(verdicts); condition != "" {
+		query += " AND " + condition
+		args = append(args, verdictArgs...)
+	}
+	query += `
+		ORDER BY risk_score DESC, object
+		LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := st.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query object_intel: %w", err)
+	}
+	defer rows.Close()
+
+	objects := []ObjectSummary{}
+	for rows.Next() {
+		var obj ObjectSummary
+		var riskScore sql.NullInt64
+		var verdict, lastSeen sql.NullString
+		if err := rows.Scan(&obj.Object, &obj.ObjectType, &riskScore, &verdict, &lastSeen); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		obj.RiskScore = int(riskScore.Int64)
+		obj.Verdict = verdict.String
+		obj.LastSeen = lastSeen.String
+		objects = append(objects, obj)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return objects, nil
+}
+
+func (st *sqlStore) Blocklist(filter BlocklistFilter) ([]BlocklistEntry, error) {
+	query := `
+		SELECT object, object_type, risk_score, verdict, last_seen
+		FROM object_intel
+		WHERE trusted = FALSE AND risk_score >= ? AND (? = '' OR object_type = ?)`
+	args := []any{filter.MinScore, filter.ObjectType, filter.ObjectType}
+	if condition, verdictArgs := verdictFilter(filter.Verdicts); condition != "" {
+		query += " AND " + condition
+		args = append(args, verdictArgs...)
+	}
+
+	var expired []string
+	for _, expiry := range filter.Expiries {
+		condition := "(risk_score >= ?"
+		args = append(args, expiry.MinScore)
+		if expiry.MaxScore > 0 {
+			condition += " AND risk_score < ?"
+			args = append(args, expiry.MaxScore)
+		}
+		condition += " AND COALESCE(last_seen, first_seen) < ?)"
+		args = append(args, formatSightingTime(expiry.LastSeenBefore))
+		expired = append(expired, condition)
+	}
+	if len(expired) > 0 {
+		query += "\n\t\tAND NOT (" + strings.Join(expired, " OR ") + ")"
+	}
+	query += `
+		ORDER BY risk_score DESC, object
+		LIMIT ?`
+	args = append(args, filter.Limit)
+
+	rows, err := st.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the blocklist: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []BlocklistEntry{}
+	for rows.Next() {
+		var entry BlocklistEntry
+		var verdict, lastSeen sql.NullString
+		if err := rows.Scan(&entry.Object, &entry.ObjectType, &entry.RiskScore, &verdict, &lastSeen); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		entry.Verdict = verdict.String
+		entry.LastSeen = lastSeen.String
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return entries, nil
+}
+
+func (st *sqlStore) SightingTrend(object string, since time.Time) ([]SightingTrendDay, error) {
+	rows, err := st.db.Query(`
+		SELECT `+st.db.dialect.dayExpr+` AS day, COUNT(*), COUNT(DISTINCT NULLIF(source, ''))
+		FROM sightings
+		WHERE object = ? AND observed_at >= ?
+		GROUP BY day
+		ORDER BY day
+	`, object, formatSightingTime(since))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sightings: %w", err)
+	}
+	defer rows.Close()
+
+	trend := []SightingTrendDay{}
+	for rows.Next() {
+		var day SightingTrendDay
+		if err := rows.Scan(&day.Day, &day.Count, &day.Sources); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		trend = append(trend, day)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return trend, nil
+}
+
+func (st *sqlStore) ObjectsToEnrich(objectTypes []string, enrichedBefore time.Time, limit int) ([]ObjectRef, error) {
+	if len(objectTypes) == 0 {
+		return nil, nil
+	}
+	args := make([]any, 0, len(objectTypes)+2)
+	for _, objectType := range objectTypes {
+		args = append(args, objectType)
+	}
+	args = append(args, formatSightingTime(enrichedBefore), limit)
+	// NULLs sort first in SQLite and last in Postgres, the CASE orders them the same in both
+	rows, err := st.db.Query(`
+		SELECT object, object_type
+		FROM object_intel
+		WHERE object_type IN (?`+strings.Repeat(", ?", len(objectTypes)-1)+`) AND (enriched_at IS NULL OR enriched_at < ?)
+		ORDER BY CASE WHEN enriched_at IS NULL THEN 0 ELSE 1 END, enriched_at
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query object_intel: %w", err)
+	}
+	defer rows.Close()
+
+	var objects []ObjectRef
+	for rows.Next() {
+		var ref ObjectRef
+		if err := rows.Scan(&ref.Object, &ref.ObjectType); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		objects = append(objects, ref)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return objects, nil
+}
+
+func (st *sqlStore) SaveEnrichments(enrichments []ObjectEnrichment, enrichedAt time.Time) error {
+	return st.update(func(tx sqlTx) error {
+		at := formatSightingTime(enrichedAt)
+		for _, e := range enrichments {
+			if err := saveEnrichment(tx, e.Object, e.Enrichment, at); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// saveEnrichment sets the fields an enricher returned, the others keep what the submitter or an earlier lookup set.
+// The Info goes in enrichment_info, object_additionalInfo is the submitter's.
+func saveEnrichment(tx sqlTx, object string, e Enrichment, enrichedAt string) error {
+	_, err := tx.Exec(`
+		UPDATE object_intel SET
+			geo_region = COALESCE(NULLIF(?, ''), geo_region),
+			geo_country = COALESCE(NULLIF(?, ''), geo_country),
+			geo_org = COALESCE(NULLIF(?, ''), geo_org),
+			geo_asn = COALESCE(NULLIF(?, ''), geo_asn),
+			enrichment_info = COALESCE(NULLIF(?, ''), enrichment_info),
+			enriched_at = ?
+		WHERE object = ?
+	`, e.GeoRegion, e.GeoCountry, e.GeoOrg, e.GeoASN, e.Info, enrichedAt, object)
+	if err != nil {
+		return fmt.Errorf("failed to save the enrichment of %s: %w", object, err)
+	}
+	return nil
+}
+
+func (st *sqlStore) AddTrustedObjects(objects []TrustedObject) (int64, error) {
+	var count int64
+	err := st.update(func(tx sqlTx) error {
+		stmt, err := tx.Prepare(`
+			INSERT INTO trusted_objects (object, object_type, ipDecimal, startIPDecimal, endIPDecimal, notes, source, occurrence_count)
+			VALUES (?, ?, ?, ?, ?, ?, ?, 1)
+			ON CONFLICT(object) DO UPDATE SET
+				notes=excluded.notes,
+				source=excluded.source,
+				last_seen=CURRENT_TIMESTAMP,
+				occurrence_count = trusted_objects.occurrence_count + 1
+		`)
+		if err != nil {
+			return fmt.Errorf("failed to prepare statement: %w", err)
+		}
+		defer stmt.Close()
+
+		for i, obj := range objects {
+			ipv4Decimal, startIPDecimal, endIPDecimal, err := trustedObjectDecimals(obj.Object, obj.ObjectType)
+			if err != nil {
+				return fmt.Errorf("invalid trusted object %d %s: %w", i, obj.Object, err)
+			}
+			if _, err := stmt.Exec(obj.Object, obj.ObjectType, ipv4Decimal, startIPDecimal, endIPDecimal, obj.Notes, obj.Source); err != nil {
+				return fmt.Errorf("failed to insert/update trusted object %s: %w", obj.Object, err)
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (st *sqlStore) ListTrustedObjects() ([]TrustedObject, error) {
+	rows, err := st.db.Query(`SELECT object, object_type, notes, source, time_imported, last_seen, occurrence_count FROM trusted_objects ORDER BY object_type, object`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query trusted_objects: %w", err)
+	}
+	defer rows.Close()
+
+	objects := []TrustedObject{}
+	for rows.Next() {
+		var obj TrustedObject
+		var notes, source, timeImported, lastSeen sql.NullString
+		var occurrenceCount sql.NullInt64
+		if err := rows.Scan(&obj.Object, &obj.ObjectType, &notes, &source, &timeImported, &lastSeen, &occurrenceCount); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		obj.Notes = notes.String
+		obj.Source = source.String
+		obj.TimeImported = timeImported.String
+		obj.LastSeen = lastSeen.String
+		obj.OccurrenceCount = int(occurrenceCount.Int64)
+		objects = append(objects, obj)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return objects, nil
+}
+
+func (st *sqlStore) RemoveTrustedObject(object string) (bool, error) {
+	var found bool
+	err := st.update(func(tx sqlTx) error {
+		var objectType string
+		var startIPDecimal, endIPDecimal sql.NullInt64
+		err := tx.QueryRow(`SELECT object_type, startIPDecimal, endIPDecimal FROM trusted_objects WHERE object = ?`, object).Scan(&objectType, &startIPDecimal, &endIPDecimal)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to query trusted_objects: %w", err)
+		}
+		found = true
+
+		if _, err := tx.Exec(`DELETE FROM trusted_objects WHERE object = ?`, object); err != nil {
+			return fmt.Errorf("failed to delete trusted object: %w", err)
+		}
+		if objectType == "ipv4CIDR" {
+			_, err = tx.Exec(`UPDATE object_intel SET trusted = FALSE WHERE object_type = 'ipv4' AND IPDecimal BETWEEN ? AND ?`, startIPDecimal.Int64, endIPDecimal.Int64)
+		} else {
+			_, err = tx.Exec(`UPDATE object_intel SET trusted = FALSE WHERE object = ?`, object)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to clear trusted objects: %w", err)
+		}
+		return nil
+	})
+	return found, err
+}
+
+func (st *sqlStore) MarkTrustedObjects(rules VerdictRules) (int, error) {
+	var changed int
+	err := st.update(func(tx sqlTx) error {
+		// ipv4 and ipv6 trusted objects match the object itself
+		_, err := tx.Exec(`
+			UPDATE object_intel
+			SET trusted = TRUE
+			WHERE object_type IN ('ipv4', 'ipv6')
+				AND object IN (SELECT object FROM trusted_objects WHERE trusted_objects.object_type = object_intel.object_type)
+		`)
+		if err != nil {
+			return fmt.Errorf("failed to mark trusted objects: %w", err)
+		}
+
+		// Read the ipv4CIDR trusted objects before marking, a transaction runs one statement at a time
+		rows, err := tx.Query(`SELECT object FROM trusted_objects WHERE object_type = 'ipv4CIDR'`)
+		if err != nil {
+			return fmt.Errorf("failed to query ipv4CIDR trusted objects: %w", err)
+		}
+		var cidrs []string
+		for rows.Next() {
+			var cidr string
+			if err := rows.Scan(&cidr); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan cidr: %w", err)
+			}
+			cidrs = append(cidrs, cidr)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating over rows: %w", err)
+		}
+
+		for _, cidr := range cidrs {
+			_, startIPDec, endIPDec, err := trustedObjectDecimals(cidr, "ipv4CIDR")
+			if err != nil {
+				return fmt.Errorf("failed to get the range of cidr %s: %w", cidr, err)
+			}
+			log.Printf("Marking trusted ipv4CIDR objects in %s\n", cidr)
+
+			_, err = tx.Exec(`
+				UPDATE object_intel
+				SET trusted = TRUE
+				WHERE object_type = 'ipv4'
+					AND IPDecimal BETWEEN ? AND ?
+			`, startIPDec, endIPDec)
+			if err != nil {
+				return fmt.Errorf("failed to mark ipv4CIDR trusted objects: %w", err)
+			}
+		}
+
+		// Objects that became trusted, or were trusted before RemoveTrustedObject cleared them
+		changed, err = refreshVerdicts(tx, rules, `COALESCE(trusted, FALSE) <> (COALESCE(verdict, '') = 'trusted')`)
+		return err
+	})
+	return changed, err
+}
+
+// staleObjects matches the objects expired by Prune, the arguments are the StaleMaxScore and StaleBefore of the policy
+const staleObjects = `COALESCE(trusted, FALSE) = FALSE AND COALESCE(confirmed_risk, FALSE) = FALSE
+	AND COALESCE(risk_score, 0) <= ? AND COALESCE(last_seen, first_seen) < ?`
+
+func (st *sqlStore) Prune(policy PrunePolicy) (PruneResult, error) {
+	var result PruneResult
+	sightingsBefore := formatSightingTime(policy.SightingsBefore)
+	stageRunsBefore := formatSightingTime(policy.StageRunsBefore)
+	batchesBefore := formatSightingTime(policy.BatchesBefore)
+	staleArgs := []any{policy.StaleMaxScore, formatSightingTime(policy.StaleBefore)}
+
+	if policy.DryRun {
+		if !policy.SightingsBefore.IsZero() {
+			if err := st.db.QueryRow(`SELECT COUNT(*) FROM sightings WHERE observed_at < ?`, sightingsBefore).Scan(&result.Sightings); err != nil {
+				return result, fmt.Errorf("failed to count sightings: %w", err)
+			}
+		}
+		if !policy.StageRunsBefore.IsZero() {
+			if err := st.db.QueryRow(`SELECT COUNT(*) FROM stage_runs WHERE started_at < ?`, stageRunsBefore).Scan(&result.StageRuns); err != nil {
+				return result, fmt.Errorf("failed to count stage runs: %w", err)
+			}
+		}
+		if !policy.BatchesBefore.IsZero() {
+			if err := st.db.QueryRow(`SELECT COUNT(*) FROM import_batches WHERE finished_at < ?`, batchesBefore).Scan(&result.ImportBatches); err != nil {
+				return result, fmt.Errorf("failed to count import batches: %w", err)
+			}
+		}
+		if !policy.StaleBefore.IsZero() {
+			if err := st.db.QueryRow(`SELECT COUNT(*) FROM object_intel WHERE `+staleObjects, staleArgs...).Scan(&result.Objects); err != nil {
+				return result, fmt.Errorf("failed to count stale objects: %w", err)
+			}
+		}
+		return result, nil
+	}
+
+	err := st.update(func(tx sqlTx) error {
+		if !policy.SightingsBefore.IsZero() {
+			deleted, err := tx.Exec(`DELETE FROM sightings WHERE observed_at < ?`, sightingsBefore)
+			if err != nil {
+				return fmt.Errorf("failed to delete sightings: %w", err)
+			}
+			if result.Sightings, err = deleted.RowsAffected(); err != nil {
+				return err
+			}
+		}
+		if !policy.StageRunsBefore.IsZero() {
+			deleted, err := tx.Exec(`DELETE FROM stage_runs WHERE started_at < ?`, stageRunsBefore)
+			if err != nil {
+				return fmt.Errorf("failed to delete stage runs: %w", err)
+			}
+			if result.StageRuns, err = deleted.RowsAffected(); err != nil {
+				return err
+			}
+		}
+		if !policy.BatchesBefore.IsZero() {
+			_, err := tx.Exec(`DELETE FROM import_batch_rows WHERE batch_id IN (SELECT id FROM import_batches WHERE finished_at < ?)`, batchesBefore)
+			if err != nil {
+				return fmt.Errorf("failed to delete the rows of import batches: %w", err)
+			}
+			deleted, err := tx.Exec(`DELETE FROM import_batches WHERE finished_at < ?`, batchesBefore)
+			if err != nil {
+				return fmt.Errorf("failed to delete import batches: %w", err)
+			}
+			if result.ImportBatches, err = deleted.RowsAffected(); err != nil {
+				return err
+			}
+		}
+		if policy.StaleBefore.IsZero() {
+			return nil
+		}
+
+		// The tombstone keeps the last state of the object, an object expired again replaces it
+		_, err := tx.Exec(`
+			INSERT INTO object_tombstones (object, object_type, first_seen, last_seen, occurrence_count, risk_score, verdict, expired_at)
+			SELECT object, object_type, first_seen, last_seen, occurrence_count, risk_score, verdict, ?
+			FROM object_intel
+			WHERE `+staleObjects+`
+			ON CONFLICT (object) DO UPDATE SET
+				object_type = excluded.object_type,
+				first_seen = excluded.first_seen,
+				last_seen = excluded.last_seen,
+				occurrence_count = excluded.occurrence_count,
+				risk_score = excluded.risk_score,
+				verdict = excluded.verdict,
+				expired_at = excluded.expired_at
+		`, append([]any{formatSightingTime(time.Now())}, staleArgs...)...)
+		if err != nil {
+			return fmt.Errorf("failed to write tombstones: %w", err)
+		}
+		for _, query := range []string{
+			`DELETE FROM sightings WHERE object IN (SELECT object FROM object_intel WHERE ` + staleObjects + `)`,
+			`DELETE FROM score_history WHERE object IN (SELECT object FROM object_intel WHERE ` + staleObjects + `)`,
+			`DELETE FROM verdict_history WHERE object IN (SELECT object FROM object_intel WHERE ` + staleObjects + `)`,
+		} {
+			if _, err := tx.Exec(query, staleArgs...); err != nil {
+				return fmt.Errorf("failed to delete the history of stale objects: %w", err)
+			}
+		}
+		deleted, err := tx.Exec(`DELETE FROM object_intel WHERE `+staleObjects, staleArgs...)
+		if err != nil {
+			return fmt.Errorf("failed to delete stale objects: %w", err)
+		}
+		result.Objects, err = deleted.RowsAffected()
+		return err
+	})
+	return result, err
+}
+
+func (st *sqlStore) Tombstone(object string) (Tombstone, error) {
+	var tombstone Tombstone
+	var firstSeen, lastSeen, verdict sql.NullString
+	var occurrenceCount, riskScore sql.NullInt64
+	err := st.db.QueryRow(`
+		SELECT object, object_type, first_seen, last_seen, occurrence_count, risk_score, verdict, expired_at
+		FROM object_tombstones
+		WHERE object = ?
+	`, object).Scan(&tombstone.Object, &tombstone.ObjectType, &firstSeen, &lastSeen, &occurrenceCount, &riskScore, &verdict, &tombstone.ExpiredAt)
+	if err == sql.ErrNoRows {
+		return tombstone, ErrNotFound
+	}
+	if err != nil {
+		return tombstone, fmt.Errorf("failed to query object_tombstones: %w", err)
+	}
+	tombstone.FirstSeen = firstSeen.String
+	tombstone.LastSeen = lastSeen.String
+	tombstone.OccurrenceCount = int(occurrenceCount.Int64)
+	tombstone.RiskScore = int(riskScore.Int64)
+	tombstone.Verdict = verdict.String
+	return tombstone, nil
+}
+
+func (st *sqlStore) RecordStageRun(run StageRun) error {
+	return st.write(func(db sqlDB) error {
+		_, err := db.Exec(`
+			INSERT INTO stage_runs (stage, status, error, started_at, finished_at, duration_ms)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, run.Stage, run.Status, sql.NullString{String: run.Error, Valid: run.Error != ""}, run.StartedAt, run.FinishedAt, run.DurationMS)
+		if err != nil {
+			return fmt.Errorf("failed to insert stage run: %w", err)
+		}
+		return nil
+	})
+}
+
+func (st *sqlStore) StageRuns(stage string, limit int) ([]StageRun, error) {
+	rows, err := st.db.Query(`
+		SELECT stage, status, error, started_at, finished_at, duration_ms
+		FROM stage_runs
+		WHERE ? = '' OR stage = ?
+		ORDER BY started_at DESC, id DESC
+		LIMIT ?
+	`, stage, stage, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query stage_runs: %w", err)
+	}
+	defer rows.Close()
+
+	runs := []StageRun{}
+	for rows.Next() {
+		var run StageRun
+		var runError sql.NullString
+		if err := rows.Scan(&run.Stage, &run.Status, &runError, &run.StartedAt, &run.FinishedAt, &run.DurationMS); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		run.Error = runError.String
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+	return runs, nil
+}
@@ -0,0 +1,239 @@
+//go:build !nosqlite
+
+package common
+
+// The SQLite store, the database file at dbPath
+//
+// go-sqlite3 needs cgo, build with -tags nosqlite to leave it out when cross-compiling.
+//
+// The apiServer and workerBee open the same file, so it is switched to WAL mode
+// where readers do not block the writer or each other.  Each process has a
+// single write connection that starts its transactions with BEGIN IMMEDIATE
+// and waits up to dbBusyTimeoutSeconds for the write lock of the other one.
+// The read pool is query_only, a write sent to it by mistake fails.
+//
+// Backups are copied with the online backup API from a read connection, so the
+// apiServer and workerBee keep writing while one is made.  A restore copies
+// the other way on the write connection.
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var sqliteDialect = sqlDialect{
+	name:    "sqlite",
+	dayExpr: "date(observed_at)",
+	vacuum:  "VACUUM",
+}
+
+// sqliteStore adds the copies made with the online backup API of SQLite to sqlStore
+type sqliteStore struct {
+	*sqlStore
+	busyTimeout int
+}
+
+func init() {
+	RegisterStore("sqlite", OpenSQLiteStore)
+}
+
+// sqliteDSN adds the go-sqlite3 connection parameters to the path of the database
+func sqliteDSN(path string, busyTimeout int, params url.Values) string {
+	params.Set("_busy_timeout", strconv.Itoa(busyTimeout*1000))
+	return path + "?" + params.Encode()
+}
+
+// OpenSQLiteStore opens the database file at dbPath, it is created when it does not exist
+func OpenSQLiteStore(c Configuration) (Store, error) {
+	migrations, err := loadMigrations(migrationFiles, "migrations", goMigrations)
+	if err != nil {
+		return nil, err
+	}
+	busyTimeout := c.DBBusyTimeout
+	if busyTimeout == 0 {
+		busyTimeout = defaultDBBusyTimeoutSeconds
+	}
+
+	// Opened first so the file exists and is in WAL mode before a reader connects
+	writer, err := sql.Open("sqlite3", sqliteDSN(c.DBPath, busyTimeout, url.Values{
+		"_journal_mode": {"WAL"},
+		"_synchronous":  {"NORMAL"},
+		"_txlock":       {"immediate"},
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", c.DBPath, err)
+	}
+	writer.SetMaxOpenConns(1)
+	if err := writer.Ping(); err != nil {
+		writer.Close()
+		return nil, fmt.Errorf("failed to open %s: %w", c.DBPath, err)
+	}
+
+	reader, err := sql.Open("sqlite3", sqliteDSN(c.DBPath, busyTimeout, url.Values{
+		"_query_only": {"true"},
+	}))
+	if err != nil {
+		writer.Close()
+		return nil, fmt.Errorf("failed to open %s: %w", c.DBPath, err)
+	}
+	reader.SetMaxOpenConns(max(4, runtime.NumCPU()))
+
+	return &sqliteStore{sqlStore: newSQLStore(reader, writer, sqliteDialect, migrations), busyTimeout: busyTimeout}, nil
+}
+
+// copySQLite copies the main database of src over the one of dest
+func copySQLite(dest *sql.Conn, src *sql.Conn) error {
+	return dest.Raw(func(destConn any) error {
+		return src.Raw(func(srcConn any) error {
+			d, ok := destConn.(*sqlite3.SQLiteConn)
+			s, ok2 := srcConn.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return errors.New("the connections are not SQLite connections")
+			}
+			backup, err := d.Backup("main", s, "main")
+			if err != nil {
+				return err
+			}
+			// Every page in one step, the source is read in a single transaction so the copy is consistent
+			if _, err := backup.Step(-1); err != nil {
+				backup.Close()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// checkIntegrity runs PRAGMA integrity_check on the database
+func checkIntegrity(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return fmt.Errorf("failed to check the integrity: %w", err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating over rows: %w", err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check failed: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Backup copies the database to path from a read connection, in WAL mode the writers are not blocked
+func (st *sqliteStore) Backup(path string) error {
+	ctx := context.Background()
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("backup %s already exists", path)
+	}
+
+	dest, err := sql.Open("sqlite3", sqliteDSN(path, st.busyTimeout, url.Values{}))
+	if err != nil {
+		return fmt.Errorf("failed to create the backup %s: %w", path, err)
+	}
+	defer dest.Close()
+	err = func() error {
+		src, err := st.db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		destConn, err := dest.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer destConn.Close()
+		if err := copySQLite(destConn, src); err != nil {
+			return err
+		}
+		// A copy of a WAL database is in WAL mode, the backup is kept as a single file
+		_, err = destConn.ExecContext(ctx, `PRAGMA journal_mode=DELETE`)
+		return err
+	}()
+	if err == nil {
+		err = checkIntegrity(dest)
+	}
+	if err != nil {
+		dest.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to backup the database: %w", err)
+	}
+	return dest.Close()
+}
+
+// Restore checks the integrity and the migrations of the copy at path and copies it over the database
+// A copy with fewer migrations is restored, Migrate brings it up to date
+func (st *sqliteStore) Restore(path string) error {
+	ctx := context.Background()
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("failed to open the backup: %w", err)
+	}
+	src, err := sql.Open("sqlite3", sqliteDSN(path, st.busyTimeout, url.Values{"_query_only": {"true"}}))
+	if err != nil {
+		return fmt.Errorf("failed to open the backup %s: %w", path, err)
+	}
+	defer src.Close()
+
+	if err := checkIntegrity(src); err != nil {
+		return fmt.Errorf("backup %s: %w", path, err)
+	}
+	var objectIntel, schemaMigrations bool
+	err = src.QueryRow(`
+		SELECT COUNT(CASE WHEN name = 'object_intel' THEN 1 END) > 0, COUNT(CASE WHEN name = 'schema_migrations' THEN 1 END) > 0
+		FROM sqlite_master
+		WHERE type = 'table'
+	`).Scan(&objectIntel, &schemaMigrations)
+	if err != nil {
+		return fmt.Errorf("failed to read the backup %s: %w", path, err)
+	}
+	if !objectIntel {
+		return fmt.Errorf("%s is not a database of objectAnalyzer", path)
+	}
+	// A database from before the migrations were versioned has no schema_migrations
+	if schemaMigrations {
+		applied, err := appliedMigrations(sqlDB{DB: src, dialect: sqliteDialect})
+		if err != nil {
+			return err
+		}
+		if err := checkMigrationStates(migrationStates(st.migrations, applied)); err != nil {
+			return fmt.Errorf("backup %s can not be restored: %w", path, err)
+		}
+	}
+
+	return st.write(func(db sqlDB) error {
+		srcConn, err := src.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer srcConn.Close()
+		destConn, err := db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer destConn.Close()
+		if err := copySQLite(destConn, srcConn); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", path, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,25 @@
+//go:build !nosqlite
+
+package common
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	storeContract(t, func(t *testing.T) Store {
+		var c Configuration
+		c.SetDefaults()
+		c.DBPath = filepath.Join(t.TempDir(), "objectAnalyzer.db")
+		st, err := OpenSQLiteStore(c)
+		if err != nil {
+			t.Fatalf("OpenSQLiteStore: %v", err)
+		}
+		t.Cleanup(func() { st.Close() })
+		if _, err := st.Migrate(); err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		return st
+	})
+}
@@ -0,0 +1,539 @@
+package common
+
+// The contract every Store backend keeps
+//
+// storeContract runs the same checks against new empty stores of a backend,
+// the memory store here, SQLite in commonStoreSQLite_test.go and PostgreSQL in
+// commonStorePostgres_test.go.  The drivers return times in their own format,
+// so times are only compared after parseTimestamp.
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+const contractWorker = "contract"
+
+func TestMemoryStore(t *testing.T) {
+	storeContract(t, func(t *testing.T) Store {
+		return NewMemoryStore()
+	})
+}
+
+// storeContract runs every check with a new store from open, open closes it when the test ends
+func storeContract(t *testing.T, open func(t *testing.T) Store) {
+	t.Run("Settings", func(t *testing.T) { contractSettings(t, open(t)) })
+	t.Run("APIKeys", func(t *testing.T) { contractAPIKeys(t, open(t)) })
+	t.Run("ClaimsAndLeases", func(t *testing.T) { contractClaimsAndLeases(t, open(t)) })
+	t.Run("ImportBatches", func(t *testing.T) { contractImportBatches(t, open(t)) })
+	t.Run("Quarantine", func(t *testing.T) { contractQuarantine(t, open(t)) })
+	t.Run("Rollback", func(t *testing.T) { contractRollback(t, open(t)) })
+	t.Run("RollbackSeen", func(t *testing.T) { contractRollbackSeen(t, open(t)) })
+	t.Run("RollbackOnlySighting", func(t *testing.T) { contractRollbackOnlySighting(t, open(t)) })
+	t.Run("Retention", func(t *testing.T) { contractRetention(t, open(t)) })
+	t.Run("Enrichment", func(t *testing.T) { contractEnrichment(t, open(t)) })
+}
+
+// addBatch adds the ipv4 objects as one api batch, seen at timeProvided when it is set
+func addBatch(t *testing.T, st Store, timeProvided string, objects ...string) int64 {
+	t.Helper()
+	rows := make([]InsertPendingImportStruct, len(objects))
+	for i, object := range objects {
+		rows[i] = InsertPendingImportStruct{Object: object, ObjectType: "ipv4", Source: "contract", TimeProvided: timeProvided}
+	}
+	id, err := st.AddPendingImports(ImportBatch{Source: "api", SubmittedBy: contractWorker}, rows)
+	if err != nil {
+		t.Fatalf("AddPendingImports: %v", err)
+	}
+	return id
+}
+
+// processPending claims every pending row and applies it, the rows of the objects in reject are rejected
+func processPending(t *testing.T, st Store, reject ...string) {
+	t.Helper()
+	rows, err := st.ClaimPendingImports(contractWorker, 1000, time.Minute)
+	if err != nil {
+		t.Fatalf("ClaimPendingImports: %v", err)
+	}
+	var accepted []PendingImport
+	var rejected []RejectedImport
+	for _, row := range rows {
+		if slices.Contains(reject, row.Object) {
+			rejected = append(rejected, RejectedImport{PendingImport: row, Reason: "rejected by the contract"})
+		} else {
+			accepted = append(accepted, row)
+		}
+	}
+	lost, err := st.ApplyPendingImports(contractWorker, accepted, rejected)
+	if err != nil {
+		t.Fatalf("ApplyPendingImports: %v", err)
+	}
+	if lost != 0 {
+		t.Fatalf("ApplyPendingImports lost %d rows", lost)
+	}
+}
+
+func occurrences(t *testing.T, st Store, object string) int {
+	t.Helper()
+	obj, err := st.ObjectIntel(object)
+	if errors.Is(err, ErrNotFound) {
+		return 0
+	}
+	if err != nil {
+		t.Fatalf("ObjectIntel %s: %v", object, err)
+	}
+	return obj.OccurrenceCount
+}
+
+func batchStatus(t *testing.T, st Store, id int64) ImportBatch {
+	t.Helper()
+	batch, err := st.ImportBatch(id)
+	if err != nil {
+		t.Fatalf("ImportBatch %d: %v", id, err)
+	}
+	return batch
+}
+
+func pendingStats(t *testing.T, st Store) PendingStats {
+	t.Helper()
+	stats, err := st.PendingStats()
+	if err != nil {
+		t.Fatalf("PendingStats: %v", err)
+	}
+	return stats
+}
+
+func contractSettings(t *testing.T, st Store) {
+	if err := st.SaveSettings(map[string]string{"contract_a": `{"a":1}`, "contract_b": `[]`}); err != nil {
+		t.Fatalf("SaveSettings: %v", err)
+	}
+	if value, ok, err := st.Setting("contract_a"); err != nil || !ok || value != `{"a":1}` {
+		t.Errorf("Setting contract_a = %q, %v, %v", value, ok, err)
+	}
+	if _, ok, err := st.Setting("contract_missing"); err != nil || ok {
+		t.Errorf("Setting contract_missing found %v, %v", ok, err)
+	}
+	if err := st.SaveSettings(map[string]string{"contract_a": `{"a":2}`}); err != nil {
+		t.Fatalf("SaveSettings: %v", err)
+	}
+	settings, err := st.Settings()
+	if err != nil {
+		t.Fatalf("Settings: %v", err)
+	}
+	if settings["contract_a"] != `{"a":2}` || settings["contract_b"] != `[]` {
+		t.Errorf("Settings = %v", settings)
+	}
+}
+
+func contractAPIKeys(t *testing.T, st Store) {
+	id, err := st.CreateAPIKey("contract", "hash-of-the-key", "oa_contr", APIKeyRoleSubmit)
+	if err != nil {
+		t.Fatalf("CreateAPIKey: %v", err)
+	}
+	if role, err := st.APIKeyRole("hash-of-the-key"); err != nil || role != APIKeyRoleSubmit {
+		t.Errorf("APIKeyRole = %q, %v", role, err)
+	}
+	keys, err := st.ListAPIKeys()
+	if err != nil || len(keys) != 1 || keys[0].ID != id || keys[0].Role != APIKeyRoleSubmit {
+		t.Errorf("ListAPIKeys = %+v, %v", keys, err)
+	}
+	if revoked, err := st.RevokeAPIKey(id); err != nil || !revoked {
+		t.Errorf("RevokeAPIKey = %v, %v", revoked, err)
+	}
+	if role, err := st.APIKeyRole("hash-of-the-key"); err != nil || role != "" {
+		t.Errorf("APIKeyRole of a revoked key = %q, %v", role, err)
+	}
+	if revoked, err := st.RevokeAPIKey(id + 100); err != nil || revoked {
+		t.Errorf("RevokeAPIKey of a missing key = %v, %v", revoked, err)
+	}
+}
+
+func contractClaimsAndLeases(t *testing.T, st Store) {
+	addBatch(t, st, "", "10.0.0.1", "10.0.0.2", "10.0.0.3")
+
+	first, err := st.ClaimPendingImports("first", 2, time.Minute)
+	if err != nil || len(first) != 2 {
+		t.Fatalf("ClaimPendingImports first = %d rows, %v", len(first), err)
+	}
+	second, err := st.ClaimPendingImports("second", 10, time.Minute)
+	if err != nil || len(second) != 1 {
+		t.Fatalf("ClaimPendingImports second = %d rows, %v", len(second), err)
+	}
+	if rows, err := st.ClaimPendingImports("third", 10, time.Minute); err != nil || len(rows) != 0 {
+		t.Fatalf("ClaimPendingImports of leased rows = %d rows, %v", len(rows), err)
+	}
+	if held, err := st.ExtendPendingLease("first", time.Minute); err != nil || held != 2 {
+		t.Errorf("ExtendPendingLease = %d, %v", held, err)
+	}
+
+	// A released row is claimed right away
+	if err := st.ReleasePendingImports("second"); err != nil {
+		t.Fatalf("ReleasePendingImports: %v", err)
+	}
+	third, err := st.ClaimPendingImports("third", 10, time.Minute)
+	if err != nil || len(third) != 1 || third[0].Object != second[0].Object || third[0].Claims != 2 {
+		t.Fatalf("ClaimPendingImports of a released row = %+v, %v", third, err)
+	}
+
+	// The rows of a lapsed lease are claimed again, the first worker lost them
+	if _, err := st.ExtendPendingLease("first", -time.Minute); err != nil {
+		t.Fatalf("ExtendPendingLease: %v", err)
+	}
+	fourth, err := st.ClaimPendingImports("fourth", 10, time.Minute)
+	if err != nil || len(fourth) != 2 {
+		t.Fatalf("ClaimPendingImports of a lapsed lease = %d rows, %v", len(fourth), err)
+	}
+	for _, row := range fourth {
+		if row.Claims != 2 {
+			t.Errorf("row %s was claimed %d times, want 2", row.Object, row.Claims)
+		}
+	}
+	if lost, err := st.ApplyPendingImports("first", first, nil); err != nil || lost != 2 {
+		t.Errorf("ApplyPendingImports of lost rows = %d lost, %v", lost, err)
+	}
+	if n := occurrences(t, st, first[0].Object); n != 0 {
+		t.Errorf("a lost row was applied, %d occurrences", n)
+	}
+	if lost, err := st.ApplyPendingImports("fourth", fourth, nil); err != nil || lost != 0 {
+		t.Errorf("ApplyPendingImports = %d lost, %v", lost, err)
+	}
+	if n := occurrences(t, st, first[0].Object); n != 1 {
+		t.Errorf("%s has %d occurrences, want 1", first[0].Object, n)
+	}
+
+	stats := pendingStats(t, st)
+	if stats.Total != 1 || stats.Claimed != 1 {
+		t.Errorf("PendingStats = %+v, want 1 row claimed", stats)
+	}
+}
+
+func contractImportBatches(t *testing.T, st Store) {
+	id := addBatch(t, st, "", "10.0.1.1", "10.0.1.2", "10.0.1.3")
+	batch := batchStatus(t, st, id)
+	if batch.Status != ImportStatusQueued || batch.TotalRows != 3 || batch.Pending != 3 || batch.Source != "api" {
+		t.Errorf("new batch = %+v", batch)
+	}
+
+	processPending(t, st, "10.0.1.3")
+	batch = batchStatus(t, st, id)
+	if batch.Status != ImportStatusPartiallyFailed || batch.Accepted != 2 || batch.Rejected != 1 || batch.Pending != 0 || batch.FinishedAt == "" {
+		t.Errorf("processed batch = %+v", batch)
+	}
+	rows, err := st.ImportBatchRows(id, "", 10)
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("ImportBatchRows = %d rows, %v", len(rows), err)
+	}
+	for i, row := range rows {
+		if row.Row != i+1 {
+			t.Errorf("row %d is numbered %d", i+1, row.Row)
+		}
+	}
+	rejected, err := st.ImportBatchRows(id, ImportRowRejected, 10)
+	if err != nil || len(rejected) != 1 || rejected[0].Object != "10.0.1.3" || rejected[0].Reason == "" {
+		t.Errorf("rejected ImportBatchRows = %+v, %v", rejected, err)
+	}
+	if _, err := st.ImportBatch(id + 100); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ImportBatch of a missing batch = %v, want ErrNotFound", err)
+	}
+
+	// A second batch adds an occurrence to the object
+	id = addBatch(t, st, "", "10.0.1.1")
+	processPending(t, st)
+	if batch := batchStatus(t, st, id); batch.Status != ImportStatusDone || batch.Accepted != 1 {
+		t.Errorf("second batch = %+v", batch)
+	}
+	obj, err := st.ObjectIntel("10.0.1.1")
+	if err != nil || obj.OccurrenceCount != 2 || obj.ObjectType != "ipv4" || obj.FirstSeen == "" || obj.LastSeen == "" {
+		t.Errorf("ObjectIntel = %+v, %v", obj, err)
+	}
+	if _, err := st.ObjectIntel("10.0.1.3"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ObjectIntel of a rejected object = %v, want ErrNotFound", err)
+	}
+}
+
+func contractQuarantine(t *testing.T, st Store) {
+	id := addBatch(t, st, "", "10.0.2.1", "10.0.2.999")
+	processPending(t, st, "10.0.2.999")
+
+	quarantined, err := st.ListQuarantine(QuarantineFilter{BatchID: id, Limit: 10})
+	if err != nil || len(quarantined) != 1 {
+		t.Fatalf("ListQuarantine = %d rows, %v", len(quarantined), err)
+	}
+	row := quarantined[0]
+	if row.Object != "10.0.2.999" || row.BatchRow != 2 || row.Reason == "" || row.QuarantinedAt == "" {
+		t.Errorf("quarantined row = %+v", row)
+	}
+	if stats := pendingStats(t, st); stats.Quarantined != 1 {
+		t.Errorf("PendingStats.Quarantined = %d, want 1", stats.Quarantined)
+	}
+
+	if err := st.FixQuarantined(row.ID, "10.0.2.2", "ipv4"); err != nil {
+		t.Fatalf("FixQuarantined: %v", err)
+	}
+	if err := st.FixQuarantined(row.ID+100, "10.0.2.2", "ipv4"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("FixQuarantined of a missing row = %v, want ErrNotFound", err)
+	}
+	quarantined, err = st.ListQuarantine(QuarantineFilter{ID: row.ID, Limit: 10})
+	if err != nil || len(quarantined) != 1 || quarantined[0].Object != "10.0.2.2" || quarantined[0].FixedAt == "" {
+		t.Fatalf("fixed row = %+v, %v", quarantined, err)
+	}
+
+	// The resubmitted row goes back in its batch and is accepted this time
+	if n, err := st.ResubmitQuarantined(QuarantineFilter{ID: row.ID}); err != nil || n != 1 {
+		t.Fatalf("ResubmitQuarantined = %d, %v", n, err)
+	}
+	if stats := pendingStats(t, st); stats.Total != 1 || stats.Quarantined != 0 {
+		t.Errorf("PendingStats after resubmitting = %+v", stats)
+	}
+	if batch := batchStatus(t, st, id); batch.Pending != 1 || batch.Rejected != 0 || batch.FinishedAt != "" {
+		t.Errorf("batch of the resubmitted row = %+v", batch)
+	}
+	processPending(t, st)
+	if batch := batchStatus(t, st, id); batch.Status != ImportStatusDone || batch.Accepted != 2 || batch.Rejected != 0 {
+		t.Errorf("batch after the resubmitted row was processed = %+v", batch)
+	}
+	if n := occurrences(t, st, "10.0.2.2"); n != 1 {
+		t.Errorf("the fixed object has %d occurrences, want 1", n)
+	}
+
+	addBatch(t, st, "", "10.0.2.3")
+	processPending(t, st, "10.0.2.3")
+	if n, err := st.PurgeQuarantine(QuarantineFilter{Reason: "rejected by the contract"}); err != nil || n != 1 {
+		t.Errorf("PurgeQuarantine = %d, %v", n, err)
+	}
+	if quarantined, err := st.ListQuarantine(QuarantineFilter{Limit: 10}); err != nil || len(quarantined) != 0 {
+		t.Errorf("ListQuarantine after purging = %+v, %v", quarantined, err)
+	}
+}
+
+func contractRollback(t *testing.T, st Store) {
+	addBatch(t, st, "", "10.0.3.1", "10.0.3.2")
+	processPending(t, st)
+	id := addBatch(t, st, "", "10.0.3.1", "10.0.3.3")
+	processPending(t, st)
+
+	// A dry run reports the rollback and changes nothing
+	dryRun, err := st.RollbackImportBatch(id, true)
+	if err != nil {
+		t.Fatalf("RollbackImportBatch dry run: %v", err)
+	}
+	if !dryRun.DryRun || dryRun.Sightings != 2 || dryRun.ObjectsUpdated != 1 || dryRun.ObjectsDeleted != 1 || len(dryRun.Objects) != 2 {
+		t.Errorf("dry run = %+v", dryRun)
+	}
+	if n := occurrences(t, st, "10.0.3.1"); n != 2 {
+		t.Errorf("the dry run changed 10.0.3.1 to %d occurrences", n)
+	}
+	if n := occurrences(t, st, "10.0.3.3"); n != 1 {
+		t.Errorf("the dry run changed 10.0.3.3 to %d occurrences", n)
+	}
+	if batch := batchStatus(t, st, id); batch.Status != ImportStatusDone {
+		t.Errorf("the dry run changed the batch to %s", batch.Status)
+	}
+
+	result, err := st.RollbackImportBatch(id, false)
+	if err != nil {
+		t.Fatalf("RollbackImportBatch: %v", err)
+	}
+	if result.DryRun || result.Sightings != dryRun.Sightings || result.ObjectsUpdated != 1 || result.ObjectsDeleted != 1 || !reflect.DeepEqual(result.Objects, dryRun.Objects) {
+		t.Errorf("rollback = %+v, dry run = %+v", result, dryRun)
+	}
+	for _, obj := range result.Objects {
+		switch obj.Object {
+		case "10.0.3.1":
+			if obj.Deleted || obj.Occurrences != 1 || obj.OccurrenceCount != 1 || obj.FirstSeen == "" || obj.LastSeen == "" {
+				t.Errorf("rolled back object = %+v", obj)
+			}
+		case "10.0.3.3":
+			if !obj.Deleted || obj.OccurrenceCount != 0 {
+				t.Errorf("deleted object = %+v", obj)
+			}
+		default:
+			t.Errorf("rollback touched %s", obj.Object)
+		}
+	}
+	if n := occurrences(t, st, "10.0.3.1"); n != 1 {
+		t.Errorf("10.0.3.1 has %d occurrences after the rollback, want 1", n)
+	}
+	if n := occurrences(t, st, "10.0.3.3"); n != 0 {
+		t.Errorf("10.0.3.3 was only in the rolled back batch and has %d occurrences", n)
+	}
+	if batch := batchStatus(t, st, id); batch.Status != ImportStatusRolledBack || batch.RolledBackAt == "" {
+		t.Errorf("rolled back batch = %+v", batch)
+	}
+	if _, err := st.RollbackImportBatch(id, false); !errors.Is(err, ErrRolledBack) {
+		t.Errorf("second rollback = %v, want ErrRolledBack", err)
+	}
+
+	// The rows no workerBee processed yet are deleted
+	id = addBatch(t, st, "", "10.0.3.4", "10.0.3.5")
+	if result, err := st.RollbackImportBatch(id, false); err != nil || result.PendingRows != 2 {
+		t.Errorf("rollback of a pending batch = %+v, %v", result, err)
+	}
+	if stats := pendingStats(t, st); stats.Total != 0 {
+		t.Errorf("%d rows left pending after the rollback", stats.Total)
+	}
+}
+
+// Without sightings left the first_seen and last_seen of an object come from its accepted rows in the other batches
+func contractRollbackSeen(t *testing.T, st Store) {
+	kept := addBatch(t, st, "2020-01-01 00:00:00", "10.0.5.1")
+	processPending(t, st)
+	if _, err := st.Prune(PrunePolicy{SightingsBefore: time.Now().AddDate(0, 0, -1)}); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	rows, err := st.ImportBatchRows(kept, ImportRowAccepted, 10)
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("ImportBatchRows = %+v, %v", rows, err)
+	}
+	processedAt := parseTimestamp(rows[0].ProcessedAt)
+
+	// The batch rolled back is imported a second later, so it gave the object its last_seen
+	time.Sleep(1100 * time.Millisecond)
+	id := addBatch(t, st, "", "10.0.5.1")
+	processPending(t, st)
+	dryRun, err := st.RollbackImportBatch(id, true)
+	if err != nil {
+		t.Fatalf("RollbackImportBatch dry run: %v", err)
+	}
+	result, err := st.RollbackImportBatch(id, false)
+	if err != nil {
+		t.Fatalf("RollbackImportBatch: %v", err)
+	}
+	if !reflect.DeepEqual(result.Objects, dryRun.Objects) || len(result.Objects) != 1 {
+		t.Fatalf("rollback = %+v, dry run = %+v", result.Objects, dryRun.Objects)
+	}
+	obj, err := st.ObjectIntel("10.0.5.1")
+	if err != nil || obj.OccurrenceCount != 1 {
+		t.Fatalf("ObjectIntel = %+v, %v", obj, err)
+	}
+	if !parseTimestamp(obj.LastSeen).Equal(processedAt) || !parseTimestamp(result.Objects[0].LastSeen).Equal(processedAt) {
+		t.Errorf("last_seen is %s after the rollback, the row left was processed at %s", obj.LastSeen, rows[0].ProcessedAt)
+	}
+	if first := parseTimestamp(obj.FirstSeen); first.IsZero() || first.After(processedAt) {
+		t.Errorf("first_seen is %s after the rollback, the row left was processed at %s", obj.FirstSeen, rows[0].ProcessedAt)
+	}
+}
+
+// The other import of the object was pruned with its sighting, so its first_seen and last_seen are kept
+func contractRollbackOnlySighting(t *testing.T, st Store) {
+	addBatch(t, st, "2020-01-01 00:00:00", "10.0.5.2")
+	processPending(t, st)
+	if _, err := st.Prune(PrunePolicy{SightingsBefore: time.Now().AddDate(0, 0, -1), BatchesBefore: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	before, err := st.ObjectIntel("10.0.5.2")
+	if err != nil {
+		t.Fatalf("ObjectIntel: %v", err)
+	}
+
+	id := addBatch(t, st, "", "10.0.5.2")
+	processPending(t, st)
+	seen, err := st.ObjectIntel("10.0.5.2")
+	if err != nil || seen.OccurrenceCount != 2 {
+		t.Fatalf("ObjectIntel = %+v, %v", seen, err)
+	}
+	dryRun, err := st.RollbackImportBatch(id, true)
+	if err != nil {
+		t.Fatalf("RollbackImportBatch dry run: %v", err)
+	}
+	result, err := st.RollbackImportBatch(id, false)
+	if err != nil {
+		t.Fatalf("RollbackImportBatch: %v", err)
+	}
+	if !reflect.DeepEqual(result.Objects, dryRun.Objects) || len(result.Objects) != 1 || result.ObjectsUpdated != 1 {
+		t.Fatalf("rollback = %+v, dry run = %+v", result, dryRun)
+	}
+	obj, err := st.ObjectIntel("10.0.5.2")
+	if err != nil || obj.OccurrenceCount != 1 {
+		t.Fatalf("ObjectIntel = %+v, %v", obj, err)
+	}
+	if !parseTimestamp(obj.FirstSeen).Equal(parseTimestamp(before.FirstSeen)) || !parseTimestamp(obj.LastSeen).Equal(parseTimestamp(seen.LastSeen)) {
+		t.Errorf("first_seen %s and last_seen %s after the rollback, want %s and %s", obj.FirstSeen, obj.LastSeen, before.FirstSeen, seen.LastSeen)
+	}
+}
+
+func contractRetention(t *testing.T, st Store) {
+	now := time.Now()
+	addBatch(t, st, "2020-01-01 00:00:00", "10.0.4.1")
+	addBatch(t, st, "", "10.0.4.2")
+	processPending(t, st)
+	for _, startedAt := range []time.Time{now.AddDate(-1, 0, 0), now} {
+		run := StageRun{Stage: StageRescore, Status: "ok", StartedAt: formatSightingTime(startedAt), FinishedAt: formatSightingTime(startedAt)}
+		if err := st.RecordStageRun(run); err != nil {
+			t.Fatalf("RecordStageRun: %v", err)
+		}
+	}
+
+	policy := PrunePolicy{SightingsBefore: now.AddDate(0, 0, -1), StageRunsBefore: now.AddDate(0, 0, -1), DryRun: true}
+	dryRun, err := st.Prune(policy)
+	if err != nil || dryRun.Sightings != 1 || dryRun.StageRuns != 1 || dryRun.Objects != 0 {
+		t.Errorf("Prune dry run = %+v, %v", dryRun, err)
+	}
+	policy.DryRun = false
+	if result, err := st.Prune(policy); err != nil || result != dryRun {
+		t.Errorf("Prune = %+v, %v, dry run = %+v", result, err, dryRun)
+	}
+	if result, err := st.Prune(policy); err != nil || result != (PruneResult{}) {
+		t.Errorf("second Prune = %+v, %v", result, err)
+	}
+	if runs, err := st.StageRuns("", 10); err != nil || len(runs) != 1 {
+		t.Errorf("StageRuns after pruning = %+v, %v", runs, err)
+	}
+
+	// Objects last seen before StaleBefore are expired and leave a tombstone
+	stale := PrunePolicy{StaleBefore: now.Add(time.Hour), StaleMaxScore: 100, BatchesBefore: now.Add(time.Hour)}
+	if result, err := st.Prune(stale); err != nil || result.Objects != 2 || result.ImportBatches != 2 {
+		t.Errorf("Prune of stale objects = %+v, %v", result, err)
+	}
+	if n := occurrences(t, st, "10.0.4.1"); n != 0 {
+		t.Errorf("an expired object has %d occurrences", n)
+	}
+	tombstone, err := st.Tombstone("10.0.4.1")
+	if err != nil || tombstone.OccurrenceCount != 1 || tombstone.ObjectType != "ipv4" || tombstone.ExpiredAt == "" {
+		t.Errorf("Tombstone = %+v, %v", tombstone, err)
+	}
+	if _, err := st.Tombstone("10.0.4.9"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Tombstone of an object never expired = %v, want ErrNotFound", err)
+	}
+}
+
+func contractEnrichment(t *testing.T, st Store) {
+	addBatch(t, st, "", "10.0.6.1", "10.0.6.2")
+	processPending(t, st)
+	refs, err := st.ObjectsToEnrich([]string{"ipv4"}, time.Now(), 10)
+	if err != nil || len(refs) != 2 {
+		t.Fatalf("ObjectsToEnrich = %+v, %v", refs, err)
+	}
+
+	enrichedAt := time.Now().Add(-time.Hour)
+	info := `{"rdns":{"ptr":"host.example"}}`
+	err = st.SaveEnrichments([]ObjectEnrichment{{Object: "10.0.6.1", Enrichment: Enrichment{GeoCountry: "NL", GeoASN: "AS64500", Info: info}}}, enrichedAt)
+	if err != nil {
+		t.Fatalf("SaveEnrichments: %v", err)
+	}
+	obj, err := st.ObjectIntel("10.0.6.1")
+	if err != nil || obj.GeoCountry != "NL" || obj.GeoASN != "AS64500" || obj.EnrichmentInfo != info || obj.ObjectAdditionalInfo != "" || obj.EnrichedAt == "" {
+		t.Errorf("enriched ObjectIntel = %+v, %v", obj, err)
+	}
+
+	// A lookup that returned less keeps what the earlier one set
+	if err := st.SaveEnrichments([]ObjectEnrichment{{Object: "10.0.6.1", Enrichment: Enrichment{GeoOrg: "Example"}}}, enrichedAt); err != nil {
+		t.Fatalf("SaveEnrichments: %v", err)
+	}
+	obj, err = st.ObjectIntel("10.0.6.1")
+	if err != nil || obj.GeoCountry != "NL" || obj.GeoOrg != "Example" || obj.EnrichmentInfo != info {
+		t.Errorf("ObjectIntel enriched again = %+v, %v", obj, err)
+	}
+
+	// Never enriched first, then the oldest
+	refs, err = st.ObjectsToEnrich([]string{"ipv4"}, time.Now(), 10)
+	if err != nil || len(refs) != 2 || refs[0].Object != "10.0.6.2" {
+		t.Errorf("ObjectsToEnrich = %+v, %v", refs, err)
+	}
+	if refs, err := st.ObjectsToEnrich([]string{"ipv4"}, enrichedAt.Add(-time.Minute), 10); err != nil || len(refs) != 1 {
+		t.Errorf("ObjectsToEnrich of the objects never enriched = %+v, %v", refs, err)
+	}
+}
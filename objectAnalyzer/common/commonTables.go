@@ -0,0 +1,46 @@
+package common
+
+// Table and column names can not be bound as parameters, the few statements
+// that need one in their text take it from here.  Values are always bound.
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// schemaTables are the tables created by the migrations
+var schemaTables = map[string]bool{
+	"api_keys":          true,
+	"import_batch_rows": true,
+	"import_batches":    true,
+	"object_intel":      true,
+	"object_tombstones": true,
+	"pending_import":    true,
+	"quarantine":        true,
+	"schema_lock":       true,
+	"schema_migrations": true,
+	"score_history":     true,
+	"settings":          true,
+	"sightings":         true,
+	"stage_runs":        true,
+	"trusted_objects":   true,
+	"verdict_history":   true,
+}
+
+var columnPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// tableIdent returns the quoted name of a schema table or a weekly table left by older versions
+func tableIdent(name string) (string, error) {
+	if !schemaTables[name] && !weeklyTablePattern.MatchString(name) {
+		return "", fmt.Errorf("table %q is not part of the schema", name)
+	}
+	return `"` + name + `"`, nil
+}
+
+// columnIdent returns the quoted name of a column
+func columnIdent(name string) (string, error) {
+	if !columnPattern.MatchString(name) {
+		return "", fmt.Errorf("invalid column name %q", name)
+	}
+	return `"` + name + `"`, nil
+}
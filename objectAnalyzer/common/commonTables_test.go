@@ -0,0 +1,110 @@
+package common
+
+// FuzzObject feeds arbitrary objects through the validation, the identifier
+// allowlist and an import into the memory store.  The seeds in
+// testdata/fuzz/FuzzObject run with go test, more inputs with:
+//
+//	go test -run '^$' -fuzz FuzzObject
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var fuzzObjectTypes = []string{"ipv4", "ipv6", "domain", "url", "hash"}
+
+func FuzzObject(f *testing.F) {
+	f.Fuzz(func(t *testing.T, object string) {
+		// An accepted object is trimmed and valid for its type
+		for _, objectType := range fuzzObjectTypes {
+			row, reason := validateImport(PendingImport{Object: object, ObjectType: objectType})
+			if reason != "" {
+				continue
+			}
+			if row.Object == "" || row.Object != strings.TrimSpace(object) {
+				t.Errorf("%s %q was accepted as %q", objectType, object, row.Object)
+			}
+			if objectType == "ipv4" && (!IsValidIPv4(row.Object) || row.IPDecimal < 0 || row.IPDecimal > 1<<32-1) {
+				t.Errorf("ipv4 %q was accepted with ipDecimal %d", object, row.IPDecimal)
+			}
+			if objectType == "ipv6" && !IsValidIPv6(row.Object) {
+				t.Errorf("ipv6 %q was accepted", object)
+			}
+		}
+
+		// Only the schema tables and plain column names get into SQL text
+		if ident, err := tableIdent(object); err == nil {
+			if !schemaTables[object] && !weeklyTablePattern.MatchString(object) {
+				t.Errorf("tableIdent accepted %q", object)
+			}
+			if ident != `"`+object+`"` {
+				t.Errorf("tableIdent(%q) = %s", object, ident)
+			}
+		}
+		if ident, err := columnIdent(object); err == nil {
+			if object == "" || strings.ContainsAny(object, "\"'`;\\ \t\r\n\x00-") {
+				t.Errorf("columnIdent accepted %q", object)
+			}
+			if ident != `"`+object+`"` {
+				t.Errorf("columnIdent(%q) = %s", object, ident)
+			}
+		}
+
+		fuzzImport(t, object)
+	})
+}
+
+// fuzzImport imports the object as every type into a memory store and checks where each row ended up
+func fuzzImport(t *testing.T, object string) {
+	st := NewMemoryStore()
+	rows := make([]InsertPendingImportStruct, len(fuzzObjectTypes))
+	for i, objectType := range fuzzObjectTypes {
+		rows[i] = InsertPendingImportStruct{Object: object, ObjectType: objectType, Source: "fuzz", Notes: object}
+	}
+	id, err := st.AddPendingImports(ImportBatch{Source: "api", SubmittedBy: "fuzz"}, rows)
+	if err != nil {
+		t.Fatalf("AddPendingImports: %v", err)
+	}
+	claimed, err := st.ClaimPendingImports("fuzz", len(rows), time.Minute)
+	if err != nil || len(claimed) != len(rows) {
+		t.Fatalf("ClaimPendingImports = %d rows, %v", len(claimed), err)
+	}
+
+	var accepted []PendingImport
+	var rejected []RejectedImport
+	for _, row := range claimed {
+		if row.Object != object {
+			t.Errorf("pending row holds %q, %q was added", row.Object, object)
+		}
+		row, reason := validateImport(row)
+		if reason != "" {
+			rejected = append(rejected, RejectedImport{PendingImport: row, Reason: reason})
+		} else {
+			accepted = append(accepted, row)
+		}
+	}
+	if lost, err := st.ApplyPendingImports("fuzz", accepted, rejected); err != nil || lost != 0 {
+		t.Fatalf("ApplyPendingImports = %d lost, %v", lost, err)
+	}
+
+	if len(accepted) > 0 {
+		obj, err := st.ObjectIntel(accepted[0].Object)
+		if err != nil || obj.OccurrenceCount != len(accepted) || obj.Notes != object {
+			t.Errorf("ObjectIntel(%q) = %+v, %v, %d rows were accepted", accepted[0].Object, obj, err, len(accepted))
+		}
+	}
+	quarantined, err := st.ListQuarantine(QuarantineFilter{BatchID: id, Limit: len(rows)})
+	if err != nil || len(quarantined) != len(rejected) {
+		t.Fatalf("ListQuarantine = %d rows, %v, %d rows were rejected", len(quarantined), err, len(rejected))
+	}
+	for i, row := range quarantined {
+		if row.Object != rejected[i].Object || row.Notes != object {
+			t.Errorf("quarantined %q, %q was rejected", row.Object, rejected[i].Object)
+		}
+	}
+	batch, err := st.ImportBatch(id)
+	if err != nil || batch.Accepted != len(accepted) || batch.Rejected != len(rejected) || batch.Pending != 0 {
+		t.Errorf("ImportBatch = %+v, %v", batch, err)
+	}
+}
@@ -0,0 +1,320 @@
+package common
+
+// Verdict of each object in the object_intel table
+//
+// The verdict turns the risk_score into a label for downstream tools.  It is
+// computed after scoring and whenever the trust or the confirmation of an
+// object changes, every change is recorded in the verdict_history table.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	VerdictMalicious  = "malicious"
+	VerdictSuspicious = "suspicious"
+	VerdictUnknown    = "unknown"
+	VerdictBenign     = "benign"
+	VerdictTrusted    = "trusted"
+)
+
+var verdicts = []string{VerdictMalicious, VerdictSuspicious, VerdictUnknown, VerdictBenign, VerdictTrusted}
+
+// Fidelity values in increasing order
+var fidelityLevels = []string{"Low", "Medium", "High"}
+
+// VerdictRules are the score bands of each verdict
+type VerdictRules struct {
+	MaliciousScore       int    `json:"malicious_score"`        // Scores at or above are malicious
+	MaliciousMinFidelity string `json:"malicious_min_fidelity"` // Below this fidelity a malicious score is only suspicious
+	SuspiciousScore      int    `json:"suspicious_score"`       // Scores at or above are suspicious
+	BenignMaxScore       int    `json:"benign_max_score"`       // Scored objects at or below are benign, between this and suspicious_score is unknown
+}
+
+func DefaultVerdictRules() VerdictRules {
+	return VerdictRules{MaliciousScore: 40, MaliciousMinFidelity: "Medium", SuspiciousScore: 15, BenignMaxScore: 5}
+}
+
+func (vr VerdictRules) Validate() error {
+	var errs []error
+	if vr.BenignMaxScore < 0 {
+		errs = append(errs, fmt.Errorf("verdict_rules.benign_max_score must not be negative"))
+	}
+	if vr.SuspiciousScore <= vr.BenignMaxScore {
+		errs = append(errs, fmt.Errorf("verdict_rules.suspicious_score must be greater than benign_max_score"))
+	}
+	if vr.MaliciousScore < vr.SuspiciousScore {
+		errs = append(errs, fmt.Errorf("verdict_rules.malicious_score must be at least suspicious_score"))
+	}
+	if vr.MaliciousMinFidelity != "" && fidelityRank(vr.MaliciousMinFidelity) < 0 {
+		errs = append(errs, fmt.Errorf("verdict_rules.malicious_min_fidelity must be one of %s", strings.Join(fidelityLevels, ", ")))
+	}
+	return errors.Join(errs...)
+}
+
+// fidelityRank returns the position of a fidelity in fidelityLevels, -1 when it is not known
+func fidelityRank(fidelity string) int {
+	for i, level := range fidelityLevels {
+		if strings.EqualFold(level, fidelity) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isValidVerdict(verdict string) bool {
+	for _, v := range verdicts {
+		if v == verdict {
+			return true
+		}
+	}
+	return false
+}
+
+// parseVerdicts reads a comma separated list of verdicts from a query parameter
+func parseVerdicts(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if !isValidVerdict(v) {
+			return nil, fmt.Errorf("invalid verdict %q.  Valid verdicts are: %s", v, strings.Join(verdicts, ", "))
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+// verdictFilter returns the SQL condition and arguments that match a list of verdicts, "" for no filter
+func verdictFilter(list []string) (string, []any) {
+	if len(list) == 0 {
+		return "", nil
+	}
+	args := make([]any, len(list))
+	for i, v := range list {
+		args[i] = v
+	}
+	return "verdict IN (?" + strings.Repeat(", ?", len(list)-1) + ")", args
+}
+
+type VerdictInput struct {
+	RiskScore     int
+	Scored        bool // risk_score has been calculated
+	Fidelity      string
+	ConfirmedRisk bool
+	Trusted       bool
+}
+
+// Verdict returns the verdict of an object and the reason for it
+func (vr VerdictRules) Verdict(in VerdictInput) (string, string) {
+	switch {
+	case in.Trusted:
+		return VerdictTrusted, "trusted object"
+	case in.ConfirmedRisk:
+		return VerdictMalicious, "risk confirmed by an analyst"
+	case !in.Scored:
+		return VerdictUnknown, "not scored"
+	case in.RiskScore >= vr.MaliciousScore && fidelityRank(in.Fidelity) >= fidelityRank(vr.MaliciousMinFidelity):
+		return VerdictMalicious, fmt.Sprintf("risk_score %d at or above %d", in.RiskScore, vr.MaliciousScore)
+	case in.RiskScore >= vr.MaliciousScore:
+		return VerdictSuspicious, fmt.Sprintf("risk_score %d at or above %d with %s fidelity", in.RiskScore, vr.MaliciousScore, in.Fidelity)
+	case in.RiskScore >= vr.SuspiciousScore:
+		return VerdictSuspicious, fmt.Sprintf("risk_score %d at or above %d", in.RiskScore, vr.SuspiciousScore)
+	case in.RiskScore <= vr.BenignMaxScore:
+		return VerdictBenign, fmt.Sprintf("risk_score %d at or below %d", in.RiskScore, vr.BenignMaxScore)
+	}
+	return VerdictUnknown, fmt.Sprintf("risk_score %d between %d and %d", in.RiskScore, vr.BenignMaxScore, vr.SuspiciousScore)
+}
+
+// refreshVerdicts computes the verdict of the object_intel rows matching the condition
+// and records every change in verdict_history in the write transaction of the caller
+func refreshVerdicts(tx sqlTx, rules VerdictRules, condition string, args ...any) (int, error) {
+	rows, err := tx.Query(`
+		SELECT object, risk_score, risk_score_last_updated, fidelity, confirmed_risk, trusted, verdict
+		FROM object_intel
+		WHERE `+condition, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query object_intel for verdicts: %w", err)
+	}
+
+	type change struct {
+		object, oldVerdict, newVerdict, reason string
+	}
+	var changes []change
+	for rows.Next() {
+		var object string
+		var riskScore sql.NullInt64
+		var lastUpdated, fidelity, verdict sql.NullString
+		var confirmedRisk, trusted sql.NullBool
+		if err := rows.Scan(&object, &riskScore, &lastUpdated, &fidelity, &confirmedRisk, &trusted, &verdict); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan row: %w", err)
+		}
+		newVerdict, reason := rules.Verdict(VerdictInput{
+			RiskScore:     int(riskScore.Int64),
+			Scored:        riskScore.Valid && lastUpdated.Valid,
+			Fidelity:      fidelity.String,
+			ConfirmedRisk: confirmedRisk.Bool,
+			Trusted:       trusted.Bool,
+		})
+		if newVerdict != verdict.String {
+			changes = append(changes, change{object, verdict.String, newVerdict, reason})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating over rows: %w", err)
+	}
+
+	for _, c := range changes {
+		if _, err := tx.Exec(`UPDATE object_intel SET verdict = ? WHERE object = ?`, c.newVerdict, c.object); err != nil {
+			return 0, fmt.Errorf("failed to update the verdict of %s: %w", c.object, err)
+		}
+		_, err := tx.Exec(`
+			INSERT INTO verdict_history (object, old_verdict, new_verdict, reason, changed_at)
+			VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+		`, c.object, c.oldVerdict, c.newVerdict, c.reason)
+		if err != nil {
+			return 0, fmt.Errorf("failed to insert into verdict_history: %w", err)
+		}
+	}
+	return len(changes), nil
+}
+
+// RefreshVerdicts recomputes the verdict of an object with the verdict rules in the settings
+// An empty object recomputes every object, for example after the verdict rules change
+func (s *ServerConfig) RefreshVerdicts(object string) (int, error) {
+	settings, err := s.GetSettings()
+	if err != nil {
+		return 0, fmt.Errorf("failed to load settings: %w", err)
+	}
+	return s.Store.RefreshVerdicts(settings.VerdictRules, object)
+}
+
+type VerdictChange struct {
+	ChangedAt  string `json:"changed_at"`
+	OldVerdict string `json:"old_verdict"`
+	NewVerdict string `json:"new_verdict"`
+	Reason     string `json:"reason"`
+}
+
+type VerdictHistoryResponse struct {
+	Object  string          `json:"object"`
+	Verdict string          `json:"verdict"`
+	History []VerdictChange `json:"history"` // Newest first
+}
+
+type ObjectSummary struct {
+	Object     string `json:"object"`
+	ObjectType string `json:"object_type"`
+	RiskScore  int    `json:"risk_score"`
+	Verdict    string `json:"verdict" enum:"malicious,suspicious,unknown,benign,trusted"`
+	LastSeen   string `json:"last_seen"`
+}
+
+type ObjectListResponse struct {
+	Count   int             `json:"count"`
+	Objects []ObjectSummary `json:"objects"`
+}
+
+// GetVerdictHistory returns the verdict changes of an object, newest first
+func (s *ServerConfig) GetVerdictHistory(object string, limit int) ([]VerdictChange, error) {
+	return s.Store.VerdictHistory(object, limit)
+}
+
+// ListObjects returns the objects with one of the verdicts, highest score first
+func (s *ServerConfig) ListObjects(verdictList []string, objectType string, limit int) ([]ObjectSummary, error) {
+	return s.Store.ListObjects(verdictList, objectType, limit)
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/object/114.6.6.6/verdicts" -H "X-API-Key: testingtheapikey"
+func (s *ServerConfig) HandleVerdictHistory(w http.ResponseWriter, r *http.Request) {
+	if !s.apiKeyAuthorized(w, r) {
+		return
+	}
+
+	object := strings.TrimSpace(r.PathValue("object"))
+	limit := defaultScoreHistoryLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxScoreHistoryLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxScoreHistoryLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	intel, err := s.GetObjectIntel(object)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "No data found for the given object", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to retrieve data", http.StatusInternalServerError)
+		return
+	}
+	history, err := s.GetVerdictHistory(object, limit)
+	if err != nil {
+		http.Error(w, "Failed to retrieve the verdict history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(VerdictHistoryResponse{Object: intel.Object, Verdict: intel.Verdict, History: history}); err != nil {
+		http.Error(w, "Failed to encode result", http.StatusInternalServerError)
+		return
+	}
+}
+
+// Test curl command: curl -k "https://127.0.0.1:9000/api/objects?verdict=malicious,suspicious&object_type=ipv4" -H "X-API-Key: testingtheapikey"
+func (s *ServerConfig) HandleListObjects(w http.ResponseWriter, r *http.Request) {
+	if !s.apiKeyAuthorized(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	verdictList, err := parseVerdicts(query.Get("verdict"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	objectType := query.Get("object_type")
+	if objectType != "" && !isValidObjectType(objectType) {
+		http.Error(w, "Invalid object_type.  Valid Object Types are: ipv4, ipv6, domain, url, hash", http.StatusBadRequest)
+		return
+	}
+	settings, err := s.GetSettings()
+	if err != nil {
+		http.Error(w, "Failed to retrieve settings", http.StatusInternalServerError)
+		return
+	}
+	limit := settings.BatchLimits.Export
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > settings.BatchLimits.Export {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", settings.BatchLimits.Export), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	objects, err := s.ListObjects(verdictList, objectType, limit)
+	if err != nil {
+		http.Error(w, "Failed to retrieve objects", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ObjectListResponse{Count: len(objects), Objects: objects}); err != nil {
+		http.Error(w, "Failed to encode result", http.StatusInternalServerError)
+		return
+	}
+}
@@ -2,4 +2,4 @@ module common
 
 go 1.25.5
 
-require github.com/mattn/go-sqlite3 v1.14.33 // indirect
+require github.com/mattn/go-sqlite3 v1.14.33
@@ -1,7 +1,7 @@
 package common
 
 import (
-	"database/sql"
+	"crypto/subtle"
 	"encoding/csv"
 	"encoding/json"
 	"errors"
@@ -11,28 +11,43 @@ import (
 	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Configuration struct {
-	Hostname           string `json:"hostname"`
-	Port               int    `json:"port"`
-	DBPath             string `json:"dbPath"`
-	TLSConfig          string `json:"tlsConfig"`
-	TLSCert            string `json:"tlsCert"`
-	TLSKey             string `json:"tlsKey"`
-	APIKey             string `json:"apiKey"`
+	Hostname           string `json:"hostname" reload:"restart"`
+	Port               int    `json:"port" reload:"restart"`
+	Store              string `json:"store" reload:"restart"` // sqlite, memory or postgres, see StoreBackends
+	DBPath             string `json:"dbPath" reload:"restart"`
+	DBBusyTimeout      int    `json:"dbBusyTimeoutSeconds" reload:"restart"`      // Wait for a write of the other program on the SQLite database
+	DatabaseURL        string `json:"databaseURL" secret:"true" reload:"restart"` // Used by the postgres store
+	BackupKeep         int    `json:"backupKeep"`                                 // Newest backups kept in the backups directory, 0 keeps every backup
+	BackupGzip         bool   `json:"backupGzip"`                                 // Compress the backups with gzip
+	WorkerID           string `json:"workerID" reload:"restart"`                  // Name of this workerBee in the claims of pending rows, defaults to <host>-<pid>
+	PendingLease       int    `json:"pendingLeaseSeconds"`                        // A claimed pending row is claimed again by another workerBee after this
+	PipelineWorkers    int    `json:"pipelineWorkers"`                            // Goroutines validating the pending rows, 0 uses one for each CPU
+	EnrichGeoCSV       string `json:"enrichGeoCSV"`                               // Networks with their geo fields and ASN for the geo_csv enricher of the workerBee
+	TLSConfig          string `json:"tlsConfig" reload:"restart"`
+	TLSCert            string `json:"tlsCert" reload:"restart"`
+	TLSKey             string `json:"tlsKey" reload:"restart"`
+	APIKey             string `json:"apiKey" secret:"true"`
+	AdminAPIKey        string `json:"adminApiKey" secret:"true"` // Sent in the X-API-Key header to the /api/admin endpoints
 	Debug              bool   `json:"debug"`
 	TrustedCSVLocation string `json:"trustedCSVDirectory"`
 	ImportCSVLocation  string `json:"importCSVDirectory"`
 	ArchiveCSVLocation string `json:"archiveCSVDirectory"`
+	CertRenewDays      int    `json:"certRenewDays" reload:"restart"`    // Days before expiry a self-signed certificate is re-issued
+	CertWarnDays       int    `json:"certWarnDays" reload:"restart"`     // Days before expiry a warning is logged
+	CertCheckSeconds   int    `json:"certCheckSeconds" reload:"restart"` // Interval the certificate and key files are checked for changes
 }
 
 type InsertPendingImportStruct struct {
-	Object       string `json:"object"`
-	ObjectType   string `json:"object_type"`
+	Object       string `json:"object" required:"true"`
+	ObjectType   string `json:"object_type" required:"true" enum:"ipv4,ipv6,domain,url,hash"`
 	Notes        string `json:"notes"`
 	Source       string `json:"source"`
 	TimeProvided string `json:"time_provided"`
@@ -42,18 +57,33 @@ type InsertPendingImportStruct struct {
 	APIKey       string `json:"apiKey,omitempty"`
 }
 
+type ImportJSONRequest struct {
+	APIKey     string                      `json:"apiKey,omitempty"`
+	ImportData []InsertPendingImportStruct `json:"data" required:"true"`
+}
+
+type VerifyImportRequest struct {
+	Object string `json:"object" required:"true"`
+	APIKey string `json:"apiKey,omitempty"`
+}
+
+type VerifyImportResult struct {
+	ID           int    `json:"id"`
+	Object       string `json:"object"`
+	ObjectType   string `json:"object_type"`
+	IPDecimal    int    `json:"ipDecimal"`
+	Notes        string `json:"notes"`
+	Source       string `json:"source"`
+	TimeImported string `json:"time_imported"`
+	TimeProvided string `json:"time_provided"`
+}
+
+type StatusResponse struct {
+	Status string `json:"status"`
+}
+
 func (c *Configuration) CreateConfig(f string) error {
-	c.Hostname = "localhost"
-	c.Port = 9000
-	c.DBPath = "../data/threatintel.sqlite"
-	c.TLSConfig = "keys/tlsconfig.json"
-	c.TLSCert = "keys/tls.crt"
-	c.TLSKey = "keys/tls.key"
-	c.APIKey = "changeThisAPIKeyToSomethingSecure" // This needs to be passed on each call
-	c.Debug = false
-	c.TrustedCSVLocation = "trustedCSV"
-	c.ImportCSVLocation = "importCSV"
-	c.ArchiveCSVLocation = "archiveCSV"
+	c.SetDefaults()
 
 	jsonData, err := json.MarshalIndent(c, "", "    ")
 	if err != nil {
@@ -68,6 +98,27 @@ func (c *Configuration) CreateConfig(f string) error {
 	return nil
 }
 
+func (c *Configuration) SetDefaults() {
+	c.Hostname = "localhost"
+	c.Port = 9000
+	c.Store = defaultStore
+	c.DBPath = "../data/threatintel.sqlite"
+	c.DBBusyTimeout = defaultDBBusyTimeoutSeconds
+	c.BackupKeep = defaultBackupKeep
+	c.PendingLease = defaultPendingLeaseSeconds
+	c.TLSConfig = "keys/tlsconfig.json"
+	c.TLSCert = "keys/tls.crt"
+	c.TLSKey = "keys/tls.key"
+	c.APIKey = defaultAPIKey // This needs to be passed on each call
+	c.Debug = false
+	c.TrustedCSVLocation = "trustedCSV"
+	c.ImportCSVLocation = "importCSV"
+	c.ArchiveCSVLocation = "archiveCSV"
+	c.CertRenewDays = defaultCertRenewDays
+	c.CertWarnDays = defaultCertWarnDays
+	c.CertCheckSeconds = defaultCertCheckSeconds
+}
+
 func (c *Configuration) SaveConfig(f string) error {
 	jsonData, err := json.MarshalIndent(c, "", "    ")
 	if err != nil {
@@ -82,25 +133,51 @@ func (c *Configuration) SaveConfig(f string) error {
 	return nil
 }
 
+// LoadConfig decodes the config file, rejecting unknown keys, then applies any OA_* environment overrides
+// The file may be missing when every required setting is provided through the environment
 func (c *Configuration) LoadConfig(cPtr string) error {
 	configFile, err := os.Open(cPtr)
 	if err != nil {
-		return err
+		if !errors.Is(err, os.ErrNotExist) || !HasEnvOverrides() {
+			return err
+		}
+		log.Printf("Config file %s not found, using the defaults and OA_* environment variables\n", cPtr)
+		c.SetDefaults()
+		return c.ApplyEnvOverrides()
 	}
 	defer configFile.Close()
 	decoder := json.NewDecoder(configFile)
+	decoder.DisallowUnknownFields()
 	if err := decoder.Decode(&c); err != nil {
-		return err
+		return fmt.Errorf("failed to decode %s: %w", cPtr, err)
+	}
+	if decoder.More() {
+		return fmt.Errorf("failed to decode %s: unexpected data after the configuration object", cPtr)
 	}
 
-	return nil
+	return c.ApplyEnvOverrides()
 }
 
 type ServerConfig struct {
-	Config   Configuration // Each configuration may be differenct depending on the function
-	DB       *sql.DB
-	Mutex    sync.RWMutex
-	InitOnce sync.Once
+	config      atomic.Pointer[Configuration] // Each configuration may be differenct depending on the function, read it with Config()
+	ConfigPath  string                        // File the configuration is reloaded from
+	reloadMutex sync.Mutex
+	Store       Store // Opened by OpenDatabase
+	// Scoring rules are read from this JSON file instead of the settings table when it is set
+	ScoringRulesFile string
+	enrich           enrichState // Enrichers opened by the workerBee and their cached lookups
+}
+
+func NewServerConfig(c Configuration, configPath string) *ServerConfig {
+	s := &ServerConfig{ConfigPath: configPath}
+	s.config.Store(&c)
+	return s
+}
+
+// Config returns a copy of the live configuration snapshot.  Read it once per
+// request so a reload in the middle of a handler is not seen half applied.
+func (s *ServerConfig) Config() Configuration {
+	return *s.config.Load()
 }
 
 func CreateIndexHTML(folderDir string) {
@@ -116,6 +193,7 @@ func CreateIndexHTML(folderDir string) {
 		f.Write([]byte("<h1>Yet Another Threat Intelligence Platform</h1>"))
 		f.Write([]byte("<hr />"))
 		f.Write([]byte("<p><a href=\"/upload.html\">Upload CSV File</a> with column headers of object, object_type, notes, source, and time.  Required columns are object and object_type.</p>"))
+		f.Write([]byte("<p><a href=\"/api/docs\">API Documentation</a></p>"))
 		f.Write([]byte(tailHTML()))
 		f.Close()
 	}
@@ -138,115 +216,32 @@ func tailHTML() string {
 	return tHTML
 }
 
-func (s *ServerConfig) InitDatabase() error {
+// OpenDatabase opens the store without migrating it, used by -migrate status
+func (s *ServerConfig) OpenDatabase() error {
 	var err error
-	if s.Config.Debug {
-		log.Printf("DB Path: %s\n", s.Config.DBPath)
+	if s.Config().Debug {
+		log.Printf("Store: %s DB Path: %s\n", storeName(s.Config()), s.Config().DBPath)
 	}
-	s.DB, err = sql.Open("sqlite3", s.Config.DBPath)
-	//s.DB, err = sql.Open("sqlite3", ":memory:")
+	s.Store, err = OpenStore(s.Config())
 	if err != nil {
 		return fmt.Errorf("failed to open database: %w", err)
 	}
+	return nil
+}
 
-	// Create pending_import table
-	// Object types: ip, domain, url, hash
-	_, err = s.DB.Exec(`
-		CREATE TABLE IF NOT EXISTS pending_import (
-			id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-			object VARCHAR NOT NULL,  
-			object_type VARCHAR NOT NULL,
-			notes TEXT,
-			source VARCHAR,
-			geo_region VARCHAR,
-			geo_country VARCHAR,
-			geo_org VARCHAR,
-			fidelity VARCHAR DEFAULT 'Low',
-			time_imported TIMESTAMP NOT NULL,
-			time_provided TIMESTAMP
-		)
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to create pending_import table: %w", err)
-	}
-	if s.Config.Debug {
-		log.Println("pending_import table created successfully or already exists")
-	}
-	// Create the Main Threat Intelligence Table
-	_, err = s.DB.Exec(`
-		CREATE TABLE IF NOT EXISTS object_intel (
-			object VARCHAR NOT NULL PRIMARY KEY, 
-			object_additionalInfo VARCHAR, 
-			object_type VARCHAR NOT NULL,
-			IPDecimal INTEGER,
-			geo_region VARCHAR,
-			geo_country VARCHAR,
-			geo_org VARCHAR,
-			geo_asn VARCHAR,
-			notes TEXT,
-			fidelity VARCHAR DEFAULT 'Low',
-			first_seen TIMESTAMP NOT NULL,
-			last_seen TIMESTAMP,
-			occurrence_count INTEGER DEFAULT 1,
-			risk_score INTEGER,
-			risk_score_last_updated TIMESTAMP,
-			confirmed_risk BOOLEAN DEFAULT FALSE,
-			trusted BOOLEAN DEFAULT FALSE
-		)
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to create object_intel table: %w", err)
-	}
-	if s.Config.Debug {
-		log.Println("object_intel table created successfully or already exists")
-	}
-	now := time.Now()
-	year, week := now.ISOWeek()
-	// The API server may not restart on a weekly basis, will need another script to run this also...
-	// Create Weekly Table to Track Object Occurrences
-	_, err = s.DB.Exec(`
-		CREATE TABLE IF NOT EXISTS objects_` + fmt.Sprintf("%d_%d", week, year) + ` (
-			id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-			object VARCHAR NOT NULL,  
-			object_additionalInfo VARCHAR,
-			object_type VARCHAR NOT NULL,
-			ipDecimal INTEGER,
-			notes TEXT,
-			source VARCHAR,
-			fidelity VARCHAR DEFAULT 'Low',
-			time_imported TIMESTAMP NOT NULL,
-			time_provided TIMESTAMP
-		)
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to create objects table: %w", err)
-	}
-	if s.Config.Debug {
-		log.Println("objects table created successfully or already exists")
-	}
-
-	// Create the Table of Trusted Objects
-	// Objects are ipv4, ipv4CIDR, ipv6, (ipv6CIDR Future)
-	_, err = s.DB.Exec(`
-		CREATE TABLE IF NOT EXISTS trusted_objects (
-			object VARCHAR NOT NULL PRIMARY KEY,
-			object_additionalInfo VARCHAR,  
-			object_type VARCHAR NOT NULL,
-			ipDecimal INTEGER DEFAULT 0,
-			startIPDecimal INTEGER DEFAULT 0,
-			endIPDecimal INTEGER DEFAULT 0,
-			notes TEXT,
-			source TEXT,
-			time_imported TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			occurrence_count INTEGER DEFAULT 1,
-			last_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
+// InitDatabase opens the database and applies the pending migrations
+func (s *ServerConfig) InitDatabase() error {
+	if err := s.OpenDatabase(); err != nil {
+		return err
+	}
+
+	// The tables are created and changed by the versioned migrations in migrations/
+	count, err := s.Store.Migrate()
 	if err != nil {
-		return fmt.Errorf("failed to create trusted_objects table: %w", err)
+		return fmt.Errorf("failed to migrate the database: %w", err)
 	}
-	if s.Config.Debug {
-		log.Println("trusted_objects table created successfully or already exists")
+	if s.Config().Debug {
+		log.Printf("Applied %d migrations, the database schema is current\n", count)
 	}
 
 	return nil
@@ -271,21 +266,100 @@ func (s *ServerConfig) HandleConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.Mutex.RLock()
-	defer s.Mutex.RUnlock()
-
-	// Remove the API Key before sending the config
-	backupAPIKey := s.Config.APIKey
-	s.Config.APIKey = ""
-
+	// Remove the API Keys from the copy of the config that is sent
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(s.Config); err != nil {
+	if err := json.NewEncoder(w).Encode(s.Config().Redacted()); err != nil {
 		http.Error(w, "Failed to encode config", http.StatusInternalServerError)
 		return
 	}
+}
+
+// validAPIKey checks the apiKey from the config and the active keys in the api_keys table
+func (s *ServerConfig) validAPIKey(apiKey string) bool {
+	if apiKey == "" {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(apiKey), []byte(s.Config().APIKey)) == 1 {
+		return true
+	}
+	return s.lookupAPIKeyRole(apiKey) != ""
+}
+
+// validAdminKey checks the adminApiKey from the config and the active admin keys in the api_keys table
+func (s *ServerConfig) validAdminKey(apiKey string) bool {
+	if apiKey == "" {
+		return false
+	}
+	adminAPIKey := s.Config().AdminAPIKey
+	if adminAPIKey != "" && subtle.ConstantTimeCompare([]byte(apiKey), []byte(adminAPIKey)) == 1 {
+		return true
+	}
+	return s.lookupAPIKeyRole(apiKey) == APIKeyRoleAdmin
+}
+
+// lookupAPIKeyRole returns the role of an active key in the api_keys table or "" when it is not found
+func (s *ServerConfig) lookupAPIKeyRole(apiKey string) string {
+	if s.Store == nil {
+		return ""
+	}
+	role, err := s.Store.APIKeyRole(hashAPIKey(apiKey))
+	if err != nil {
+		log.Printf("Failed to look up API key: %v\n", err)
+		return ""
+	}
+	return role
+}
+
+// adminAuthorized checks the X-API-Key header for an admin key and writes the error response when it fails
+func (s *ServerConfig) adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if !s.validAdminKey(r.Header.Get("X-API-Key")) {
+		if s.Config().AdminAPIKey == "" {
+			http.Error(w, "Invalid API Key, set adminApiKey in the config to create the first admin key", http.StatusUnauthorized)
+			return false
+		}
+		http.Error(w, "Invalid API Key", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// apiKeyAuthorized checks the X-API-Key header against the API keys for the endpoints that do not take a JSON body
+// Admin keys are also accepted
+func (s *ServerConfig) apiKeyAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	apiKey := r.Header.Get("X-API-Key")
+	if s.validAPIKey(apiKey) || s.validAdminKey(apiKey) {
+		return true
+	}
+	http.Error(w, "Invalid API Key", http.StatusUnauthorized)
+	return false
+}
+
+// Reload the config file, the same as sending SIGHUP to the apiServer
+// Test curl command: curl -k "https://127.0.0.1:9000/api/admin/reloadConfig" -X POST -H "X-API-Key: theadminapikey"
+func (s *ServerConfig) HandleReloadConfig(w http.ResponseWriter, r *http.Request) {
+	// Respond to POST Requests
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	// Restore the API Key
-	s.Config.APIKey = backupAPIKey
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+
+	report, err := s.ReloadConfig(true)
+	if err != nil {
+		log.Printf("Config reload requested by %s failed: %v\n", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Config reloaded by %s: %s\n", r.RemoteAddr, report)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		http.Error(w, "Failed to encode report", http.StatusInternalServerError)
+		return
+	}
 }
 
 // Test by uploading a CSV file via the HTML form at /upload.html
@@ -299,7 +373,7 @@ func (s *ServerConfig) HandleImportCSV(w http.ResponseWriter, r *http.Request) {
 
 	// Validate API Key
 	apiKey := r.FormValue("apiKey")
-	if apiKey != s.Config.APIKey {
+	if !s.validAPIKey(apiKey) {
 		http.Error(w, "Invalid API Key", http.StatusUnauthorized)
 		return
 	}
@@ -370,10 +444,6 @@ func (s *ServerConfig) HandleImportCSV(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Process records
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-
 	// Assume first row is header
 	header := records[0]
 	colIndex := make(map[string]int)
@@ -390,13 +460,8 @@ func (s *ServerConfig) HandleImportCSV(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Insert records into the database
-	tx, err := s.DB.Begin()
-	if err != nil {
-		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
-		return
-	}
-
+	// Insert records into the database once every row is valid
+	var rows []InsertPendingImportStruct
 	for i, record := range records {
 		var data InsertPendingImportStruct
 		if i == 0 {
@@ -429,19 +494,19 @@ func (s *ServerConfig) HandleImportCSV(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := s.InsertImportTable(data, tx); err != nil {
-			log.Printf("Failed to insert import table data for row %d: %v\n", i, err)
-		}
-
+		rows = append(rows, data)
 	}
 
-	err = tx.Commit()
+	batch := ImportBatch{Source: ImportSourceUpload, SubmittedBy: s.submitter(apiKey), FileName: filepath.Base(filename)}
+	batchID, err := s.Store.AddPendingImports(batch, rows)
 	if err != nil {
-		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+		log.Printf("Failed to insert import table data: %v\n", err)
+		http.Error(w, "Failed to save the imported records", http.StatusInternalServerError)
 		return
 	}
 
 	fmt.Fprintf(w, "Imported CSV with %d records<br />", len(records)-1) // Assume the 1st record listed is the header
+	fmt.Fprintf(w, "Import batch ID: %d, its status is at /api/import/%d<br />", batchID, batchID)
 	fmt.Fprint(w, "<a href='/upload.html'>Link to Upload another File</a>")
 }
 
@@ -474,7 +539,7 @@ func (s *ServerConfig) HandleImport(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate API Key
-	if data.APIKey != s.Config.APIKey {
+	if !s.validAPIKey(data.APIKey) {
 		http.Error(w, "Invalid API Key", http.StatusUnauthorized)
 		return
 	}
@@ -487,30 +552,16 @@ func (s *ServerConfig) HandleImport(w http.ResponseWriter, r *http.Request) {
 	// Future Enhancement - Include a validation step for the objects imported... (Security and Integrity of the Data)
 
 	// Insert the data into the pending_import table
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-
-	tx, err := s.DB.Begin()
+	batch := ImportBatch{Source: ImportSourceAPI, SubmittedBy: s.submitter(data.APIKey)}
+	batchID, err := s.Store.AddPendingImports(batch, []InsertPendingImportStruct{data})
 	if err != nil {
-		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
-		return
-	}
-
-	if err := s.InsertImportTable(data, tx); err != nil {
 		log.Printf("Failed to insert import table data for row %s - %s: %v\n", data.Object, data.TimeProvided, err)
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		tx.Rollback()
-		http.Error(w, fmt.Sprintf("Failed to commit transaction: %v", err), http.StatusInternalServerError)
+		http.Error(w, "Failed to save the import", http.StatusInternalServerError)
 		return
 	}
 
-	// For demonstration, we just return a success message
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status":"import successful"}`))
+	// The outcome of the import is at GET /api/import/{batch_id} once a workerBee processed it
+	writeImportResponse(w, batchID, 1)
 }
 
 // Test curl command w/o APIKey: curl -k "https://127.0.0.1:9000/api/importJSON" -X POST  -d '{ "apiKey": "testing", "data": [{"object": "149.9.9.9", "object_type": "ipv4"}, {"object": "149.9.9.8", "object_type": "ipv4"} ] }'
@@ -522,10 +573,7 @@ func (s *ServerConfig) HandleImportJSON(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	var JSONData struct {
-		APIKey     string                      `json:"apiKey,omitempty"`
-		ImportData []InsertPendingImportStruct `json:"data"`
-	}
+	var JSONData ImportJSONRequest
 
 	if err := json.NewDecoder(r.Body).Decode(&JSONData); err != nil {
 		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
@@ -533,21 +581,11 @@ func (s *ServerConfig) HandleImportJSON(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Validate API Key
-	if JSONData.APIKey != s.Config.APIKey {
+	if !s.validAPIKey(JSONData.APIKey) {
 		http.Error(w, "Invalid API Key", http.StatusUnauthorized)
 		return
 	}
 
-	// Insert the data into the pending_import table
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-
-	tx, err := s.DB.Begin()
-	if err != nil {
-		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
-		return
-	}
-
 	for _, data := range JSONData.ImportData {
 		//log.Printf("%s\n", importData.ObjectType)
 		if data.ObjectType != "ipv4" && data.ObjectType != "ipv6" && data.ObjectType != "domain" && data.ObjectType != "url" && data.ObjectType != "hash" {
@@ -557,24 +595,19 @@ func (s *ServerConfig) HandleImportJSON(w http.ResponseWriter, r *http.Request)
 
 		// ** Future Enhancement **
 		// Include a validation step for the objects imported... (Security and Integrity of the Data)
-
-		if err := s.InsertImportTable(data, tx); err != nil {
-			log.Printf("Failed to insert import table data for row %s - %s: %v\n", data.Object, data.TimeProvided, err)
-		}
-
 	}
 
-	err = tx.Commit()
+	// Insert the data into the pending_import table, none of the rows are saved when one fails
+	batch := ImportBatch{Source: ImportSourceJSON, SubmittedBy: s.submitter(JSONData.APIKey)}
+	batchID, err := s.Store.AddPendingImports(batch, JSONData.ImportData)
 	if err != nil {
-		tx.Rollback()
-		http.Error(w, fmt.Sprintf("Failed to commit transaction: %v", err), http.StatusInternalServerError)
+		log.Printf("Failed to insert import table data: %v\n", err)
+		http.Error(w, "Failed to save the import", http.StatusInternalServerError)
 		return
 	}
 
-	// For demonstration, we just return a success message
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status":"import successful"}`))
+	// The outcome of the import is at GET /api/import/{batch_id} once a workerBee processed it
+	writeImportResponse(w, batchID, len(JSONData.ImportData))
 }
 
 // Test curl command w/o APIKey: curl -k "https://127.0.0.1:9000/api/verifyImport" -X GET  -d '{ "object": "114.6.6.6" }'
@@ -587,10 +620,7 @@ func (s *ServerConfig) HandleVerify(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse the incoming JSON payload
-	var importData struct {
-		Object string `json:"object"`
-		APIKey string `json:"apiKey,omitempty"`
-	}
+	var importData VerifyImportRequest
 
 	// ** Future Enhancement **
 	// Provide a JSON payload that would be valid when an error is sent
@@ -600,34 +630,14 @@ func (s *ServerConfig) HandleVerify(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate API Key
-	if importData.APIKey != s.Config.APIKey {
+	if !s.validAPIKey(importData.APIKey) {
 		http.Error(w, "Invalid API Key", http.StatusUnauthorized)
 		return
 	}
 
-	s.Mutex.RLock()
-	defer s.Mutex.RUnlock()
-
-	row := s.DB.QueryRow(`
-		SELECT id, object, object_type, ipDecimal, notes, source, time_imported, time_provided
-		FROM pending_import
-		WHERE object = ?
-	`, importData.Object)
-
-	var result struct {
-		ID           int    `json:"id"`
-		Object       string `json:"object"`
-		ObjectType   string `json:"object_type"`
-		IPDecimal    int    `json:"ipDecimal"`
-		Notes        string `json:"notes"`
-		Source       string `json:"source"`
-		TimeImported string `json:"time_imported"`
-		TimeProvided string `json:"time_provided"`
-	}
-
-	err := row.Scan(&result.ID, &result.Object, &result.ObjectType, &result.IPDecimal, &result.Notes, &result.Source, &result.TimeImported, &result.TimeProvided)
+	result, err := s.Store.FindPendingImport(importData.Object)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, ErrNotFound) {
 			http.Error(w, "No data found for the given object", http.StatusNotFound)
 			return
 		}
@@ -643,648 +653,281 @@ func (s *ServerConfig) HandleVerify(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *ServerConfig) ProcessPendingImports() error {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
+// Objects are ipv4, ipv4CIDR, ipv6, ipv6CIDR
+// A file that fails to load stays in the import directory, the other files are still loaded
+func (s *ServerConfig) LoadImportObjectsFromCSV() error {
+	cfg := s.Config()
 
-	tx, err := s.DB.Begin()
+	// read the files in the directory at cfg.CSVLocation and loop through them
+	files, err := os.ReadDir(cfg.ImportCSVLocation)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return fmt.Errorf("failed to read import CSV directory: %w", err)
 	}
 
-	rows, err := s.DB.Query(`SELECT id, object, object_type, notes, source, time_imported, time_provided, geo_region, geo_country, geo_org FROM pending_import LIMIT 10000`) // Due to performance issues this limit may need to be modified
-	if err != nil {
-		return fmt.Errorf("failed to query pending_import table: %w", err)
+	var errs []error
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(strings.ToLower(file.Name()), ".csv") {
+			continue
+		}
+		fullPath := cfg.ImportCSVLocation + "/" + file.Name()
+		log.Printf("Loading import objects from CSV file: %s\n", fullPath)
+		if err := s.loadImportCSVFile(cfg, fullPath, file.Name()); err != nil {
+			log.Printf("Skipping %s: %v\n", fullPath, err)
+			errs = append(errs, err)
+		}
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var id int
-		var object, objectType, notes, source, timeImported, timeProvided, geoRegion, geoCountry, geoOrg string
-		invalidObject := false
-		if err := rows.Scan(&id, &object, &objectType, &notes, &source, &timeImported, &timeProvided, &geoRegion, &geoCountry, &geoOrg); err != nil {
-			return fmt.Errorf("failed to scan row: %w", err)
-		}
+	return errors.Join(errs...)
+}
 
-		fmt.Printf("Processing ID: %d, Object: %s, Type: %s\n", id, object, objectType)
-
-		// Validate the object_type for example if ipv4 verify the structure matches a regex of IPv4
-		var ipv4Decimal int
-		if objectType == "ipv4" {
-			// Add IPv4 validation logic here
-			if !IsValidIPv4(object) {
-				fmt.Printf("invalid IPv4 address: %s", object)
-				invalidObject = true
-			}
-			ipv4Decimal, err = ipv4ToDecimal(object)
-			if err != nil {
-				return fmt.Errorf("failed to convert IPv4 to decimal: %w", err)
-			}
-		} else if objectType == "ipv6" {
-			// Add IPv6 validation logic here
-			if !IsValidIPv6(object) {
-				fmt.Printf("invalid IPv6 address: %s", object)
-				invalidObject = true
-			}
-		}
+// readCSVFile reads the rows of a CSV file with a header, the columns are indexed by their lower case name
+// Rows with a different number of fields are returned, the callers skip the ones missing a required column
+func readCSVFile(path string, requiredCols []string) ([][]string, map[string]int, error) {
+	csvFile, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open CSV file: %w", err)
+	}
+	defer csvFile.Close()
 
-		if !invalidObject {
-			_, err = tx.Exec(`
-			INSERT INTO object_intel (object, object_type, ipDecimal, notes, first_seen, last_seen, occurrence_count, geo_region, geo_country, geo_org)
-			VALUES (?, ?, ?, ?, ?, ?, 1, ?, ?, ?)
-			ON CONFLICT(object) DO UPDATE SET
-				notes=excluded.notes,
-				last_seen=excluded.last_seen,
-				occurrence_count = object_intel.occurrence_count + 1
-			`, object, objectType, ipv4Decimal, notes, timeImported, timeImported, geoRegion, geoCountry, geoOrg)
-			if err != nil {
-				tx.Rollback()
-				return fmt.Errorf("failed to insert/update object_intel: %w", err)
-			}
-
-			now := time.Now()
-			year, week := now.ISOWeek()
-			_, err = tx.Exec(`
-			INSERT INTO objects_`+fmt.Sprintf("%d_%d", week, year)+` (object, object_type, ipDecimal, notes, source, time_imported, time_provided)
-			VALUES (?, ?, ?, ?, ?, ?, ?)
-		`, object, objectType, ipv4Decimal, notes, source, timeImported, timeProvided)
-			if err != nil {
-				tx.Rollback()
-				return fmt.Errorf("failed to insert into weekly occurrences table: %w", err)
-			}
-
-			_, err = tx.Exec(`DELETE FROM pending_import WHERE id = ?`, id)
-			if err != nil {
-				tx.Rollback()
-				return fmt.Errorf("failed to delete from pending_import: %w", err)
-			}
-		} else {
-			log.Printf("Skipping invalid object with ID %d\n", id)
-			_, err = s.DB.Exec(`DELETE FROM pending_import WHERE id = ?`, id)
-			if err != nil {
-				tx.Rollback()
-				log.Printf("failed to delete from pending_import: %v", err)
-			}
-		}
+	reader := csv.NewReader(csvFile)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
 
+	// Read all records
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read CSV file %s: %w", path, err)
 	}
-	if err := rows.Err(); err != nil {
-		return fmt.Errorf("error iterating over rows: %w", err)
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("CSV file %s is empty", path)
 	}
 
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+	// Assume first row is header
+	colIndex := make(map[string]int)
+	for i, colName := range records[0] {
+		colIndex[strings.ToLower(colName)] = i
 	}
 
-	return nil
+	// Required columns
+	for _, col := range requiredCols {
+		if _, ok := colIndex[col]; !ok {
+			return nil, nil, fmt.Errorf("CSV file %s is missing the required column: %s", path, col)
+		}
+	}
+	return records[1:], colIndex, nil
 }
 
-func (s *ServerConfig) InsertImportTable(importData InsertPendingImportStruct, tx *sql.Tx) error {
-
-	stmt, err := tx.Prepare(`
-			INSERT INTO pending_import (object, object_type, notes, source, time_imported, time_provided, geo_region, geo_country, geo_org)
-			VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
-		`)
-	if err != nil {
-		return fmt.Errorf("failed to prepare statement: %w", err)
+// csvField returns the column of a record, "" when the column or the field is missing
+func csvField(record []string, colIndex map[string]int, col string) string {
+	i, ok := colIndex[col]
+	if !ok || i >= len(record) {
+		return ""
 	}
-	defer stmt.Close()
+	return record[i]
+}
 
-	if _, err := stmt.Exec(importData.Object, importData.ObjectType, importData.Notes, importData.Source, importData.TimeProvided, importData.GeoRegion, importData.GeoCountry, importData.GeoOrg); err != nil {
-		return fmt.Errorf("failed to insert/update trusted object in row %s - %s: %w", importData.Object, importData.TimeProvided, err)
+// archiveCSVFile moves a loaded CSV file to the archive directory
+func archiveCSVFile(cfg Configuration, fullPath string, name string, kind string) error {
+	archiveDir := cfg.ArchiveCSVLocation
+	if err := os.MkdirAll(archiveDir, 0755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
 	}
-
+	archivedFilePath := archiveDir + "/" + name + "_" + kind + "_" + time.Now().Format("20060102_150405")
+	if err := os.Rename(fullPath, archivedFilePath); err != nil {
+		return fmt.Errorf("failed to move processed CSV file to archive: %w", err)
+	}
+	log.Printf("Moved processed %s CSV file to archive: %s\n", kind, archivedFilePath)
 	return nil
 }
 
-// Objects are ipv4, ipv4CIDR, ipv6, ipv6CIDR
-func (s *ServerConfig) LoadImportObjectsFromCSV() error {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-
-	tx, err := s.DB.Begin()
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
-	}
-
-	// read the files in the directory at s.Config.CSVLocation and loop through them
-	files, err := os.ReadDir(s.Config.ImportCSVLocation)
+func (s *ServerConfig) loadImportCSVFile(cfg Configuration, fullPath string, name string) error {
+	records, colIndex, err := readCSVFile(fullPath, []string{"object", "object_type"})
 	if err != nil {
-		return fmt.Errorf("failed to read trusted CSV directory: %w", err)
+		return err
 	}
 
-	for _, file := range files {
-		fullPath := ""
-		if !file.IsDir() && strings.HasSuffix(strings.ToLower(file.Name()), ".csv") {
-			fullPath = s.Config.ImportCSVLocation + "/" + file.Name()
-			log.Printf("Loading import objects from CSV file: %s\n", fullPath)
-		} else {
+	var rows []InsertPendingImportStruct
+	for i, record := range records {
+		var data InsertPendingImportStruct
+		data.Object = csvField(record, colIndex, "object")
+		data.ObjectType = csvField(record, colIndex, "object_type")
+		if data.Object == "" || data.ObjectType == "" {
+			log.Printf("Skipping CSV row %d of %s, object and object_type are required\n", i+1, fullPath)
 			continue
 		}
-		csvFile, err := os.Open(fullPath)
-		if err != nil {
-			return fmt.Errorf("failed to open import CSV file: %w", err)
-		}
-		defer csvFile.Close()
-
-		reader := csv.NewReader(csvFile)
-		reader.TrimLeadingSpace = true
+		data.Notes = csvField(record, colIndex, "notes")
+		data.Source = csvField(record, colIndex, "source")
+		data.TimeProvided = csvField(record, colIndex, "time_provided")
+		data.GeoRegion = csvField(record, colIndex, "geo_region")
+		data.GeoCountry = csvField(record, colIndex, "geo_country")
+		data.GeoOrg = csvField(record, colIndex, "geo_org")
 
-		// Read all records
-		records, err := reader.ReadAll()
-		if err != nil {
-			return fmt.Errorf("failed to read CSV file: %w", err)
-		}
-
-		// Assume first row is header
-		header := records[0]
-		colIndex := make(map[string]int)
-		for i, colName := range header {
-			colIndex[strings.ToLower(colName)] = i
-		}
-
-		// Required columns
-		requiredCols := []string{"object", "object_type"}
-		for _, col := range requiredCols {
-			if _, ok := colIndex[col]; !ok {
-				return fmt.Errorf("missing required columns object, object_type: %s", col)
-			}
-		}
-
-		for i, record := range records {
-			var data InsertPendingImportStruct
-			if i == 0 {
-				continue // Skip header row
-			}
-			data.Object = record[colIndex["object"]]
-			data.ObjectType = record[colIndex["object_type"]]
-
-			if colIndex["notes"] < len(record) {
-				data.Notes = record[colIndex["notes"]]
-			} else {
-				data.Notes = ""
-			}
-			if colIndex["source"] < len(record) {
-				data.Source = record[colIndex["source"]]
-			} else {
-				data.Source = ""
-			}
-			if colIndex["time_provided"] < len(record) {
-				data.TimeProvided = record[colIndex["time_provided"]]
-			} else {
-				data.TimeProvided = ""
-			}
-			if colIndex["geo_region"] < len(record) {
-				data.GeoRegion = record[colIndex["geo_region"]]
-			} else {
-				data.GeoRegion = ""
-			}
-			if colIndex["geo_country"] < len(record) {
-				data.GeoCountry = record[colIndex["geo_country"]]
-			} else {
-				data.GeoCountry = ""
-			}
-			if colIndex["geo_org"] < len(record) {
-				data.GeoOrg = record[colIndex["geo_org"]]
-			} else {
-				data.GeoOrg = ""
-			}
-
-			fmt.Printf("Processing CSV Row %d: Object: %s, Type: %s, Notes: %s, Source: %s, GeoRegion: %s, GeoCountry: %s, GeoOrg: %s\n", i, data.Object, data.ObjectType, data.Notes, data.Source, data.GeoRegion, data.GeoCountry, data.GeoOrg)
-
-			if err := s.InsertImportTable(data, tx); err != nil {
-				log.Printf("Failed to insert import table data for row %d: %v\n", i, err)
-			}
-		}
-
-		err = tx.Commit()
-		if err != nil {
-			tx.Rollback()
-			return fmt.Errorf("failed to commit transaction: %w", err)
-		}
+		rows = append(rows, data)
+	}
 
-		// Move the import CSV file to an archive directory
-		archiveDir := s.Config.ArchiveCSVLocation
-		CreateDirectory(archiveDir)
-		if _, err := os.Stat(archiveDir); os.IsNotExist(err) {
-			err = os.MkdirAll(archiveDir, 0755)
-			if err != nil {
-				return fmt.Errorf("failed to create archive directory: %w", err)
-			}
-		}
-		archivedFilePath := archiveDir + "/" + file.Name() + "_import_" + time.Now().Format("20060102_150405")
-		err = os.Rename(fullPath, archivedFilePath)
-		if err != nil {
-			return fmt.Errorf("failed to move processed CSV file to archive: %w", err)
-		}
-		log.Printf("Moved processed import CSV file to archive: %s\n", archivedFilePath)
+	// The file stays in the import directory when its rows are not saved
+	batchID, err := s.Store.AddPendingImports(ImportBatch{Source: ImportSourceCSV, SubmittedBy: "workerBee", FileName: name}, rows)
+	if err != nil {
+		return fmt.Errorf("failed to insert the rows of %s: %w", fullPath, err)
 	}
+	log.Printf("Queued %d rows of %s as import batch %d\n", len(rows), name, batchID)
 
-	return nil
+	// Move the import CSV file to an archive directory
+	return archiveCSVFile(cfg, fullPath, name, "import")
 }
 
 // Objects are ipv4, ipv4CIDR, ipv6, ipv6CIDR
+// A file that fails to load stays in the trusted directory, the other files are still loaded
 func (s *ServerConfig) LoadTrustedObjectsFromCSV() error {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
+	cfg := s.Config()
 
-	// read the files in the directory at s.Config.CSVLocation and loop through them
-	files, err := os.ReadDir(s.Config.TrustedCSVLocation)
+	// read the files in the directory at cfg.CSVLocation and loop through them
+	files, err := os.ReadDir(cfg.TrustedCSVLocation)
 	if err != nil {
 		return fmt.Errorf("failed to read trusted CSV directory: %w", err)
 	}
 
+	var errs []error
 	for _, file := range files {
-		fullPath := ""
-		if !file.IsDir() && strings.HasSuffix(strings.ToLower(file.Name()), ".csv") {
-			fullPath = s.Config.TrustedCSVLocation + "/" + file.Name()
-			log.Printf("Loading trusted objects from CSV file: %s\n", fullPath)
-		} else {
+		if file.IsDir() || !strings.HasSuffix(strings.ToLower(file.Name()), ".csv") {
 			continue
 		}
-		csvFile, err := os.Open(fullPath)
-		if err != nil {
-			return fmt.Errorf("failed to open trusted CSV file: %w", err)
+		fullPath := cfg.TrustedCSVLocation + "/" + file.Name()
+		log.Printf("Loading trusted objects from CSV file: %s\n", fullPath)
+		if err := s.loadTrustedCSVFile(cfg, fullPath, file.Name()); err != nil {
+			log.Printf("Skipping %s: %v\n", fullPath, err)
+			errs = append(errs, err)
 		}
-		defer csvFile.Close()
-
-		reader := csv.NewReader(csvFile)
-		reader.TrimLeadingSpace = true
-
-		// Read all records
-		records, err := reader.ReadAll()
-		if err != nil {
-			return fmt.Errorf("failed to read CSV file: %w", err)
-		}
-
-		tx, err := s.DB.Begin()
-		if err != nil {
-			return fmt.Errorf("failed to begin transaction: %w", err)
-		}
-
-		stmt, err := tx.Prepare(`
-		INSERT INTO trusted_objects (object, object_type, ipDecimal, startIPDecimal, endIPDecimal, notes, source, occurrence_count)
-		VALUES (?, ?, ?, ?, ?, ?, ?, 1)
-		ON CONFLICT(object) DO UPDATE SET
-			notes=excluded.notes,
-			source=excluded.source,
-			last_seen=CURRENT_TIMESTAMP,
-			occurrence_count = trusted_objects.occurrence_count + 1
-		`)
-		if err != nil {
-			tx.Rollback()
-			return fmt.Errorf("failed to prepare statement: %w", err)
-		}
-		defer stmt.Close()
-
-		// Assume first row is header
-		header := records[0]
-		colIndex := make(map[string]int)
-		for i, colName := range header {
-			colIndex[strings.ToLower(colName)] = i
-		}
-
-		// Required columns
-		requiredCols := []string{"object", "object_type"}
-		for _, col := range requiredCols {
-			if _, ok := colIndex[col]; !ok {
-				tx.Rollback()
-				return fmt.Errorf("missing required column: %s", col)
-			}
-		}
-
-		for i, record := range records {
-			if i == 0 {
-				continue // Skip header row
-			}
-			object := record[colIndex["object"]]
-			objectType := record[colIndex["object_type"]]
-			var notes, source string
-			if colIndex["notes"] < len(record) {
-				notes = record[colIndex["notes"]]
-			}
-			if colIndex["source"] < len(record) {
-				source = record[colIndex["source"]]
-			}
-
-			var ipv4Decimal int
-			if objectType == "ipv4" {
-				ipv4Decimal, err = ipv4ToDecimal(object)
-				if err != nil {
-					tx.Rollback()
-					return fmt.Errorf("unable to convert IPv4 address to decimal in row %d: %w", i, err)
-				}
-			}
-
-			var startIPDecimal, endIPDecimal int
-			if objectType == "ipv4CIDR" {
-				startIP, endIP, err := GetFirstAndLastIP(object)
-				startIPDecimal, err = ipv4ToDecimal(startIP.String())
-				if err != nil {
-					tx.Rollback()
-					return fmt.Errorf("unable to convert start IPv4 address to decimal in row %d: %w", i, err)
-				}
-				endIPDecimal, err = ipv4ToDecimal(endIP.String())
-				if err != nil {
-					tx.Rollback()
-					return fmt.Errorf("unable to convert end IPv4 address to decimal in row %d: %w", i, err)
-				}
-			}
-
-			if _, err := stmt.Exec(object, objectType, ipv4Decimal, startIPDecimal, endIPDecimal, notes, source); err != nil {
-				tx.Rollback()
-				return fmt.Errorf("failed to insert/update trusted object in row %d: %w", i, err)
-			}
-
-		}
-
-		err = tx.Commit()
-		if err != nil {
-			return fmt.Errorf("failed to commit transaction: %w", err)
-		}
-
-		// Move the trusted CSV file to an archive directory
-		archiveDir := s.Config.ArchiveCSVLocation
-		CreateDirectory(archiveDir)
-		if _, err := os.Stat(archiveDir); os.IsNotExist(err) {
-			err = os.MkdirAll(archiveDir, 0755)
-			if err != nil {
-				return fmt.Errorf("failed to create archive directory: %w", err)
-			}
-		}
-		archivedFilePath := archiveDir + "/" + file.Name() + "_trusted_" + time.Now().Format("20060102_150405")
-		err = os.Rename(fullPath, archivedFilePath)
-		if err != nil {
-			return fmt.Errorf("failed to move processed CSV file to archive: %w", err)
-		}
-		log.Printf("Moved processed trusted CSV file to archive: %s\n", archivedFilePath)
-
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
-func (s *ServerConfig) MarkTrustedObjects() error {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-
-	tx, err := s.DB.Begin()
+func (s *ServerConfig) loadTrustedCSVFile(cfg Configuration, fullPath string, name string) error {
+	records, colIndex, err := readCSVFile(fullPath, []string{"object", "object_type"})
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return err
 	}
 
-	// Update for ipv4 trusted objects
-	_, err = tx.Exec(`
-		UPDATE object_intel
-		SET trusted = TRUE
-		WHERE object IN (SELECT object FROM trusted_objects WHERE object_type = "ipv4")
-			AND object_type = "ipv4"
-	`)
-	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("failed to mark trusted objects: %w", err)
-	}
+	var objects []TrustedObject
+	for i, record := range records {
+		object := csvField(record, colIndex, "object")
+		objectType := csvField(record, colIndex, "object_type")
+		if object == "" || objectType == "" {
+			log.Printf("Skipping CSV row %d of %s, object and object_type are required\n", i+1, fullPath)
+			continue
+		}
+		notes := csvField(record, colIndex, "notes")
+		source := csvField(record, colIndex, "source")
 
-	// Update for ipv6 trusted objects
-	_, err = tx.Exec(`
-		UPDATE object_intel
-		SET trusted = TRUE
-		WHERE object IN (SELECT object FROM trusted_objects WHERE object_type = "ipv6")
-			AND object_type = "ipv6"
-	`)
-	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("failed to mark trusted objects: %w", err)
+		objects = append(objects, TrustedObject{Object: object, ObjectType: objectType, Notes: notes, Source: source})
 	}
 
-	// Cycle through the ipv4CIDR trusted objects and mark them
-	rows, err := tx.Query(`SELECT object FROM trusted_objects WHERE object_type = "ipv4CIDR"`)
-	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("failed to query ipv4CIDR trusted objects: %w", err)
+	// None of the rows are saved when one is not a valid trusted object
+	if _, err := s.Store.AddTrustedObjects(objects); err != nil {
+		return fmt.Errorf("failed to load the trusted objects of %s: %w", fullPath, err)
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var cidr string
-		if err := rows.Scan(&cidr); err != nil {
-			tx.Rollback()
-			return fmt.Errorf("failed to scan cidr: %w", err)
-		}
+	// Move the trusted CSV file to an archive directory
+	return archiveCSVFile(cfg, fullPath, name, "trusted")
+}
 
-		startIP, endIP, err := GetFirstAndLastIP(cidr)
+// trustedObjectDecimals returns the ipDecimal of an ipv4 object and the range of an ipv4CIDR object
+func trustedObjectDecimals(object string, objectType string) (int, int, int, error) {
+	var ipv4Decimal, startIPDecimal, endIPDecimal int
+	var err error
+	if objectType == "ipv4" {
+		ipv4Decimal, err = ipv4ToDecimal(object)
 		if err != nil {
-			tx.Rollback()
-			return fmt.Errorf("failed to get first and last IP for cidr %s: %w", cidr, err)
+			return 0, 0, 0, fmt.Errorf("unable to convert IPv4 address to decimal: %w", err)
 		}
-		startIPDec, err := ipv4ToDecimal(startIP.String())
+	}
+
+	if objectType == "ipv4CIDR" {
+		startIP, endIP, err := GetFirstAndLastIP(object)
 		if err != nil {
-			tx.Rollback()
-			return fmt.Errorf("failed to convert start IP to decimal for cidr %s: %w", cidr, err)
+			return 0, 0, 0, fmt.Errorf("unable to parse the CIDR %s: %w", object, err)
 		}
-		endIPDec, err := ipv4ToDecimal(endIP.String())
+		startIPDecimal, err = ipv4ToDecimal(startIP.String())
 		if err != nil {
-			tx.Rollback()
-			return fmt.Errorf("failed to convert end IP to decimal for cidr %s: %w", cidr, err)
+			return 0, 0, 0, fmt.Errorf("unable to convert start IPv4 address to decimal: %w", err)
 		}
-
-		log.Printf("Marking trusted ipv4CIDR objects from %s to %s\n", startIP.String(), endIP.String())
-
-		_, err = tx.Exec(`
-			UPDATE object_intel
-			SET trusted = TRUE
-			WHERE object_type = "ipv4" 
-				AND IPDecimal BETWEEN ? AND ?
-		`, startIPDec, endIPDec)
+		endIPDecimal, err = ipv4ToDecimal(endIP.String())
 		if err != nil {
-			tx.Rollback()
-			return fmt.Errorf("failed to mark ipv4CIDR trusted objects: %w", err)
+			return 0, 0, 0, fmt.Errorf("unable to convert end IPv4 address to decimal: %w", err)
 		}
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
-	}
-
-	return nil
+	return ipv4Decimal, startIPDecimal, endIPDecimal, nil
 }
 
-func (s *ServerConfig) TableExists(tableName string) (bool, error) {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-
-	_, err := s.DB.Begin()
+func (s *ServerConfig) MarkTrustedObjects() error {
+	settings, err := s.GetSettings()
 	if err != nil {
-		return false, fmt.Errorf("failed to begin transaction: %w", err)
+		return fmt.Errorf("failed to load settings: %w", err)
 	}
 
-	var name string
-	err = s.DB.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name=?`, tableName).Scan(&name)
+	changed, err := s.Store.MarkTrustedObjects(settings.VerdictRules)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return false, nil
-		}
-		return false, err
-	}
-	return true, nil
-}
-
-// Select a row from the object_intel table where the last updated date is within the last 7 days
-func (s *ServerConfig) GetObjectListIPv4(tableName string, ipv4 string) ([]string, error) {
-	s.Mutex.RLock()
-	defer s.Mutex.RUnlock()
-
-	query := "SELECT id FROM " + tableName + " WHERE object = '" + ipv4 + "'"
-
-	// Set the risk scoring to 2 days due to large databases and performance concerns
-	if tableName == "object_intel" {
-		query = `SELECT object
-		FROM object_intel
-		WHERE (risk_score_last_updated <= datetime('now', '-2 days') OR risk_score_last_updated IS NULL) AND trusted = FALSE
-		LIMIT 10000`
-	}
-
-	rows, err := s.DB.Query(query)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query recent object_intel: %w", err)
-	}
-	defer rows.Close()
-
-	// The results only have 1 value return as a list of strings
-	var results []string
-	for rows.Next() {
-		var object string
-		if err := rows.Scan(&object); err != nil {
-			return nil, fmt.Errorf("failed to scan row: %w", err)
-		}
-		result := strings.TrimSpace(object)
-		results = append(results, result)
+		return err
 	}
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	if changed > 0 {
+		log.Printf("Updated the verdict of %d objects after marking trusted objects\n", changed)
 	}
-
-	return results, nil
+	return nil
 }
 
-func (s *ServerConfig) UpdateObjectRiskScore(object string, riskScore int) error {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-
-	_, err := s.DB.Exec(`
-		UPDATE object_intel
-		SET risk_score = ?, risk_score_last_updated = CURRENT_TIMESTAMP
-		WHERE object = ?
-	`, riskScore, object)
-	if err != nil {
-		return fmt.Errorf("failed to update risk score: %w", err)
-	}
-
-	return nil
+// UpdateObjectRiskScore saves the score of an object, records the breakdown in the score_history table
+// and computes the verdict from the new score
+func (s *ServerConfig) UpdateObjectRiskScore(object string, result ScoreResult, verdictRules VerdictRules) error {
+	return s.Store.SaveRiskScore(object, result, verdictRules)
 }
 
+// UpdateObjectIntelRiskScores rescores the objects whose risk score is older than the rescore interval with the scoring rules
 func (s *ServerConfig) UpdateObjectIntelRiskScores() error {
-	now := time.Now()
-	year, week := now.ISOWeek()
-	tableNowName := "objects_" + fmt.Sprintf("%d_%d", week, year)
-	boolTableNow, err := s.TableExists(tableNowName)
+	settings, err := s.GetSettings()
 	if err != nil {
-		log.Fatalf("Error checking if table %s exists: %v", tableNowName, err)
+		return fmt.Errorf("failed to load settings: %w", err)
 	}
 
-	// Last Week
-	lastWeek := now.AddDate(0, 0, -7)
-	year, week = lastWeek.ISOWeek()
-	tableLastWeekName := "objects_" + fmt.Sprintf("%d_%d", week, year)
-	boolTableLastWeek, err := s.TableExists(tableLastWeekName)
+	// The rescore interval and batch limit are in the settings due to large databases and performance concerns
+	scoredBefore := time.Now().Add(-time.Duration(settings.RescoreIntervalHours) * time.Hour)
+	listObjects, err := s.Store.ObjectsToRescore(scoredBefore, settings.BatchLimits.Rescore)
 	if err != nil {
-		log.Fatalf("Error checking if table %s exists: %v", tableLastWeekName, err)
+		return fmt.Errorf("retrieving the object list failed: %w", err)
 	}
+	return s.rescoreObjects(settings, listObjects)
+}
 
-	// 2 weeks ago
-	twoWeeksago := now.AddDate(0, 0, -14)
-	year, week = twoWeeksago.ISOWeek()
-	tableTwoWeeksAgoName := "objects_" + fmt.Sprintf("%d_%d", week, year)
-	boolTableTwoWeeksAgo, err := s.TableExists(tableTwoWeeksAgoName)
+// rescoreObjects scores the objects with the current scoring rules and saves their scores and verdicts
+func (s *ServerConfig) rescoreObjects(settings Settings, listObjects []string) error {
+	rules, err := s.scoringRules()
 	if err != nil {
-		log.Fatalf("Error checking if table %s exists: %v", tableTwoWeeksAgoName, err)
+		return fmt.Errorf("failed to load scoring rules: %w", err)
 	}
-
-	// 3 weeks ago
-	threeWeeksago := now.AddDate(0, 0, -21)
-	year, week = threeWeeksago.ISOWeek()
-	tableThreeWeeksAgoName := "objects_" + fmt.Sprintf("%d_%d", week, year)
-	boolTableThreeWeeksAgo, err := s.TableExists(tableThreeWeeksAgoName)
-	if err != nil {
-		log.Fatalf("Error checking if table %s exists: %v", tableThreeWeeksAgoName, err)
+	if s.Config().Debug {
+		log.Printf("Retrieved %d objects for risk score calculation with rules version %d.\n", len(listObjects), rules.Version)
 	}
 
-	// Calculate Risk Score for the IP Addresses in the object intel database
-	listIPv4, err := s.GetObjectListIPv4("object_intel", "")
-	if err != nil {
-		log.Fatalf("retrieving IPv4 object list failed: %v", err)
-	}
-	if s.Config.Debug {
-		log.Printf("Retrieved %d IPv4 objects for risk score calculation.\n", len(listIPv4))
-	}
-
-	for _, obj := range listIPv4 {
-		score := 0
-		// Now
-		if boolTableNow {
-			listNow, err := s.GetObjectListIPv4(tableNowName, obj)
-			if err != nil {
-				log.Fatalf("retrieving IPv4 object list from %s failed: %v", tableNowName, err)
-			}
-			if s.Config.Debug {
-				log.Printf("Retrieved %d IPv4 objects from %s for risk score calculation.\n", len(listNow), tableNowName)
-			}
-			score += len(listNow) * 4
-		}
-		// Last Week
-		if boolTableLastWeek {
-			listLastWeek, err := s.GetObjectListIPv4(tableLastWeekName, obj)
-			if err != nil {
-				log.Fatalf("retrieving IPv4 object list from %s failed: %v", tableLastWeekName, err)
-			}
-			if s.Config.Debug {
-				log.Printf("Retrieved %d IPv4 objects from %s for risk score calculation.\n", len(listLastWeek), tableLastWeekName)
-			}
-			score += len(listLastWeek) * 2
-		}
-
-		// 2 Weeks Ago
-		if boolTableTwoWeeksAgo {
-			listTwoWeeksAgo, err := s.GetObjectListIPv4(tableTwoWeeksAgoName, obj)
-			if err != nil {
-				log.Fatalf("retrieving IPv4 object list from %s failed: %v", tableTwoWeeksAgoName, err)
-			}
-			if s.Config.Debug {
-				log.Printf("Retrieved %d IPv4 objects from %s for risk score calculation.\n", len(listTwoWeeksAgo), tableTwoWeeksAgoName)
-			}
-			score += len(listTwoWeeksAgo) * 1
-		}
+	// Sightings older than the lookback of the decay half-lives are not read
+	lookback := time.Now().AddDate(0, 0, -settings.DecayHalfLives.LookbackDays)
 
-		// 3 Weeks Ago
-		if boolTableThreeWeeksAgo {
-			listThreeWeeksAgo, err := s.GetObjectListIPv4(tableThreeWeeksAgoName, obj)
-			if err != nil {
-				log.Fatalf("retrieving IPv4 object list from %s failed: %v", tableThreeWeeksAgoName, err)
-			}
-			if s.Config.Debug {
-				log.Printf("Retrieved %d IPv4 objects from %s for risk score calculation.\n", len(listThreeWeeksAgo), tableThreeWeeksAgoName)
-			}
-			score += len(listThreeWeeksAgo) * 1
+	for _, obj := range listObjects {
+		facts, err := s.GetObjectFacts(obj, lookback)
+		if err != nil {
+			return err
 		}
+		facts.Weights = settings.ScoringWeights
+		facts.HalfLives = settings.DecayHalfLives
+		result := rules.Score(facts)
 
 		// Update the risk score in the database
-		err = s.UpdateObjectRiskScore(obj, score)
+		err = s.UpdateObjectRiskScore(obj, result, settings.VerdictRules)
 		if err != nil {
-			log.Fatalf("updating risk score for object %s failed: %v", obj, err)
+			return fmt.Errorf("updating risk score for object %s failed: %w", obj, err)
 		}
-		if s.Config.Debug {
-			log.Printf("Updated risk score for object %s to %d.\n", obj, score)
+		if s.Config().Debug {
+			log.Printf("Updated risk score for object %s to %d (raw %.2f).\n", obj, result.Score, result.RawScore)
 		}
 	}
 
@@ -0,0 +1,82 @@
+-- Tables of the versions before the schema was versioned, IF NOT EXISTS so existing databases keep their data
+
+-- Object types: ipv4, ipv6, domain, url, hash
+CREATE TABLE IF NOT EXISTS pending_import (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	object VARCHAR NOT NULL,
+	object_type VARCHAR NOT NULL,
+	notes TEXT,
+	source VARCHAR,
+	geo_region VARCHAR,
+	geo_country VARCHAR,
+	geo_org VARCHAR,
+	fidelity VARCHAR DEFAULT 'Low',
+	time_imported TIMESTAMP NOT NULL,
+	time_provided TIMESTAMP
+);
+
+-- Main Threat Intelligence Table
+CREATE TABLE IF NOT EXISTS object_intel (
+	object VARCHAR NOT NULL PRIMARY KEY,
+	object_additionalInfo VARCHAR,
+	object_type VARCHAR NOT NULL,
+	IPDecimal INTEGER,
+	geo_region VARCHAR,
+	geo_country VARCHAR,
+	geo_org VARCHAR,
+	geo_asn VARCHAR,
+	notes TEXT,
+	fidelity VARCHAR DEFAULT 'Low',
+	first_seen TIMESTAMP NOT NULL,
+	last_seen TIMESTAMP,
+	occurrence_count INTEGER DEFAULT 1,
+	risk_score INTEGER,
+	risk_score_last_updated TIMESTAMP,
+	confirmed_risk BOOLEAN DEFAULT FALSE,
+	trusted BOOLEAN DEFAULT FALSE
+);
+
+-- Objects are ipv4, ipv4CIDR, ipv6, (ipv6CIDR Future)
+CREATE TABLE IF NOT EXISTS trusted_objects (
+	object VARCHAR NOT NULL PRIMARY KEY,
+	object_additionalInfo VARCHAR,
+	object_type VARCHAR NOT NULL,
+	ipDecimal INTEGER DEFAULT 0,
+	startIPDecimal INTEGER DEFAULT 0,
+	endIPDecimal INTEGER DEFAULT 0,
+	notes TEXT,
+	source TEXT,
+	time_imported TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	occurrence_count INTEGER DEFAULT 1,
+	last_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Only the sha256 of a key is stored, roles are submit (import, lookup and export) and admin
+CREATE TABLE IF NOT EXISTS api_keys (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	name VARCHAR NOT NULL,
+	key_hash VARCHAR NOT NULL UNIQUE,
+	key_prefix VARCHAR NOT NULL,
+	role VARCHAR NOT NULL DEFAULT 'submit',
+	created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	revoked TIMESTAMP
+);
+
+-- Every scoring run records the rules that contributed to the score
+CREATE TABLE IF NOT EXISTS score_history (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	object VARCHAR NOT NULL,
+	score INTEGER NOT NULL,
+	raw_score REAL,
+	rule_version INTEGER,
+	breakdown TEXT,
+	scored_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_score_history_object ON score_history (object, scored_at);
+
+-- Admin settings, values are JSON
+CREATE TABLE IF NOT EXISTS settings (
+	key VARCHAR NOT NULL PRIMARY KEY,
+	value TEXT NOT NULL,
+	last_updated TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
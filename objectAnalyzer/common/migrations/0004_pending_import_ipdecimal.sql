@@ -0,0 +1,2 @@
+-- HandleVerify returns the ipDecimal of a pending object, the column was never created
+ALTER TABLE pending_import ADD COLUMN ipDecimal INTEGER DEFAULT 0;
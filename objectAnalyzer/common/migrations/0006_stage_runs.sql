@@ -0,0 +1,12 @@
+-- Runs of the workerBee stages, the status is ok, failed or skipped when the previous run was still going
+CREATE TABLE IF NOT EXISTS stage_runs (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	stage VARCHAR NOT NULL,
+	status VARCHAR NOT NULL,
+	error TEXT,
+	started_at TIMESTAMP NOT NULL,
+	finished_at TIMESTAMP NOT NULL,
+	duration_ms INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idx_stage_runs_stage ON stage_runs (stage, started_at);
+CREATE INDEX IF NOT EXISTS idx_stage_runs_started ON stage_runs (started_at);
@@ -0,0 +1,6 @@
+-- A workerBee claims pending rows for lease_expires, a row whose lease has passed is claimed again by the next worker
+-- claims counts the claims of a row, more than one means a worker lost it before it was applied
+ALTER TABLE pending_import ADD COLUMN claimed_by VARCHAR;
+ALTER TABLE pending_import ADD COLUMN lease_expires TIMESTAMP;
+ALTER TABLE pending_import ADD COLUMN claims INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS idx_pending_import_claim ON pending_import (claimed_by, lease_expires);
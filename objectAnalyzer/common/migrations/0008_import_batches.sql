@@ -0,0 +1,31 @@
+-- Each import request, upload or CSV file is a batch, its pending rows link to it with batch_id and batch_row
+-- source is api, json, upload or csv, submitted_by the key prefix or the config key that sent it
+CREATE TABLE IF NOT EXISTS import_batches (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	source VARCHAR NOT NULL,
+	submitted_by VARCHAR NOT NULL,
+	file_name VARCHAR,
+	total_rows INTEGER NOT NULL DEFAULT 0,
+	accepted INTEGER NOT NULL DEFAULT 0,
+	rejected INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMP NOT NULL,
+	started_at TIMESTAMP,
+	finished_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_import_batches_finished ON import_batches (finished_at);
+
+-- The outcome of each row of a batch, accepted or rejected with the reason, once a workerBee processed it
+CREATE TABLE IF NOT EXISTS import_batch_rows (
+	batch_id INTEGER NOT NULL,
+	batch_row INTEGER NOT NULL,
+	object VARCHAR NOT NULL,
+	object_type VARCHAR NOT NULL,
+	outcome VARCHAR NOT NULL,
+	reason TEXT,
+	processed_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (batch_id, batch_row)
+);
+
+ALTER TABLE pending_import ADD COLUMN batch_id INTEGER;
+ALTER TABLE pending_import ADD COLUMN batch_row INTEGER;
+CREATE INDEX IF NOT EXISTS idx_pending_import_batch ON pending_import (batch_id);
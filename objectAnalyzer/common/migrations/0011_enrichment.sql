@@ -0,0 +1,3 @@
+-- When the enrichers of the workerBee last looked up the object, the enrich stage refreshes the oldest first
+ALTER TABLE object_intel ADD COLUMN enriched_at TIMESTAMP;
+CREATE INDEX IF NOT EXISTS idx_object_intel_enriched ON object_intel (enriched_at);
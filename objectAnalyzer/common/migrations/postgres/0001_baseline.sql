@@ -0,0 +1,110 @@
+-- The schema of the SQLite migrations 0001 to 0004 for a new PostgreSQL database
+
+-- Object types: ipv4, ipv6, domain, url, hash
+-- time_provided is what the submitter sent and may not be a valid time
+CREATE TABLE IF NOT EXISTS pending_import (
+	id BIGSERIAL PRIMARY KEY,
+	object VARCHAR NOT NULL,
+	object_type VARCHAR NOT NULL,
+	ipDecimal BIGINT DEFAULT 0,
+	notes TEXT,
+	source VARCHAR,
+	geo_region VARCHAR,
+	geo_country VARCHAR,
+	geo_org VARCHAR,
+	fidelity VARCHAR DEFAULT 'Low',
+	time_imported TIMESTAMP NOT NULL,
+	time_provided TEXT
+);
+
+-- Main Threat Intelligence Table
+CREATE TABLE IF NOT EXISTS object_intel (
+	object VARCHAR NOT NULL PRIMARY KEY,
+	object_additionalInfo VARCHAR,
+	object_type VARCHAR NOT NULL,
+	IPDecimal BIGINT,
+	geo_region VARCHAR,
+	geo_country VARCHAR,
+	geo_org VARCHAR,
+	geo_asn VARCHAR,
+	notes TEXT,
+	fidelity VARCHAR DEFAULT 'Low',
+	first_seen TIMESTAMP NOT NULL,
+	last_seen TIMESTAMP,
+	occurrence_count INTEGER DEFAULT 1,
+	risk_score INTEGER,
+	risk_score_last_updated TIMESTAMP,
+	confirmed_risk BOOLEAN DEFAULT FALSE,
+	trusted BOOLEAN DEFAULT FALSE,
+	verdict VARCHAR DEFAULT 'unknown'
+);
+CREATE INDEX IF NOT EXISTS idx_object_intel_verdict ON object_intel (verdict);
+
+-- Objects are ipv4, ipv4CIDR, ipv6, (ipv6CIDR Future)
+CREATE TABLE IF NOT EXISTS trusted_objects (
+	object VARCHAR NOT NULL PRIMARY KEY,
+	object_additionalInfo VARCHAR,
+	object_type VARCHAR NOT NULL,
+	ipDecimal BIGINT DEFAULT 0,
+	startIPDecimal BIGINT DEFAULT 0,
+	endIPDecimal BIGINT DEFAULT 0,
+	notes TEXT,
+	source TEXT,
+	time_imported TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	occurrence_count INTEGER DEFAULT 1,
+	last_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Only the sha256 of a key is stored, roles are submit (import, lookup and export) and admin
+CREATE TABLE IF NOT EXISTS api_keys (
+	id BIGSERIAL PRIMARY KEY,
+	name VARCHAR NOT NULL,
+	key_hash VARCHAR NOT NULL UNIQUE,
+	key_prefix VARCHAR NOT NULL,
+	role VARCHAR NOT NULL DEFAULT 'submit',
+	created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	revoked TIMESTAMP
+);
+
+-- Every scoring run records the rules that contributed to the score
+CREATE TABLE IF NOT EXISTS score_history (
+	id BIGSERIAL PRIMARY KEY,
+	object VARCHAR NOT NULL,
+	score INTEGER NOT NULL,
+	raw_score DOUBLE PRECISION,
+	rule_version INTEGER,
+	breakdown TEXT,
+	scored_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_score_history_object ON score_history (object, scored_at);
+
+-- Admin settings, values are JSON
+CREATE TABLE IF NOT EXISTS settings (
+	key VARCHAR NOT NULL PRIMARY KEY,
+	value TEXT NOT NULL,
+	last_updated TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS verdict_history (
+	id BIGSERIAL PRIMARY KEY,
+	object VARCHAR NOT NULL,
+	old_verdict VARCHAR,
+	new_verdict VARCHAR NOT NULL,
+	reason TEXT,
+	changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_verdict_history_object ON verdict_history (object, changed_at);
+
+CREATE TABLE IF NOT EXISTS sightings (
+	id BIGSERIAL PRIMARY KEY,
+	object VARCHAR NOT NULL,
+	object_type VARCHAR NOT NULL,
+	ipDecimal BIGINT,
+	notes TEXT,
+	source VARCHAR,
+	observed_at TIMESTAMP NOT NULL,
+	time_imported TIMESTAMP NOT NULL,
+	time_provided TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_sightings_object ON sightings (object, observed_at);
+CREATE INDEX IF NOT EXISTS idx_sightings_observed ON sightings (observed_at);
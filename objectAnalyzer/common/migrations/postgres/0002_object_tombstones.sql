@@ -0,0 +1,11 @@
+-- Objects expired by the retention step, so a lookup can tell them apart from objects never seen
+CREATE TABLE IF NOT EXISTS object_tombstones (
+	object VARCHAR NOT NULL PRIMARY KEY,
+	object_type VARCHAR NOT NULL,
+	first_seen TIMESTAMP,
+	last_seen TIMESTAMP,
+	occurrence_count INTEGER,
+	risk_score INTEGER,
+	verdict VARCHAR,
+	expired_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,5 @@
+-- Sightings link to the import batch of their row so a rolled back batch removes them
+-- rolled_back_at is set when an admin reverted the batch
+ALTER TABLE sightings ADD COLUMN IF NOT EXISTS batch_id BIGINT;
+CREATE INDEX IF NOT EXISTS idx_sightings_batch ON sightings (batch_id);
+ALTER TABLE import_batches ADD COLUMN IF NOT EXISTS rolled_back_at TIMESTAMP;
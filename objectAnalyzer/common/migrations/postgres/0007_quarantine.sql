@@ -0,0 +1,22 @@
+-- Pending rows the workerBee rejected, with the reason, until an admin resubmits or purges them
+-- fixed_at is set when an admin corrected the object or object_type of the row
+CREATE TABLE IF NOT EXISTS quarantine (
+	id BIGSERIAL PRIMARY KEY,
+	object VARCHAR NOT NULL,
+	object_type VARCHAR NOT NULL,
+	notes TEXT,
+	source VARCHAR,
+	geo_region VARCHAR,
+	geo_country VARCHAR,
+	geo_org VARCHAR,
+	time_imported TIMESTAMP NOT NULL,
+	time_provided TEXT,
+	batch_id BIGINT,
+	batch_row INTEGER,
+	reason TEXT NOT NULL,
+	quarantined_at TIMESTAMP NOT NULL,
+	fixed_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_quarantine_batch ON quarantine (batch_id);
+CREATE INDEX IF NOT EXISTS idx_quarantine_source ON quarantine (source);
+CREATE INDEX IF NOT EXISTS idx_quarantine_quarantined ON quarantine (quarantined_at);
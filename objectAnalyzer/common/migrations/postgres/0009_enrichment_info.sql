@@ -0,0 +1,2 @@
+-- The Info of the enrichers by name, object_additionalInfo is left to the submitter
+ALTER TABLE object_intel ADD COLUMN IF NOT EXISTS enrichment_info TEXT;
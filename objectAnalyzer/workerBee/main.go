@@ -15,7 +15,7 @@ use (
 
 // Query the pending_import table for new objects to process
 // Create or update the entries in the object_intel table
-// Create entries in the weekly object occurrences table
+// Create entries in the sightings table
 
 // Enhancements:
 // Remove the files from the trusted folder after imported... (Completed)
@@ -28,29 +28,110 @@ use (
 
 import (
 	"common"
+	"context"
+	"errors"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
-	_ "github.com/mattn/go-sqlite3"
+	_ "workerBee/processor" // Registers the enrichers
 )
 
 func main() {
 	ConfigPtr := flag.String("config", "config.json", "Path to configuration file")
+	CheckConfigPtr := flag.Bool("check-config", false, "Print the effective configuration with secrets redacted, validate it and exit")
 	ImportsPtr := flag.Bool("i", false, "Process pending_imports")
 	ImportsCSVPtr := flag.Bool("ic", false, "Load import sources from CSV")
 	TrustedCSVPtr := flag.Bool("tc", false, "Load trusted sources from CSV")
 	UpdateRiskScoresPtr := flag.Bool("u", false, "Update object risk scores")
 	MarkTrustedPtr := flag.Bool("m", false, "Mark trusted objects in the object_intel table")
-	RunAllPtr := flag.Bool("all", false, "Run all processing: import CSV, process imports, trusted CSV, mark trusted, update risk scores")
+	EnrichPtr := flag.Bool("e", false, "Enrich the objects never enriched or enriched refresh_days ago with the enrichers in the enrichment setting")
+	RunAllPtr := flag.Bool("all", false, "Run all processing: import CSV, process imports, trusted CSV, mark trusted, enrich, update risk scores")
+	RulesPtr := flag.String("rules", "", "Score with the rules in this JSON file instead of the rules saved with the admin API")
+	MigratePtr := flag.String("migrate", "", "status shows the database migrations, up applies the pending ones, then exit")
+	PrunePtr := flag.Bool("prune", false, "Delete the sightings, archived CSV files and stale objects past the retention settings")
+	DryRunPtr := flag.Bool("dry-run", false, "With -prune, report what would be deleted without deleting it")
+	BackupPtr := flag.Bool("backup", false, "Write a backup of the database to the backups directory next to it")
+	RestorePtr := flag.String("restore", "", "Replace the database with this backup file, then exit")
+	DaemonPtr := flag.Bool("daemon", false, "Keep running every stage on its interval in the stage_intervals setting until SIGINT or SIGTERM")
 	flag.Parse()
+	if *DryRunPtr && !*PrunePtr {
+		log.Fatalf("-dry-run only applies to -prune")
+	}
+
+	// The stages of a one-shot run, in the order of server.Stages
+	selected := map[string]bool{
+		common.StageImportCSV:      *ImportsCSVPtr || *RunAllPtr,
+		common.StageProcessImports: *ImportsPtr || *RunAllPtr,
+		common.StageTrustedCSV:     *TrustedCSVPtr || *RunAllPtr,
+		common.StageMarkTrusted:    *MarkTrustedPtr || *RunAllPtr,
+		common.StageEnrich:         *EnrichPtr || *RunAllPtr,
+		common.StageRescore:        *UpdateRiskScoresPtr || *RunAllPtr,
+		common.StagePrune:          *PrunePtr, // Not part of -all
+		common.StageBackup:         *BackupPtr,
+	}
+	if *DaemonPtr {
+		for stage, on := range selected {
+			if on {
+				log.Fatalf("-daemon runs every stage on its interval, it can not be combined with the flag of %s\n", stage)
+			}
+		}
+	}
 
 	// Load the Configuration file
 	var config common.Configuration
 	configFile := *ConfigPtr
 	log.Println("Loading the following config file: " + configFile + "\n")
 	if err := config.LoadConfig(configFile); err != nil {
-		config.CreateConfig(configFile)
-		log.Fatalf("Created %s, modify the file to customize how the tool functions.\n", configFile)
+		// Only create the default config when it is missing, never overwrite a config that failed to load
+		if errors.Is(err, os.ErrNotExist) && !*CheckConfigPtr {
+			config.CreateConfig(configFile)
+			log.Fatalf("Created %s, modify the file to customize how the tool functions.\n", configFile)
+		}
+		log.Fatalf("Failed to load the config file %s: %v\n", configFile, err)
+	}
+
+	if *CheckConfigPtr {
+		if err := config.PrintCheckConfig(configFile, false); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// The workerBee does not use the API keys, they are only checked by the apiServer
+	if err := config.Validate(false); err != nil {
+		log.Fatalf("Invalid configuration in %s:\n%v\n", configFile, err)
+	}
+
+	// Show or apply the database migrations and exit
+	if *MigratePtr != "" {
+		server := common.NewServerConfig(config, configFile)
+		if err := server.OpenDatabase(); err != nil {
+			log.Fatalf("database initialization failed: %v", err)
+		}
+		err := server.RunMigrateCommand(*MigratePtr, os.Stdout)
+		server.Store.Close()
+		if err != nil {
+			log.Fatalf("migrate %s failed: %v", *MigratePtr, err)
+		}
+		os.Exit(0)
+	}
+
+	// Restore a backup and exit, a backup of an older version is migrated
+	if *RestorePtr != "" {
+		server := common.NewServerConfig(config, configFile)
+		if err := server.OpenDatabase(); err != nil {
+			log.Fatalf("database initialization failed: %v", err)
+		}
+		restored, err := server.RestoreDatabase(*RestorePtr)
+		server.Store.Close()
+		if err != nil {
+			log.Fatalf("restoring %s failed: %v", *RestorePtr, err)
+		}
+		log.Printf("Restored %s, applied %d migrations\n", restored.Restored, restored.MigrationsApplied)
+		os.Exit(0)
 	}
 
 	if config.Debug {
@@ -58,8 +139,13 @@ func main() {
 		log.Printf("Database Path from config: %s\n", config.DBPath)
 	}
 	// Initialize the server with the configuration loaded from the config file
-	server := &common.ServerConfig{
-		Config: config,
+	server := common.NewServerConfig(config, configFile)
+	if *RulesPtr != "" {
+		// Fail before any processing when the rules file is invalid
+		if _, err := common.LoadScoringRules(*RulesPtr); err != nil {
+			log.Fatalf("loading the scoring rules failed: %v", err)
+		}
+		server.ScoringRulesFile = *RulesPtr
 	}
 
 	// Initialize the database
@@ -67,65 +153,51 @@ func main() {
 	if err != nil {
 		log.Fatalf("database initialization failed: %v", err)
 	}
-	defer server.DB.Close()
+	defer server.Store.Close()
 	log.Println("Database initialized successfully.")
 
-	// Check if any csv files are available to add to pending_import
-	common.CreateDirectory(config.ImportCSVLocation)
-	if *ImportsCSVPtr || *RunAllPtr {
-		err = server.LoadImportObjectsFromCSV()
-		if err != nil {
-			log.Fatalf("processing import sources CSV failed: %v", err)
-		}
-		if config.Debug {
-			log.Println("Import sources CSV processed successfully.")
-		}
-	}
+	// SIGINT or SIGTERM stops process_imports at its next batch and enrich at its next object, the other stages finish first
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Process the pending_import table to the main threat intelligence table after validation
-	if *ImportsPtr || *RunAllPtr {
-		err = server.ProcessPendingImports()
-		if err != nil {
-			log.Fatalf("processing pending imports failed: %v", err)
-		}
-		if config.Debug {
-			log.Println("Pending imports processed successfully.")
+	// Run the stages on their intervals until stopped
+	if *DaemonPtr {
+		if err := server.RunDaemon(ctx); err != nil {
+			log.Fatalf("workerBee daemon failed: %v", err)
 		}
+		log.Println("Database connection closed.")
+		return
 	}
 
-	// Check if any csv files are available to process for trusted sources
-	// Crashing...
-	common.CreateDirectory(config.TrustedCSVLocation)
-	if *TrustedCSVPtr || *RunAllPtr {
-		err = server.LoadTrustedObjectsFromCSV()
-		if err != nil {
-			log.Fatalf("processing trusted sources CSV failed: %v", err)
+	// A failed stage does not stop the ones after it, the exit status is 1 when any failed
+	failed := false
+	for _, stage := range server.Stages() {
+		if !selected[stage.Name] {
+			continue
 		}
-		if config.Debug {
-			log.Println("Trusted sources CSV processed successfully.")
+		if ctx.Err() != nil {
+			log.Printf("Stopped before stage %s\n", stage.Name)
+			failed = true
+			break
 		}
-	}
-
-	// Query the trusted_objects and mark objects in object_intel as trusted
-	if *MarkTrustedPtr || *RunAllPtr {
-		err = server.MarkTrustedObjects()
-		if err != nil {
-			log.Fatalf("marking trusted objects failed: %v", err)
+		// A dry run is not recorded in the stage runs
+		if stage.Name == common.StagePrune && *DryRunPtr {
+			report, err := server.Prune(true)
+			if err != nil {
+				log.Printf("pruning failed: %v", err)
+				failed = true
+				continue
+			}
+			report.Print(os.Stdout)
+			continue
 		}
-		if config.Debug {
-			log.Println("Trusted objects marked successfully.")
+		if err := server.RunStage(ctx, stage); err != nil {
+			failed = true
 		}
 	}
-
-	// Update 1000 of the Objects in the object_intel table
-	if *UpdateRiskScoresPtr || *RunAllPtr {
-		err = server.UpdateObjectIntelRiskScores()
-		if err != nil {
-			log.Fatalf("updating object risk scores failed: %v", err)
-		}
-		if config.Debug {
-			log.Println("Object risk scores updated successfully.")
-		}
+	if failed {
+		server.Store.Close()
+		log.Fatalf("One or more stages failed, see the errors above")
 	}
 
 	log.Println("Database connection closed.")
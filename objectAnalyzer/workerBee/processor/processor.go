@@ -0,0 +1,21 @@
+// Package processor holds the enrichers of the workerBee
+//
+// Importing the package registers them with common.RegisterEnricher, the
+// enrichment setting names the ones that run for each object type:
+//
+//	geo_csv  geo fields and ASN of ipv4 and ipv6 from the networks in enrichGeoCSV
+//	rdns     PTR names of ipv4 and ipv6
+//	dns      addresses of a domain or the host of a url
+package processor
+
+import "common"
+
+func init() {
+	common.RegisterEnricher(geoCSVName, openGeoCSV)
+	common.RegisterEnricher(rdnsName, func(c common.Configuration) (common.Enricher, error) {
+		return rdnsEnricher{}, nil
+	})
+	common.RegisterEnricher(dnsName, func(c common.Configuration) (common.Enricher, error) {
+		return dnsEnricher{}, nil
+	})
+}
@@ -0,0 +1,89 @@
+package processor
+
+// The rdns and dns enrichers ask the resolver of the host
+//
+// A name that does not exist is not an error, the object is enriched with
+// nothing so it is not looked up again until refresh_days pass.
+
+import (
+	"common"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+const (
+	rdnsName = "rdns"
+	dnsName  = "dns"
+)
+
+type rdnsEnricher struct{}
+
+func (rdnsEnricher) Name() string {
+	return rdnsName
+}
+
+// Enrich returns the PTR names of the address in Info["ptr"], comma separated
+func (rdnsEnricher) Enrich(ctx context.Context, object string, objectType string) (common.Attributes, error) {
+	if objectType != "ipv4" && objectType != "ipv6" {
+		return common.Attributes{}, fmt.Errorf("%s only looks up ipv4 and ipv6, not %s", rdnsName, objectType)
+	}
+	names, err := net.DefaultResolver.LookupAddr(ctx, object)
+	if err != nil {
+		if notFound(err) {
+			return common.Attributes{}, nil
+		}
+		return common.Attributes{}, err
+	}
+	for i, name := range names {
+		names[i] = strings.TrimSuffix(name, ".")
+	}
+	return common.Attributes{Info: map[string]string{"ptr": strings.Join(names, ",")}}, nil
+}
+
+type dnsEnricher struct{}
+
+func (dnsEnricher) Name() string {
+	return dnsName
+}
+
+// Enrich returns the addresses of the domain, or of the host of the url, in Info["addresses"], comma separated
+func (dnsEnricher) Enrich(ctx context.Context, object string, objectType string) (common.Attributes, error) {
+	host := object
+	switch objectType {
+	case "domain":
+	case "url":
+		u, err := url.Parse(object)
+		if err != nil || u.Hostname() == "" {
+			return common.Attributes{}, fmt.Errorf("no host in the url %q", object)
+		}
+		host = u.Hostname()
+		// A url to an address has nothing to resolve
+		if net.ParseIP(host) != nil {
+			return common.Attributes{Info: map[string]string{"addresses": host}}, nil
+		}
+	default:
+		return common.Attributes{}, fmt.Errorf("%s only looks up domain and url, not %s", dnsName, objectType)
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		if notFound(err) {
+			return common.Attributes{}, nil
+		}
+		return common.Attributes{}, err
+	}
+	addresses := make([]string, len(addrs))
+	for i, addr := range addrs {
+		addresses[i] = addr.IP.String()
+	}
+	return common.Attributes{Info: map[string]string{"addresses": strings.Join(addresses, ",")}}, nil
+}
+
+func notFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
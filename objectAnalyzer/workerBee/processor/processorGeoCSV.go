@@ -0,0 +1,130 @@
+package processor
+
+// The geo_csv enricher looks up addresses in a CSV file of networks
+//
+// The file has the header network,geo_region,geo_country,geo_org,geo_asn, a
+// network is a CIDR or a single address.  The longest network holding an
+// address wins, so a /24 of a customer can refine the /16 of its provider.
+// The file is read once when the workerBee opens the enricher.
+
+import (
+	"common"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+const geoCSVName = "geo_csv"
+
+var geoCSVHeader = []string{"network", "geo_region", "geo_country", "geo_org", "geo_asn"}
+
+type geoCSVEnricher struct {
+	networks map[int]map[netip.Addr]common.Attributes // Masked address of each network by prefix length
+	lengths  []int                                    // Prefix lengths in the file, longest first
+}
+
+func openGeoCSV(c common.Configuration) (common.Enricher, error) {
+	if c.EnrichGeoCSV == "" {
+		return nil, errors.New("enrichGeoCSV is not set in the config")
+	}
+	file, err := os.Open(c.EnrichGeoCSV)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", c.EnrichGeoCSV, err)
+	}
+	defer file.Close()
+	return readGeoCSV(file, c.EnrichGeoCSV)
+}
+
+func readGeoCSV(r io.Reader, name string) (*geoCSVEnricher, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = len(geoCSVHeader)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the header of %s: %w", name, err)
+	}
+	for i, column := range geoCSVHeader {
+		if strings.ToLower(strings.TrimSpace(header[i])) != column {
+			return nil, fmt.Errorf("%s must have the header %s", name, strings.Join(geoCSVHeader, ","))
+		}
+	}
+
+	e := &geoCSVEnricher{networks: map[int]map[netip.Addr]common.Attributes{}}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		line, _ := reader.FieldPos(0)
+		prefix, err := parseNetwork(strings.TrimSpace(record[0]))
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", name, line, err)
+		}
+		if e.networks[prefix.Bits()] == nil {
+			e.networks[prefix.Bits()] = map[netip.Addr]common.Attributes{}
+			e.lengths = append(e.lengths, prefix.Bits())
+		}
+		e.networks[prefix.Bits()][prefix.Addr()] = common.Attributes{
+			GeoRegion:  strings.TrimSpace(record[1]),
+			GeoCountry: strings.TrimSpace(record[2]),
+			GeoOrg:     strings.TrimSpace(record[3]),
+			GeoASN:     strings.TrimSpace(record[4]),
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(e.lengths)))
+	return e, nil
+}
+
+// parseNetwork reads a CIDR or a single address, masked so it can be compared
+func parseNetwork(network string) (netip.Prefix, error) {
+	if strings.Contains(network, "/") {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return prefix, fmt.Errorf("invalid network %q", network)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(network)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid network %q", network)
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+func (e *geoCSVEnricher) Name() string {
+	return geoCSVName
+}
+
+// Enrich returns the fields of the longest network holding the address, none when no network does
+func (e *geoCSVEnricher) Enrich(ctx context.Context, object string, objectType string) (common.Attributes, error) {
+	if objectType != "ipv4" && objectType != "ipv6" {
+		return common.Attributes{}, fmt.Errorf("%s only looks up ipv4 and ipv6, not %s", geoCSVName, objectType)
+	}
+	addr, err := netip.ParseAddr(object)
+	if err != nil {
+		return common.Attributes{}, fmt.Errorf("invalid address %q", object)
+	}
+	addr = addr.Unmap()
+	for _, bits := range e.lengths {
+		if bits > addr.BitLen() {
+			continue
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if attributes, ok := e.networks[bits][prefix.Addr()]; ok {
+			return attributes, nil
+		}
+	}
+	return common.Attributes{}, nil
+}